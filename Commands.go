@@ -0,0 +1,651 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/LiamDotPro/Go-Multitenancy/migrations"
+	"github.com/LiamDotPro/Go-Multitenancy/tenants"
+	"os"
+)
+
+const commandUsage = `Usage: Go-Multitenancy <command> [options]
+
+Commands:
+  migrate up [-master] [-tenant identifier]             Apply pending migrations, defaults to master and every tenant.
+  migrate down -steps N (-master | -tenant identifier | -all)  Roll back the last N migrations.
+  migrate status                                         Print the schema version of master and every tenant.
+  migrate dry-run [-master] [-tenant identifier]        Print the SQL pending migrations would run without applying it.
+  migrate rollout [-waves json] [-resume]                Migrate tenants in waves, pausing when too many fail.
+  migrate drift [-tenant identifier] [-json]             Compare tenant databases against the schema expected from the tenant models.
+  tenants reconcile [-apply]                             Find databases, schemas, records and jobs left behind by failed provisioning.
+  tenants purge-deletions                                Purge the tenants whose deletion grace period is over.
+  tenants rotate-credentials [-tenant identifier] [-force]  Rotate tenant database credentials, moving older tenants onto their own roles.
+  tenants reencrypt                                      Re-encrypt every tenant connection string with the current master key.
+  tenants relocate -tenant identifier -server name       Move a database isolated tenant to another database server, or carry on moving it.
+  tenants cancel-relocation -tenant identifier           Stop moving a tenant that hasn't been switched over yet.
+  servers list                                           Print the database servers tenants can be placed on and how many tenants each has.
+  servers add -name name -host host [-port 5432] [-sslmode mode] [-region region] [-capacity N] [-weight N] [-admin connection]
+                                                         Register a database server, -admin is needed when the master connection can't manage it.
+`
+
+// Runs a command line command instead of the web server, returns the exit code.
+func runCommand(args []string) int {
+
+	switch args[0] {
+	case "migrate":
+		return runMigrateCommand(args[1:])
+	case "tenants":
+		return runTenantsCommand(args[1:])
+	case "servers":
+		return runServersCommand(args[1:])
+	default:
+		fmt.Print(commandUsage)
+		return 2
+	}
+}
+
+func runMigrateCommand(args []string) int {
+
+	if len(args) == 0 {
+		fmt.Print(commandUsage)
+		return 2
+	}
+
+	flags := flag.NewFlagSet("migrate "+args[0], flag.ContinueOnError)
+	masterOnly := flags.Bool("master", false, "only migrate the master database")
+	tenantIdentifier := flags.String("tenant", "", "only migrate the tenant with this subdomain identifier")
+	allTenants := flags.Bool("all", false, "roll back master and every tenant")
+	steps := flags.Int("steps", 0, "number of migrations to roll back")
+	waves := flags.String("waves", "", "rollout waves as JSON, defaults to tenantRolloutWaves")
+	resume := flags.Bool("resume", false, "resume the paused or interrupted rollout")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	var err error
+
+	switch args[0] {
+	case "up":
+		err = migrateUpCommand(*masterOnly, *tenantIdentifier)
+	case "down":
+		err = migrateDownCommand(*masterOnly, *tenantIdentifier, *allTenants, *steps)
+	case "status":
+		err = migrateStatusCommand()
+	case "dry-run":
+		err = migrateDryRunCommand(*masterOnly, *tenantIdentifier)
+	case "rollout":
+		err = migrateRolloutCommand(*waves, *resume)
+	case "drift":
+		err = migrateDriftCommand(*tenantIdentifier, *asJSON)
+	default:
+		fmt.Print(commandUsage)
+		return 2
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	return 0
+}
+
+func runTenantsCommand(args []string) int {
+
+	if len(args) == 0 {
+		fmt.Print(commandUsage)
+		return 2
+	}
+
+	flags := flag.NewFlagSet("tenants "+args[0], flag.ContinueOnError)
+	apply := flags.Bool("apply", false, "clean up what was found rather than only reporting it")
+	tenantIdentifier := flags.String("tenant", "", "only the tenant with this subdomain identifier")
+	force := flags.Bool("force", false, "rotate even if the credentials were rotated recently")
+	server := flags.String("server", "", "the name of the database server to relocate the tenant to")
+
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	var err error
+
+	switch args[0] {
+	case "reconcile":
+		err = tenantsReconcileCommand(*apply)
+	case "purge-deletions":
+		err = tenantsPurgeDeletionsCommand()
+	case "rotate-credentials":
+		err = tenantsRotateCredentialsCommand(*tenantIdentifier, *force)
+	case "reencrypt":
+		err = tenantsReencryptCommand()
+	case "relocate":
+		err = tenantsRelocateCommand(*tenantIdentifier, *server)
+	case "cancel-relocation":
+		err = tenantsCancelRelocationCommand(*tenantIdentifier)
+	default:
+		fmt.Print(commandUsage)
+		return 2
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	return 0
+}
+
+func runServersCommand(args []string) int {
+
+	if len(args) == 0 {
+		fmt.Print(commandUsage)
+		return 2
+	}
+
+	var server tenants.DatabaseServer
+
+	flags := flag.NewFlagSet("servers "+args[0], flag.ContinueOnError)
+	flags.StringVar(&server.Name, "name", "", "the name tenants are pinned to the server with")
+	flags.StringVar(&server.Host, "host", "", "the host tenant connection strings use")
+	flags.IntVar(&server.Port, "port", 5432, "the port tenant connection strings use")
+	flags.StringVar(&server.SSLMode, "sslmode", "disable", "the sslmode tenant connection strings use")
+	flags.StringVar(&server.Region, "region", "", "the region the server is in")
+	flags.IntVar(&server.Capacity, "capacity", 0, "the most tenants the server takes, 0 is unlimited")
+	flags.IntVar(&server.Weight, "weight", 1, "the servers share of new tenants relative to the others")
+	flags.StringVar(&server.AdminConnectionString, "admin", "", "a connection string able to create databases and roles on the server")
+
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	var err error
+
+	switch args[0] {
+	case "list":
+		err = serversListCommand()
+	case "add":
+		err = addDatabaseServer(&server)
+
+		if err == nil {
+			fmt.Printf("Added database server %v\n", server.Name)
+		}
+	default:
+		fmt.Print(commandUsage)
+		return 2
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	return 0
+}
+
+func migrateUpCommand(masterOnly bool, tenantIdentifier string) error {
+
+	if len(tenantIdentifier) == 0 {
+		var applied []migrations.Migration
+
+		err := migrations.WithLock(Connection, "master", masterLockOptions(), func() (err error) {
+			applied, err = masterMigrations.Migrate(Connection)
+			return err
+		})
+
+		printMigrations("master", "applied", applied)
+
+		if err != nil || masterOnly {
+			return err
+		}
+	}
+
+	targets, err := commandTargets(tenantIdentifier)
+
+	if err != nil {
+		return err
+	}
+
+	summary := migrations.RunFleet(tenantFleetTargets(targets), migrations.FleetOptionsFromEnv())
+
+	fmt.Print(summary)
+
+	if summary.Failed > 0 {
+		return fmt.Errorf("%d of %d tenant databases failed to migrate", summary.Failed, len(targets))
+	}
+
+	return nil
+}
+
+func migrateDownCommand(masterOnly bool, tenantIdentifier string, allTenants bool, steps int) error {
+
+	if !masterOnly && len(tenantIdentifier) == 0 && !allTenants {
+		return errors.New("choose what to roll back with -master, -tenant or -all")
+	}
+
+	if masterOnly || allTenants {
+		var reverted []migrations.Migration
+
+		err := migrations.WithLock(Connection, "master", masterLockOptions(), func() (err error) {
+			reverted, err = masterMigrations.Rollback(Connection, steps)
+			return err
+		})
+
+		printMigrations("master", "rolled back", reverted)
+
+		if err != nil || masterOnly {
+			return err
+		}
+	}
+
+	targets, err := commandTargets(tenantIdentifier)
+
+	if err != nil {
+		return err
+	}
+
+	for _, target := range targets {
+		conn, err := TenantConnections.GetConnection(target.Tenant)
+
+		if err != nil {
+			return fmt.Errorf("%v: %v", target.Label, err)
+		}
+
+		var reverted []migrations.Migration
+
+		options, err := tenantLockOptions(target.Tenant)
+
+		if err != nil {
+			return fmt.Errorf("%v: %v", target.Label, err)
+		}
+
+		err = migrations.WithLock(conn, tenantLockName(target.Tenant), options, func() (err error) {
+			reverted, err = tenantMigrations.Rollback(conn, steps)
+			return err
+		})
+
+		printMigrations(target.Label, "rolled back", reverted)
+
+		if err != nil {
+			return fmt.Errorf("%v: %v", target.Label, err)
+		}
+	}
+
+	return nil
+}
+
+func migrateStatusCommand() error {
+
+	report, err := migrationStatusReport()
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-30v %10v %10v %10v\n", "DATABASE", "CURRENT", "LATEST", "PENDING")
+
+	for _, entry := range report {
+		if len(entry.Error) > 0 {
+			fmt.Printf("%-30v %v\n", entry.Database, entry.Error)
+			continue
+		}
+
+		fmt.Printf("%-30v %10d %10d %10d\n", entry.Database, entry.CurrentVersion, entry.LatestVersion, entry.Pending)
+	}
+
+	return nil
+}
+
+func migrateDryRunCommand(masterOnly bool, tenantIdentifier string) error {
+
+	plans, err := migrationPreview(masterOnly, tenantIdentifier)
+
+	if err != nil {
+		return err
+	}
+
+	for _, plan := range plans {
+		fmt.Print(plan)
+	}
+
+	return nil
+}
+
+func migrateRolloutCommand(rawWaves string, resume bool) error {
+
+	waves, err := tenantRolloutWaves()
+
+	if len(rawWaves) > 0 {
+		waves, err = migrations.ParseWaves(rawWaves)
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid rollout waves: %v", err)
+	}
+
+	var rollout *migrations.Rollout
+
+	err = withRolloutLock(func() (err error) {
+		if resume {
+			rollout, err = activeTenantRollout()
+		} else {
+			rollout, err = startTenantRollout(waves)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return tenantRolloutRunner().Run(rollout)
+	})
+
+	if err == migrations.ErrLockNotAcquired {
+		return errors.New("another instance is running the tenant migration rollout")
+	}
+
+	if rollout != nil {
+		if report, reportErr := migrations.LoadRolloutReport(Connection, rollout.ID); reportErr == nil {
+			fmt.Print(report)
+		}
+	}
+
+	if err == nil && rollout.Status == migrations.RolloutPaused {
+		return fmt.Errorf("rollout %d paused: %v", rollout.ID, rollout.PausedReason)
+	}
+
+	return err
+}
+
+func migrateDriftCommand(tenantIdentifier string, asJSON bool) error {
+
+	reports, err := schemaDriftReport(tenantIdentifier)
+
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+
+		if err := encoder.Encode(reports); err != nil {
+			return err
+		}
+	} else {
+		for _, report := range reports {
+			fmt.Print(report)
+		}
+	}
+
+	drifted := 0
+
+	for _, report := range reports {
+		if report.Drifted || len(report.Error) > 0 {
+			drifted++
+		}
+	}
+
+	if drifted > 0 {
+		return fmt.Errorf("%d of %d tenant databases don't match the expected schema", drifted, len(reports))
+	}
+
+	return nil
+}
+
+// Compares every tenant database against the schema expected from the tenant models.
+func schemaDriftReport(tenantIdentifier string) ([]migrations.DriftReport, error) {
+
+	targets, err := commandTargets(tenantIdentifier)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var reports []migrations.DriftReport
+
+	for _, target := range targets {
+		conn, err := TenantConnections.GetConnection(target.Tenant)
+
+		if err != nil {
+			reports = append(reports, migrations.DriftReport{Database: target.Label, Error: err.Error()})
+			continue
+		}
+
+		reports = append(reports, migrations.CheckDrift(conn, target.Label, tenantModels...))
+	}
+
+	return reports, nil
+}
+
+// Works out the pending statements for master and every tenant database without applying them.
+func migrationPreview(masterOnly bool, tenantIdentifier string) ([]migrations.Plan, error) {
+
+	var plans []migrations.Plan
+
+	if len(tenantIdentifier) == 0 {
+		plans = append(plans, masterMigrations.Plan(Connection, "master"))
+
+		if masterOnly {
+			return plans, nil
+		}
+	}
+
+	targets, err := commandTargets(tenantIdentifier)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, target := range targets {
+		conn, err := TenantConnections.GetConnection(target.Tenant)
+
+		if err != nil {
+			plans = append(plans, migrations.Plan{Database: target.Label, Error: err.Error()})
+			continue
+		}
+
+		plans = append(plans, tenantMigrations.Plan(conn, target.Label))
+	}
+
+	return plans, nil
+}
+
+// The migration status of a single database, used by the status command and endpoint.
+type migrationStatusEntry struct {
+	Database string `json:"database"`
+	migrations.Status
+	Error string `json:"error,omitempty"`
+}
+
+// Returns the schema version of the master database and every tenant database.
+func migrationStatusReport() ([]migrationStatusEntry, error) {
+
+	masterStatus, err := masterMigrations.Status(Connection)
+
+	if err != nil {
+		return nil, err
+	}
+
+	report := []migrationStatusEntry{{Database: "master", Status: masterStatus}}
+
+	targets, err := commandTargets("")
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, target := range targets {
+		entry := migrationStatusEntry{Database: target.Label}
+
+		conn, err := TenantConnections.GetConnection(target.Tenant)
+
+		if err == nil {
+			entry.Status, err = tenantMigrations.Status(conn)
+		}
+
+		if err != nil {
+			entry.Error = err.Error()
+		}
+
+		report = append(report, entry)
+	}
+
+	return report, nil
+}
+
+// Returns the tenant databases a command should run against, every tenant when no identifier is given.
+func commandTargets(tenantIdentifier string) ([]tenantMigrationTarget, error) {
+
+	if len(tenantIdentifier) == 0 {
+		tenantInformation, err := findAllTenants()
+
+		if err != nil {
+			return nil, err
+		}
+
+		return tenantMigrationTargets(tenantInformation), nil
+	}
+
+	tenant, err := tenants.FindTenantByIdentifier(Connection, tenantIdentifier)
+
+	if err != nil {
+		return nil, fmt.Errorf("tenant %v was not found: %v", tenantIdentifier, err)
+	}
+
+	if tenant.Isolation() == tenants.IsolationShared {
+		fmt.Fprintln(os.Stderr, "Tenant "+tenantIdentifier+" uses shared tables, the change applies to every shared tenant.")
+	}
+
+	return tenantMigrationTargets([]tenants.TenantConnectionInformation{tenant}), nil
+}
+
+func printMigrations(database string, action string, applied []migrations.Migration) {
+
+	if len(applied) == 0 {
+		fmt.Printf("%v: nothing %v\n", database, action)
+		return
+	}
+
+	for _, m := range applied {
+		fmt.Printf("%v: %v %d %v\n", database, action, m.Version, m.Name)
+	}
+}
+
+func tenantsReconcileCommand(apply bool) error {
+
+	findings, err := reconcileTenants(apply)
+
+	if err != nil {
+		return err
+	}
+
+	return printReconcileFindings(findings, apply)
+}
+
+func tenantsPurgeDeletionsCommand() error {
+
+	completed, err := purgeDueTenantDeletions()
+
+	if err == migrations.ErrLockNotAcquired {
+		fmt.Println("Another instance is purging tenant deletions, skipping.")
+		return nil
+	}
+
+	for _, deletion := range completed {
+		fmt.Printf("Purged %v, deletion %d\n", deletion.SubDomainIdentifier, deletion.ID)
+	}
+
+	if err == nil && len(completed) == 0 {
+		fmt.Println("No tenant deletions are due.")
+	}
+
+	return err
+}
+
+func tenantsRotateCredentialsCommand(tenantIdentifier string, force bool) error {
+
+	rotated, err := rotateCredentials(tenantIdentifier, force)
+
+	for _, identifier := range rotated {
+		fmt.Printf("Rotated the credentials of %v\n", identifier)
+	}
+
+	return err
+}
+
+func tenantsReencryptCommand() error {
+
+	reencrypted, err := reencryptConnectionStrings()
+
+	fmt.Printf("Re-encrypted %d tenant connection strings.\n", reencrypted)
+
+	return err
+}
+
+// Relocates the tenant in the foreground, printing each step as it starts.
+func tenantsRelocateCommand(tenantIdentifier string, server string) error {
+
+	if len(tenantIdentifier) == 0 || len(server) == 0 {
+		return errors.New("relocate needs -tenant and -server")
+	}
+
+	relocation, err := relocateTenant(tenantIdentifier, server, 0)
+
+	if err != nil {
+		return err
+	}
+
+	err = runTenantRelocation(relocation.ID)
+
+	if err == migrations.ErrLockNotAcquired {
+		fmt.Println("Another instance is relocating this tenant, skipping.")
+		return nil
+	}
+
+	return err
+}
+
+func tenantsCancelRelocationCommand(tenantIdentifier string) error {
+
+	if len(tenantIdentifier) == 0 {
+		return errors.New("cancel-relocation needs -tenant")
+	}
+
+	relocation, err := cancelTenantRelocation(tenantIdentifier)
+
+	if err == nil {
+		fmt.Printf("Cancelled relocation %d of %v\n", relocation.ID, tenantIdentifier)
+	}
+
+	return err
+}
+
+func serversListCommand() error {
+
+	statuses, err := listDatabaseServers()
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-20v %-30v %-12v %10v %10v %8v %v\n", "NAME", "HOST", "REGION", "TENANTS", "CAPACITY", "WEIGHT", "STATE")
+
+	for _, status := range statuses {
+		state := "accepting"
+
+		if !status.Server.HasRoom(status.Tenants) {
+			state = "full"
+		}
+
+		if status.Server.Draining {
+			state = "draining"
+		}
+
+		fmt.Printf("%-20v %-30v %-12v %10d %10d %8d %v\n", status.Server.Name, fmt.Sprintf("%v:%d", status.Server.Host, status.Server.Port), status.Server.Region, status.Tenants, status.Server.Capacity, status.Server.Weight, state)
+	}
+
+	return nil
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"encoding/gob"
 	"fmt"
+	"github.com/LiamDotPro/Go-Multitenancy/helpers"
+	"github.com/LiamDotPro/Go-Multitenancy/migrations"
 	"github.com/LiamDotPro/Go-Multitenancy/tenants"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
@@ -13,9 +15,84 @@ import (
 
 var Connection *gorm.DB
 var Store *gormstore.Store
+var TenantConnections *tenants.ConnectionManager
+
+// Cached tenant lookups for the tenant middleware, kept in step across instances.
+var TenantLookupCache *tenants.LookupCache
+
+// Closed at shutdown to stop the periodic session cleanup.
+var sessionCleanupQuit chan struct{}
 
 func startDatabaseServices() {
 
+	connectDatabaseServices()
+
+	// Always attempt to migrate changes to the master tenant schema
+	if err := migrateMasterTenantDatabase(); err != nil {
+		fmt.Print("There was an error while trying to migrate the tenant tables..")
+		os.Exit(1)
+	}
+
+	// Hear about tenants other instances create, rename or remove, without it cached lookups only expire.
+	if os.Getenv("dialect") == "postgres" {
+		if err := TenantLookupCache.Listen(os.Getenv("connectionString")); err != nil {
+			fmt.Println("Tenant lookups will not be invalidated across instances:", err)
+		}
+	}
+
+	// attempt to migrate any tenant table changes to all clients.
+	AutoMigrateTenantTableChanges()
+
+	// Carry on creating the tenants that were queued when the last instance stopped.
+	resumeQueuedProvisioningJobs()
+
+	// Carry on moving the tenants that were being relocated when the last instance stopped.
+	resumeTenantRelocations()
+
+	// Makes quit Available
+	sessionCleanupQuit = make(chan struct{})
+
+	// Every hour remove dead sessions.
+	go Store.PeriodicCleanup(1*time.Hour, sessionCleanupQuit)
+
+	tenantDeletionQuit = make(chan struct{})
+
+	// Purge the tenants whose deletion grace period is over.
+	go periodicTenantDeletionPurge(helpers.GetEnvDuration("tenantDeletionInterval", 1*time.Hour), tenantDeletionQuit)
+
+	// Send tenant reads to their replicas, picking up replicas changed by other instances as we go.
+	if err := loadReadReplicas(); err != nil {
+		fmt.Println(err)
+	}
+
+	readReplicaQuit = make(chan struct{})
+
+	go periodicReadReplicaRefresh(helpers.GetEnvDuration("readReplicaRefreshInterval", 1*time.Minute), readReplicaQuit)
+}
+
+// Opens the master connection, tenant connection manager and session store without migrating anything.
+func connectDatabaseServices() {
+
+	// Pick up any SQL migrations living alongside the Go ones.
+	if err := loadSQLMigrations(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// Tenant connection strings are encrypted with the master key when one has been configured.
+	provider, err := tenants.KeyProviderFromEnv()
+
+	if err != nil {
+		fmt.Println("Could not load the connection string master keys:", err)
+		os.Exit(1)
+	}
+
+	if provider == nil {
+		fmt.Println("No connection string master key configured, tenant connection strings will be stored unencrypted.")
+	}
+
+	tenants.SetKeyProvider(provider)
+
 	// Database Connection string
 	db, err := gorm.Open(os.Getenv("dialect"), os.Getenv("connectionString"))
 
@@ -30,6 +107,11 @@ func startDatabaseServices() {
 	// Make Master connection available globally.
 	Connection = db
 
+	// Tenant connections are pooled and shared between requests.
+	TenantConnections = tenants.NewConnectionManager(tenants.ConnectionManagerOptionsFromEnv())
+
+	TenantLookupCache = tenants.NewLookupCache(tenants.LookupCacheOptionsFromEnv())
+
 	// Now Setup store - Tenant Store
 	// Password is passed as byte key method
 	Store = gormstore.NewOptions(db, gormstore.Options{
@@ -40,37 +122,96 @@ func startDatabaseServices() {
 	// Register session types for consuming in sessions
 	gob.Register(HostProfile{})
 	gob.Register(ClientProfile{})
+}
 
-	// Always attempt to migrate changes to the master tenant schema
-	if err := migrateMasterTenantDatabase(); err != nil {
-		fmt.Print("There was an error while trying to migrate the tenant tables..")
-		os.Exit(1)
+// Closes every tenant pool and the master connection, called once the router has stopped serving.
+func stopDatabaseServices() {
+
+	if sessionCleanupQuit != nil {
+		close(sessionCleanupQuit)
 	}
 
-	// attempt to migrate any tenant table changes to all clients.
-	AutoMigrateTenantTableChanges()
+	if tenantDeletionQuit != nil {
+		close(tenantDeletionQuit)
+	}
 
-	// Makes quit Available
-	quit := make(chan struct{})
+	if readReplicaQuit != nil {
+		close(readReplicaQuit)
+	}
 
-	// Every hour remove dead sessions.
-	go Store.PeriodicCleanup(1*time.Hour, quit)
+	// Let running provisioning jobs finish before the connections are closed.
+	provisioningJobs.Wait()
+
+	if err := TenantLookupCache.Close(); err != nil {
+		fmt.Println(err)
+	}
+
+	if err := TenantConnections.Close(); err != nil {
+		fmt.Println(err)
+	}
+
+	if err := Connection.Close(); err != nil {
+		fmt.Println(err)
+	}
 }
 
-// Simply migrates all of the tenant tables
-func AutoMigrateTenantTableChanges() {
+// Migrates every tenant database concurrently, one broken tenant never stops the rest.
+// The summary is logged and kept for the migration summary endpoint.
+// With tenantMigrationStrategy set to waves tenants are migrated in a rollout instead, returning the last waves summary.
+func AutoMigrateTenantTableChanges() migrations.FleetSummary {
+
+	if tenantMigrationStrategy() == tenantMigrationStrategyWaves {
+		err := rolloutTenantMigrations()
 
-	var TenantInformation [] tenants.TenantConnectionInformation
+		switch {
+		case err == migrations.ErrLockNotAcquired:
+			fmt.Println("Another instance is running the tenant migration rollout, skipping.")
+		case err != nil:
+			fmt.Println("An error occurred while rolling out tenant migrations", err)
+		}
 
-	Connection.Find(&tenants.TenantConnectionInformation{})
+		return latestFleetSummary()
+	}
 
-	for _, element := range TenantInformation {
+	tenantInformation, err := findAllTenants()
 
-		conn, _ := element.GetConnection()
+	if err != nil {
+		fmt.Println("An error occurred while attempting to find the tenants to migrate", err)
+		return migrations.FleetSummary{}
+	}
+
+	summary := migrations.RunFleet(tenantFleetTargets(tenantMigrationTargets(tenantInformation)), migrations.FleetOptionsFromEnv())
+
+	fmt.Print(summary)
+
+	recordFleetSummary(summary)
+
+	return summary
+}
 
-		if err := migrateTenantTables(conn); err != nil {
-			fmt.Print("An error occurred while attempting to migrate tenant tables")
-			os.Exit(1)
+// Registers SQL migrations from the directories set in masterMigrationsPath and tenantMigrationsPath.
+func loadSQLMigrations() error {
+
+	if dir := os.Getenv("masterMigrationsPath"); len(dir) > 0 {
+		if err := masterMigrations.RegisterSQLDirectory(dir); err != nil {
+			return err
 		}
 	}
+
+	if dir := os.Getenv("tenantMigrationsPath"); len(dir) > 0 {
+		if err := tenantMigrations.RegisterSQLDirectory(dir); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Drops a tenants cached lookups on every instance, called whenever a tenant or one of its identifiers or domains changes.
+// A failed notification is only logged, other instances catch up once their entries expire.
+func invalidateTenantLookups(tenantId uint, keys ...string) {
+
+	if err := TenantLookupCache.Publish(Connection, tenantId, keys...); err != nil {
+		fmt.Println(err)
+	}
 }
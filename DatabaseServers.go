@@ -0,0 +1,160 @@
+package main
+
+import (
+	"github.com/LiamDotPro/Go-Multitenancy/helpers"
+	"github.com/LiamDotPro/Go-Multitenancy/tenants"
+	"github.com/jinzhu/gorm"
+	"strings"
+)
+
+// A registered server along with how many tenants it has.
+type databaseServerStatus struct {
+	Server  tenants.DatabaseServer
+	Tenants int
+}
+
+// Runs fn against the admin connection of a database server, server 0 and servers without an admin connection of their own use the master connection.
+func withDatabaseServer(serverId uint, fn func(admin *gorm.DB) error) error {
+
+	if serverId == 0 {
+		return fn(Connection)
+	}
+
+	var server tenants.DatabaseServer
+
+	if err := Connection.First(&server, serverId).Error; err != nil {
+		return err
+	}
+
+	if server.ManagedByMaster() {
+		return fn(Connection)
+	}
+
+	admin, err := server.AdminConnection()
+
+	if err != nil {
+		return err
+	}
+
+	defer admin.Close()
+
+	return fn(admin)
+}
+
+// Works out where a new tenant should go, checking the policy and pinned server before the tenant is queued.
+// An empty policy uses tenantPlacementPolicy, naming a server pins the tenant to it.
+func tenantPlacement(policy string, region string, server string) (tenants.TenantPlacement, error) {
+
+	placement := tenants.TenantPlacement{Policy: strings.ToLower(policy), Region: region}
+
+	if len(server) > 0 && len(placement.Policy) == 0 {
+		placement.Policy = tenants.PlacementPinned
+	}
+
+	if len(placement.Policy) == 0 {
+		placement.Policy = tenants.DefaultPlacementPolicy()
+	}
+
+	if !tenants.ValidPlacementPolicy(placement.Policy) {
+		return placement, tenants.ErrUnknownPlacementPolicy
+	}
+
+	if placement.Policy != tenants.PlacementPinned {
+		return placement, nil
+	}
+
+	if len(server) == 0 {
+		server = helpers.GetEnvString("tenantPlacementServer", "")
+	}
+
+	if len(server) == 0 {
+		return placement, tenants.ErrNoServerPinned
+	}
+
+	pinned, err := tenants.FindDatabaseServer(Connection, server)
+
+	placement.ServerId = pinned.ID
+
+	return placement, err
+}
+
+// Checks a server could take the tenant right now, so a request that can't be placed is turned away instead of failing in the background.
+func checkTenantPlacement(placement tenants.TenantPlacement) error {
+
+	servers, err := tenants.DatabaseServers(Connection)
+
+	if err != nil {
+		return err
+	}
+
+	loads, err := tenants.ServerLoads(Connection)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tenants.ChooseServer(servers, loads, placement)
+
+	return err
+}
+
+// Places a database isolated tenant on a server, everyone else lives in the shared tenant database.
+func placeProvisionedTenant(p *tenantProvisioning) error {
+
+	if p.Job.Isolation != tenants.IsolationDatabase {
+		return nil
+	}
+
+	_, err := tenants.PlaceTenant(Connection, p.Job)
+
+	return err
+}
+
+// Registers a server new tenants can be placed on.
+func addDatabaseServer(server *tenants.DatabaseServer) error {
+	return tenants.RegisterDatabaseServer(Connection, server)
+}
+
+// Changes how a server takes new tenants, only the fields set in updates are changed.
+func updateDatabaseServer(name string, updates map[string]interface{}) (databaseServerStatus, error) {
+
+	server, err := tenants.FindDatabaseServer(Connection, name)
+
+	if err != nil {
+		return databaseServerStatus{}, err
+	}
+
+	if len(updates) > 0 {
+		if err := Connection.Model(&server).Updates(updates).Error; err != nil {
+			return databaseServerStatus{}, err
+		}
+	}
+
+	loads, err := tenants.ServerLoads(Connection)
+
+	return databaseServerStatus{Server: server, Tenants: loads[server.ID]}, err
+}
+
+// Returns every registered server with how many tenants are on it.
+func listDatabaseServers() ([]databaseServerStatus, error) {
+
+	servers, err := tenants.DatabaseServers(Connection)
+
+	if err != nil {
+		return nil, err
+	}
+
+	loads, err := tenants.ServerLoads(Connection)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []databaseServerStatus
+
+	for _, server := range servers {
+		statuses = append(statuses, databaseServerStatus{Server: server, Tenants: loads[server.ID]})
+	}
+
+	return statuses, nil
+}
@@ -2,15 +2,21 @@ package main
 
 import (
 	_ "./docs" // docs is generated by Swag CLI, you have to import it.
+	"context"
 	"fmt"
+	"github.com/LiamDotPro/Go-Multitenancy/middleware"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	"github.com/swaggo/gin-swagger"
 	"github.com/swaggo/gin-swagger/swaggerFiles"
 	"log"
+	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"runtime"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -20,6 +26,14 @@ func main() {
 		log.Fatal("Error loading .env file")
 	}
 
+	// Run a command line command instead of the web server, e.g. "migrate status".
+	if len(os.Args) > 1 {
+		connectDatabaseServices()
+		code := runCommand(os.Args[1:])
+		stopDatabaseServices()
+		os.Exit(code)
+	}
+
 	// Show Swagger pages
 	if os.Getenv("environment") == "development" && os.Getenv("showSwag") == "true" {
 		if err := open("http://localhost:8000/swagger/index.html"); err != nil {
@@ -50,16 +64,37 @@ func main() {
 	// Master Users
 	setupMasterUsersRoutes(router)
 
+	// Master Tenants
+	setupMasterTenantsRoutes(router)
+
 	// Add routing for swag
 	if os.Getenv("environment") == "development" {
 		router.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 	}
 
+	// Requests for /t/{tenant}/... are routed as if the prefix wasn't there, leaving the tenant for the path resolver.
+	server := &http.Server{Addr: port, Handler: middleware.StripTenantPathPrefix(router)}
+
 	// Starting the router instance
-	if err := router.Run(port); err != nil {
-		fmt.Print(err)
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fmt.Print(err)
+		}
+	}()
+
+	// Wait for an interrupt then let in flight requests finish before closing the database handles.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Print(err)
 	}
+
+	stopDatabaseServices()
 }
 
 // Helper function that allows us to open a browser dependant on your OS
@@ -0,0 +1,1310 @@
+package main
+
+import (
+	"github.com/LiamDotPro/Go-Multitenancy/middleware"
+	"github.com/LiamDotPro/Go-Multitenancy/migrations"
+	"github.com/LiamDotPro/Go-Multitenancy/params"
+	"github.com/LiamDotPro/Go-Multitenancy/tenants"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"log"
+	"net/http"
+)
+
+// Init
+func setupMasterTenantsRoutes(router *gin.Engine) {
+
+	tenants := router.Group("/master/api/tenants")
+
+	// Every tenant route is for logged in master users only.
+	tenants.Use(middleware.IfMasterAuthorized(Store))
+
+	// GET
+	tenants.GET("connectionStats", HandleTenantConnectionStats)
+	tenants.GET("migrationStatus", HandleTenantMigrationStatus)
+	tenants.GET("migrationSummary", HandleTenantMigrationSummary)
+	tenants.GET("migrationPreview", HandleTenantMigrationPreview)
+	tenants.GET("rolloutStatus", HandleTenantRolloutStatus)
+	tenants.GET("schemaDrift", HandleTenantSchemaDrift)
+	tenants.GET("tenantDomains", HandleTenantDomains)
+	tenants.GET("tenantAliases", HandleTenantAliases)
+	tenants.GET("provisioningStatus", HandleTenantProvisioningStatus)
+	tenants.GET("tenantStateHistory", HandleTenantStateHistory)
+	tenants.GET("tenantDeletion", HandleTenantDeletion)
+	tenants.GET("databaseServers", HandleDatabaseServers)
+	tenants.GET("tenantRelocation", HandleTenantRelocation)
+	tenants.GET("readReplicas", HandleReadReplicas)
+
+	// POST
+	tenants.POST("startRollout", HandleStartTenantRollout)
+	tenants.POST("resumeRollout", HandleResumeTenantRollout)
+	tenants.POST("updateTenantRollout", HandleUpdateTenantRollout)
+	tenants.POST("addTenantDomain", HandleAddTenantDomain)
+	tenants.POST("verifyTenantDomain", HandleVerifyTenantDomain)
+	tenants.POST("renameTenant", HandleRenameTenant)
+	tenants.POST("addTenantAlias", HandleAddTenantAlias)
+	tenants.POST("changeTenantState", HandleChangeTenantState)
+	tenants.POST("scheduleTenantDeletion", HandleScheduleTenantDeletion)
+	tenants.POST("cancelTenantDeletion", HandleCancelTenantDeletion)
+	tenants.POST("rotateTenantCredentials", HandleRotateTenantCredentials)
+	tenants.POST("addDatabaseServer", HandleAddDatabaseServer)
+	tenants.POST("updateDatabaseServer", HandleUpdateDatabaseServer)
+	tenants.POST("relocateTenant", HandleRelocateTenant)
+	tenants.POST("cancelTenantRelocation", HandleCancelTenantRelocation)
+	tenants.POST("addReadReplica", HandleAddReadReplica)
+
+	// DELETE
+	tenants.DELETE("removeTenantDomain", HandleRemoveTenantDomain)
+	tenants.DELETE("removeTenantAlias", HandleRemoveTenantAlias)
+	tenants.DELETE("removeReadReplica", HandleRemoveReadReplica)
+}
+
+// @Summary Lists the pooled connection statistics for every tenant with an open pool.
+// @tags master/tenants
+// @Router /master/api/tenants/connectionStats [get]
+func HandleTenantConnectionStats(c *gin.Context) {
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Successfully found tenant connection statistics",
+		"pools":   TenantConnections.Stats(),
+	})
+
+}
+
+// @Summary Lists the schema version of the master database and every tenant database.
+// @tags master/tenants
+// @Router /master/api/tenants/migrationStatus [get]
+func HandleTenantMigrationStatus(c *gin.Context) {
+
+	report, err := migrationStatusReport()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": err.Error()})
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":   "Successfully found migration status",
+		"databases": report,
+	})
+
+}
+
+// @Summary Returns the summary of the last fleet wide tenant migration, including failures and durations.
+// @tags master/tenants
+// @Router /master/api/tenants/migrationSummary [get]
+func HandleTenantMigrationSummary(c *gin.Context) {
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Successfully found the last tenant migration summary",
+		"summary": latestFleetSummary(),
+	})
+
+}
+
+// @Summary Previews the SQL pending migrations would run against master and every tenant without applying it.
+// @tags master/tenants
+// @Router /master/api/tenants/migrationPreview [get]
+func HandleTenantMigrationPreview(c *gin.Context) {
+
+	var json params.MigrationPreviewParams
+
+	if err := c.ShouldBindQuery(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Incorrect details supplied, please try again."})
+		return
+	}
+
+	plans, err := migrationPreview(json.Master, json.Tenant)
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": err.Error()})
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Successfully previewed pending migrations",
+		"plans":   plans,
+	})
+
+}
+
+// @Summary Compares tenant databases against the schema expected from the tenant models and lists the differences.
+// @tags master/tenants
+// @Router /master/api/tenants/schemaDrift [get]
+func HandleTenantSchemaDrift(c *gin.Context) {
+
+	var json params.SchemaDriftParams
+
+	if err := c.ShouldBindQuery(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Incorrect details supplied, please try again."})
+		return
+	}
+
+	reports, err := schemaDriftReport(json.Tenant)
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": err.Error()})
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":   "Successfully checked tenant schemas",
+		"databases": reports,
+	})
+
+}
+
+// @Summary Returns a tenant migration rollout and where each of its tenants is up to, the newest rollout when no id is given.
+// @tags master/tenants
+// @Router /master/api/tenants/rolloutStatus [get]
+func HandleTenantRolloutStatus(c *gin.Context) {
+
+	var json params.RolloutStatusParams
+
+	if err := c.ShouldBindQuery(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Incorrect details supplied, please try again."})
+		return
+	}
+
+	report, err := migrations.LoadRolloutReport(Connection, json.Id)
+
+	if gorm.IsRecordNotFoundError(err) {
+		c.JSON(http.StatusNotFound, gin.H{"message": "The rollout could not be found."})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": err.Error()})
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Successfully found the rollout",
+		"rollout": report,
+	})
+
+}
+
+// @Summary Starts a wave based tenant migration rollout in the background, superseding any unfinished rollout.
+// @tags master/tenants
+// @Router /master/api/tenants/startRollout [post]
+func HandleStartTenantRollout(c *gin.Context) {
+
+	var json params.StartRolloutParams
+
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Incorrect details supplied, please try again."})
+		return
+	}
+
+	waves := json.Waves
+
+	if len(waves) == 0 {
+		var err error
+
+		if waves, err = tenantRolloutWaves(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "The configured rollout waves are invalid.", "error": err.Error()})
+			return
+		}
+	}
+
+	rollout, err := launchTenantRollout(func() (*migrations.Rollout, error) {
+		return startTenantRollout(waves)
+	})
+
+	respondToRolloutLaunch(c, rollout, err, "Successfully started the rollout")
+
+}
+
+// @Summary Resumes a paused or interrupted tenant migration rollout in the background, failed tenants in the current wave are retried.
+// @tags master/tenants
+// @Router /master/api/tenants/resumeRollout [post]
+func HandleResumeTenantRollout(c *gin.Context) {
+
+	rollout, err := launchTenantRollout(activeTenantRollout)
+
+	respondToRolloutLaunch(c, rollout, err, "Successfully resumed the rollout")
+
+}
+
+// @Summary Sets the rollout tags and order used to place a tenant in migration waves.
+// @tags master/tenants
+// @Router /master/api/tenants/updateTenantRollout [post]
+func HandleUpdateTenantRollout(c *gin.Context) {
+
+	var json params.UpdateTenantRolloutParams
+
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Incorrect details supplied, please try again."})
+		return
+	}
+
+	result := Connection.Model(&tenants.TenantConnectionInformation{}).
+		Where("tenant_sub_domain_identifier = ?", json.SubDomainIdentifier).
+		Updates(map[string]interface{}{"rollout_tags": json.Tags, "rollout_order": json.Order})
+
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": result.Error.Error()})
+		log.Println(result.Error)
+		return
+	}
+
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"message": "The tenant could not be found."})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Successfully updated the tenants rollout settings"})
+
+}
+
+func respondToRolloutLaunch(c *gin.Context, rollout *migrations.Rollout, err error, message string) {
+
+	switch {
+	case err == migrations.ErrLockNotAcquired:
+		c.JSON(http.StatusConflict, gin.H{"message": "A rollout is already running."})
+	case err == errNoActiveRollout:
+		c.JSON(http.StatusNotFound, gin.H{"message": "There is no rollout to resume."})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": err.Error()})
+		log.Println(err)
+	default:
+		c.JSON(http.StatusAccepted, gin.H{"message": message, "rolloutId": rollout.ID})
+	}
+
+}
+
+// @Summary Lists the custom domains of a tenant along with their verification records.
+// @tags master/tenants
+// @Router /master/api/tenants/tenantDomains [get]
+func HandleTenantDomains(c *gin.Context) {
+
+	var json params.TenantIdentifierParams
+
+	if err := c.ShouldBindQuery(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Incorrect details supplied, please try again."})
+		return
+	}
+
+	tenant, err := tenants.FindTenantByIdentifier(Connection, json.SubDomainIdentifier)
+
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "The tenant could not be found."})
+		return
+	}
+
+	var domains []tenants.TenantDomain
+
+	if err := Connection.Where("tenant_connection_information_id = ?", tenant.ID).Order("hostname").Find(&domains).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": err.Error()})
+		log.Println(err)
+		return
+	}
+
+	var output []gin.H
+
+	for _, domain := range domains {
+		output = append(output, tenantDomainResponse(domain))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Successfully found the tenants domains",
+		"domains": output,
+	})
+
+}
+
+// @Summary Adds an unverified custom domain to a tenant, returning the TXT record that proves ownership.
+// @tags master/tenants
+// @Router /master/api/tenants/addTenantDomain [post]
+func HandleAddTenantDomain(c *gin.Context) {
+
+	var json params.AddTenantDomainParams
+
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Incorrect details supplied, please try again."})
+		return
+	}
+
+	tenant, err := tenants.FindTenantByIdentifier(Connection, json.SubDomainIdentifier)
+
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "The tenant could not be found."})
+		return
+	}
+
+	var count int
+
+	// Other tenants can claim the hostname too until one of them verifies it.
+	if err := Connection.Model(&tenants.TenantDomain{}).Where("hostname = ? AND (verified_at IS NOT NULL OR tenant_connection_information_id = ?)", tenants.NormalizeHost(json.Hostname), tenant.ID).Count(&count).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": err.Error()})
+		log.Println(err)
+		return
+	}
+
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"message": "That domain is already in use."})
+		return
+	}
+
+	domain, err := tenants.AddTenantDomain(Connection, tenant, json.Hostname)
+
+	if err == tenants.ErrInvalidHostname {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "The hostname is not a valid domain name."})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": err.Error()})
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Successfully added the domain, publish the TXT record then verify it",
+		"domain":  tenantDomainResponse(domain),
+	})
+
+}
+
+// @Summary Checks the TXT record of a custom domain and starts routing its requests to the tenant once it matches.
+// @tags master/tenants
+// @Router /master/api/tenants/verifyTenantDomain [post]
+func HandleVerifyTenantDomain(c *gin.Context) {
+
+	var json params.TenantDomainParams
+
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Incorrect details supplied, please try again."})
+		return
+	}
+
+	domain, err := tenants.VerifyTenantDomainClaims(Connection, tenants.TXTResolverFromEnv(), json.Hostname)
+
+	if gorm.IsRecordNotFoundError(err) {
+		c.JSON(http.StatusNotFound, gin.H{"message": "The domain could not be found."})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "The domain could not be verified, check the TXT record has been published.", "error": err.Error(), "domain": tenantDomainResponse(domain)})
+		return
+	}
+
+	invalidateTenantLookups(domain.TenantConnectionInformationId, tenants.DomainCacheKey(domain.Hostname))
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Successfully verified the domain",
+		"domain":  tenantDomainResponse(domain),
+	})
+
+}
+
+// @Summary Removes a custom domain from its tenant.
+// @tags master/tenants
+// @Router /master/api/tenants/removeTenantDomain [delete]
+func HandleRemoveTenantDomain(c *gin.Context) {
+
+	var json params.TenantDomainParams
+
+	if err := c.ShouldBindQuery(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Incorrect details supplied, please try again."})
+		return
+	}
+
+	// Hard delete so the hostname can be added again later.
+	result := Connection.Unscoped().Where("hostname = ?", tenants.NormalizeHost(json.Hostname)).Delete(&tenants.TenantDomain{})
+
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": result.Error.Error()})
+		log.Println(result.Error)
+		return
+	}
+
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"message": "The domain could not be found."})
+		return
+	}
+
+	invalidateTenantLookups(0, tenants.DomainCacheKey(json.Hostname))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Successfully removed the domain"})
+
+}
+
+// Responds with the rules an identifier broke, returns false when err isn't an identifier policy error.
+// Identifiers that are only taken get a 409, anything else a 422.
+func respondToIdentifierError(c *gin.Context, err error) bool {
+
+	problems, ok := err.(*tenants.IdentifierError)
+
+	if !ok {
+		return false
+	}
+
+	status := http.StatusUnprocessableEntity
+
+	if len(problems.Violations) == 1 && problems.Violations[0].Code == tenants.IdentifierTaken {
+		status = http.StatusConflict
+	}
+
+	c.JSON(status, gin.H{
+		"message":    "That identifier can't be used.",
+		"identifier": problems.Identifier,
+		"violations": problems.Violations,
+	})
+
+	return true
+}
+
+func tenantDomainResponse(domain tenants.TenantDomain) gin.H {
+	return gin.H{
+		"hostname":          domain.Hostname,
+		"verified":          domain.Verified(),
+		"verifiedAt":        domain.VerifiedAt,
+		"verificationName":  domain.VerificationRecord(),
+		"verificationValue": domain.VerificationValue(),
+	}
+}
+
+// @Summary Changes a tenants subdomain identifier, the old identifier is kept as an alias and the tenants database is left alone.
+// @tags master/tenants
+// @Router /master/api/tenants/renameTenant [post]
+func HandleRenameTenant(c *gin.Context) {
+
+	var json params.RenameTenantParams
+
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Incorrect details supplied, please try again."})
+		return
+	}
+
+	tenant, err := tenants.FindTenantByIdentifier(Connection, json.SubDomainIdentifier)
+
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "The tenant could not be found."})
+		return
+	}
+
+	if err := tenants.IdentifierPolicyFromEnv().ValidateAvailable(Connection, json.NewSubDomainIdentifier, tenant.ID); err != nil {
+		if !respondToIdentifierError(c, err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": err.Error()})
+			log.Println(err)
+		}
+		return
+	}
+
+	previousIdentifier := tenant.TenantSubDomainIdentifier
+
+	err = tenants.RenameTenant(Connection, &tenant, tenants.NormalizeIdentifier(json.NewSubDomainIdentifier))
+
+	if err == tenants.ErrIdentifierInUse {
+		c.JSON(http.StatusConflict, gin.H{"message": "That identifier is already in use."})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": err.Error()})
+		log.Println(err)
+		return
+	}
+
+	invalidateTenantLookups(tenant.ID, tenants.IdentifierCacheKey(previousIdentifier), tenants.IdentifierCacheKey(tenant.TenantSubDomainIdentifier))
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":             "Successfully renamed the tenant",
+		"subDomainIdentifier": tenant.TenantSubDomainIdentifier,
+	})
+
+}
+
+// @Summary Lists the previous and extra identifiers of a tenant.
+// @tags master/tenants
+// @Router /master/api/tenants/tenantAliases [get]
+func HandleTenantAliases(c *gin.Context) {
+
+	var json params.TenantIdentifierParams
+
+	if err := c.ShouldBindQuery(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Incorrect details supplied, please try again."})
+		return
+	}
+
+	tenant, err := tenants.FindTenantByIdentifier(Connection, json.SubDomainIdentifier)
+
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "The tenant could not be found."})
+		return
+	}
+
+	var aliases []tenants.TenantAlias
+
+	if err := Connection.Where("tenant_connection_information_id = ?", tenant.ID).Order("identifier").Find(&aliases).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": err.Error()})
+		log.Println(err)
+		return
+	}
+
+	var identifiers []string
+
+	for _, alias := range aliases {
+		identifiers = append(identifiers, alias.Identifier)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Successfully found the tenants aliases",
+		"aliases": identifiers,
+	})
+
+}
+
+// @Summary Adds an extra identifier a tenant can be reached by.
+// @tags master/tenants
+// @Router /master/api/tenants/addTenantAlias [post]
+func HandleAddTenantAlias(c *gin.Context) {
+
+	var json params.AddTenantAliasParams
+
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Incorrect details supplied, please try again."})
+		return
+	}
+
+	tenant, err := tenants.FindTenantByIdentifier(Connection, json.SubDomainIdentifier)
+
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "The tenant could not be found."})
+		return
+	}
+
+	if err := tenants.IdentifierPolicyFromEnv().ValidateAvailable(Connection, json.Alias, 0); err != nil {
+		if !respondToIdentifierError(c, err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": err.Error()})
+			log.Println(err)
+		}
+		return
+	}
+
+	_, err = tenants.AddTenantAlias(Connection, tenant, tenants.NormalizeIdentifier(json.Alias))
+
+	if err == tenants.ErrIdentifierInUse {
+		c.JSON(http.StatusConflict, gin.H{"message": "That identifier is already in use."})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": err.Error()})
+		log.Println(err)
+		return
+	}
+
+	invalidateTenantLookups(tenant.ID, tenants.IdentifierCacheKey(json.Alias))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Successfully added the alias"})
+
+}
+
+// @Summary Removes an alias, the identifier stops resolving and becomes free to use again.
+// @tags master/tenants
+// @Router /master/api/tenants/removeTenantAlias [delete]
+func HandleRemoveTenantAlias(c *gin.Context) {
+
+	var json params.TenantAliasParams
+
+	if err := c.ShouldBindQuery(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Incorrect details supplied, please try again."})
+		return
+	}
+
+	result := Connection.Unscoped().Where("lower(identifier) = lower(?)", json.Alias).Delete(&tenants.TenantAlias{})
+
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": result.Error.Error()})
+		log.Println(result.Error)
+		return
+	}
+
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"message": "The alias could not be found."})
+		return
+	}
+
+	invalidateTenantLookups(0, tenants.IdentifierCacheKey(json.Alias))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Successfully removed the alias"})
+
+}
+
+// @Summary Returns a tenant provisioning job with the time each step started and finished and any error it hit.
+// @tags master/tenants
+// @Router /master/api/tenants/provisioningStatus [get]
+func HandleTenantProvisioningStatus(c *gin.Context) {
+
+	var json params.ProvisioningStatusParams
+
+	if err := c.ShouldBindQuery(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Incorrect details supplied, please try again."})
+		return
+	}
+
+	job, err := tenants.FindProvisioningJob(Connection, json.JobId)
+
+	if gorm.IsRecordNotFoundError(err) {
+		c.JSON(http.StatusNotFound, gin.H{"message": "The provisioning job could not be found."})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": err.Error()})
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "Successfully found the provisioning job",
+		"job":      job,
+		"finished": job.Finished(),
+	})
+
+}
+
+// @Summary Moves a tenant to another lifecycle state, e.g. suspended, the change is recorded along with who made it.
+// @tags master/tenants
+// @Router /master/api/tenants/changeTenantState [post]
+func HandleChangeTenantState(c *gin.Context) {
+
+	var json params.ChangeTenantStateParams
+
+	if err := c.ShouldBindJSON(&json); err != nil || !tenants.ValidState(json.State) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Incorrect details supplied, please try again."})
+		return
+	}
+
+	tenant, err := tenants.FindTenantByIdentifier(Connection, json.SubDomainIdentifier)
+
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "The tenant could not be found."})
+		return
+	}
+
+	// Deletion has a grace period and a purge to go with it, it can't be started or undone by changing the state.
+	if json.State == tenants.StatePendingDeletion || json.State == tenants.StateDeleted || tenant.State() == tenants.StatePendingDeletion {
+		c.JSON(http.StatusConflict, gin.H{"message": "Use scheduleTenantDeletion and cancelTenantDeletion to delete a tenant or stop its deletion."})
+		return
+	}
+
+	userId, _ := c.Get("userId")
+	changedBy, _ := userId.(uint)
+
+	transition, err := tenants.TransitionTenant(Connection, &tenant, json.State, json.Reason, changedBy)
+
+	if _, invalid := err.(tenants.InvalidTransitionError); invalid || err == tenants.ErrStateChanged {
+		c.JSON(http.StatusConflict, gin.H{"message": err.Error()})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": err.Error()})
+		log.Println(err)
+		return
+	}
+
+	// Every instance has to see the new state on the next request.
+	invalidateTenantLookups(tenant.ID)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":    "Successfully changed the tenants state",
+		"transition": transition,
+	})
+
+}
+
+// @Summary Lists the lifecycle state changes of a tenant, oldest first.
+// @tags master/tenants
+// @Router /master/api/tenants/tenantStateHistory [get]
+func HandleTenantStateHistory(c *gin.Context) {
+
+	var json params.TenantIdentifierParams
+
+	if err := c.ShouldBindQuery(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Incorrect details supplied, please try again."})
+		return
+	}
+
+	tenant, err := tenants.FindTenantByIdentifier(Connection, json.SubDomainIdentifier)
+
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "The tenant could not be found."})
+		return
+	}
+
+	history, err := tenants.TenantStateHistory(Connection, tenant.ID)
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": err.Error()})
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Successfully found the tenants state history",
+		"state":   tenant.State(),
+		"history": history,
+	})
+
+}
+
+// @Summary Schedules a tenant to be purged once the deletion grace period is over, it can be cancelled until then.
+// @tags master/tenants
+// @Router /master/api/tenants/scheduleTenantDeletion [post]
+func HandleScheduleTenantDeletion(c *gin.Context) {
+
+	var json params.ScheduleTenantDeletionParams
+
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Incorrect details supplied, please try again."})
+		return
+	}
+
+	tenant, err := tenants.FindTenantByIdentifier(Connection, json.SubDomainIdentifier)
+
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "The tenant could not be found."})
+		return
+	}
+
+	userId, _ := c.Get("userId")
+	requestedBy, _ := userId.(uint)
+
+	deletion, err := tenants.ScheduleTenantDeletion(Connection, &tenant, tenantDeletionGracePeriod(), json.Reason, requestedBy)
+
+	if _, invalid := err.(tenants.InvalidTransitionError); invalid || err == tenants.ErrStateChanged {
+		c.JSON(http.StatusConflict, gin.H{"message": err.Error()})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": err.Error()})
+		log.Println(err)
+		return
+	}
+
+	// Every instance has to stop serving the tenant on the next request.
+	invalidateTenantLookups(tenant.ID)
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":  "Successfully scheduled the tenants deletion",
+		"deletion": deletion,
+	})
+
+}
+
+// @Summary Cancels a tenants deletion during its grace period, putting the tenant back in the state it was in.
+// @tags master/tenants
+// @Router /master/api/tenants/cancelTenantDeletion [post]
+func HandleCancelTenantDeletion(c *gin.Context) {
+
+	var json params.TenantIdentifierParams
+
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Incorrect details supplied, please try again."})
+		return
+	}
+
+	tenant, err := tenants.FindTenantByIdentifier(Connection, json.SubDomainIdentifier)
+
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "The tenant could not be found."})
+		return
+	}
+
+	userId, _ := c.Get("userId")
+	cancelledBy, _ := userId.(uint)
+
+	deletion, err := tenants.CancelTenantDeletion(Connection, &tenant, cancelledBy)
+
+	if _, invalid := err.(tenants.InvalidTransitionError); invalid || err == tenants.ErrStateChanged || err == tenants.ErrDeletionNotCancellable {
+		c.JSON(http.StatusConflict, gin.H{"message": err.Error()})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": err.Error()})
+		log.Println(err)
+		return
+	}
+
+	invalidateTenantLookups(tenant.ID)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "Successfully cancelled the tenants deletion",
+		"deletion": deletion,
+		"state":    tenant.State(),
+	})
+
+}
+
+// @Summary Returns the latest deletion of a tenant, with its certificate once the tenant has been purged.
+// @tags master/tenants
+// @Router /master/api/tenants/tenantDeletion [get]
+func HandleTenantDeletion(c *gin.Context) {
+
+	var json params.TenantIdentifierParams
+
+	if err := c.ShouldBindQuery(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Incorrect details supplied, please try again."})
+		return
+	}
+
+	// Purged tenants only have their deletion left, found by the identifier they had when it was scheduled.
+	query := Connection.Where("sub_domain_identifier = ?", json.SubDomainIdentifier)
+
+	tenant, err := tenants.FindTenantByIdentifier(Connection, json.SubDomainIdentifier)
+
+	if err == nil {
+		query = Connection.Where("tenant_connection_information_id = ?", tenant.ID)
+	}
+
+	var deletion tenants.TenantDeletion
+
+	if err := query.Order("id DESC").First(&deletion).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "The tenant has no deletion."})
+		return
+	}
+
+	response := gin.H{
+		"message":  "Successfully found the tenants deletion",
+		"deletion": deletion,
+	}
+
+	var certificate tenants.DeletionCertificate
+
+	err = Connection.Where("tenant_deletion_id = ?", deletion.ID).First(&certificate).Error
+
+	switch {
+	case err == nil:
+		response["certificate"] = certificate
+		response["certificateValid"] = certificate.Digest == certificate.ComputeDigest()
+	case !gorm.IsRecordNotFoundError(err):
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": err.Error()})
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+
+}
+
+// @Summary Rotates a tenants database credentials, connections on the old credentials carry on until they are replaced.
+// @tags master/tenants
+// @Router /master/api/tenants/rotateTenantCredentials [post]
+func HandleRotateTenantCredentials(c *gin.Context) {
+
+	var json params.RotateTenantCredentialsParams
+
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Incorrect details supplied, please try again."})
+		return
+	}
+
+	tenant, err := tenants.FindTenantByIdentifier(Connection, json.SubDomainIdentifier)
+
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "The tenant could not be found."})
+		return
+	}
+
+	err = rotateTenantCredentials(&tenant, json.Force)
+
+	if err == errSharedCredentials || err == errRotatedRecently || err == errRotationConflict {
+		c.JSON(http.StatusConflict, gin.H{"message": err.Error()})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": err.Error()})
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":              "Successfully rotated the tenants credentials",
+		"roleName":             tenant.RoleName,
+		"loginRole":            tenant.LoginRole,
+		"credentialsRotatedAt": tenant.CredentialsRotatedAt,
+	})
+
+}
+
+// @Summary Lists the database servers tenants can be placed on along with how many tenants each has.
+// @tags master/tenants
+// @Router /master/api/tenants/databaseServers [get]
+func HandleDatabaseServers(c *gin.Context) {
+
+	statuses, err := listDatabaseServers()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": err.Error()})
+		log.Println(err)
+		return
+	}
+
+	var output []gin.H
+
+	for _, status := range statuses {
+		output = append(output, databaseServerResponse(status.Server, status.Tenants))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Successfully found the database servers",
+		"servers": output,
+	})
+
+}
+
+// @Summary Registers a database server new tenants can be placed on.
+// @tags master/tenants
+// @Router /master/api/tenants/addDatabaseServer [post]
+func HandleAddDatabaseServer(c *gin.Context) {
+
+	var json params.AddDatabaseServerParams
+
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Incorrect details supplied, please try again."})
+		return
+	}
+
+	server := tenants.DatabaseServer{
+		Name:                  json.Name,
+		Host:                  json.Host,
+		Port:                  json.Port,
+		SSLMode:               json.SSLMode,
+		Region:                json.Region,
+		Capacity:              json.Capacity,
+		Weight:                json.Weight,
+		AdminConnectionString: json.AdminConnectionString,
+	}
+
+	err := addDatabaseServer(&server)
+
+	if err == tenants.ErrInvalidDatabaseServer {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	if err == tenants.ErrDatabaseServerExists {
+		c.JSON(http.StatusConflict, gin.H{"message": err.Error()})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": err.Error()})
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Successfully added the database server",
+		"server":  databaseServerResponse(server, 0),
+	})
+
+}
+
+// @Summary Changes a database servers region, capacity or weight, or drains it so it is given no new tenants.
+// @tags master/tenants
+// @Router /master/api/tenants/updateDatabaseServer [post]
+func HandleUpdateDatabaseServer(c *gin.Context) {
+
+	var json params.UpdateDatabaseServerParams
+
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Incorrect details supplied, please try again."})
+		return
+	}
+
+	if (json.Capacity != nil && *json.Capacity < 0) || (json.Weight != nil && *json.Weight < 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "A database servers capacity and weight can't be negative."})
+		return
+	}
+
+	updates := map[string]interface{}{}
+
+	if json.Region != nil {
+		updates["region"] = *json.Region
+	}
+
+	if json.Capacity != nil {
+		updates["capacity"] = *json.Capacity
+	}
+
+	if json.Weight != nil {
+		updates["weight"] = *json.Weight
+	}
+
+	if json.Draining != nil {
+		updates["draining"] = *json.Draining
+	}
+
+	status, err := updateDatabaseServer(json.Name, updates)
+
+	if err == tenants.ErrUnknownDatabaseServer {
+		c.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": err.Error()})
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Successfully updated the database server",
+		"server":  databaseServerResponse(status.Server, status.Tenants),
+	})
+
+}
+
+// The admin connection string is left out, it holds the servers credentials.
+func databaseServerResponse(server tenants.DatabaseServer, tenantCount int) gin.H {
+	return gin.H{
+		"name":            server.Name,
+		"host":            server.Host,
+		"port":            server.Port,
+		"region":          server.Region,
+		"capacity":        server.Capacity,
+		"weight":          server.Weight,
+		"draining":        server.Draining,
+		"managedByMaster": server.ManagedByMaster(),
+		"tenants":         tenantCount,
+	}
+}
+
+// @Summary Moves a database isolated tenant to another database server, copying its database while it carries on as normal.
+// @tags master/tenants
+// @Router /master/api/tenants/relocateTenant [post]
+func HandleRelocateTenant(c *gin.Context) {
+
+	var json params.RelocateTenantParams
+
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Incorrect details supplied, please try again."})
+		return
+	}
+
+	userId, _ := c.Get("userId")
+	requestedBy, _ := userId.(uint)
+
+	relocation, err := relocateTenant(json.SubDomainIdentifier, json.DatabaseServer, requestedBy)
+
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		c.JSON(http.StatusNotFound, gin.H{"message": "The tenant could not be found."})
+		return
+	case err == tenants.ErrUnknownDatabaseServer || err == errNotRelocatable:
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	case err == errSameServer || err == errRelocationPendingDeletion || err == tenants.ErrServerUnavailable || err == tenants.ErrRelocationInProgress:
+		c.JSON(http.StatusConflict, gin.H{"message": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": err.Error()})
+		log.Println(err)
+		return
+	}
+
+	startTenantRelocation(relocation.ID)
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":    "Successfully started relocating the tenant",
+		"relocation": relocationResponse(relocation),
+	})
+
+}
+
+// @Summary Returns the latest relocation of a tenant and how far through it is.
+// @tags master/tenants
+// @Router /master/api/tenants/tenantRelocation [get]
+func HandleTenantRelocation(c *gin.Context) {
+
+	var json params.TenantIdentifierParams
+
+	if err := c.ShouldBindQuery(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Incorrect details supplied, please try again."})
+		return
+	}
+
+	tenant, err := tenants.FindTenantByIdentifier(Connection, json.SubDomainIdentifier)
+
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "The tenant could not be found."})
+		return
+	}
+
+	relocation, found, err := tenants.LatestTenantRelocation(Connection, tenant.ID)
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": err.Error()})
+		log.Println(err)
+		return
+	}
+
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"message": "The tenant has never been relocated."})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":    "Successfully found the tenants relocation",
+		"relocation": relocationResponse(relocation),
+	})
+
+}
+
+// @Summary Cancels a relocation that hasn't switched the tenant over yet, leaving the tenant where it was.
+// @tags master/tenants
+// @Router /master/api/tenants/cancelTenantRelocation [post]
+func HandleCancelTenantRelocation(c *gin.Context) {
+
+	var json params.TenantIdentifierParams
+
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Incorrect details supplied, please try again."})
+		return
+	}
+
+	relocation, err := cancelTenantRelocation(json.SubDomainIdentifier)
+
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		c.JSON(http.StatusNotFound, gin.H{"message": "The tenant could not be found."})
+		return
+	case err == tenants.ErrRelocationNotCancellable:
+		c.JSON(http.StatusConflict, gin.H{"message": err.Error()})
+		return
+	case err == migrations.ErrLockNotAcquired:
+		c.JSON(http.StatusConflict, gin.H{"message": "The relocation is being worked on by another instance, please try again shortly."})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": err.Error()})
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":    "Successfully cancelled the tenants relocation",
+		"relocation": relocationResponse(relocation),
+	})
+
+}
+
+// The target connection string is left out, it holds the tenants new credentials.
+func relocationResponse(relocation tenants.TenantRelocation) gin.H {
+	return gin.H{
+		"id":             relocation.ID,
+		"tenant":         relocation.SubDomainIdentifier,
+		"sourceServerId": relocation.SourceServerId,
+		"targetServerId": relocation.TargetServerId,
+		"status":         relocation.Status,
+		"step":           relocation.Step,
+		"completedSteps": relocation.CompletedSteps,
+		"progress":       relocation.Progress(),
+		"tablesTotal":    relocation.TablesTotal,
+		"tablesCopied":   relocation.TablesCopied,
+		"rowsVerified":   relocation.RowsVerified,
+		"error":          relocation.Error,
+		"startedAt":      relocation.CreatedAt,
+		"completedAt":    relocation.CompletedAt,
+	}
+}
+
+// @Summary Lists the read replicas tenant reads can be sent to.
+// @tags master/tenants
+// @Router /master/api/tenants/readReplicas [get]
+func HandleReadReplicas(c *gin.Context) {
+
+	replicas, err := tenants.ReadReplicas(Connection)
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": err.Error()})
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "Successfully found the read replicas",
+		"replicas": replicas,
+	})
+
+}
+
+// @Summary Adds a read replica of a tenants database, or of every database on a database server.
+// @tags master/tenants
+// @Router /master/api/tenants/addReadReplica [post]
+func HandleAddReadReplica(c *gin.Context) {
+
+	var json params.AddReadReplicaParams
+
+	if err := c.ShouldBindJSON(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Incorrect details supplied, please try again."})
+		return
+	}
+
+	replica := tenants.ReadReplica{Name: json.Name, Host: json.Host, Port: json.Port}
+
+	err := addReadReplica(&replica, json.SubDomainIdentifier, json.DatabaseServer)
+
+	switch {
+	case gorm.IsRecordNotFoundError(err):
+		c.JSON(http.StatusNotFound, gin.H{"message": "The tenant could not be found."})
+		return
+	case err == tenants.ErrUnknownDatabaseServer:
+		c.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		return
+	case err == tenants.ErrInvalidReadReplica:
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	case err == tenants.ErrReadReplicaExists:
+		c.JSON(http.StatusConflict, gin.H{"message": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": err.Error()})
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Successfully added the read replica",
+		"replica": replica,
+	})
+
+}
+
+// @Summary Removes a read replica, its reads go back to the primary or the other replicas.
+// @tags master/tenants
+// @Router /master/api/tenants/removeReadReplica [delete]
+func HandleRemoveReadReplica(c *gin.Context) {
+
+	var json params.ReadReplicaParams
+
+	if err := c.ShouldBindQuery(&json); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Incorrect details supplied, please try again."})
+		return
+	}
+
+	if _, err := removeReadReplica(json.Name); err == tenants.ErrUnknownReadReplica {
+		c.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": err.Error()})
+		log.Println(err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Successfully removed the read replica"})
+
+}
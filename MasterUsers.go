@@ -5,8 +5,7 @@ import (
 	"github.com/LiamDotPro/Go-Multitenancy/helpers"
 	"github.com/LiamDotPro/Go-Multitenancy/tenants"
 	"github.com/jinzhu/gorm"
-	"os"
-	"strings"
+	"github.com/lib/pq"
 )
 
 type MasterUser struct {
@@ -110,31 +109,81 @@ func deleteMasterUser(id uint) (string, error) {
 	return "The user has been successfully deleted", nil
 }
 
-// Create's a tenant using a domain identifier
-func createNewTenant(subDomainIdentifier string) (msg string, err error) {
+// Queues a tenant to be created using a domain identifier, the job is worked through in the background.
+// The isolation mode decides if the tenant gets its own database, its own schema in the shared tenant database or rows in shared tables.
+// Tenants with their own database are placed on a database server using the placement policy, or the server named.
+func createNewTenant(subDomainIdentifier string, isolation string, policy string, region string, server string) (tenants.ProvisioningJob, error) {
 
-	// Create new database to hold client.
-	if err := Connection.Exec("CREATE DATABASE " + strings.ToLower(subDomainIdentifier) + " OWNER admin").Error; err != nil {
-		return "error making the database", err
+	if len(isolation) == 0 {
+		isolation = tenants.DefaultIsolationMode()
 	}
 
-	var connectionInfo = tenants.TenantConnectionInformation{TenantSubDomainIdentifier: subDomainIdentifier, ConnectionString: "host="+os.Getenv("dbHost") + " port=" + os.Getenv("dbPort") + " user=" + os.Getenv("dbUser") +" dbname=" + subDomainIdentifier + " password=" + os.Getenv("dbPassword") + " sslmode=disable"}
+	if !tenants.ValidIsolationMode(isolation) {
+		return tenants.ProvisioningJob{}, errors.New("isolation mode must be one of database, schema or shared")
+	}
+
+	if err := tenants.IdentifierPolicyFromEnv().ValidateAvailable(Connection, subDomainIdentifier, 0); err != nil {
+		return tenants.ProvisioningJob{}, err
+	}
+
+	subDomainIdentifier = tenants.NormalizeIdentifier(subDomainIdentifier)
+
+	inProgress, err := tenants.ProvisioningInProgress(Connection, subDomainIdentifier)
+
+	if err != nil {
+		return tenants.ProvisioningJob{}, err
+	}
+
+	if inProgress {
+		return tenants.ProvisioningJob{}, errProvisioningInProgress
+	}
+
+	var placement tenants.TenantPlacement
 
-	if err := Connection.Create(&connectionInfo).Error; err != nil {
-		return "error inserting the new database record", err
+	if isolation == tenants.IsolationDatabase {
+		if placement, err = tenantPlacement(policy, region, server); err != nil {
+			return tenants.ProvisioningJob{}, err
+		}
+
+		if err := checkTenantPlacement(placement); err != nil {
+			return tenants.ProvisioningJob{}, err
+		}
 	}
 
-	tenConn, tenConErr := connectionInfo.GetConnection()
+	job, err := tenants.QueueProvisioningJob(Connection, subDomainIdentifier, isolation, placement)
 
-	if tenConErr != nil {
-		return "error creating the connection using connection method", err
+	if err != nil {
+		return job, err
 	}
 
-	if migrateErr := migrateTenantTables(tenConn); migrateErr != nil {
-		return "error attempting to migrate the existing tables to new database", migrateErr
+	startProvisioningJob(job.ID)
+
+	return job, nil
+}
+
+// Creates a schema for a tenant inside of the shared tenant database, owned by the tenants role.
+func createTenantSchema(schemaName string, owner string) error {
+	return withSharedDatabase(func(shared *gorm.DB) error {
+		if err := shared.Exec("CREATE SCHEMA " + pq.QuoteIdentifier(schemaName) + " AUTHORIZATION " + pq.QuoteIdentifier(owner)).Error; err != nil {
+			return err
+		}
+
+		return grantSharedDatabaseAccess(shared, owner)
+	})
+}
+
+// Opens a short lived connection to the shared tenant database.
+func withSharedDatabase(fn func(shared *gorm.DB) error) error {
+
+	shared, err := gorm.Open("postgres", tenants.SharedConnectionString())
+
+	if err != nil {
+		return err
 	}
 
-	return "New Tenant has been successfully made", nil
+	defer shared.Close()
+
+	return fn(shared)
 }
 
 // Get a specific user from the database.
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/LiamDotPro/Go-Multitenancy/helpers"
 	"github.com/LiamDotPro/Go-Multitenancy/params"
+	"github.com/LiamDotPro/Go-Multitenancy/tenants"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/sessions"
 	"log"
@@ -157,6 +158,10 @@ func HandleMasterLogin(c *gin.Context) {
 	// Set host profile back to values.
 	session.(*sessions.Session).Values["host"] = hostProfile
 
+	// Mark the session for the master authorization middleware.
+	session.(*sessions.Session).Values["masterAuthorised"] = true
+	session.(*sessions.Session).Values["masterUserId"] = userId
+
 	// Save changes to our session.
 	if err := Store.Save(c.Request, c.Writer, session.(*sessions.Session)); err != nil {
 		fmt.Print(err)
@@ -200,6 +205,9 @@ func HandleMasterLogout(c *gin.Context) {
 	// Set host profile back to values.
 	session.Values["host"] = hostProfile
 
+	delete(session.Values, "masterAuthorised")
+	delete(session.Values, "masterUserId")
+
 	// Save changes to our session.
 	if err := Store.Save(c.Request, c.Writer, session); err != nil {
 		fmt.Print(err)
@@ -312,7 +320,7 @@ func HandleMasterGetCurrentUser(c *gin.Context) {
 
 }
 
-// @Summary Attempts to create a new tenant as a privileged user.
+// @Summary Queues a new tenant to be created as a privileged user, progress is polled from /master/api/tenants/provisioningStatus.
 // @tags master/users
 // @Router /master/api/users/createNewTenant [Post]
 func HandleCreateNewTenant(c *gin.Context) {
@@ -324,7 +332,26 @@ func HandleCreateNewTenant(c *gin.Context) {
 		return
 	}
 
-	outcome, err := createNewTenant(json.SubDomainIdentifier)
+	job, err := createNewTenant(json.SubDomainIdentifier, json.Isolation, json.Placement, json.Region, json.DatabaseServer)
+
+	if respondToIdentifierError(c, err) {
+		return
+	}
+
+	if err == tenants.ErrUnknownPlacementPolicy || err == tenants.ErrUnknownDatabaseServer || err == tenants.ErrNoServerPinned {
+		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	if err == tenants.ErrNoServerAvailable || err == tenants.ErrServerUnavailable {
+		c.JSON(http.StatusConflict, gin.H{"message": err.Error()})
+		return
+	}
+
+	if err == errProvisioningInProgress {
+		c.JSON(http.StatusConflict, gin.H{"message": "A tenant with that identifier is already being created."})
+		return
+	}
 
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again.", "error": err.Error()})
@@ -332,8 +359,10 @@ func HandleCreateNewTenant(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"message": outcome,
+	c.JSON(http.StatusAccepted, gin.H{
+		"message": "The tenant is being created",
+		"jobId":   job.ID,
+		"status":  job.Status,
 	})
 
 }
@@ -1,28 +1,599 @@
 package main
 
-import "github.com/LiamDotPro/Go-Multitenancy/tenants"
+import (
+	"fmt"
+	"github.com/LiamDotPro/Go-Multitenancy/helpers"
+	"github.com/LiamDotPro/Go-Multitenancy/migrations"
+	"github.com/LiamDotPro/Go-Multitenancy/tenants"
+	"github.com/jinzhu/gorm"
+	"os"
+	"time"
+)
 
-/**
-This method uses the base tenant connection set out within init.
-*/
-func migrateMasterTenantDatabase() error {
+// Versioned migrations for the master database, add new changes to the end with a higher version.
+var masterMigrations = migrations.NewRegistry("master")
 
-	if err := Connection.AutoMigrate(&tenants.TenantConnectionInformation{}).Error; err != nil {
-		return err
-	}
+// Each migration describes the tables it makes or changes with structs of its own rather than the models,
+// so it keeps making the same schema as the models change and rolling back to a version returns to that versions schema.
+func init() {
+	masterMigrations.Register(migrations.Migration{
+		Version: 1,
+		Name:    "initial master schema",
+		Up: func(db *gorm.DB) error {
+			type tenantConnectionInformation struct {
+				gorm.Model
+				TenantId                  uint `gorm:"AUTO_INCREMENT"`
+				TenantSubDomainIdentifier string
+				ConnectionString          string
+				IsolationMode             string
+				SchemaName                string
+			}
 
-	if err := Connection.AutoMigrate(&TenantSubscriptionInformation{}).Error; err != nil {
-		return err
+			type tenantSubscriptionInformation struct {
+				gorm.Model
+				TenantId         uint
+				SubscriptionType uint
+			}
+
+			type tenantSubscriptionType struct {
+				gorm.Model
+				SubscriptionName    string
+				SubscriptionPrice   uint
+				SubscriptionPeriod  uint
+				SubscriptionRenewal bool
+			}
+
+			type masterUser struct {
+				gorm.Model
+				Email         string
+				Password      string
+				AccountType   int
+				FirstName     string
+				LastName      string
+				PhoneNumber   string
+				RecoveryEmail string
+			}
+
+			return migrateMasterTables(db, map[string]interface{}{
+				"tenant_connection_informations":   &tenantConnectionInformation{},
+				"tenant_subscription_informations": &tenantSubscriptionInformation{},
+				"tenant_subscription_types":        &tenantSubscriptionType{},
+				"master_users":                     &masterUser{},
+			})
+		},
+		Down: func(db *gorm.DB) error {
+			return db.DropTableIfExists("tenant_connection_informations", "tenant_subscription_informations", "tenant_subscription_types", "master_users").Error
+		},
+	})
+
+	masterMigrations.Register(migrations.Migration{
+		Version: 2,
+		Name:    "tenant migration rollouts",
+		Up: func(db *gorm.DB) error {
+			type tenantConnectionInformation struct {
+				RolloutTags  string
+				RolloutOrder int
+			}
+
+			type rollout struct {
+				gorm.Model
+				Status        string
+				TargetVersion uint64
+				CurrentWave   int
+				Waves         string `gorm:"type:text"`
+				PausedReason  string
+			}
+
+			type rolloutTenant struct {
+				gorm.Model
+				RolloutID uint `gorm:"index"`
+				TenantID  uint
+				Database  string
+				Wave      int
+				Outcome   string
+				Error     string `gorm:"type:text"`
+				Duration  time.Duration
+			}
+
+			return migrateMasterTables(db, map[string]interface{}{
+				"tenant_connection_informations": &tenantConnectionInformation{},
+				"rollouts":                       &rollout{},
+				"rollout_tenants":                &rolloutTenant{},
+			})
+		},
+		Down: func(db *gorm.DB) error {
+			if err := db.DropTableIfExists("rollout_tenants", "rollouts").Error; err != nil {
+				return err
+			}
+
+			return dropMasterColumns(db, "tenant_connection_informations", "rollout_tags", "rollout_order")
+		},
+	})
+
+	masterMigrations.Register(migrations.Migration{
+		Version: 3,
+		Name:    "tenant domains",
+		Up: func(db *gorm.DB) error {
+			type tenantDomain struct {
+				gorm.Model
+				Hostname                      string `gorm:"unique_index"`
+				TenantConnectionInformationId uint   `gorm:"index"`
+			}
+
+			return db.Table("tenant_domains").AutoMigrate(&tenantDomain{}).Error
+		},
+		Down: func(db *gorm.DB) error {
+			return db.DropTableIfExists("tenant_domains").Error
+		},
+	})
+
+	masterMigrations.Register(migrations.Migration{
+		Version: 4,
+		Name:    "tenant domain verification",
+		Up: func(db *gorm.DB) error {
+			type tenantDomain struct {
+				VerificationToken string
+				VerifiedAt        *time.Time
+			}
+
+			return db.Table("tenant_domains").AutoMigrate(&tenantDomain{}).Error
+		},
+		Down: func(db *gorm.DB) error {
+			return dropMasterColumns(db, "tenant_domains", "verification_token", "verified_at")
+		},
+	})
+
+	masterMigrations.Register(migrations.Migration{
+		Version: 5,
+		Name:    "tenant aliases",
+		Up: func(db *gorm.DB) error {
+			type tenantConnectionInformation struct {
+				DatabaseName string
+			}
+
+			type tenantAlias struct {
+				gorm.Model
+				Identifier                    string `gorm:"unique_index"`
+				TenantConnectionInformationId uint   `gorm:"index"`
+			}
+
+			if err := migrateMasterTables(db, map[string]interface{}{
+				"tenant_connection_informations": &tenantConnectionInformation{},
+				"tenant_aliases":                 &tenantAlias{},
+			}); err != nil {
+				return err
+			}
+
+			// Databases used to be named after the identifier, record them before identifiers can change.
+			return db.Exec("UPDATE tenant_connection_informations SET database_name = lower(tenant_sub_domain_identifier) WHERE coalesce(database_name, '') = '' AND coalesce(isolation_mode, '') IN ('', ?)", tenants.IsolationDatabase).Error
+		},
+		Down: func(db *gorm.DB) error {
+			if err := db.DropTableIfExists("tenant_aliases").Error; err != nil {
+				return err
+			}
+
+			return dropMasterColumns(db, "tenant_connection_informations", "database_name")
+		},
+	})
+
+	masterMigrations.Register(migrations.Migration{
+		Version: 6,
+		Name:    "tenant provisioning jobs",
+		Up: func(db *gorm.DB) error {
+			type provisioningJob struct {
+				gorm.Model
+				SubDomainIdentifier           string `gorm:"index"`
+				Isolation                     string
+				Status                        string `gorm:"index"`
+				Error                         string
+				TenantConnectionInformationId uint
+				FinishedAt                    *time.Time
+			}
+
+			type provisioningStep struct {
+				gorm.Model
+				ProvisioningJobId uint `gorm:"index"`
+				Status            string
+				StartedAt         time.Time
+				FinishedAt        *time.Time
+				Error             string
+			}
+
+			return migrateMasterTables(db, map[string]interface{}{
+				"provisioning_jobs":  &provisioningJob{},
+				"provisioning_steps": &provisioningStep{},
+			})
+		},
+		Down: func(db *gorm.DB) error {
+			return db.DropTableIfExists("provisioning_steps", "provisioning_jobs").Error
+		},
+	})
+
+	masterMigrations.Register(migrations.Migration{
+		Version: 7,
+		Name:    "tenant provisioning compensation",
+		Up: func(db *gorm.DB) error {
+			type provisioningJob struct {
+				DatabaseName string
+				SchemaName   string
+			}
+
+			type provisioningStep struct {
+				Name              string
+				CompensatedAt     *time.Time
+				CompensationError string
+			}
+
+			return migrateMasterTables(db, map[string]interface{}{
+				"provisioning_jobs":  &provisioningJob{},
+				"provisioning_steps": &provisioningStep{},
+			})
+		},
+		Down: func(db *gorm.DB) error {
+			if err := dropMasterColumns(db, "provisioning_steps", "name", "compensated_at", "compensation_error"); err != nil {
+				return err
+			}
+
+			return dropMasterColumns(db, "provisioning_jobs", "database_name", "schema_name")
+		},
+	})
+
+	masterMigrations.Register(migrations.Migration{
+		Version: 8,
+		Name:    "tenant lifecycle states",
+		Up: func(db *gorm.DB) error {
+			type tenantConnectionInformation struct {
+				LifecycleState string
+				StateReason    string
+			}
+
+			type tenantStateTransition struct {
+				gorm.Model
+				TenantConnectionInformationId uint `gorm:"index"`
+				FromState                     string
+				ToState                       string
+				Reason                        string
+				ChangedBy                     uint
+			}
+
+			return migrateMasterTables(db, map[string]interface{}{
+				"tenant_connection_informations": &tenantConnectionInformation{},
+				"tenant_state_transitions":       &tenantStateTransition{},
+			})
+		},
+		Down: func(db *gorm.DB) error {
+			if err := db.DropTableIfExists("tenant_state_transitions").Error; err != nil {
+				return err
+			}
+
+			return dropMasterColumns(db, "tenant_connection_informations", "lifecycle_state", "state_reason")
+		},
+	})
+
+	masterMigrations.Register(migrations.Migration{
+		Version: 9,
+		Name:    "tenant deletion",
+		Up: func(db *gorm.DB) error {
+			type tenantDeletion struct {
+				gorm.Model
+				TenantConnectionInformationId uint   `gorm:"index"`
+				SubDomainIdentifier           string `gorm:"index"`
+				Identifiers                   string
+				IsolationMode                 string
+				DatabaseName                  string
+				SchemaName                    string
+				PreviousState                 string
+				Reason                        string
+				RequestedBy                   uint
+				PurgeAfter                    time.Time `gorm:"index"`
+				Status                        string    `gorm:"index"`
+				CompletedSteps                string
+				Error                         string
+				CompletedAt                   *time.Time
+			}
+
+			type deletionCertificate struct {
+				gorm.Model
+				TenantDeletionId              uint `gorm:"unique_index"`
+				TenantConnectionInformationId uint
+				SubDomainIdentifier           string
+				IsolationMode                 string
+				DatabaseName                  string
+				SchemaName                    string
+				Steps                         string
+				RequestedBy                   uint
+				RequestedAt                   time.Time
+				PurgedAt                      time.Time
+				Digest                        string
+			}
+
+			return migrateMasterTables(db, map[string]interface{}{
+				"tenant_deletions":      &tenantDeletion{},
+				"deletion_certificates": &deletionCertificate{},
+			})
+		},
+		Down: func(db *gorm.DB) error {
+			return db.DropTableIfExists("deletion_certificates", "tenant_deletions").Error
+		},
+	})
+
+	masterMigrations.Register(migrations.Migration{
+		Version: 10,
+		Name:    "tenant roles",
+		Up: func(db *gorm.DB) error {
+			type tenantConnectionInformation struct {
+				RoleName             string
+				LoginRole            string
+				CredentialsRotatedAt *time.Time
+			}
+
+			type roleName struct {
+				RoleName string
+			}
+
+			if err := migrateMasterTables(db, map[string]interface{}{
+				"tenant_connection_informations": &tenantConnectionInformation{},
+				"provisioning_jobs":              &roleName{},
+				"tenant_deletions":               &roleName{},
+			}); err != nil {
+				return err
+			}
+
+			if db.Dialect().GetName() != "postgres" {
+				return nil
+			}
+
+			// Tenant roles can connect to any database that hasn't been closed to them, this one included.
+			return db.Exec("DO $$ BEGIN EXECUTE format('REVOKE CONNECT, TEMPORARY ON DATABASE %I FROM PUBLIC', current_database()); END $$").Error
+		},
+		Down: func(db *gorm.DB) error {
+			if err := dropMasterColumns(db, "tenant_connection_informations", "role_name", "login_role", "credentials_rotated_at"); err != nil {
+				return err
+			}
+
+			if err := dropMasterColumns(db, "provisioning_jobs", "role_name"); err != nil {
+				return err
+			}
+
+			return dropMasterColumns(db, "tenant_deletions", "role_name")
+		},
+	})
+
+	masterMigrations.Register(migrations.Migration{
+		Version: 11,
+		Name:    "database servers",
+		Up: func(db *gorm.DB) error {
+			type databaseServer struct {
+				gorm.Model
+				Name                  string `gorm:"unique_index"`
+				Host                  string
+				Port                  int
+				SSLMode               string
+				Region                string
+				Capacity              int
+				Weight                int
+				Draining              bool
+				Placements            int
+				AdminConnectionString string
+			}
+
+			type tenantConnectionInformation struct {
+				DatabaseServerId uint `gorm:"index"`
+			}
+
+			type provisioningJob struct {
+				PlacementPolicy  string
+				PlacementRegion  string
+				PinnedServerId   uint
+				DatabaseServerId uint
+			}
+
+			type tenantDeletion struct {
+				DatabaseServerId uint
+			}
+
+			if err := migrateMasterTables(db, map[string]interface{}{
+				"database_servers":               &databaseServer{},
+				"tenant_connection_informations": &tenantConnectionInformation{},
+				"provisioning_jobs":              &provisioningJob{},
+				"tenant_deletions":               &tenantDeletion{},
+			}); err != nil {
+				return err
+			}
+
+			host := os.Getenv("dbHost")
+
+			if len(host) == 0 {
+				return nil
+			}
+
+			// Tenant databases used to all be made on dbHost, register it so they and new tenants have a server.
+			server := databaseServer{Name: "default", Host: host, Port: helpers.GetEnvInt("dbPort", 5432), SSLMode: "disable", Weight: 1}
+
+			if err := db.Table("database_servers").Create(&server).Error; err != nil {
+				return err
+			}
+
+			return db.Exec("UPDATE tenant_connection_informations SET database_server_id = ? WHERE coalesce(isolation_mode, '') IN ('', ?)", server.ID, tenants.IsolationDatabase).Error
+		},
+		Down: func(db *gorm.DB) error {
+			if err := db.DropTableIfExists("database_servers").Error; err != nil {
+				return err
+			}
+
+			if err := dropMasterColumns(db, "provisioning_jobs", "placement_policy", "placement_region", "pinned_server_id", "database_server_id"); err != nil {
+				return err
+			}
+
+			if err := dropMasterColumns(db, "tenant_connection_informations", "database_server_id"); err != nil {
+				return err
+			}
+
+			return dropMasterColumns(db, "tenant_deletions", "database_server_id")
+		},
+	})
+
+	masterMigrations.Register(migrations.Migration{
+		Version: 12,
+		Name:    "tenant relocations",
+		Up: func(db *gorm.DB) error {
+			type tenantRelocation struct {
+				gorm.Model
+				TenantConnectionInformationId uint   `gorm:"index"`
+				SubDomainIdentifier           string `gorm:"index"`
+				DatabaseName                  string
+				RoleName                      string
+				SourceServerId                uint
+				TargetServerId                uint
+				TargetConnectionString        string
+				PreviousState                 string
+				RequestedBy                   uint
+				Status                        string `gorm:"index"`
+				Step                          string
+				CompletedSteps                string
+				TablesTotal                   int
+				TablesCopied                  int
+				RowsVerified                  int64
+				Error                         string
+				CompletedAt                   *time.Time
+			}
+
+			return db.Table("tenant_relocations").AutoMigrate(&tenantRelocation{}).Error
+		},
+		Down: func(db *gorm.DB) error {
+			return db.DropTableIfExists("tenant_relocations").Error
+		},
+	})
+
+	masterMigrations.Register(migrations.Migration{
+		Version: 13,
+		Name:    "read replicas",
+		Up: func(db *gorm.DB) error {
+			type readReplica struct {
+				gorm.Model
+				Name                          string `gorm:"unique_index"`
+				Host                          string
+				Port                          int
+				TenantConnectionInformationId uint `gorm:"index"`
+				DatabaseServerId              uint `gorm:"index"`
+			}
+
+			return db.Table("read_replicas").AutoMigrate(&readReplica{}).Error
+		},
+		Down: func(db *gorm.DB) error {
+			return db.DropTableIfExists("read_replicas").Error
+		},
+	})
+
+	masterMigrations.Register(migrations.Migration{
+		Version: 14,
+		Name:    "provisioning job leases",
+		Up: func(db *gorm.DB) error {
+			type provisioningJob struct {
+				LeaseExpiresAt *time.Time
+			}
+
+			return db.Table("provisioning_jobs").AutoMigrate(&provisioningJob{}).Error
+		},
+		Down: func(db *gorm.DB) error {
+			return dropMasterColumns(db, "provisioning_jobs", "lease_expires_at")
+		},
+	})
+
+	masterMigrations.Register(migrations.Migration{
+		Version: 15,
+		Name:    "unique verified tenant domains",
+		Up: func(db *gorm.DB) error {
+			if err := db.Exec("DROP INDEX IF EXISTS uix_tenant_domains_hostname").Error; err != nil {
+				return err
+			}
+
+			if err := db.Table("tenant_domains").AddIndex("idx_tenant_domains_hostname", "hostname").Error; err != nil {
+				return err
+			}
+
+			return tenants.AddVerifiedHostnameIndex(db)
+		},
+		Down: func(db *gorm.DB) error {
+			if err := db.Exec("DROP INDEX IF EXISTS " + tenants.VerifiedHostnameIndex).Error; err != nil {
+				return err
+			}
+
+			if err := db.Table("tenant_domains").RemoveIndex("idx_tenant_domains_hostname").Error; err != nil {
+				return err
+			}
+
+			return db.Table("tenant_domains").AddUniqueIndex("uix_tenant_domains_hostname", "hostname").Error
+		},
+	})
+
+	masterMigrations.Register(migrations.Migration{
+		Version: 16,
+		Name:    "unique unfinished provisioning jobs",
+		Up: func(db *gorm.DB) error {
+			return tenants.AddProvisioningIdentifierIndex(db)
+		},
+		Down: func(db *gorm.DB) error {
+			return db.Exec("DROP INDEX IF EXISTS " + tenants.ProvisioningIdentifierIndex).Error
+		},
+	})
+
+	masterMigrations.Register(migrations.Migration{
+		Version: 17,
+		Name:    "provisioning steps undone on failure",
+		UpSQL:   "ALTER TABLE provisioning_steps ADD COLUMN undo_if_failed boolean NOT NULL DEFAULT false",
+		DownSQL: "ALTER TABLE provisioning_steps DROP COLUMN undo_if_failed",
+	})
+}
+
+// Lock options for the master database, its advisory lock is held on a connection of its own to it.
+func masterLockOptions() migrations.LockOptions {
+
+	options := migrations.LockOptionsFromEnv()
+	options.ConnectionString = os.Getenv("connectionString")
+
+	return options
+}
+
+// Creates or adds the missing columns of each table from the struct given for it.
+func migrateMasterTables(db *gorm.DB, tables map[string]interface{}) error {
+
+	for table, model := range tables {
+		if err := db.Table(table).AutoMigrate(model).Error; err != nil {
+			return err
+		}
 	}
 
-	if err := Connection.AutoMigrate(&TenantSubscriptionType{}).Error; err != nil {
-		return err
+	return nil
+}
+
+func dropMasterColumns(db *gorm.DB, table string, columns ...string) error {
+
+	for _, column := range columns {
+		if err := db.Table(table).DropColumn(column).Error; err != nil {
+			return err
+		}
 	}
 
-	if err := Connection.AutoMigrate(&MasterUser{}).Error; err != nil {
+	return nil
+}
+
+/**
+This method uses the base tenant connection set out within init.
+*/
+// Only one instance migrates the master database at a time, the others wait or skip depending on migrationLockMode.
+func migrateMasterTenantDatabase() error {
+
+	err := migrations.WithLock(Connection, "master", masterLockOptions(), func() error {
+		_, err := masterMigrations.Migrate(Connection)
 		return err
+	})
+
+	if err == migrations.ErrLockNotAcquired {
+		fmt.Println("Another instance is migrating the master database, skipping.")
+		return nil
 	}
 
-	return nil
+	return err
 
 }
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/LiamDotPro/Go-Multitenancy/helpers"
+	"github.com/LiamDotPro/Go-Multitenancy/migrations"
+	"github.com/LiamDotPro/Go-Multitenancy/tenants"
+	"strings"
+)
+
+// How tenant migrations are applied on startup.
+const (
+	tenantMigrationStrategyFleet = "fleet" // Every tenant at once.
+	tenantMigrationStrategyWaves = "waves" // A wave based rollout that pauses when too many tenants fail.
+)
+
+// Returned when asked to resume a rollout but there isn't one running or paused.
+var errNoActiveRollout = errors.New("there is no tenant migration rollout to resume")
+
+// The lock held by whichever instance is driving a rollout.
+const rolloutLockName = "tenant-rollout"
+
+// Returns the tenant migration strategy set in tenantMigrationStrategy.
+func tenantMigrationStrategy() string {
+	return strings.ToLower(helpers.GetEnvString("tenantMigrationStrategy", tenantMigrationStrategyFleet))
+}
+
+// Returns the waves set in tenantRolloutWaves, or the default canary, 10% and everyone waves.
+func tenantRolloutWaves() ([]migrations.Wave, error) {
+	return migrations.ParseWaves(helpers.GetEnvString("tenantRolloutWaves", ""))
+}
+
+// Migrates tenants on startup in waves, resuming a rollout a restart interrupted rather than starting over.
+// Paused rollouts are left for someone to look at and resume.
+func rolloutTenantMigrations() error {
+
+	return withRolloutLock(func() error {
+		rollout, found, err := migrations.ActiveRollout(Connection)
+
+		if err != nil {
+			return err
+		}
+
+		latest := tenantMigrations.LatestVersion()
+
+		switch {
+		case found && rollout.TargetVersion == latest && rollout.Status == migrations.RolloutPaused:
+			fmt.Printf("Tenant migration rollout %d is paused, %v. Resume it once the failures are fixed.\n", rollout.ID, rollout.PausedReason)
+			return nil
+		case found && rollout.TargetVersion == latest:
+			fmt.Printf("Resuming tenant migration rollout %d from wave %d.\n", rollout.ID, rollout.CurrentWave+1)
+		default:
+			waves, err := tenantRolloutWaves()
+
+			if err != nil {
+				return err
+			}
+
+			if rollout, err = startTenantRollout(waves); err != nil {
+				return err
+			}
+		}
+
+		return tenantRolloutRunner().Run(rollout)
+	})
+}
+
+// Assigns every tenant to a wave and persists the new rollout, superseding any unfinished one.
+func startTenantRollout(waves []migrations.Wave) (*migrations.Rollout, error) {
+
+	tenantInformation, err := findAllTenants()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return migrations.StartRollout(Connection, waves, tenantRolloutCandidates(tenantInformation), tenantMigrations.LatestVersion())
+}
+
+// Returns the rollout that is running or paused.
+func activeTenantRollout() (*migrations.Rollout, error) {
+
+	rollout, found, err := migrations.ActiveRollout(Connection)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !found {
+		return nil, errNoActiveRollout
+	}
+
+	return rollout, nil
+}
+
+// Takes the rollout lock in the background and runs the rollout returned by begin,
+// returning as soon as the rollout has been picked so requests don't wait on every wave.
+func launchTenantRollout(begin func() (*migrations.Rollout, error)) (*migrations.Rollout, error) {
+
+	type launched struct {
+		rollout *migrations.Rollout
+		err     error
+	}
+
+	result := make(chan launched, 1)
+
+	go func() {
+		began := false
+
+		err := withRolloutLock(func() error {
+			rollout, err := begin()
+			began = true
+			result <- launched{rollout, err}
+
+			if err != nil {
+				return err
+			}
+
+			return tenantRolloutRunner().Run(rollout)
+		})
+
+		if !began {
+			result <- launched{nil, err}
+			return
+		}
+
+		if err != nil {
+			fmt.Println("Tenant migration rollout failed:", err)
+		}
+	}()
+
+	outcome := <-result
+
+	return outcome.rollout, outcome.err
+}
+
+// Only one instance drives a rollout, anyone else finds the lock taken and leaves it alone.
+func withRolloutLock(fn func() error) error {
+
+	options := masterLockOptions()
+	options.Mode = migrations.LockSkip
+
+	return migrations.WithLock(Connection, rolloutLockName, options, fn)
+}
+
+func tenantRolloutRunner() migrations.RolloutRunner {
+	return migrations.RolloutRunner{
+		DB:      Connection,
+		Options: migrations.FleetOptionsFromEnv(),
+		Target:  tenantRolloutTarget,
+		OnWave: func(wave migrations.Wave, summary migrations.FleetSummary) {
+			fmt.Printf("Wave %v: ", wave.Name)
+			fmt.Print(summary)
+			recordFleetSummary(summary)
+		},
+	}
+}
+
+// Builds the migration for a tenant in a rollout, reloading it so changes since the rollout started are used.
+func tenantRolloutTarget(tenantID uint) (migrations.FleetTarget, error) {
+
+	var tenant tenants.TenantConnectionInformation
+
+	if err := Connection.First(&tenant, tenantID).Error; err != nil {
+		return migrations.FleetTarget{}, fmt.Errorf("tenant %d was not found: %v", tenantID, err)
+	}
+
+	targets := tenantFleetTargets(tenantMigrationTargets([]tenants.TenantConnectionInformation{tenant}))
+
+	return targets[0], nil
+}
+
+// Turns tenants into rollout candidates, tenants on shared tables are migrated together
+// so they become a single candidate with every tag and the earliest order of its members.
+func tenantRolloutCandidates(tenantInformation []tenants.TenantConnectionInformation) []migrations.RolloutCandidate {
+
+	var candidates []migrations.RolloutCandidate
+	shared := -1
+
+	for _, tenant := range tenantInformation {
+		if tenant.Isolation() != tenants.IsolationShared {
+			candidates = append(candidates, migrations.RolloutCandidate{
+				TenantID: tenant.ID,
+				Database: tenant.TenantSubDomainIdentifier,
+				Tags:     tenant.RolloutTagList(),
+				Order:    tenant.RolloutOrder,
+			})
+			continue
+		}
+
+		if shared < 0 {
+			shared = len(candidates)
+			candidates = append(candidates, migrations.RolloutCandidate{TenantID: tenant.ID, Database: tenants.IsolationShared, Order: tenant.RolloutOrder})
+		}
+
+		candidates[shared].Tags = append(candidates[shared].Tags, tenant.RolloutTagList()...)
+
+		if tenant.RolloutOrder < candidates[shared].Order {
+			candidates[shared].Order = tenant.RolloutOrder
+		}
+	}
+
+	return candidates
+}
@@ -2,16 +2,202 @@ package main
 
 import (
 	"fmt"
+	"github.com/LiamDotPro/Go-Multitenancy/migrations"
+	"github.com/LiamDotPro/Go-Multitenancy/tenants"
 	"github.com/jinzhu/gorm"
+	"strings"
+	"sync"
 )
 
+// Models stored in tenant databases, tenants on shared tables keep these rows apart by tenant_id.
+var tenantModels = []interface{}{&User{}}
+
+// Versioned migrations for tenant databases, add new changes to the end with a higher version.
+var tenantMigrations = migrations.NewRegistry("tenant")
+
+// The summary of the most recent fleet wide tenant migration.
+var lastFleetSummary migrations.FleetSummary
+var lastFleetSummaryMutex sync.RWMutex
+
+func init() {
+	// Schema and shared table tenants can live in the same database as the master tables,
+	// so tenant versions get their own ledger rather than schema_migrations, where they would be read as the masters.
+	tenantMigrations.SetLedger("tenant_schema_migrations")
+
+	tenantMigrations.Register(migrations.Migration{
+		Version: 1,
+		Name:    "initial tenant schema",
+		Up: func(db *gorm.DB) error {
+			return db.AutoMigrate(&User{}).Error
+		},
+		Down: func(db *gorm.DB) error {
+			return db.DropTableIfExists(&User{}).Error
+		},
+	})
+}
+
 // Attempts to migrate tables using database connection
 func migrateTenantTables(connection *gorm.DB) error {
 	fmt.Println("Attempting to migrate tables to new database.")
 
-	if err := connection.AutoMigrate(&User{}).Error; err != nil {
+	if _, err := tenantMigrations.Migrate(connection); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// Migrates the shared tenant tables and applies the row level security policies keeping tenants rows apart.
+func migrateSharedTenantTables(connection *gorm.DB) error {
+
+	if err := migrateTenantTables(connection); err != nil {
+		return err
+	}
+
+	return tenants.ApplyRowLevelSecurity(connection, tenantModels...)
+}
+
+// Migrates a tenant using the strategy matching its isolation mode.
+// Only one instance migrates a tenant at a time, the others wait or get migrations.ErrLockNotAcquired depending on migrationLockMode.
+func migrateTenant(tenant tenants.TenantConnectionInformation, connection *gorm.DB) error {
+
+	options, err := tenantLockOptions(tenant)
+
+	if err != nil {
+		return err
+	}
+
+	return migrations.WithLock(connection, tenantLockName(tenant), options, func() error {
+		if tenant.Isolation() == tenants.IsolationShared {
+			return migrateSharedTenantTables(connection)
+		}
+
+		return migrateTenantTables(connection)
+	})
+}
+
+// Schema isolated tenants share a database, so locks are named after the tenant rather than the database.
+func tenantLockName(tenant tenants.TenantConnectionInformation) string {
+
+	if tenant.Isolation() == tenants.IsolationShared {
+		return "tenant:" + tenants.IsolationShared
+	}
+
+	return fmt.Sprintf("tenant:%d", tenant.ID)
+}
+
+// Lock options for a tenants database, its advisory lock is held on a connection of its own made with the tenants connection string.
+func tenantLockOptions(tenant tenants.TenantConnectionInformation) (migrations.LockOptions, error) {
+
+	options := migrations.LockOptionsFromEnv()
+	connectionString, err := tenants.DecryptConnectionString(tenant.ConnectionString)
+
+	if err != nil {
+		return options, err
+	}
+
+	options.ConnectionString = connectionString
+
+	return options, nil
+}
+
+// A database tenant migrations run against, every tenant on shared tables shares a single target.
+type tenantMigrationTarget struct {
+	Label  string
+	Tenant tenants.TenantConnectionInformation
+}
+
+// Returns every tenant record from the master database.
+func findAllTenants() ([]tenants.TenantConnectionInformation, error) {
+
+	var tenantInformation []tenants.TenantConnectionInformation
+
+	if err := Connection.Find(&tenantInformation).Error; err != nil {
+		return nil, err
+	}
+
+	return tenantInformation, nil
+}
+
+// Groups tenants into the databases that need migrating, so shared tables are only migrated once.
+func tenantMigrationTargets(tenantInformation []tenants.TenantConnectionInformation) []tenantMigrationTarget {
+
+	var targets []tenantMigrationTarget
+	sharedAdded := false
+
+	for _, tenant := range tenantInformation {
+		if tenant.Isolation() == tenants.IsolationShared {
+			if !sharedAdded {
+				targets = append(targets, tenantMigrationTarget{Label: tenants.IsolationShared, Tenant: tenant})
+				sharedAdded = true
+			}
+			continue
+		}
+
+		targets = append(targets, tenantMigrationTarget{Label: tenant.TenantSubDomainIdentifier, Tenant: tenant})
+	}
+
+	return targets
+}
+
+// Turns migration targets into fleet targets for the fleet migrator.
+func tenantFleetTargets(targets []tenantMigrationTarget) []migrations.FleetTarget {
+
+	var fleet []migrations.FleetTarget
+
+	for _, target := range targets {
+		tenant := target.Tenant
+
+		fleet = append(fleet, migrations.FleetTarget{
+			Name:    target.Label,
+			Migrate: func() error { return migrateTenantTarget(tenant) },
+		})
+	}
+
+	return fleet
+}
+
+// Migrates a single tenant database, skipping it when there is nothing to do.
+func migrateTenantTarget(tenant tenants.TenantConnectionInformation) error {
+
+	if len(strings.TrimSpace(tenant.ConnectionString)) == 0 {
+		return migrations.Skip("tenant has no connection string")
+	}
+
+	conn, err := TenantConnections.GetConnection(tenant)
+
+	if err != nil {
+		return err
+	}
+
+	pending, err := tenantMigrations.Pending(conn)
+
+	if err != nil {
+		return err
+	}
+
+	if len(pending) == 0 {
+		return migrations.Skip("already up to date")
+	}
+
+	if err := migrateTenant(tenant, conn); err != migrations.ErrLockNotAcquired {
+		return err
+	}
+
+	return migrations.Skip("another instance is migrating this tenant")
+}
+
+func recordFleetSummary(summary migrations.FleetSummary) {
+	lastFleetSummaryMutex.Lock()
+	defer lastFleetSummaryMutex.Unlock()
+
+	lastFleetSummary = summary
+}
+
+// Returns the summary of the most recent fleet wide tenant migration.
+func latestFleetSummary() migrations.FleetSummary {
+	lastFleetSummaryMutex.RLock()
+	defer lastFleetSummaryMutex.RUnlock()
+
+	return lastFleetSummary
+}
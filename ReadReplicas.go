@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"github.com/LiamDotPro/Go-Multitenancy/tenants"
+	"time"
+)
+
+// Closed at shutdown to stop refreshing the read replicas.
+var readReplicaQuit chan struct{}
+
+// Hands the registered read replicas to the connection manager.
+func loadReadReplicas() error {
+
+	replicas, err := tenants.ReadReplicas(Connection)
+
+	if err != nil {
+		return err
+	}
+
+	TenantConnections.SetReadReplicas(replicas)
+
+	return nil
+}
+
+// Reloads the read replicas every interval, so replicas added or removed through another instance are picked up.
+func periodicReadReplicaRefresh(interval time.Duration, quit <-chan struct{}) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := loadReadReplicas(); err != nil {
+				fmt.Println("An error occurred while loading the read replicas", err)
+			}
+		case <-quit:
+			return
+		}
+	}
+}
+
+// Adds a replica of a tenants database, or of every database on a server when the tenant identifier is empty.
+func addReadReplica(replica *tenants.ReadReplica, tenantIdentifier string, serverName string) error {
+
+	if len(tenantIdentifier) > 0 {
+		tenant, err := tenants.FindTenantByIdentifier(Connection, tenantIdentifier)
+
+		if err != nil {
+			return err
+		}
+
+		replica.TenantConnectionInformationId = tenant.ID
+	}
+
+	if len(serverName) > 0 {
+		server, err := tenants.FindDatabaseServer(Connection, serverName)
+
+		if err != nil {
+			return err
+		}
+
+		replica.DatabaseServerId = server.ID
+	}
+
+	if err := tenants.AddReadReplica(Connection, replica); err != nil {
+		return err
+	}
+
+	return loadReadReplicas()
+}
+
+// Removes a replica, reads going to it move back to the primary or the other replicas.
+func removeReadReplica(name string) (tenants.ReadReplica, error) {
+
+	replica, err := tenants.RemoveReadReplica(Connection, name)
+
+	if err != nil {
+		return replica, err
+	}
+
+	return replica, loadReadReplicas()
+}
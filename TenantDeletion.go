@@ -0,0 +1,347 @@
+package main
+
+import (
+	"fmt"
+	"github.com/LiamDotPro/Go-Multitenancy/helpers"
+	"github.com/LiamDotPro/Go-Multitenancy/migrations"
+	"github.com/LiamDotPro/Go-Multitenancy/tenants"
+	"github.com/gorilla/securecookie"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"time"
+)
+
+// Only one instance purges deletions at a time.
+const deletionLockName = "tenant-deletions"
+
+// The name sessions are saved under, needed to decode them outside of a request.
+const sessionName = "connect.s.id"
+
+// How many sessions are decoded at a time when purging a deleted tenant from them.
+const sessionPurgePageSize = 500
+
+// A step of purging a deleted tenant. Steps are recorded as they finish so a retried purge skips them, each has to be safe to run twice.
+type deletionStep struct {
+	Name string
+	Run  func(deletion *tenants.TenantDeletion) error
+}
+
+// The steps every deleted tenant goes through, in order. Records go last so the tenant can be found again if an earlier step fails.
+var deletionSteps = []deletionStep{
+	{Name: "storage", Run: dropDeletedTenantStorage},
+	{Name: "role", Run: dropDeletedTenantRoles},
+	{Name: "sessions", Run: purgeDeletedTenantSessions},
+	{Name: "records", Run: removeDeletedTenantRecords},
+}
+
+// Closed at shutdown to stop the periodic deletion purge.
+var tenantDeletionQuit chan struct{}
+
+// How long a tenant is kept pending deletion before it is purged.
+func tenantDeletionGracePeriod() time.Duration {
+	return helpers.GetEnvDuration("tenantDeletionGracePeriod", 30*24*time.Hour)
+}
+
+// Purges the deletions that are due every interval until quit is closed.
+func periodicTenantDeletionPurge(interval time.Duration, quit <-chan struct{}) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := purgeDueTenantDeletions(); err != nil && err != migrations.ErrLockNotAcquired {
+				fmt.Println("An error occurred while purging deleted tenants", err)
+			}
+		case <-quit:
+			return
+		}
+	}
+}
+
+// Purges every deletion whose grace period is over, carrying on past failures so one broken tenant doesn't hold up the rest.
+// Returns the deletions it completed.
+func purgeDueTenantDeletions() ([]tenants.TenantDeletion, error) {
+
+	options := masterLockOptions()
+	options.Mode = migrations.LockSkip
+
+	var completed []tenants.TenantDeletion
+
+	err := migrations.WithLock(Connection, deletionLockName, options, func() error {
+		deletions, err := tenants.DueTenantDeletions(Connection)
+
+		if err != nil {
+			return err
+		}
+
+		var failed int
+
+		for i := range deletions {
+			deletion := &deletions[i]
+
+			if err := purgeTenantDeletion(deletion); err != nil {
+				fmt.Printf("Could not purge tenant %v: %v\n", deletion.SubDomainIdentifier, err)
+				failed++
+				continue
+			}
+
+			if deletion.Status == tenants.DeletionCompleted {
+				completed = append(completed, *deletion)
+			}
+		}
+
+		if failed > 0 {
+			return fmt.Errorf("%d of %d tenant deletions could not be purged", failed, len(deletions))
+		}
+
+		return nil
+	})
+
+	return completed, err
+}
+
+// Moves the tenant to deleted and runs the deletion steps it hasn't finished yet, issuing the certificate once they are all done.
+func purgeTenantDeletion(deletion *tenants.TenantDeletion) error {
+
+	claimed, err := tenants.ClaimTenantDeletion(Connection, deletion)
+
+	if err != nil || !claimed {
+		return err
+	}
+
+	if err := markTenantDeleted(deletion); err != nil {
+		return failTenantDeletion(deletion, err)
+	}
+
+	for _, step := range deletionSteps {
+		if deletion.StepDone(step.Name) {
+			continue
+		}
+
+		if err := step.Run(deletion); err != nil {
+			return failTenantDeletion(deletion, fmt.Errorf("%v: %v", step.Name, err))
+		}
+
+		if err := tenants.CompleteDeletionStep(Connection, deletion, step.Name); err != nil {
+			return failTenantDeletion(deletion, err)
+		}
+	}
+
+	_, err = tenants.CompleteTenantDeletion(Connection, deletion)
+
+	return err
+}
+
+// Leaves the deletion failed so the next run retries it.
+func failTenantDeletion(deletion *tenants.TenantDeletion, err error) error {
+
+	if statusErr := tenants.SetDeletionStatus(Connection, deletion, tenants.DeletionFailed, err); statusErr != nil {
+		fmt.Println(statusErr)
+	}
+
+	return err
+}
+
+// Moves a tenant still pending deletion to deleted, so requests stop reaching it, and records what the later steps need while the records are there.
+func markTenantDeleted(deletion *tenants.TenantDeletion) error {
+
+	if deletion.StepDone("records") {
+		return nil
+	}
+
+	var tenant tenants.TenantConnectionInformation
+
+	if err := Connection.Unscoped().First(&tenant, deletion.TenantConnectionInformationId).Error; err != nil {
+		// Removed some other way, there is nothing left to snapshot.
+		if gorm.IsRecordNotFoundError(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	var aliases []tenants.TenantAlias
+
+	if err := Connection.Where("tenant_connection_information_id = ?", tenant.ID).Find(&aliases).Error; err != nil {
+		return err
+	}
+
+	identifiers := []string{tenant.TenantSubDomainIdentifier}
+
+	for _, alias := range aliases {
+		identifiers = append(identifiers, alias.Identifier)
+	}
+
+	if err := tenants.SnapshotTenantDeletion(Connection, deletion, tenant, identifiers); err != nil {
+		return err
+	}
+
+	if tenant.State() == tenants.StateDeleted {
+		return nil
+	}
+
+	if _, err := tenants.TransitionTenant(Connection, &tenant, tenants.StateDeleted, "grace period over", 0); err != nil {
+		return err
+	}
+
+	invalidateTenantLookups(tenant.ID)
+
+	return nil
+}
+
+// Drops the database or schema the tenant lived in, or its rows in the shared tables.
+func dropDeletedTenantStorage(deletion *tenants.TenantDeletion) error {
+
+	// Open connections would stop the database being dropped.
+	TenantConnections.Evict(deletion.TenantConnectionInformationId)
+
+	switch deletion.IsolationMode {
+	case tenants.IsolationSchema:
+		return withSharedDatabase(func(shared *gorm.DB) error {
+			return shared.Exec("DROP SCHEMA IF EXISTS " + pq.QuoteIdentifier(deletion.SchemaName) + " CASCADE").Error
+		})
+	case tenants.IsolationShared:
+		return deleteSharedTenantRows(deletion.TenantConnectionInformationId)
+	default:
+		if len(deletion.DatabaseName) == 0 {
+			return nil
+		}
+
+		return withDatabaseServer(deletion.DatabaseServerId, func(admin *gorm.DB) error {
+			return admin.Exec("DROP DATABASE IF EXISTS " + pq.QuoteIdentifier(deletion.DatabaseName)).Error
+		})
+	}
+}
+
+// Drops the tenants roles, once the storage they owned has gone.
+func dropDeletedTenantRoles(deletion *tenants.TenantDeletion) error {
+	return dropTenantRoles(deletion.DatabaseServerId, deletion.RoleName)
+}
+
+// Removes the tenant from every session, deleting sessions that were only for the tenant.
+// Sessions that can't be decoded have expired or were made with an old key, the store cleans those up itself.
+func purgeDeletedTenantSessions(deletion *tenants.TenantDeletion) error {
+
+	identifiers := deletion.IdentifierList()
+
+	if len(identifiers) == 0 {
+		identifiers = []string{deletion.SubDomainIdentifier}
+	}
+
+	var last string
+
+	// Go through the sessions a page at a time so a large sessions table isn't held in memory at once.
+	for {
+		var sessions []struct {
+			Id   string
+			Data string
+		}
+
+		if err := Connection.Table("sessions").Select("id, data").Where("id > ?", last).Order("id").Limit(sessionPurgePageSize).Scan(&sessions).Error; err != nil {
+			return err
+		}
+
+		for _, session := range sessions {
+			if err := purgeTenantsFromSession(session.Id, session.Data, identifiers); err != nil {
+				return err
+			}
+		}
+
+		if len(sessions) < sessionPurgePageSize {
+			return nil
+		}
+
+		last = sessions[len(sessions)-1].Id
+	}
+}
+
+// Removes the tenants from a single session, deleting it when nothing else is left in it.
+func purgeTenantsFromSession(id string, data string, identifiers []string) error {
+
+	values := map[interface{}]interface{}{}
+
+	if err := securecookie.DecodeMulti(sessionName, data, &values, Store.Codecs...); err != nil {
+		return nil
+	}
+
+	client, found := values["client"].(ClientProfile)
+
+	if !found || !removeTenantsFromProfile(&client, identifiers) {
+		return nil
+	}
+
+	host, _ := values["host"].(HostProfile)
+
+	if len(client.AuthorizationMap) == 0 && len(client.LoginAttempts) == 0 && host.Authorized == 0 {
+		return Connection.Exec("DELETE FROM sessions WHERE id = ?", id).Error
+	}
+
+	values["client"] = client
+
+	encoded, err := securecookie.EncodeMulti(sessionName, values, Store.Codecs...)
+
+	if err != nil {
+		return err
+	}
+
+	return Connection.Table("sessions").Where("id = ?", id).Update("data", encoded).Error
+}
+
+// Removes the tenants logins and login attempts from a client profile, false when it had none.
+func removeTenantsFromProfile(client *ClientProfile, identifiers []string) bool {
+
+	var changed bool
+
+	for _, identifier := range identifiers {
+		if _, found := client.AuthorizationMap[identifier]; found {
+			delete(client.AuthorizationMap, identifier)
+			changed = true
+		}
+
+		if _, found := client.LoginAttempts[identifier]; found {
+			delete(client.LoginAttempts, identifier)
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// Removes the tenants connection record, aliases and domains for good, freeing its identifiers.
+func removeDeletedTenantRecords(deletion *tenants.TenantDeletion) error {
+	return removeTenantRecords(deletion.TenantConnectionInformationId, deletion.IdentifierList()...)
+}
+
+// Removes a tenant record along with its aliases and domains.
+func removeTenantRecords(tenantId uint, identifiers ...string) error {
+
+	err := Connection.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("tenant_connection_information_id = ?", tenantId).Delete(&tenants.TenantAlias{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Unscoped().Where("tenant_connection_information_id = ?", tenantId).Delete(&tenants.TenantDomain{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Unscoped().Delete(&tenants.TenantConnectionInformation{}, tenantId).Error
+	})
+
+	if err != nil {
+		return err
+	}
+
+	TenantConnections.Evict(tenantId)
+
+	var keys []string
+
+	for _, identifier := range identifiers {
+		keys = append(keys, tenants.IdentifierCacheKey(identifier))
+	}
+
+	invalidateTenantLookups(tenantId, keys...)
+
+	return nil
+}
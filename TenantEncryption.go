@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"github.com/LiamDotPro/Go-Multitenancy/tenants"
+	"strings"
+)
+
+// Re-encrypts every tenant connection string with the current master key, encrypting plaintext ones as well.
+// Run after making a new master key current, the old key can be removed once this has finished without errors.
+func reencryptConnectionStrings() (int, error) {
+
+	if !tenants.EncryptionEnabled() {
+		return 0, tenants.ErrNoKeyProvider
+	}
+
+	var records []tenants.TenantConnectionInformation
+
+	// Soft deleted tenants keep their connection string too.
+	if err := Connection.Unscoped().Find(&records).Error; err != nil {
+		return 0, err
+	}
+
+	var reencrypted int
+	var failed []string
+
+	for _, record := range records {
+		if len(record.ConnectionString) == 0 {
+			continue
+		}
+
+		encrypted, changed, err := tenants.ReencryptConnectionString(record.ConnectionString)
+
+		if err != nil {
+			failed = append(failed, record.TenantSubDomainIdentifier+": "+err.Error())
+			continue
+		}
+
+		if !changed {
+			continue
+		}
+
+		// Leave the record alone if its credentials were rotated in the meantime, the rotation encrypted it with the current key.
+		result := quietly(Connection).Unscoped().Model(&tenants.TenantConnectionInformation{}).Where("id = ? AND connection_string = ?", record.ID, record.ConnectionString).Update("connection_string", encrypted)
+
+		if result.Error != nil {
+			failed = append(failed, record.TenantSubDomainIdentifier+": "+result.Error.Error())
+			continue
+		}
+
+		if result.RowsAffected > 0 {
+			reencrypted++
+			invalidateTenantLookups(record.ID)
+		}
+	}
+
+	if len(failed) > 0 {
+		return reencrypted, fmt.Errorf("could not re-encrypt the connection strings of %v", strings.Join(failed, ", "))
+	}
+
+	return reencrypted, nil
+}
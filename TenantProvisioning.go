@@ -0,0 +1,407 @@
+package main
+
+import (
+	"fmt"
+	"github.com/LiamDotPro/Go-Multitenancy/helpers"
+	"github.com/LiamDotPro/Go-Multitenancy/tenants"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"sync"
+	"time"
+)
+
+// Returned when a tenant with the same identifier is already being provisioned.
+var errProvisioningInProgress = tenants.ErrProvisioningInProgress
+
+// What a provisioning job has made so far, handed from step to step.
+type tenantProvisioning struct {
+	Job        *tenants.ProvisioningJob
+	Tenant     tenants.TenantConnectionInformation
+	Connection *gorm.DB
+	LoginRole  string
+	Password   string // The password of LoginRole, only held in memory until it is in the tenants connection string.
+}
+
+// A step of provisioning a tenant, run while the job is in Status.
+type provisioningStep struct {
+	Name   string
+	Status string
+	Run    func(p *tenantProvisioning) error
+	Undo   func(p *tenantProvisioning) error // Reverses Run when a later step fails, nil when there is nothing to undo.
+
+	// Undo is also run when the step fails itself, only for steps whose undo is safe however far Run got.
+	UndoIfFailed bool
+}
+
+// The steps every new tenant goes through, in order. When one fails the steps before it are undone in reverse.
+// Database isolated tenants are placed on a server first, as their role and database are made there.
+// The role comes next as it owns the database or schema, and is dropped last for the same reason.
+// Migrations and seeds made in a tenants own database or schema go with it, so only shared table seeds need undoing.
+// Seeding is the last step, so it is undone when it fails itself, removing whatever rows the seeds got to.
+var provisioningSteps = []provisioningStep{
+	{Name: "placement", Status: tenants.ProvisioningCreatingDatabase, Run: placeProvisionedTenant},
+	{Name: "role", Status: tenants.ProvisioningCreatingDatabase, Run: createTenantRoles, Undo: dropProvisionedTenantRoles},
+	{Name: "database", Status: tenants.ProvisioningCreatingDatabase, Run: createTenantStorage, Undo: dropTenantStorage},
+	{Name: "record", Status: tenants.ProvisioningCreatingDatabase, Run: insertTenantRecord, Undo: deleteTenantRecord},
+	{Name: "migrations", Status: tenants.ProvisioningMigrating, Run: migrateProvisionedTenant},
+	{Name: "seed", Status: tenants.ProvisioningSeeding, Run: seedProvisionedTenant, Undo: unseedProvisionedTenant, UndoIfFailed: true},
+}
+
+// Data every new tenant starts with, run against the tenant connection once it has been migrated.
+var tenantSeeds []func(tenant tenants.TenantConnectionInformation, db *gorm.DB) error
+
+// Limits how many jobs run at once, sized by provisioningWorkers.
+var provisioningSlots chan struct{}
+var provisioningSlotsOnce sync.Once
+
+// Jobs running in this instance, waited on at shutdown so a job isn't cut off half way through a step.
+var provisioningJobs sync.WaitGroup
+
+// Works through a queued job in the background.
+func startProvisioningJob(id uint) {
+
+	provisioningSlotsOnce.Do(func() {
+		provisioningSlots = make(chan struct{}, helpers.GetEnvInt("provisioningWorkers", 2))
+	})
+
+	provisioningJobs.Add(1)
+
+	go func() {
+		defer provisioningJobs.Done()
+
+		provisioningSlots <- struct{}{}
+		defer func() { <-provisioningSlots }()
+
+		if err := runProvisioningJob(id); err != nil {
+			fmt.Printf("Provisioning job %d failed: %v\n", id, err)
+		}
+	}()
+}
+
+// Picks up the jobs that were still queued when the last instance stopped.
+func resumeQueuedProvisioningJobs() {
+
+	ids, err := tenants.QueuedProvisioningJobs(Connection)
+
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	for _, id := range ids {
+		startProvisioningJob(id)
+	}
+}
+
+// Runs each provisioning step in turn, recording when it started and finished.
+// The first step to fail stops the job and everything the earlier steps made is undone.
+func runProvisioningJob(id uint) error {
+
+	lease := provisioningLease()
+
+	job, claimed, err := tenants.ClaimProvisioningJob(Connection, id, lease)
+
+	if err != nil || !claimed {
+		return err
+	}
+
+	// Keep the lease while the steps run, however long migrations take.
+	stopRenewing := renewProvisioningLease(job.ID, lease)
+	defer stopRenewing()
+
+	provisioning := &tenantProvisioning{Job: &job}
+
+	var started []tenants.ProvisioningStep
+
+	for _, step := range provisioningSteps {
+		record, err := tenants.StartProvisioningStep(Connection, &job, step.Name, step.Status, step.UndoIfFailed)
+
+		if err == nil {
+			err = step.Run(provisioning)
+
+			if finishErr := tenants.FinishProvisioningStep(Connection, &record, err); finishErr != nil {
+				fmt.Println(finishErr)
+			}
+		}
+
+		if record.ID != 0 {
+			started = append(started, record)
+		}
+
+		// The failed step is only undone when marked UndoIfFailed, it may have failed because what it makes already belongs to someone else.
+		if err != nil {
+			if undoErr := compensateProvisioning(provisioning, started); undoErr != nil {
+				fmt.Println(undoErr)
+			}
+
+			if finishErr := tenants.FinishProvisioningJob(Connection, &job, err); finishErr != nil {
+				fmt.Println(finishErr)
+			}
+
+			return err
+		}
+	}
+
+	return tenants.FinishProvisioningJob(Connection, &job, nil)
+}
+
+// How long a job stays claimed without being renewed, it is renewed a few times within it while the job runs.
+func provisioningLease() time.Duration {
+	return helpers.GetEnvDuration("provisioningJobLease", 2*time.Minute)
+}
+
+// Renews the jobs lease in the background until the returned func is called.
+func renewProvisioningLease(id uint, lease time.Duration) func() {
+
+	quit := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(lease / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := tenants.RenewProvisioningLease(Connection, id, lease); err != nil {
+					fmt.Printf("Could not renew the lease of provisioning job %d: %v\n", id, err)
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+// Undoes the steps that need it in reverse, carrying on past failures so as much as possible is cleaned up.
+// Steps that couldn't be undone keep their error and are retried by the reconcile command.
+func compensateProvisioning(p *tenantProvisioning, steps []tenants.ProvisioningStep) error {
+
+	var known []tenants.ProvisioningStep
+
+	// Steps this version doesn't know of can't be undone here, they are left for someone to look at.
+	for _, record := range steps {
+		if _, found := findProvisioningStep(record.Name); found {
+			known = append(known, record)
+		}
+	}
+
+	return tenants.CompensateProvisioningSteps(Connection, p.Job, known, func(record tenants.ProvisioningStep) error {
+		if step, _ := findProvisioningStep(record.Name); step.Undo != nil {
+			return step.Undo(p)
+		}
+
+		return nil
+	})
+}
+
+// Returns the provisioning step with the name.
+func findProvisioningStep(name string) (provisioningStep, bool) {
+
+	for _, step := range provisioningSteps {
+		if step.Name == name {
+			return step, true
+		}
+	}
+
+	return provisioningStep{}, false
+}
+
+// Makes the tenants database or schema, shared table tenants have nothing to make.
+// The name is recorded first so the reconcile command can find it if the instance dies part way through.
+func createTenantStorage(p *tenantProvisioning) error {
+
+	switch p.Job.Isolation {
+	case tenants.IsolationSchema:
+		p.Job.SchemaName = tenants.PhysicalName(p.Job.SubDomainIdentifier)
+
+		if err := tenants.RecordProvisionedResources(Connection, p.Job); err != nil {
+			return err
+		}
+
+		// Create new schema to hold client inside of the shared database.
+		return createTenantSchema(p.Job.SchemaName, p.Job.RoleName)
+	case tenants.IsolationShared:
+		// Shared tables already exist, rows are told apart by tenant id.
+		return nil
+	default:
+		p.Job.DatabaseName = tenants.PhysicalName(p.Job.SubDomainIdentifier)
+
+		if err := tenants.RecordProvisionedResources(Connection, p.Job); err != nil {
+			return err
+		}
+
+		// Create new database to hold client on the server it was placed on, owned by its role and closed to every other.
+		return withDatabaseServer(p.Job.DatabaseServerId, func(admin *gorm.DB) error {
+			if err := admin.Exec("CREATE DATABASE " + pq.QuoteIdentifier(p.Job.DatabaseName) + " OWNER " + pq.QuoteIdentifier(p.Job.RoleName)).Error; err != nil {
+				return err
+			}
+
+			return admin.Exec("REVOKE ALL ON DATABASE " + pq.QuoteIdentifier(p.Job.DatabaseName) + " FROM PUBLIC").Error
+		})
+	}
+}
+
+// Drops the database or schema made for the tenant.
+func dropTenantStorage(p *tenantProvisioning) error {
+
+	if len(p.Job.SchemaName) > 0 {
+		return withSharedDatabase(func(shared *gorm.DB) error {
+			return shared.Exec("DROP SCHEMA IF EXISTS " + pq.QuoteIdentifier(p.Job.SchemaName) + " CASCADE").Error
+		})
+	}
+
+	if len(p.Job.DatabaseName) > 0 {
+		// Open connections would stop the database being dropped.
+		if p.Job.TenantConnectionInformationId > 0 {
+			TenantConnections.Evict(p.Job.TenantConnectionInformationId)
+		}
+
+		return withDatabaseServer(p.Job.DatabaseServerId, func(admin *gorm.DB) error {
+			return admin.Exec("DROP DATABASE IF EXISTS " + pq.QuoteIdentifier(p.Job.DatabaseName)).Error
+		})
+	}
+
+	return nil
+}
+
+// Inserts the tenants connection record pointing at its database or schema, database isolated tenants connect to the server they were placed on.
+func insertTenantRecord(p *tenantProvisioning) error {
+
+	connectionInfo := tenants.TenantConnectionInformation{TenantSubDomainIdentifier: p.Job.SubDomainIdentifier, IsolationMode: p.Job.Isolation, LifecycleState: tenants.StateActive}
+
+	switch p.Job.Isolation {
+	case tenants.IsolationSchema:
+		connectionInfo.SchemaName = p.Job.SchemaName
+		connectionInfo.ConnectionString = tenants.ConnectionStringWithSearchPath(tenants.SharedConnectionString(), connectionInfo.SchemaName)
+	case tenants.IsolationShared:
+		connectionInfo.ConnectionString = tenants.SharedConnectionString()
+	default:
+		var server tenants.DatabaseServer
+
+		if err := Connection.First(&server, p.Job.DatabaseServerId).Error; err != nil {
+			return err
+		}
+
+		connectionInfo.DatabaseName = p.Job.DatabaseName
+		connectionInfo.DatabaseServerId = server.ID
+		connectionInfo.ConnectionString = server.ConnectionString(connectionInfo.DatabaseName)
+	}
+
+	// Tenants with their own storage connect as their own login.
+	if len(p.Job.RoleName) > 0 {
+		now := time.Now()
+		connectionInfo.ConnectionString = tenants.ConnectionStringWithCredentials(connectionInfo.ConnectionString, p.LoginRole, p.Password)
+		connectionInfo.RoleName = p.Job.RoleName
+		connectionInfo.LoginRole = p.LoginRole
+		connectionInfo.CredentialsRotatedAt = &now
+	}
+
+	encrypted, err := tenants.EncryptConnectionString(connectionInfo.ConnectionString)
+
+	if err != nil {
+		return err
+	}
+
+	connectionInfo.ConnectionString = encrypted
+
+	if err := quietly(Connection).Create(&connectionInfo).Error; err != nil {
+		return err
+	}
+
+	p.Tenant = connectionInfo
+	p.Job.TenantConnectionInformationId = connectionInfo.ID
+
+	// Forget the identifier having been unknown.
+	invalidateTenantLookups(connectionInfo.ID, tenants.IdentifierCacheKey(p.Job.SubDomainIdentifier))
+
+	return tenants.RecordProvisionedResources(Connection, p.Job)
+}
+
+// Removes the tenants connection record for good, so the identifier can be used again.
+func deleteTenantRecord(p *tenantProvisioning) error {
+
+	if p.Job.TenantConnectionInformationId == 0 {
+		return nil
+	}
+
+	TenantConnections.Evict(p.Job.TenantConnectionInformationId)
+
+	if err := Connection.Unscoped().Delete(&tenants.TenantConnectionInformation{}, p.Job.TenantConnectionInformationId).Error; err != nil {
+		return err
+	}
+
+	invalidateTenantLookups(p.Job.TenantConnectionInformationId, tenants.IdentifierCacheKey(p.Job.SubDomainIdentifier))
+
+	return nil
+}
+
+// Brings the new tenant up to the latest tenant migration.
+func migrateProvisionedTenant(p *tenantProvisioning) error {
+
+	tenConn, err := TenantConnections.GetConnection(p.Tenant)
+
+	if err != nil {
+		return err
+	}
+
+	p.Connection = tenConn
+
+	return migrateTenant(p.Tenant, tenConn)
+}
+
+// Runs the tenant seeds against the migrated tenant.
+func seedProvisionedTenant(p *tenantProvisioning) error {
+
+	for _, seed := range tenantSeeds {
+		if err := seed(p.Tenant, p.Connection); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Removes the rows seeded for a shared table tenant, other tenants lose their seeds along with their database or schema.
+func unseedProvisionedTenant(p *tenantProvisioning) error {
+
+	if p.Job.Isolation != tenants.IsolationShared || p.Job.TenantConnectionInformationId == 0 {
+		return nil
+	}
+
+	return deleteSharedTenantRows(p.Job.TenantConnectionInformationId)
+}
+
+// Deletes every row a shared table tenant has in the tenant tables.
+func deleteSharedTenantRows(tenantId uint) error {
+
+	tenant := tenants.TenantConnectionInformation{Model: gorm.Model{ID: tenantId}, IsolationMode: tenants.IsolationShared, ConnectionString: tenants.SharedConnectionString()}
+
+	connection, err := TenantConnections.GetConnection(tenant)
+
+	if err != nil {
+		return err
+	}
+
+	tx, err := tenants.BeginTenantTransaction(connection, tenant)
+
+	if err != nil {
+		return err
+	}
+
+	for _, model := range tenantModels {
+		if err := tenants.ScopeConnection(tx, tenant).Unscoped().Delete(model).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit().Error
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/LiamDotPro/Go-Multitenancy/helpers"
+	"github.com/LiamDotPro/Go-Multitenancy/tenants"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"strings"
+	"time"
+)
+
+// What the reconcile command finds.
+const (
+	reconcileStuckJob       = "stuck job"         // A job that stopped updating part way through, e.g. its instance died.
+	reconcileFailedJob      = "failed job"        // A failed job with steps that couldn't be undone.
+	reconcileOrphanDatabase = "orphaned database" // A database no tenant record points at.
+	reconcileOrphanSchema   = "orphaned schema"   // A schema in the shared database no tenant record points at.
+	reconcileOrphanRecord   = "orphaned record"   // A tenant record whose database or schema is missing.
+	reconcileOrphanRole     = "orphaned role"     // A role made by a failed provisioning job that no tenant record uses.
+)
+
+// Something the reconcile command found, Fixed is set once it has been cleaned up.
+type reconcileFinding struct {
+	Kind   string
+	Name   string
+	Detail string
+	Fixed  bool
+	Error  string
+}
+
+func (f reconcileFinding) String() string {
+
+	outcome := "found"
+
+	switch {
+	case len(f.Error) > 0:
+		outcome = "error: " + f.Error
+	case f.Fixed:
+		outcome = "cleaned up"
+	}
+
+	return fmt.Sprintf("%-18v %-30v %v (%v)\n", f.Kind, f.Name, f.Detail, outcome)
+}
+
+// Looks for what failed or interrupted provisioning left behind, cleaning it up when apply is set.
+// Databases and schemas are only dropped when a failed provisioning job made them, others are reported for someone to look at.
+func reconcileTenants(apply bool) ([]reconcileFinding, error) {
+
+	if Connection.Dialect().GetName() != "postgres" {
+		return nil, errors.New("reconciling tenants is only supported on postgres")
+	}
+
+	findings, err := reconcileProvisioningJobs(apply)
+
+	if err != nil {
+		return findings, err
+	}
+
+	storage, err := reconcileTenantStorage(apply)
+
+	return append(findings, storage...), err
+}
+
+// Undoes the finished steps of jobs that were interrupted, or that failed and couldn't be undone at the time.
+func reconcileProvisioningJobs(apply bool) ([]reconcileFinding, error) {
+
+	staleBefore := time.Now().Add(-helpers.GetEnvDuration("provisioningJobTimeout", 30*time.Minute))
+
+	jobs, err := tenants.UnfinishedProvisioningJobs(Connection, staleBefore)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var findings []reconcileFinding
+
+	for i := range jobs {
+		job := &jobs[i]
+		finding := reconcileFinding{Kind: reconcileFailedJob, Name: fmt.Sprintf("job %d", job.ID), Detail: job.SubDomainIdentifier}
+
+		if job.Status != tenants.ProvisioningFailed {
+			finding.Kind = reconcileStuckJob
+			finding.Detail += ", stuck " + job.Status + " since " + job.UpdatedAt.Format(time.RFC3339)
+
+			// Take the job over first, so a job whose instance renewed its lease in the meantime is left alone.
+			if apply {
+				claimed, err := tenants.ReclaimProvisioningJob(Connection, job, staleBefore, provisioningLease())
+
+				if err != nil {
+					finding.Error = err.Error()
+					findings = append(findings, finding)
+					continue
+				}
+
+				if !claimed {
+					finding.Detail += ", running again"
+					findings = append(findings, finding)
+					continue
+				}
+			}
+		}
+
+		if apply {
+			if err := reconcileProvisioningJob(job); err != nil {
+				finding.Error = err.Error()
+			} else {
+				finding.Fixed = true
+			}
+		}
+
+		findings = append(findings, finding)
+	}
+
+	return findings, nil
+}
+
+// Undoes what a job made and leaves it failed.
+func reconcileProvisioningJob(job *tenants.ProvisioningJob) error {
+
+	provisioning := &tenantProvisioning{Job: job}
+
+	if job.TenantConnectionInformationId > 0 {
+		if err := Connection.Unscoped().First(&provisioning.Tenant, job.TenantConnectionInformationId).Error; err != nil && !gorm.IsRecordNotFoundError(err) {
+			return err
+		}
+	}
+
+	previousError := job.Error
+
+	undoErr := compensateProvisioning(provisioning, job.Steps)
+
+	if len(previousError) > 0 {
+		if err := tenants.SetProvisioningStatus(Connection, job, tenants.ProvisioningFailed); err != nil {
+			return err
+		}
+	} else if err := tenants.FinishProvisioningJob(Connection, job, errors.New("interrupted part way through, rolled back by reconcile")); err != nil {
+		return err
+	}
+
+	return undoErr
+}
+
+// A database or role on one of the database servers.
+type serverObject struct {
+	ServerId uint
+	Name     string
+}
+
+// Compares the databases and schemas on every server with the tenant records pointing at them.
+func reconcileTenantStorage(apply bool) ([]reconcileFinding, error) {
+
+	var records []tenants.TenantConnectionInformation
+
+	// Soft deleted tenants still own their database.
+	if err := Connection.Unscoped().Find(&records).Error; err != nil {
+		return nil, err
+	}
+
+	var failedJobs []tenants.ProvisioningJob
+
+	if err := Connection.Where("status = ?", tenants.ProvisioningFailed).Find(&failedJobs).Error; err != nil {
+		return nil, err
+	}
+
+	relocations, err := tenants.OpenTenantRelocations(Connection)
+
+	if err != nil {
+		return nil, err
+	}
+
+	servers, err := reconcileServers()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Tenants made before servers were registered live on the server the master connection manages.
+	masterServer := uint(0)
+
+	for _, server := range servers {
+		if server.ManagedByMaster() {
+			masterServer = server.ID
+			break
+		}
+	}
+
+	serverOf := func(id uint) uint {
+		if id == 0 {
+			return masterServer
+		}
+
+		return id
+	}
+
+	databases := map[serverObject]bool{}
+	serverNames := map[uint]string{}
+
+	for _, server := range servers {
+		names, err := listDatabases(server)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for name := range names {
+			databases[serverObject{server.ID, name}] = true
+		}
+
+		serverNames[server.ID] = server.Name
+	}
+
+	var schemas map[string]bool
+
+	if err := withSharedDatabase(func(shared *gorm.DB) (err error) {
+		schemas, err = listSchemas(shared)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	referencedDatabases := map[serverObject]bool{}
+	referencedSchemas := map[string]bool{}
+	referencedRoles := map[serverObject]bool{}
+
+	for _, record := range records {
+		referencedDatabases[serverObject{serverOf(record.DatabaseServerId), record.DatabaseName}] = true
+		referencedSchemas[record.SchemaName] = true
+		referencedRoles[serverObject{serverOf(record.DatabaseServerId), record.RoleName}] = true
+	}
+
+	// A tenant being relocated has its database and roles on both servers until the relocation has cleaned up.
+	for _, relocation := range relocations {
+		for _, serverId := range []uint{relocation.SourceServerId, relocation.TargetServerId} {
+			referencedDatabases[serverObject{serverOf(serverId), relocation.DatabaseName}] = true
+			referencedRoles[serverObject{serverOf(serverId), relocation.RoleName}] = true
+		}
+	}
+
+	failedDatabases := map[serverObject]bool{}
+	failedSchemas := map[string]bool{}
+
+	for _, job := range failedJobs {
+		failedDatabases[serverObject{serverOf(job.DatabaseServerId), job.DatabaseName}] = true
+		failedSchemas[job.SchemaName] = true
+	}
+
+	// Names databases and roles after their server when it has one.
+	describe := func(object serverObject) string {
+		if name := serverNames[object.ServerId]; len(name) > 0 {
+			return name + "/" + object.Name
+		}
+
+		return object.Name
+	}
+
+	var findings []reconcileFinding
+
+	for database := range databases {
+		if referencedDatabases[database] {
+			continue
+		}
+
+		finding := reconcileFinding{Kind: reconcileOrphanDatabase, Name: describe(database), Detail: "not created by provisioning, drop it by hand if it isn't needed"}
+
+		if failedDatabases[database] {
+			finding.Detail = "left by a failed provisioning job"
+
+			if apply {
+				finding.Fixed, finding.Error = reconcileError(withDatabaseServer(database.ServerId, func(admin *gorm.DB) error {
+					return admin.Exec("DROP DATABASE IF EXISTS " + pq.QuoteIdentifier(database.Name)).Error
+				}))
+			}
+		}
+
+		findings = append(findings, finding)
+	}
+
+	for name := range schemas {
+		if referencedSchemas[name] {
+			continue
+		}
+
+		finding := reconcileFinding{Kind: reconcileOrphanSchema, Name: name, Detail: "not created by provisioning, drop it by hand if it isn't needed"}
+
+		if failedSchemas[name] {
+			finding.Detail = "left by a failed provisioning job"
+
+			if apply {
+				finding.Fixed, finding.Error = reconcileError(withSharedDatabase(func(shared *gorm.DB) error {
+					return shared.Exec("DROP SCHEMA IF EXISTS " + pq.QuoteIdentifier(name) + " CASCADE").Error
+				}))
+			}
+		}
+
+		findings = append(findings, finding)
+	}
+
+	// Roles are dropped after storage, they can't be dropped while they still own it.
+	for _, job := range failedJobs {
+		role := serverObject{serverOf(job.DatabaseServerId), job.RoleName}
+
+		if len(job.RoleName) == 0 || referencedRoles[role] {
+			continue
+		}
+
+		var existing []string
+
+		if err := withDatabaseServer(job.DatabaseServerId, func(admin *gorm.DB) (err error) {
+			existing, err = existingRoles(admin, []string{job.RoleName})
+			return err
+		}); err != nil {
+			return findings, err
+		}
+
+		if len(existing) == 0 {
+			continue
+		}
+
+		// Only report a role once when more than one failed job made it.
+		referencedRoles[role] = true
+
+		finding := reconcileFinding{Kind: reconcileOrphanRole, Name: describe(role), Detail: "left by a failed provisioning job"}
+
+		if apply {
+			finding.Fixed, finding.Error = reconcileError(dropTenantRoles(job.DatabaseServerId, job.RoleName))
+		}
+
+		findings = append(findings, finding)
+	}
+
+	for _, record := range records {
+		if record.DeletedAt != nil {
+			continue
+		}
+
+		var missing string
+
+		switch {
+		case record.Isolation() == tenants.IsolationDatabase && len(record.DatabaseName) > 0 && !databases[serverObject{serverOf(record.DatabaseServerId), record.DatabaseName}]:
+			missing = "database " + describe(serverObject{serverOf(record.DatabaseServerId), record.DatabaseName})
+		case record.Isolation() == tenants.IsolationSchema && !schemas[record.SchemaName]:
+			missing = "schema " + record.SchemaName
+		default:
+			continue
+		}
+
+		finding := reconcileFinding{Kind: reconcileOrphanRecord, Name: record.TenantSubDomainIdentifier, Detail: missing + " is missing"}
+
+		if apply {
+			finding.Fixed, finding.Error = reconcileError(removeTenantRecords(record.ID, record.TenantSubDomainIdentifier))
+		}
+
+		findings = append(findings, finding)
+	}
+
+	return findings, nil
+}
+
+// Returns the servers to look for databases on, the server the master connection manages is included even when it isn't registered.
+// Register each server once, a server registered twice has its databases reported twice.
+func reconcileServers() ([]tenants.DatabaseServer, error) {
+
+	servers, err := tenants.DatabaseServers(Connection)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, server := range servers {
+		if server.ManagedByMaster() {
+			return servers, nil
+		}
+	}
+
+	return append([]tenants.DatabaseServer{{}}, servers...), nil
+}
+
+// Returns the user databases on a server, leaving out the database the admin connection uses and, on the master server, the shared tenant database.
+func listDatabases(server tenants.DatabaseServer) (map[string]bool, error) {
+
+	databases := map[string]bool{}
+
+	err := withDatabaseServer(server.ID, func(admin *gorm.DB) error {
+		rows, err := admin.Raw("SELECT datname FROM pg_database WHERE NOT datistemplate AND datname <> 'postgres' AND datname <> current_database()").Rows()
+
+		if err != nil {
+			return err
+		}
+
+		defer rows.Close()
+
+		for rows.Next() {
+			var name string
+
+			if err := rows.Scan(&name); err != nil {
+				return err
+			}
+
+			databases[name] = true
+		}
+
+		return rows.Err()
+	})
+
+	if err != nil || !server.ManagedByMaster() {
+		return databases, err
+	}
+
+	err = withSharedDatabase(func(shared *gorm.DB) error {
+		name, err := currentDatabase(shared)
+
+		delete(databases, name)
+
+		return err
+	})
+
+	return databases, err
+}
+
+// Returns the schemas in a database, leaving out public and the system schemas.
+func listSchemas(db *gorm.DB) (map[string]bool, error) {
+
+	rows, err := db.Raw("SELECT nspname FROM pg_namespace WHERE nspname NOT LIKE 'pg\\_%' AND nspname NOT IN ('public', 'information_schema')").Rows()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	schemas := map[string]bool{}
+
+	for rows.Next() {
+		var name string
+
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+
+		schemas[name] = true
+	}
+
+	return schemas, rows.Err()
+}
+
+func reconcileError(err error) (bool, string) {
+
+	if err != nil {
+		return false, err.Error()
+	}
+
+	return true, ""
+}
+
+// Prints what reconcile found, errors when anything couldn't be cleaned up.
+func printReconcileFindings(findings []reconcileFinding, apply bool) error {
+
+	if len(findings) == 0 {
+		fmt.Println("Nothing to reconcile.")
+		return nil
+	}
+
+	var failed []string
+
+	for _, finding := range findings {
+		fmt.Print(finding)
+
+		if len(finding.Error) > 0 {
+			failed = append(failed, finding.Name)
+		}
+	}
+
+	if !apply {
+		fmt.Println("Run again with -apply to clean up.")
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("could not clean up %v", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
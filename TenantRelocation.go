@@ -0,0 +1,887 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/LiamDotPro/Go-Multitenancy/helpers"
+	"github.com/LiamDotPro/Go-Multitenancy/migrations"
+	"github.com/LiamDotPro/Go-Multitenancy/tenants"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"os"
+	"strings"
+	"time"
+)
+
+// Returned when relocating a tenant without its own database and roles.
+var errNotRelocatable = errors.New("only database isolated tenants with their own roles can be relocated, rotate the credentials of older tenants first")
+
+// Returned when relocating a tenant to the server it is already on.
+var errSameServer = errors.New("the tenant is already on that database server")
+
+// Returned when both servers are the same postgres cluster, there is nothing to copy the database to.
+var errSameCluster = errors.New("the target server is the same postgres cluster as the tenants current server")
+
+// Returned when relocating a tenant that is being deleted.
+var errRelocationPendingDeletion = errors.New("tenants pending deletion can't be relocated")
+
+// Returned when the tenant record changed server while the relocation was switching it over.
+var errRelocationConflict = errors.New("the tenant was moved at the same time, please check where it is before trying again")
+
+// A step of relocating a tenant. Steps are recorded as they finish so a resumed relocation skips them, each has to be safe to run twice.
+type relocationStep struct {
+	Name string
+	Run  func(relocation *tenants.TenantRelocation) error
+}
+
+// The steps that copy the tenant over and switch it, in order, they match tenants.RelocationSteps.
+// Tenant migrations are held off while they run, schema changes aren't copied and would stop the copy.
+var relocationSteps = []relocationStep{
+	{Name: "prepare", Run: prepareRelocationTarget},
+	{Name: "schema", Run: migrateRelocationTarget},
+	{Name: "copy", Run: startRelocationCopy},
+	{Name: "sync", Run: waitForRelocationCopy},
+	{Name: "cutover", Run: cutOverRelocation},
+}
+
+// Runs once the tenant has been switched over, dropping everything left on the old server.
+var relocationCleanupStep = relocationStep{Name: "cleanup", Run: cleanUpRelocationSource}
+
+// Checks a relocation can go ahead and records it, or returns the relocation to the same server still open so it can be resumed.
+func relocateTenant(identifier string, serverName string, requestedBy uint) (tenants.TenantRelocation, error) {
+
+	tenant, err := tenants.FindTenantByIdentifier(Connection, identifier)
+
+	if err != nil {
+		return tenants.TenantRelocation{}, err
+	}
+
+	if tenant.Isolation() != tenants.IsolationDatabase || len(tenant.DatabaseName) == 0 || len(tenant.RoleName) == 0 {
+		return tenants.TenantRelocation{}, errNotRelocatable
+	}
+
+	if tenant.State() == tenants.StatePendingDeletion || tenant.State() == tenants.StateDeleted {
+		return tenants.TenantRelocation{}, errRelocationPendingDeletion
+	}
+
+	target, err := tenants.FindDatabaseServer(Connection, serverName)
+
+	if err != nil {
+		return tenants.TenantRelocation{}, err
+	}
+
+	open, found, err := tenants.OpenTenantRelocation(Connection, tenant.ID)
+
+	if err != nil {
+		return open, err
+	}
+
+	// A resumed relocation already counts towards the targets tenants.
+	if !found || open.TargetServerId != target.ID {
+		if target.ID == tenant.DatabaseServerId {
+			return tenants.TenantRelocation{}, errSameServer
+		}
+
+		loads, err := tenants.ServerLoads(Connection)
+
+		if err != nil {
+			return tenants.TenantRelocation{}, err
+		}
+
+		if !target.HasRoom(loads[target.ID]) {
+			return tenants.TenantRelocation{}, tenants.ErrServerUnavailable
+		}
+	}
+
+	return tenants.StartTenantRelocation(Connection, tenant, target.ID, requestedBy)
+}
+
+// Works through a relocation in the background.
+func startTenantRelocation(id uint) {
+
+	go func() {
+		if err := runTenantRelocation(id); err != nil && err != migrations.ErrLockNotAcquired {
+			fmt.Printf("Tenant relocation %d failed: %v\n", id, err)
+		}
+	}()
+}
+
+// Carries on with the relocations that were running when the last instance stopped, failed ones wait to be relocated again.
+func resumeTenantRelocations() {
+
+	relocations, err := tenants.OpenTenantRelocations(Connection)
+
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	for _, relocation := range relocations {
+		if relocation.Status == tenants.RelocationRunning {
+			startTenantRelocation(relocation.ID)
+		}
+	}
+}
+
+// Runs the steps of a relocation it hasn't finished yet, stopping at the first to fail so running it again carries on from there.
+// Only one instance works on a relocation at a time, the others get migrations.ErrLockNotAcquired.
+func runTenantRelocation(id uint) error {
+
+	options := masterLockOptions()
+	options.Mode = migrations.LockSkip
+
+	return migrations.WithLock(Connection, fmt.Sprintf("relocation:%d", id), options, func() error {
+		var relocation tenants.TenantRelocation
+
+		if err := Connection.First(&relocation, id).Error; err != nil {
+			return err
+		}
+
+		if relocation.Status != tenants.RelocationRunning && relocation.Status != tenants.RelocationFailed {
+			return nil
+		}
+
+		if !relocation.StepDone("cutover") {
+			options := migrations.LockOptionsFromEnv()
+			connectionString, err := serverDatabaseConnectionString(relocation.SourceServerId, relocation.DatabaseName)
+
+			if err != nil {
+				return failTenantRelocation(&relocation, err)
+			}
+
+			options.ConnectionString = connectionString
+
+			err = withServerDatabase(relocation.SourceServerId, relocation.DatabaseName, func(source *gorm.DB) error {
+				return migrations.WithLock(source, fmt.Sprintf("tenant:%d", relocation.TenantConnectionInformationId), options, func() error {
+					return runRelocationSteps(&relocation, relocationSteps)
+				})
+			})
+
+			if err != nil {
+				return failTenantRelocation(&relocation, err)
+			}
+		}
+
+		// The source database can't be dropped while the lock holds a connection to it.
+		if err := runRelocationSteps(&relocation, []relocationStep{relocationCleanupStep}); err != nil {
+			return failTenantRelocation(&relocation, err)
+		}
+
+		fmt.Printf("Relocated %v\n", relocation.SubDomainIdentifier)
+
+		return tenants.SetRelocationStatus(Connection, &relocation, tenants.RelocationCompleted, "", nil)
+	})
+}
+
+func runRelocationSteps(relocation *tenants.TenantRelocation, steps []relocationStep) error {
+
+	for _, step := range steps {
+		if relocation.StepDone(step.Name) {
+			continue
+		}
+
+		fmt.Printf("Relocating %v: %v\n", relocation.SubDomainIdentifier, step.Name)
+
+		if err := tenants.SetRelocationStatus(Connection, relocation, tenants.RelocationRunning, step.Name, nil); err != nil {
+			return err
+		}
+
+		if err := step.Run(relocation); err != nil {
+			return fmt.Errorf("%v: %v", step.Name, err)
+		}
+
+		if err := tenants.CompleteRelocationStep(Connection, relocation, step.Name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Leaves the relocation failed on the step it was on, relocating again carries on from there.
+func failTenantRelocation(relocation *tenants.TenantRelocation, err error) error {
+
+	if statusErr := tenants.SetRelocationStatus(Connection, relocation, tenants.RelocationFailed, relocation.Step, err); statusErr != nil {
+		fmt.Println(statusErr)
+	}
+
+	return err
+}
+
+// Names the publication, subscription and replication slot copying the tenant.
+func relocationReplicationName(relocation *tenants.TenantRelocation) string {
+	return fmt.Sprintf("tenant_relocation_%d", relocation.ID)
+}
+
+// How often the copy is checked on while waiting for it.
+func relocationPollInterval() time.Duration {
+	return helpers.GetEnvDuration("relocationPollInterval", 2*time.Second)
+}
+
+// Returns a connection string for a database on a server as its admin user, the master connection string for servers it manages.
+// Subscriptions use it to reach the source database, so it has to work from the other servers too.
+func serverDatabaseConnectionString(serverId uint, database string) (string, error) {
+
+	connectionString := os.Getenv("connectionString")
+
+	if serverId != 0 {
+		var server tenants.DatabaseServer
+
+		if err := Connection.First(&server, serverId).Error; err != nil {
+			return "", err
+		}
+
+		if !server.ManagedByMaster() {
+			decrypted, err := tenants.DecryptConnectionString(server.AdminConnectionString)
+
+			if err != nil {
+				return "", err
+			}
+
+			connectionString = decrypted
+		}
+	}
+
+	return tenants.ConnectionStringWithDatabase(connectionString, database), nil
+}
+
+// Opens a short lived admin connection to a database on a server.
+func withServerDatabase(serverId uint, database string, fn func(db *gorm.DB) error) error {
+
+	connectionString, err := serverDatabaseConnectionString(serverId, database)
+
+	if err != nil {
+		return err
+	}
+
+	db, err := gorm.Open("postgres", connectionString)
+
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	return fn(db)
+}
+
+// Counts the rows a query finds, for checking if something exists.
+func countRows(db *gorm.DB, query string, values ...interface{}) (int, error) {
+
+	var count int
+
+	err := db.Raw(query, values...).Row().Scan(&count)
+
+	return count, err
+}
+
+// Checks if two servers are the same postgres cluster.
+func sameCluster(first uint, second uint) (bool, error) {
+
+	var identifiers []string
+
+	for _, serverId := range []uint{first, second} {
+		var identifier string
+
+		if err := withDatabaseServer(serverId, func(admin *gorm.DB) error {
+			return admin.Raw("SELECT system_identifier::text FROM pg_control_system()").Row().Scan(&identifier)
+		}); err != nil {
+			return false, err
+		}
+
+		identifiers = append(identifiers, identifier)
+	}
+
+	return identifiers[0] == identifiers[1], nil
+}
+
+// Returns the tables in the public schema of a database.
+func publicTables(db *gorm.DB) ([]string, error) {
+
+	var tables []string
+
+	err := db.Raw("SELECT tablename FROM pg_tables WHERE schemaname = 'public' ORDER BY tablename").Pluck("tablename", &tables).Error
+
+	return tables, err
+}
+
+// Makes the tenants roles and an empty database on the target, and records the connection string the tenant will use there.
+// Roles belong to a server, so the target gets roles of the same names with a new password.
+func prepareRelocationTarget(relocation *tenants.TenantRelocation) error {
+
+	same, err := sameCluster(relocation.SourceServerId, relocation.TargetServerId)
+
+	if err != nil {
+		return err
+	}
+
+	if same {
+		return errSameCluster
+	}
+
+	var target tenants.DatabaseServer
+
+	if err := Connection.First(&target, relocation.TargetServerId).Error; err != nil {
+		return err
+	}
+
+	roles := tenants.RolesForGroup(relocation.RoleName)
+
+	password, err := tenants.GeneratePassword()
+
+	if err != nil {
+		return err
+	}
+
+	if err := withDatabaseServer(target.ID, func(admin *gorm.DB) error {
+		existing, err := existingRoles(admin, roles.All())
+
+		if err != nil {
+			return err
+		}
+
+		if len(existing) == 0 {
+			err = createRoles(admin, roles, password)
+		} else {
+			err = quietly(admin).Exec("ALTER ROLE " + pq.QuoteIdentifier(roles.Logins[0]) + " LOGIN PASSWORD " + quoteLiteral(password)).Error
+		}
+
+		if err != nil {
+			return err
+		}
+
+		databases, err := countRows(admin, "SELECT count(*) FROM pg_database WHERE datname = ?", relocation.DatabaseName)
+
+		if err != nil || databases > 0 {
+			return err
+		}
+
+		if err := admin.Exec("CREATE DATABASE " + pq.QuoteIdentifier(relocation.DatabaseName) + " OWNER " + pq.QuoteIdentifier(roles.Group)).Error; err != nil {
+			return err
+		}
+
+		return admin.Exec("REVOKE ALL ON DATABASE " + pq.QuoteIdentifier(relocation.DatabaseName) + " FROM PUBLIC").Error
+	}); err != nil {
+		return err
+	}
+
+	connectionString, err := tenants.EncryptConnectionString(tenants.ConnectionStringWithCredentials(target.ConnectionString(relocation.DatabaseName), roles.Logins[0], password))
+
+	if err != nil {
+		return err
+	}
+
+	relocation.TargetConnectionString = connectionString
+
+	return tenants.RecordRelocationProgress(quietly(Connection), relocation, map[string]interface{}{"target_connection_string": connectionString})
+}
+
+// Brings the target database to the same migration as the source, connecting as the tenant so its tables belong to the tenants role.
+// Whatever the migrations inserted is removed, the copy brings every row over including the migrations ledger.
+func migrateRelocationTarget(relocation *tenants.TenantRelocation) error {
+
+	var version uint64
+
+	if err := withServerDatabase(relocation.SourceServerId, relocation.DatabaseName, func(source *gorm.DB) (err error) {
+		version, err = tenantMigrations.CurrentVersion(source)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	connectionString, err := tenants.DecryptConnectionString(relocation.TargetConnectionString)
+
+	if err != nil {
+		return err
+	}
+
+	target, err := gorm.Open("postgres", connectionString)
+
+	if err != nil {
+		return err
+	}
+
+	defer target.Close()
+
+	if _, err := tenantMigrations.MigrateTo(target, version); err != nil {
+		return err
+	}
+
+	tables, err := publicTables(target)
+
+	if err != nil || len(tables) == 0 {
+		return err
+	}
+
+	var quoted []string
+
+	for _, table := range tables {
+		quoted = append(quoted, pq.QuoteIdentifier(table))
+	}
+
+	return target.Exec("TRUNCATE " + strings.Join(quoted, ", ")).Error
+}
+
+// Publishes every table in the source database and subscribes the target to it, which copies the existing rows and then every change.
+// The source server needs wal_level set to logical.
+func startRelocationCopy(relocation *tenants.TenantRelocation) error {
+
+	name := relocationReplicationName(relocation)
+
+	if err := withServerDatabase(relocation.SourceServerId, relocation.DatabaseName, func(source *gorm.DB) error {
+		publications, err := countRows(source, "SELECT count(*) FROM pg_publication WHERE pubname = ?", name)
+
+		if err != nil || publications > 0 {
+			return err
+		}
+
+		return source.Exec("CREATE PUBLICATION " + pq.QuoteIdentifier(name) + " FOR ALL TABLES").Error
+	}); err != nil {
+		return err
+	}
+
+	sourceConnectionString, err := serverDatabaseConnectionString(relocation.SourceServerId, relocation.DatabaseName)
+
+	if err != nil {
+		return err
+	}
+
+	return withServerDatabase(relocation.TargetServerId, relocation.DatabaseName, func(target *gorm.DB) error {
+		subscriptions, err := countRows(target, "SELECT count(*) FROM pg_subscription WHERE subname = ?", name)
+
+		if err != nil || subscriptions > 0 {
+			return err
+		}
+
+		return quietly(target).Exec("CREATE SUBSCRIPTION " + pq.QuoteIdentifier(name) + " CONNECTION " + quoteLiteral(sourceConnectionString) + " PUBLICATION " + pq.QuoteIdentifier(name)).Error
+	})
+}
+
+// Waits for the existing rows of every table to be copied, recording how many tables are done as it goes.
+// Gives up after relocationSyncTimeout, relocating again carries on waiting.
+func waitForRelocationCopy(relocation *tenants.TenantRelocation) error {
+
+	name := relocationReplicationName(relocation)
+	deadline := time.Now().Add(helpers.GetEnvDuration("relocationSyncTimeout", 1*time.Hour))
+
+	return withServerDatabase(relocation.TargetServerId, relocation.DatabaseName, func(target *gorm.DB) error {
+		for {
+			var progress struct {
+				Total  int
+				Copied int
+			}
+
+			// Tables are ready once their rows have been copied and they are following changes.
+			if err := target.Raw(`SELECT count(*) AS total, count(*) FILTER (WHERE r.srsubstate IN ('r', 's')) AS copied
+				FROM pg_subscription_rel r JOIN pg_subscription s ON s.oid = r.srsubid WHERE s.subname = ?`, name).Scan(&progress).Error; err != nil {
+				return err
+			}
+
+			if progress.Total != relocation.TablesTotal || progress.Copied != relocation.TablesCopied {
+				relocation.TablesTotal, relocation.TablesCopied = progress.Total, progress.Copied
+
+				if err := tenants.RecordRelocationProgress(Connection, relocation, map[string]interface{}{"tables_total": progress.Total, "tables_copied": progress.Copied}); err != nil {
+					return err
+				}
+			}
+
+			if progress.Copied == progress.Total {
+				return nil
+			}
+
+			if time.Now().After(deadline) {
+				return fmt.Errorf("%d of %d tables have been copied so far, relocate again to carry on waiting", progress.Copied, progress.Total)
+			}
+
+			time.Sleep(relocationPollInterval())
+		}
+	})
+}
+
+// Makes the tenant read-only, waits for the copy to catch up, checks it and switches the tenant over to it.
+// The tenant is made writable again whether or not the switch worked.
+func cutOverRelocation(relocation *tenants.TenantRelocation) error {
+
+	var tenant tenants.TenantConnectionInformation
+
+	if err := Connection.First(&tenant, relocation.TenantConnectionInformationId).Error; err != nil {
+		return err
+	}
+
+	// Switched already, the instance stopped before the tenant was made writable again.
+	if tenant.DatabaseServerId == relocation.TargetServerId {
+		return restoreRelocatedTenantState(relocation)
+	}
+
+	err := enterRelocationReadOnly(relocation, &tenant)
+
+	if err == nil {
+		err = freezeRelocationSource(relocation)
+	}
+
+	if err == nil {
+		err = switchRelocatedTenant(relocation, &tenant)
+	}
+
+	if restoreErr := restoreRelocatedTenantState(relocation); restoreErr != nil && err == nil {
+		err = restoreErr
+	}
+
+	return err
+}
+
+// Makes an active tenant read-only and gives requests already writing relocationDrainPeriod to finish.
+// Suspended, read-only and archived tenants can't be written to already, so they are left alone.
+func enterRelocationReadOnly(relocation *tenants.TenantRelocation, tenant *tenants.TenantConnectionInformation) error {
+
+	if tenant.State() != tenants.StateActive {
+		return nil
+	}
+
+	// Recorded first, so the tenant is made writable again even if the instance stops part way through.
+	relocation.PreviousState = tenant.State()
+
+	if err := tenants.RecordRelocationProgress(Connection, relocation, map[string]interface{}{"previous_state": relocation.PreviousState}); err != nil {
+		return err
+	}
+
+	if _, err := tenants.TransitionTenant(Connection, tenant, tenants.StateReadOnly, "relocating", relocation.RequestedBy); err != nil {
+		return err
+	}
+
+	invalidateTenantLookups(tenant.ID)
+
+	time.Sleep(helpers.GetEnvDuration("relocationDrainPeriod", 5*time.Second))
+
+	return nil
+}
+
+// Stops the tenants logins writing to the source database and closes the sessions they have open, whichever instance opened them.
+// The read-only state is only seen by instances that got the lookup invalidation, this covers the ones that didn't,
+// so nothing can be written to the source after the copy has been checked. Runs before the position the copy has to reach is read.
+func freezeRelocationSource(relocation *tenants.TenantRelocation) error {
+
+	logins := tenants.RolesForGroup(relocation.RoleName).Logins
+
+	return withDatabaseServer(relocation.SourceServerId, func(admin *gorm.DB) error {
+		for _, login := range logins {
+			if err := admin.Exec("ALTER ROLE " + pq.QuoteIdentifier(login) + " SET default_transaction_read_only = on").Error; err != nil {
+				return err
+			}
+		}
+
+		return admin.Exec("SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = ? AND usename IN (?)", relocation.DatabaseName, logins).Error
+	})
+}
+
+// Lets the tenants logins write to the source database again, for when the tenant wasn't switched over.
+func thawRelocationSource(relocation *tenants.TenantRelocation) error {
+
+	return withDatabaseServer(relocation.SourceServerId, func(admin *gorm.DB) error {
+		for _, login := range tenants.RolesForGroup(relocation.RoleName).Logins {
+			if err := admin.Exec("ALTER ROLE " + pq.QuoteIdentifier(login) + " RESET default_transaction_read_only").Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Puts the tenant back in the state it was in before the relocation made it read-only, unless someone has moved it since.
+// A tenant still on the source can write to it again, once it has been switched the source stays read-only until it is dropped.
+func restoreRelocatedTenantState(relocation *tenants.TenantRelocation) error {
+
+	var tenant tenants.TenantConnectionInformation
+
+	if err := Connection.First(&tenant, relocation.TenantConnectionInformationId).Error; err != nil {
+		return err
+	}
+
+	if tenant.DatabaseServerId != relocation.TargetServerId {
+		if err := thawRelocationSource(relocation); err != nil {
+			return err
+		}
+	}
+
+	if len(relocation.PreviousState) == 0 {
+		return nil
+	}
+
+	if tenant.State() == tenants.StateReadOnly {
+		if _, err := tenants.TransitionTenant(Connection, &tenant, relocation.PreviousState, "relocation stopped", relocation.RequestedBy); err != nil {
+			return err
+		}
+
+		invalidateTenantLookups(tenant.ID)
+	}
+
+	relocation.PreviousState = ""
+
+	return tenants.RecordRelocationProgress(Connection, relocation, map[string]interface{}{"previous_state": ""})
+}
+
+// Waits for the target to have every change made before the tenant went read-only, checks both databases have the same rows,
+// copies the sequences, which logical replication leaves behind, and points the tenant at the target.
+func switchRelocatedTenant(relocation *tenants.TenantRelocation, tenant *tenants.TenantConnectionInformation) error {
+
+	err := withServerDatabase(relocation.SourceServerId, relocation.DatabaseName, func(source *gorm.DB) error {
+		if err := waitForRelocationCatchUp(relocation, source); err != nil {
+			return err
+		}
+
+		return withServerDatabase(relocation.TargetServerId, relocation.DatabaseName, func(target *gorm.DB) error {
+			if err := verifyRelocatedRows(relocation, source, target); err != nil {
+				return err
+			}
+
+			return copyRelocatedSequences(source, target)
+		})
+	})
+
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	result := quietly(Connection).Model(&tenants.TenantConnectionInformation{}).Where("id = ? AND coalesce(database_server_id, 0) = ?", tenant.ID, relocation.SourceServerId).Updates(map[string]interface{}{
+		"connection_string":      relocation.TargetConnectionString,
+		"database_server_id":     relocation.TargetServerId,
+		"login_role":             tenants.RolesForGroup(relocation.RoleName).Logins[0],
+		"credentials_rotated_at": &now,
+	})
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return errRelocationConflict
+	}
+
+	// Pools on the source are closed here and retired on other instances as their cached lookups are invalidated.
+	TenantConnections.Evict(tenant.ID)
+	invalidateTenantLookups(tenant.ID)
+
+	return nil
+}
+
+// Waits for the subscription to confirm it has everything written to the source so far.
+func waitForRelocationCatchUp(relocation *tenants.TenantRelocation, source *gorm.DB) error {
+
+	var position string
+
+	if err := source.Raw("SELECT pg_current_wal_lsn()::text").Row().Scan(&position); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(helpers.GetEnvDuration("relocationCatchUpTimeout", 5*time.Minute))
+
+	for {
+		var caughtUp bool
+
+		if err := source.Raw("SELECT coalesce(confirmed_flush_lsn >= ?::pg_lsn, false) FROM pg_replication_slots WHERE slot_name = ?", position, relocationReplicationName(relocation)).Row().Scan(&caughtUp); err != nil {
+			return err
+		}
+
+		if caughtUp {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return errors.New("the copy didn't catch up with the source in time, the tenant has been made writable again")
+		}
+
+		time.Sleep(relocationPollInterval())
+	}
+}
+
+// Compares the row count of every table in both databases.
+func verifyRelocatedRows(relocation *tenants.TenantRelocation, source *gorm.DB, target *gorm.DB) error {
+
+	tables, err := publicTables(source)
+
+	if err != nil {
+		return err
+	}
+
+	var verified int64
+	var mismatched []string
+
+	for _, table := range tables {
+		var counts [2]int64
+
+		for i, db := range []*gorm.DB{source, target} {
+			if err := db.Raw("SELECT count(*) FROM " + pq.QuoteIdentifier(table)).Row().Scan(&counts[i]); err != nil {
+				return err
+			}
+		}
+
+		if counts[0] != counts[1] {
+			mismatched = append(mismatched, fmt.Sprintf("%v has %d rows on the source and %d on the target", table, counts[0], counts[1]))
+		}
+
+		verified += counts[1]
+	}
+
+	if len(mismatched) > 0 {
+		return errors.New(strings.Join(mismatched, ", "))
+	}
+
+	relocation.RowsVerified = verified
+
+	return tenants.RecordRelocationProgress(Connection, relocation, map[string]interface{}{"rows_verified": verified})
+}
+
+// Sets every sequence on the target to where it is on the source.
+func copyRelocatedSequences(source *gorm.DB, target *gorm.DB) error {
+
+	var sequences []struct {
+		Sequencename string
+		LastValue    int64
+	}
+
+	if err := source.Raw("SELECT sequencename, last_value FROM pg_sequences WHERE schemaname = 'public' AND last_value IS NOT NULL").Scan(&sequences).Error; err != nil {
+		return err
+	}
+
+	for _, sequence := range sequences {
+		if err := target.Exec("SELECT setval(?::regclass, ?, true)", pq.QuoteIdentifier(sequence.Sequencename), sequence.LastValue).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Stops the copy and drops the tenants database and roles from the source, once no instance is using them.
+func cleanUpRelocationSource(relocation *tenants.TenantRelocation) error {
+
+	if err := waitForRelocationSourceSessions(relocation); err != nil {
+		return err
+	}
+
+	if err := dropRelocationCopy(relocation); err != nil {
+		return err
+	}
+
+	if err := withDatabaseServer(relocation.SourceServerId, func(admin *gorm.DB) error {
+		return admin.Exec("DROP DATABASE IF EXISTS " + pq.QuoteIdentifier(relocation.DatabaseName)).Error
+	}); err != nil {
+		return err
+	}
+
+	return dropTenantRoles(relocation.SourceServerId, relocation.RoleName)
+}
+
+// Waits for every instance to stop using the source database. Their sessions were closed at cutover,
+// so the tenants logins are only connected again from instances still sending the tenant there, which they stop doing
+// once their cached lookup expires and the pool they had is retired. Gives up after relocationSwitchTimeout, relocating again carries on waiting.
+func waitForRelocationSourceSessions(relocation *tenants.TenantRelocation) error {
+
+	logins := tenants.RolesForGroup(relocation.RoleName).Logins
+	deadline := time.Now().Add(helpers.GetEnvDuration("relocationSwitchTimeout", 5*time.Minute))
+
+	return withDatabaseServer(relocation.SourceServerId, func(admin *gorm.DB) error {
+		for {
+			sessions, err := countRows(admin, "SELECT count(*) FROM pg_stat_activity WHERE datname = ? AND usename IN (?)", relocation.DatabaseName, logins)
+
+			if err != nil || sessions == 0 {
+				return err
+			}
+
+			if time.Now().After(deadline) {
+				return fmt.Errorf("%d sessions are still connected to the source database, an instance hasn't switched the tenant over yet", sessions)
+			}
+
+			time.Sleep(relocationPollInterval())
+		}
+	})
+}
+
+// Drops the subscription, which drops its replication slot on the source, then the publication.
+func dropRelocationCopy(relocation *tenants.TenantRelocation) error {
+
+	name := relocationReplicationName(relocation)
+
+	if err := withDatabaseServer(relocation.TargetServerId, func(admin *gorm.DB) error {
+		databases, err := countRows(admin, "SELECT count(*) FROM pg_database WHERE datname = ?", relocation.DatabaseName)
+
+		if err != nil || databases == 0 {
+			return err
+		}
+
+		return withServerDatabase(relocation.TargetServerId, relocation.DatabaseName, func(target *gorm.DB) error {
+			subscriptions, err := countRows(target, "SELECT count(*) FROM pg_subscription WHERE subname = ?", name)
+
+			if err != nil || subscriptions == 0 {
+				return err
+			}
+
+			return target.Exec("DROP SUBSCRIPTION " + pq.QuoteIdentifier(name)).Error
+		})
+	}); err != nil {
+		return err
+	}
+
+	return withServerDatabase(relocation.SourceServerId, relocation.DatabaseName, func(source *gorm.DB) error {
+		return source.Exec("DROP PUBLICATION IF EXISTS " + pq.QuoteIdentifier(name)).Error
+	})
+}
+
+// Stops a relocation that hasn't switched the tenant over yet, dropping what it made on the target and leaving the tenant where it was.
+func cancelTenantRelocation(identifier string) (tenants.TenantRelocation, error) {
+
+	tenant, err := tenants.FindTenantByIdentifier(Connection, identifier)
+
+	if err != nil {
+		return tenants.TenantRelocation{}, err
+	}
+
+	relocation, found, err := tenants.OpenTenantRelocation(Connection, tenant.ID)
+
+	if err != nil {
+		return relocation, err
+	}
+
+	if !found || relocation.StepDone("cutover") || tenant.DatabaseServerId == relocation.TargetServerId {
+		return relocation, tenants.ErrRelocationNotCancellable
+	}
+
+	options := masterLockOptions()
+	options.Mode = migrations.LockSkip
+
+	err = migrations.WithLock(Connection, fmt.Sprintf("relocation:%d", relocation.ID), options, func() error {
+		if err := restoreRelocatedTenantState(&relocation); err != nil {
+			return err
+		}
+
+		// On the same cluster the database and roles on the target are the tenants own, nothing was made there.
+		same, err := sameCluster(relocation.SourceServerId, relocation.TargetServerId)
+
+		if err != nil {
+			return err
+		}
+
+		if !same {
+			if err := dropRelocationCopy(&relocation); err != nil {
+				return err
+			}
+
+			if err := withDatabaseServer(relocation.TargetServerId, func(admin *gorm.DB) error {
+				return admin.Exec("DROP DATABASE IF EXISTS " + pq.QuoteIdentifier(relocation.DatabaseName)).Error
+			}); err != nil {
+				return err
+			}
+
+			if err := dropTenantRoles(relocation.TargetServerId, relocation.RoleName); err != nil {
+				return err
+			}
+		}
+
+		return tenants.SetRelocationStatus(Connection, &relocation, tenants.RelocationCancelled, relocation.Step, nil)
+	})
+
+	return relocation, err
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/LiamDotPro/Go-Multitenancy/helpers"
+	"github.com/LiamDotPro/Go-Multitenancy/tenants"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"strings"
+	"time"
+)
+
+// Returned when rotating the credentials of a shared table tenant, they share one pool and the shared credentials.
+var errSharedCredentials = errors.New("shared table tenants use the shared tenant credentials, they have none of their own to rotate")
+
+// Returned when credentials are rotated again before every instance can have moved off the login being reset.
+var errRotatedRecently = errors.New("the tenants credentials were rotated too recently, wait or force the rotation")
+
+// Returned when another rotation finished first.
+var errRotationConflict = errors.New("the tenants credentials were rotated at the same time, please try again")
+
+// Returns a copy of the connection that doesn't log its SQL, used for statements carrying passwords.
+func quietly(db *gorm.DB) *gorm.DB {
+	return db.New().LogMode(false)
+}
+
+// Quotes a string for use as an SQL literal, for statements like CREATE ROLE that can't take parameters.
+func quoteLiteral(literal string) string {
+
+	literal = strings.Replace(literal, "'", "''", -1)
+
+	if strings.Contains(literal, `\`) {
+		return "E'" + strings.Replace(literal, `\`, `\\`, -1) + "'"
+	}
+
+	return "'" + literal + "'"
+}
+
+// Makes the group role and logins for a provisioning job, shared table tenants have none.
+func createTenantRoles(p *tenantProvisioning) error {
+
+	if p.Job.Isolation == tenants.IsolationShared {
+		return nil
+	}
+
+	p.Job.RoleName = tenants.PhysicalName(p.Job.SubDomainIdentifier)
+
+	if err := tenants.RecordProvisionedResources(Connection, p.Job); err != nil {
+		return err
+	}
+
+	password, err := tenants.GeneratePassword()
+
+	if err != nil {
+		return err
+	}
+
+	roles := tenants.RolesForGroup(p.Job.RoleName)
+	p.LoginRole, p.Password = roles.Logins[0], password
+
+	// Roles belong to a server, database isolated tenants get theirs on the server they were placed on.
+	return withDatabaseServer(p.Job.DatabaseServerId, func(admin *gorm.DB) error {
+		return createRoles(admin, roles, password)
+	})
+}
+
+// Drops the roles made for a provisioning job.
+func dropProvisionedTenantRoles(p *tenantProvisioning) error {
+	return dropTenantRoles(p.Job.DatabaseServerId, p.Job.RoleName)
+}
+
+// Makes the group role and both of its logins, only the first login can log in until the credentials are rotated.
+// Logins act as the group as soon as they connect, so tables made by migrations belong to the group whichever login made them.
+func createRoles(admin *gorm.DB, roles tenants.TenantRoles, password string) error {
+
+	return quietly(admin).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("CREATE ROLE " + pq.QuoteIdentifier(roles.Group) + " NOLOGIN").Error; err != nil {
+			return err
+		}
+
+		for i, login := range roles.Logins {
+			access := "NOLOGIN"
+
+			if i == 0 {
+				access = "LOGIN PASSWORD " + quoteLiteral(password)
+			}
+
+			if err := tx.Exec("CREATE ROLE " + pq.QuoteIdentifier(login) + " " + access + " IN ROLE " + pq.QuoteIdentifier(roles.Group)).Error; err != nil {
+				return err
+			}
+
+			if err := tx.Exec("ALTER ROLE " + pq.QuoteIdentifier(login) + " SET role TO " + quoteLiteral(roles.Group)).Error; err != nil {
+				return err
+			}
+		}
+
+		// The master user has to be a member to hand databases and schemas to the group.
+		return tx.Exec("GRANT " + pq.QuoteIdentifier(roles.Group) + " TO CURRENT_USER").Error
+	})
+}
+
+// Drops a group role and its logins from the server they were made on, along with their privileges on the shared tenant database.
+// Roles that still own a database can't be dropped, so the tenants storage has to go first.
+func dropTenantRoles(serverId uint, group string) error {
+
+	if len(group) == 0 {
+		return nil
+	}
+
+	return withDatabaseServer(serverId, func(admin *gorm.DB) error {
+		existing, err := existingRoles(admin, tenants.RolesForGroup(group).All())
+
+		if err != nil || len(existing) == 0 {
+			return err
+		}
+
+		var quoted []string
+
+		for _, role := range existing {
+			quoted = append(quoted, pq.QuoteIdentifier(role))
+		}
+
+		roles := strings.Join(quoted, ", ")
+
+		// Only tenants in the shared tenant database have privileges there, placed tenants only have them on their own server.
+		drop := func(db *gorm.DB) error {
+			return db.Exec("DROP OWNED BY " + roles).Error
+		}
+
+		if serverId == 0 {
+			err = withSharedDatabase(drop)
+		} else {
+			err = drop(admin)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return admin.Exec("DROP ROLE IF EXISTS " + roles).Error
+	})
+}
+
+// Returns which of the roles exist on the server, in the order given.
+func existingRoles(admin *gorm.DB, roles []string) ([]string, error) {
+
+	var rows []struct{ Rolname string }
+
+	if err := admin.Raw("SELECT rolname FROM pg_roles WHERE rolname IN (?)", roles).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	found := map[string]bool{}
+
+	for _, row := range rows {
+		found[row.Rolname] = true
+	}
+
+	var existing []string
+
+	for _, role := range roles {
+		if found[role] {
+			existing = append(existing, role)
+		}
+	}
+
+	return existing, nil
+}
+
+// Returns the name of the database a connection is using.
+func currentDatabase(db *gorm.DB) (string, error) {
+
+	var row struct{ Name string }
+
+	err := db.Raw("SELECT current_database() AS name").Scan(&row).Error
+
+	return row.Name, err
+}
+
+// Lets the group role into the shared tenant database and nobody else who hasn't been let in.
+func grantSharedDatabaseAccess(shared *gorm.DB, group string) error {
+
+	name, err := currentDatabase(shared)
+
+	if err != nil {
+		return err
+	}
+
+	statements := []string{
+		"REVOKE CONNECT, TEMPORARY ON DATABASE " + pq.QuoteIdentifier(name) + " FROM PUBLIC",
+		"REVOKE CREATE ON SCHEMA public FROM PUBLIC",
+		"GRANT CONNECT ON DATABASE " + pq.QuoteIdentifier(name) + " TO " + pq.QuoteIdentifier(group),
+	}
+
+	for _, statement := range statements {
+		if err := shared.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Hands the tables, views and sequences in a schema that belong to the connected user over to the group role.
+// Sequences belonging to a column move with their table.
+func handOverSchemaObjects(db *gorm.DB, schema string, group string) error {
+
+	return db.Exec(`DO $$
+DECLARE
+	r record;
+BEGIN
+	FOR r IN SELECT c.oid::regclass AS name FROM pg_class c
+		WHERE c.relnamespace = ` + quoteLiteral(pq.QuoteIdentifier(schema)) + `::regnamespace
+		AND c.relowner = (SELECT oid FROM pg_roles WHERE rolname = current_user)
+		AND c.relkind IN ('r', 'p', 'v', 'm', 'f', 'S')
+		AND (c.relkind <> 'S' OR NOT EXISTS (SELECT 1 FROM pg_depend d WHERE d.classid = 'pg_class'::regclass AND d.objid = c.oid AND d.deptype IN ('a', 'i')))
+	LOOP
+		EXECUTE format('ALTER TABLE %s OWNER TO %I', r.name, ` + quoteLiteral(group) + `);
+	END LOOP;
+END $$`).Error
+}
+
+// Moves a tenant made before roles existed onto its own roles, handing its database or schema and everything in them to the group.
+func adoptTenantRoles(tenant *tenants.TenantConnectionInformation) error {
+
+	roles := tenants.RolesFor(tenant.TenantSubDomainIdentifier)
+
+	password, err := tenants.GeneratePassword()
+
+	if err != nil {
+		return err
+	}
+
+	if err := withDatabaseServer(tenant.DatabaseServerId, func(admin *gorm.DB) error {
+		// Adopting again after a failure part way through reuses the roles already made.
+		existing, err := existingRoles(admin, roles.All())
+
+		if err != nil {
+			return err
+		}
+
+		if len(existing) == 0 {
+			return createRoles(admin, roles, password)
+		}
+
+		return quietly(admin).Exec("ALTER ROLE " + pq.QuoteIdentifier(roles.Logins[0]) + " LOGIN PASSWORD " + quoteLiteral(password)).Error
+	}); err != nil {
+		return err
+	}
+
+	switch tenant.Isolation() {
+	case tenants.IsolationSchema:
+		err = withSharedDatabase(func(shared *gorm.DB) error {
+			if err := shared.Exec("ALTER SCHEMA " + pq.QuoteIdentifier(tenant.SchemaName) + " OWNER TO " + pq.QuoteIdentifier(roles.Group)).Error; err != nil {
+				return err
+			}
+
+			if err := handOverSchemaObjects(shared, tenant.SchemaName, roles.Group); err != nil {
+				return err
+			}
+
+			return grantSharedDatabaseAccess(shared, roles.Group)
+		})
+	default:
+		err = adoptTenantDatabase(tenant, roles.Group)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return switchTenantCredentials(tenant, roles.Group, roles.Logins[0], password)
+}
+
+// Hands a database tenants database and its tables to the group, connecting with the tenants current credentials.
+func adoptTenantDatabase(tenant *tenants.TenantConnectionInformation, group string) error {
+
+	name := tenant.DatabaseName
+
+	db, err := tenant.GetConnection()
+
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	// Tenants made before database names were recorded are named after the identifier they had at the time.
+	if len(name) == 0 {
+		if name, err = currentDatabase(db); err != nil {
+			return err
+		}
+	}
+
+	statements := []string{
+		"ALTER DATABASE " + pq.QuoteIdentifier(name) + " OWNER TO " + pq.QuoteIdentifier(group),
+		"REVOKE ALL ON DATABASE " + pq.QuoteIdentifier(name) + " FROM PUBLIC",
+	}
+
+	if err := withDatabaseServer(tenant.DatabaseServerId, func(admin *gorm.DB) error {
+		for _, statement := range statements {
+			if err := admin.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return handOverSchemaObjects(db, "public", group)
+}
+
+// Sets a new password on the login the tenant isn't using and switches the tenant over to it.
+// The other login keeps working until the next rotation, so connections and instances still using it carry on.
+// Rotations closer together than tenantCredentialMinAge are refused unless forced, the login being reset may still be in use.
+func rotateTenantCredentials(tenant *tenants.TenantConnectionInformation, force bool) error {
+
+	if tenant.Isolation() == tenants.IsolationShared {
+		return errSharedCredentials
+	}
+
+	if len(tenant.RoleName) == 0 {
+		return adoptTenantRoles(tenant)
+	}
+
+	if !force && tenant.CredentialsRotatedAt != nil && time.Since(*tenant.CredentialsRotatedAt) < helpers.GetEnvDuration("tenantCredentialMinAge", 1*time.Hour) {
+		return errRotatedRecently
+	}
+
+	password, err := tenants.GeneratePassword()
+
+	if err != nil {
+		return err
+	}
+
+	next := tenants.RolesForGroup(tenant.RoleName).NextLogin(tenant.LoginRole)
+
+	if err := withDatabaseServer(tenant.DatabaseServerId, func(admin *gorm.DB) error {
+		return quietly(admin).Exec("ALTER ROLE " + pq.QuoteIdentifier(next) + " LOGIN PASSWORD " + quoteLiteral(password)).Error
+	}); err != nil {
+		return err
+	}
+
+	return switchTenantCredentials(tenant, tenant.RoleName, next, password)
+}
+
+// Points the tenant record at the login, only if nobody else switched it first.
+func switchTenantCredentials(tenant *tenants.TenantConnectionInformation, group string, login string, password string) error {
+
+	now := time.Now()
+
+	current, err := tenants.DecryptConnectionString(tenant.ConnectionString)
+
+	if err != nil {
+		return err
+	}
+
+	connectionString, err := tenants.EncryptConnectionString(tenants.ConnectionStringWithCredentials(current, login, password))
+
+	if err != nil {
+		return err
+	}
+
+	result := quietly(Connection).Model(&tenants.TenantConnectionInformation{}).Where("id = ? AND coalesce(login_role, '') = ?", tenant.ID, tenant.LoginRole).Updates(map[string]interface{}{
+		"connection_string":      connectionString,
+		"role_name":              group,
+		"login_role":             login,
+		"credentials_rotated_at": &now,
+	})
+
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return errRotationConflict
+	}
+
+	tenant.ConnectionString = connectionString
+	tenant.RoleName = group
+	tenant.LoginRole = login
+	tenant.CredentialsRotatedAt = &now
+
+	// Other instances pick up the new connection string, their pools on the old login are retired as they do.
+	invalidateTenantLookups(tenant.ID)
+
+	return nil
+}
+
+// Rotates the credentials of one tenant or, with no identifier, every tenant with credentials of its own.
+func rotateCredentials(identifier string, force bool) ([]string, error) {
+
+	var records []tenants.TenantConnectionInformation
+
+	query := Connection.Where("coalesce(isolation_mode, '') <> ?", tenants.IsolationShared)
+
+	if len(identifier) > 0 {
+		query = query.Where("tenant_sub_domain_identifier = ?", identifier)
+	}
+
+	if err := query.Find(&records).Error; err != nil {
+		return nil, err
+	}
+
+	if len(identifier) > 0 && len(records) == 0 {
+		return nil, fmt.Errorf("tenant %v could not be found or uses shared tables", identifier)
+	}
+
+	var rotated, failed []string
+
+	for i := range records {
+		if err := rotateTenantCredentials(&records[i], force); err != nil {
+			failed = append(failed, records[i].TenantSubDomainIdentifier+": "+err.Error())
+			continue
+		}
+
+		rotated = append(rotated, records[i].TenantSubDomainIdentifier)
+	}
+
+	if len(failed) > 0 {
+		return rotated, fmt.Errorf("could not rotate the credentials of %v", strings.Join(failed, ", "))
+	}
+
+	return rotated, nil
+}
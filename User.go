@@ -9,6 +9,7 @@ import (
 // User
 type User struct {
 	gorm.Model
+	TenantId      uint `gorm:"index" json:"-"` // Only used by tenants on shared tables, filled in by the tenant scope.
 	Email         string
 	Password      string `json:",omitempty"`
 	AccountType   int
@@ -18,7 +18,7 @@ func setupUsersRoutes(router *gin.Engine) {
 	users := router.Group("/api/users")
 
 	// Turn on the need for tenancy finding.
-	users.Use(middleware.FindTenancy(Connection))
+	users.Use(middleware.FindTenancy(Connection, TenantConnections, TenantLookupCache))
 
 	// POST
 	users.POST("create", HandleCreateUser)
@@ -235,8 +235,8 @@ func HandleGetUserById(c *gin.Context) {
 		return
 	}
 
-	// Get the database object from the connection.
-	db, _ := c.Get("connection")
+	// Reads can go to a replica, unless this session changed something a moment ago.
+	db, _ := c.Get("readConnection")
 
 	outcome, err := getUser(json.Id, db.(*gorm.DB))
 
@@ -261,8 +261,8 @@ func HandleGetCurrentUser(c *gin.Context) {
 	// Get the currently logged int user id.
 	userId := c.MustGet("userId")
 
-	// Get the database object from the connection.
-	db, _ := c.Get("connection")
+	// Reads can go to a replica, unless this session changed something a moment ago.
+	db, _ := c.Get("readConnection")
 
 	outcome, err := getUser(userId.(uint), db.(*gorm.DB))
 
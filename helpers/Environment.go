@@ -0,0 +1,39 @@
+package helpers
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reads an integer environment variable, falling back when it is missing or malformed.
+func GetEnvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(strings.TrimSpace(os.Getenv(key)))
+
+	if err != nil {
+		return fallback
+	}
+
+	return value
+}
+
+// Reads a duration environment variable such as "30s" or "10m", falling back when it is missing or malformed.
+func GetEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(strings.TrimSpace(os.Getenv(key)))
+
+	if err != nil {
+		return fallback
+	}
+
+	return value
+}
+
+// Reads a string environment variable, falling back when it is empty.
+func GetEnvString(key string, fallback string) string {
+	if value := strings.TrimSpace(os.Getenv(key)); len(value) > 0 {
+		return value
+	}
+
+	return fallback
+}
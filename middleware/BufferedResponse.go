@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"bytes"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// Holds back a handlers response, status and headers until Send is called,
+// so the work behind it can be committed first and the response swapped for an error when that fails.
+// Headers set before it, e.g. cookies from the session middleware, are seen by the handlers and kept.
+type BufferedResponseWriter struct {
+	gin.ResponseWriter
+	header  http.Header
+	written bool
+	body    bytes.Buffer
+}
+
+func NewBufferedResponseWriter(writer gin.ResponseWriter) *BufferedResponseWriter {
+	return &BufferedResponseWriter{ResponseWriter: writer, header: writer.Header().Clone()}
+}
+
+func (w *BufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+// gins context sets statuses on its own writer rather than this one, so the status is kept there,
+// it isn't sent until Send.
+func (w *BufferedResponseWriter) WriteHeader(code int) {
+	if !w.written {
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *BufferedResponseWriter) WriteHeaderNow() {
+	w.written = true
+}
+
+func (w *BufferedResponseWriter) Write(data []byte) (int, error) {
+	w.written = true
+	return w.body.Write(data)
+}
+
+func (w *BufferedResponseWriter) WriteString(s string) (int, error) {
+	w.written = true
+	return w.body.WriteString(s)
+}
+
+func (w *BufferedResponseWriter) Size() int {
+	if !w.written {
+		return -1
+	}
+
+	return w.body.Len()
+}
+
+func (w *BufferedResponseWriter) Written() bool {
+	return w.written
+}
+
+// Nothing is sent until the response is complete.
+func (w *BufferedResponseWriter) Flush() {}
+
+// Sends the held back response, its headers replace the ones it started from.
+func (w *BufferedResponseWriter) Send() {
+
+	header := w.ResponseWriter.Header()
+
+	for key := range header {
+		delete(header, key)
+	}
+
+	for key, values := range w.header {
+		header[key] = values
+	}
+
+	if w.body.Len() == 0 {
+		w.ResponseWriter.WriteHeaderNow()
+		return
+	}
+
+	w.ResponseWriter.Write(w.body.Bytes())
+}
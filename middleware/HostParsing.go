@@ -0,0 +1,105 @@
+package middleware
+
+import (
+	"github.com/LiamDotPro/Go-Multitenancy/helpers"
+	"github.com/LiamDotPro/Go-Multitenancy/tenants"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Picks the tenant subdomain out of a host, e.g. acme out of acme.app.example.co.uk.
+type SubdomainParser struct {
+	BaseDomains []string // Domains tenants are subdomains of, the longest match wins.
+	Reserved    []string // Labels that are never tenants, e.g. www and api.
+}
+
+// Reads the base domains and reserved labels from tenantBaseDomains and tenantReservedSubdomains.
+func SubdomainParserFromEnv() SubdomainParser {
+	return NewSubdomainParser(
+		strings.Split(helpers.GetEnvString("tenantBaseDomains", ""), ","),
+		strings.Split(helpers.GetEnvString("tenantReservedSubdomains", "www,api"), ","),
+	)
+}
+
+// Creates a parser with normalised base domains and reserved labels.
+func NewSubdomainParser(baseDomains []string, reserved []string) SubdomainParser {
+
+	var parser SubdomainParser
+
+	for _, domain := range baseDomains {
+		if domain = tenants.NormalizeHost(domain); len(domain) > 0 {
+			parser.BaseDomains = append(parser.BaseDomains, domain)
+		}
+	}
+
+	// Try the most specific base domain first, so app.example.co.uk beats example.co.uk.
+	sort.SliceStable(parser.BaseDomains, func(i, j int) bool { return len(parser.BaseDomains[i]) > len(parser.BaseDomains[j]) })
+
+	for _, label := range reserved {
+		if label = strings.ToLower(strings.TrimSpace(label)); len(label) > 0 {
+			parser.Reserved = append(parser.Reserved, label)
+		}
+	}
+
+	return parser
+}
+
+// Returns the tenant identifier in the host, found is false for apex domains, reserved labels,
+// IP addresses and hosts outside of the base domains.
+func (p SubdomainParser) Identifier(host string) (identifier string, found bool) {
+
+	host = tenants.NormalizeHost(host)
+
+	if len(host) == 0 || net.ParseIP(host) != nil {
+		return "", false
+	}
+
+	var labels []string
+
+	if len(p.BaseDomains) == 0 {
+		// Without base domains assume a single label subdomain of a two label domain, e.g. acme.example.com or acme.localhost.
+		labels = strings.Split(host, ".")
+
+		if len(labels) < 3 && !(len(labels) == 2 && labels[1] == "localhost") {
+			return "", false
+		}
+
+		labels = labels[:1]
+	} else {
+		for _, base := range p.BaseDomains {
+			// A base domain is never a tenant, even when it sits under another base domain.
+			if host == base {
+				return "", false
+			}
+		}
+
+		for _, base := range p.BaseDomains {
+			if strings.HasSuffix(host, "."+base) {
+				labels = strings.Split(strings.TrimSuffix(host, "."+base), ".")
+				break
+			}
+		}
+	}
+
+	// Reserved labels in front of the tenant are ignored, e.g. www.acme.example.com.
+	for len(labels) > 1 && p.isReserved(labels[0]) {
+		labels = labels[1:]
+	}
+
+	if len(labels) != 1 || len(labels[0]) == 0 || p.isReserved(labels[0]) {
+		return "", false
+	}
+
+	return labels[0], true
+}
+
+func (p SubdomainParser) isReserved(label string) bool {
+	for _, reserved := range p.Reserved {
+		if label == reserved {
+			return true
+		}
+	}
+
+	return false
+}
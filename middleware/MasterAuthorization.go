@@ -12,17 +12,19 @@ func IfMasterAuthorized(Store *gormstore.Store) gin.HandlerFunc {
 
 		sessionValues, err := Store.Get(c.Request, "connect.s.id")
 
-		if err != nil {
+		if err != nil || sessionValues == nil || sessionValues.IsNew {
 			c.JSON(http.StatusUnauthorized, gin.H{"message": "You are not authorized to view this."})
 			c.Abort()
+			return
 		}
 
-		if sessionValues.Values["Authorised"] != true {
+		if sessionValues.Values["masterAuthorised"] != true {
 			c.JSON(http.StatusUnauthorized, gin.H{"message": "You are not authorized to view this."})
 			c.Abort()
+			return
 		}
 
 		// Pass the user id into the handler.
-		c.Set("userId", sessionValues.Values["userId"])
+		c.Set("userId", sessionValues.Values["masterUserId"])
 	}
 }
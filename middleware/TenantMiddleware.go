@@ -1,96 +1,225 @@
 package middleware
 
 import (
-	"errors"
 	"fmt"
+	"github.com/LiamDotPro/Go-Multitenancy/helpers"
 	"github.com/LiamDotPro/Go-Multitenancy/tenants"
 	"github.com/gin-gonic/gin"
 	"github.com/jinzhu/gorm"
-	"strings"
+	"golang.org/x/net/idna"
+	"net/http"
+	"time"
 )
 
 type tenantIdentifierParams struct {
 	TenancyIdentifier string `form:"tenant" json:"tenant"`
 }
 
-func FindTenancy(Connection *gorm.DB) gin.HandlerFunc {
-	return func(c *gin.Context) {
+// Finds the tenant for the request using the resolvers named in tenantResolvers.
+func FindTenancy(Connection *gorm.DB, Connections *tenants.ConnectionManager, Cache *tenants.LookupCache) gin.HandlerFunc {
 
-		var json tenantIdentifierParams
+	resolvers, err := TenantResolversFromEnv(Connection, Cache)
 
-		// Try and find an incoming tenancy identifier on the request
-		if err := c.Bind(&json); err == nil && len(json.TenancyIdentifier) > 0 {
+	if err != nil {
+		panic(err)
+	}
 
-			var tenantInfo tenants.TenantConnectionInformation
+	return FindTenancyWith(Connections, resolvers...)
+}
 
-			if err := Connection.Where(&tenants.TenantConnectionInformation{TenantSubDomainIdentifier: json.TenancyIdentifier}).First(&tenantInfo).Error; err != nil {
-				fmt.Println("Tenant Identifier passed was not found in database")
-				c.AbortWithStatus(400)
-			}
+// Finds the tenant for the request by trying each resolver in order, the first that recognises the request wins.
+func FindTenancyWith(Connections *tenants.ConnectionManager, resolvers ...TenantResolver) gin.HandlerFunc {
+	return func(c *gin.Context) {
 
-			conn, connErr := tenantInfo.GetConnection()
+		for _, resolver := range resolvers {
+			tenantInfo, identifier, err := resolver.Resolve(c)
 
-			if connErr != nil {
-				fmt.Println("Tenant connection could not be made for the request - attempt using json tenancyIdentifier")
+			if redirect, ok := err.(TenantRedirect); ok {
+				c.Redirect(http.StatusMovedPermanently, redirect.Location)
+				c.Abort()
+				return
 			}
 
-			// Set connection into the context for routing
-			c.Set("connection", conn)
+			switch err {
+			case nil:
+				if enforceTenantState(c, tenantInfo) {
+					useTenant(c, tenantInfo, identifier, Connections)
+				}
+				return
+			case ErrTenantNotResolved:
+				continue
+			case ErrTenantNotFound:
+				fmt.Println("Tenant Identifier passed was not found in database - " + identifier)
+				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "The tenant could not be found."})
+				return
+			case ErrInvalidTenantToken:
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "The tenant token is invalid or has expired."})
+				return
+			default:
+				fmt.Println(err)
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to process that, please try again."})
+				return
+			}
+		}
+
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"message": "No tenant was given, use a tenant subdomain, identifier or token."})
+	}
+}
+
+// Refuses the request when the tenants lifecycle state doesn't allow it, returns false when it has been refused.
+func enforceTenantState(c *gin.Context, tenantInfo tenants.TenantConnectionInformation) bool {
 
-			// Set tenancy Identifier into params
-			c.Set("tenantIdentifier", json.TenancyIdentifier)
+	switch tenantInfo.State() {
+	case tenants.StateSuspended:
+		if tenantInfo.StateReason == tenants.SuspensionPayment {
+			c.AbortWithStatusJSON(http.StatusPaymentRequired, gin.H{"message": "This account has been suspended until payment is made."})
+			return false
+		}
 
-			c.Next()
-		} else {
-			// Try and make a connection using the host subdomain
-			getTenantConnectionByHost(c.Request.Host, c, Connection)
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "This account has been suspended."})
+		return false
+	case tenants.StateReadOnly:
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return true
 		}
+
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "This account is read only, changes can't be made right now."})
+		return false
+	case tenants.StateArchived:
+		c.AbortWithStatusJSON(http.StatusGone, gin.H{"message": "This account has been archived."})
+		return false
+	case tenants.StatePendingDeletion:
+		c.AbortWithStatusJSON(http.StatusGone, gin.H{"message": "This account is scheduled for deletion."})
+		return false
+	case tenants.StateDeleted:
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"message": "The tenant could not be found."})
+		return false
 	}
+
+	return true
 }
 
-func getTenantConnectionByHost(hostStr string, c *gin.Context, Connection *gorm.DB) {
+// Sets the tenants connection into the context for the rest of the handlers.
+func useTenant(c *gin.Context, tenantInfo tenants.TenantConnectionInformation, tenantIdentifier string, Connections *tenants.ConnectionManager) {
 
-	connectionInformation, tenantString, err := getSubdomainInformation(hostStr, Connection)
+	conn, connErr := Connections.GetConnection(tenantInfo)
 
-	if err != nil {
-		fmt.Println(err)
-		c.AbortWithStatus(400)
+	if connErr != nil {
+		fmt.Println("Tenant connection could not be made for the request - " + tenantIdentifier)
+		c.AbortWithStatus(500)
 		return
 	}
 
-	// Make a check for a tenancy identifier being passed by the host as a subdomain identifier
-	conn, connErr := connectionInformation.GetConnection()
+	// Tenants on shared tables are given a connection scoped to their rows.
+	conn = tenants.ScopeConnection(conn, tenantInfo)
 
-	if connErr != nil {
-		fmt.Println("Tenant connection could not be made for the request - attempt using host tenancyIdentifier")
+	// Set tenancy Identifier into params
+	c.Set("tenantIdentifier", tenantIdentifier)
+
+	if tenantInfo.Isolation() != tenants.IsolationShared {
+		// Set connection into the context for routing
+		c.Set("connection", conn)
+		c.Set("readConnection", readConnection(c, tenantInfo, conn, Connections))
+		c.Next()
+		return
 	}
 
-	// Set connection into the context for routing
-	c.Set("connection", conn)
+	// Shared tables are also protected by row level security, which needs the tenant set on the connection for each request.
+	tx, txErr := tenants.BeginTenantTransaction(conn, tenantInfo)
 
-	// Set tenancy Identifier into params
-	c.Set("tenantIdentifier", tenantString)
+	if txErr != nil {
+		fmt.Println(txErr)
+		c.AbortWithStatus(500)
+		return
+	}
+
+	defer tx.RollbackUnlessCommitted()
+
+	// Shared table tenants always read from the primary, see tenants.ReplicasFor.
+	c.Set("connection", tx)
+	c.Set("readConnection", tx)
+
+	// The response is held back until the transaction has been committed, so a failed commit isn't reported as a success.
+	response := NewBufferedResponseWriter(c.Writer)
+	c.Writer = response
 
 	c.Next()
+
+	c.Writer = response.ResponseWriter
+
+	// Only keep the changes when the handlers were successful.
+	if c.IsAborted() || response.Status() >= 400 {
+		tx.Rollback()
+		response.Send()
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		fmt.Println(err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": "Something went wrong while trying to save that, please try again."})
+		return
+	}
+
+	response.Send()
+}
+
+// Returns the connection reads should use, a read replica for GET and HEAD requests and the primary for everything else.
+// A request that changes something keeps the session reading from the primary for readReplicaStickiness,
+// so a client reading what it just wrote doesn't get an older copy from a replica that hasn't caught up.
+func readConnection(c *gin.Context, tenantInfo tenants.TenantConnectionInformation, primary *gorm.DB, Connections *tenants.ConnectionManager) *gorm.DB {
+
+	cookie := fmt.Sprintf("readPrimary-%d", tenantInfo.ID)
+
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodOptions:
+		return primary
+	default:
+		// Set before the handlers run, the headers have gone by the time they are done.
+		if stickiness := helpers.GetEnvDuration("readReplicaStickiness", 10*time.Second); stickiness > 0 {
+			c.SetCookie(cookie, "1", int(stickiness.Seconds()), "/", "", false, true)
+		}
+
+		return primary
+	}
+
+	if _, err := c.Cookie(cookie); err == nil {
+		return primary
+	}
+
+	replica, err := Connections.GetReadConnection(tenantInfo)
+
+	if err != nil {
+		fmt.Println(err)
+		return primary
+	}
+
+	return replica
 }
 
-func getSubdomainInformation(hostStr string, Connection *gorm.DB) (TenantConnectionInfo tenants.TenantConnectionInformation, tenantIdentifier string, err error) {
+// Returns the tenant named by the subdomain of the host, aliased is true when the subdomain is one of the tenants previous identifiers.
+func getSubdomainInformation(hostStr string, parser SubdomainParser, Connection *gorm.DB, Cache *tenants.LookupCache) (TenantConnectionInfo tenants.TenantConnectionInformation, tenantIdentifier string, aliased bool, err error) {
 
-	output := strings.Split(hostStr, ".")
+	identifier, found := parser.Identifier(hostStr)
 
-	if len(output) < 2 {
-		return tenants.TenantConnectionInformation{}, "", errors.New("there was no subdomain present in the string or not enough to split")
+	// Without a subdomain the host doesn't name a tenant, so leave it to the next resolver.
+	if !found {
+		return tenants.TenantConnectionInformation{}, "", false, ErrTenantNotResolved
 	}
 
-	if len(output[0]) <= 0 {
-		return tenants.TenantConnectionInformation{}, "", errors.New("subdomain was empty")
+	// Hosts arrive as lower case punycode, identifiers may have been saved in either form.
+	names := []string{identifier}
+
+	if unicode, err := idna.Lookup.ToUnicode(identifier); err == nil && unicode != identifier {
+		names = append(names, unicode)
 	}
 
-	var tenantInfo tenants.TenantConnectionInformation
+	tenantInfo, aliased, err := lookupTenant(Connection, Cache, names...)
 
-	if err := Connection.Where(&tenants.TenantConnectionInformation{TenantSubDomainIdentifier: output[0]}).First(&tenantInfo).Error; err != nil {
-		return tenants.TenantConnectionInformation{}, "", errors.New("tenancy identifier not found in database")
+	if err != nil {
+		return tenantInfo, identifier, false, err
 	}
 
-	return tenantInfo, output[0], nil
+	return tenantInfo, identifier, aliased, nil
 }
@@ -0,0 +1,433 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/LiamDotPro/Go-Multitenancy/helpers"
+	"github.com/LiamDotPro/Go-Multitenancy/tenants"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Returned by a resolver when the request doesn't carry what it looks for, the next resolver is tried.
+var ErrTenantNotResolved = errors.New("the resolver found no tenant identifier on the request")
+
+// Returned when a request names a tenant that doesn't exist.
+var ErrTenantNotFound = errors.New("tenancy identifier not found in database")
+
+// Returned when a tenant token is malformed, expired or its signature doesn't match.
+var ErrInvalidTenantToken = errors.New("the tenant token is invalid")
+
+// Works out which tenant a request is for.
+type TenantResolver interface {
+	// Returns the tenant along with the identifier it was found by.
+	Resolve(c *gin.Context) (tenants.TenantConnectionInformation, string, error)
+}
+
+// Resolver names used in tenantResolvers.
+const (
+	ResolverParam     = "param"
+	ResolverHeader    = "header"
+	ResolverPath      = "path"
+	ResolverDomain    = "domain"
+	ResolverToken     = "token"
+	ResolverSubdomain = "subdomain"
+)
+
+// Builds the resolver chain named in tenantResolvers, in order.
+// Lookups go through the cache when one is given.
+func TenantResolversFromEnv(Connection *gorm.DB, Cache *tenants.LookupCache) ([]TenantResolver, error) {
+
+	var resolvers []TenantResolver
+
+	for _, name := range strings.Split(helpers.GetEnvString("tenantResolvers", ResolverParam+","+ResolverDomain+","+ResolverSubdomain), ",") {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case ResolverParam:
+			resolvers = append(resolvers, ParamResolver{Connection: Connection, Cache: Cache})
+		case ResolverHeader:
+			resolvers = append(resolvers, HeaderResolver{Connection: Connection, Cache: Cache, Header: helpers.GetEnvString("tenantHeader", "X-Tenant-ID")})
+		case ResolverPath:
+			resolvers = append(resolvers, PathPrefixResolver{Connection: Connection, Cache: Cache})
+		case ResolverDomain:
+			resolvers = append(resolvers, DomainResolver{Connection: Connection, Cache: Cache})
+		case ResolverToken:
+			secret := helpers.GetEnvString("tenantTokenSecret", "")
+
+			if len(secret) == 0 {
+				return nil, errors.New("the token tenant resolver needs tenantTokenSecret to be set")
+			}
+
+			resolvers = append(resolvers, TokenClaimResolver{Connection: Connection, Cache: Cache, Secret: []byte(secret), Claim: helpers.GetEnvString("tenantTokenClaim", "tenant")})
+		case ResolverSubdomain:
+			redirect := strings.ToLower(helpers.GetEnvString("tenantAliasMode", "resolve")) == "redirect"
+			resolvers = append(resolvers, SubdomainResolver{Connection: Connection, Cache: Cache, Parser: SubdomainParserFromEnv(), RedirectAliases: redirect})
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown tenant resolver %q", name)
+		}
+	}
+
+	if len(resolvers) == 0 {
+		return nil, errors.New("tenantResolvers needs at least one resolver")
+	}
+
+	return resolvers, nil
+}
+
+// The most of a JSON body read while looking for the tenant field, bodies over it are left for the handlers untouched.
+const maxTenantParamBody = 64 << 10
+
+// Reads the tenant field from the query string, form or JSON body, leaving the body in place for the handlers.
+type ParamResolver struct {
+	Connection *gorm.DB
+	Cache      *tenants.LookupCache
+}
+
+func (r ParamResolver) Resolve(c *gin.Context) (tenants.TenantConnectionInformation, string, error) {
+
+	identifier := c.Query("tenant")
+
+	if len(identifier) == 0 && c.Request.Body != nil {
+		switch c.ContentType() {
+		case gin.MIMEJSON:
+			// The tenant isn't known yet, so only ever buffer a small amount of an unauthenticated body.
+			body, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, maxTenantParamBody+1))
+
+			if err != nil {
+				return tenants.TenantConnectionInformation{}, "", err
+			}
+
+			c.Request.Body = readCloser{io.MultiReader(bytes.NewReader(body), c.Request.Body), c.Request.Body}
+
+			var params tenantIdentifierParams
+
+			if len(body) <= maxTenantParamBody && json.Unmarshal(body, &params) == nil {
+				identifier = params.TenancyIdentifier
+			}
+		case gin.MIMEPOSTForm, gin.MIMEMultipartPOSTForm:
+			identifier = c.PostForm("tenant")
+		}
+	}
+
+	return findTenantByIdentifier(r.Connection, r.Cache, identifier)
+}
+
+// Reads the peeked at start of a body followed by the rest, closing the original body.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Reads the tenant identifier from a header, X-Tenant-ID by default.
+type HeaderResolver struct {
+	Connection *gorm.DB
+	Cache      *tenants.LookupCache
+	Header     string
+}
+
+func (r HeaderResolver) Resolve(c *gin.Context) (tenants.TenantConnectionInformation, string, error) {
+	return findTenantByIdentifier(r.Connection, r.Cache, strings.TrimSpace(c.GetHeader(r.Header)))
+}
+
+type tenantPathKey struct{}
+
+// Strips a /t/{tenant} prefix from the path before routing, so /t/acme/api/users/create is served by /api/users/create.
+// The tenant is kept on the request for the PathPrefixResolver.
+func StripTenantPathPrefix(next http.Handler) http.Handler {
+
+	prefix := "/" + strings.Trim(helpers.GetEnvString("tenantPathPrefix", "/t/"), "/") + "/"
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+
+		if !strings.HasPrefix(req.URL.Path, prefix) {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		rest := strings.TrimPrefix(req.URL.Path, prefix)
+		identifier := rest
+		path := "/"
+
+		if i := strings.Index(rest, "/"); i >= 0 {
+			identifier, path = rest[:i], rest[i:]
+		}
+
+		req = req.WithContext(context.WithValue(req.Context(), tenantPathKey{}, identifier))
+		req.URL.Path = path
+		req.URL.RawPath = ""
+
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Reads the tenant from a /t/{tenant}/... path prefix, the server has to be wrapped in StripTenantPathPrefix.
+type PathPrefixResolver struct {
+	Connection *gorm.DB
+	Cache      *tenants.LookupCache
+}
+
+func (r PathPrefixResolver) Resolve(c *gin.Context) (tenants.TenantConnectionInformation, string, error) {
+	identifier, _ := c.Request.Context().Value(tenantPathKey{}).(string)
+	return findTenantByIdentifier(r.Connection, r.Cache, identifier)
+}
+
+// Finds the tenant owning the exact verified hostname of the request, e.g. portal.customer.com.
+type DomainResolver struct {
+	Connection *gorm.DB
+	Cache      *tenants.LookupCache
+}
+
+func (r DomainResolver) Resolve(c *gin.Context) (tenants.TenantConnectionInformation, string, error) {
+
+	tenant, err := findTenantByDomain(r.Connection, r.Cache, c.Request.Host)
+
+	if gorm.IsRecordNotFoundError(err) {
+		return tenant, "", ErrTenantNotResolved
+	}
+
+	return tenant, tenant.TenantSubDomainIdentifier, err
+}
+
+// Finds the tenant owning a verified hostname through the cache.
+func findTenantByDomain(Connection *gorm.DB, Cache *tenants.LookupCache, host string) (tenants.TenantConnectionInformation, error) {
+
+	key := tenants.DomainCacheKey(host)
+
+	if entry, found := Cache.Get(key); found {
+		if !entry.Found {
+			return entry.Tenant, gorm.ErrRecordNotFound
+		}
+
+		return entry.Tenant, nil
+	}
+
+	tenant, err := tenants.FindTenantByDomain(Connection, host)
+
+	if err == nil {
+		Cache.Put(key, tenants.LookupEntry{Tenant: tenant, Found: true})
+	} else if gorm.IsRecordNotFoundError(err) {
+		Cache.Put(key, tenants.LookupEntry{})
+	}
+
+	return tenant, err
+}
+
+// Reads the tenant identifier from a claim in an HS256 signed bearer token.
+type TokenClaimResolver struct {
+	Connection *gorm.DB
+	Cache      *tenants.LookupCache
+	Secret     []byte
+	Claim      string
+}
+
+func (r TokenClaimResolver) Resolve(c *gin.Context) (tenants.TenantConnectionInformation, string, error) {
+
+	header := c.GetHeader("Authorization")
+
+	if !strings.HasPrefix(header, "Bearer ") {
+		return tenants.TenantConnectionInformation{}, "", ErrTenantNotResolved
+	}
+
+	claims, err := verifyTenantToken(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")), r.Secret)
+
+	if err != nil {
+		return tenants.TenantConnectionInformation{}, "", err
+	}
+
+	identifier, _ := claims[r.Claim].(string)
+
+	return findTenantByIdentifier(r.Connection, r.Cache, identifier)
+}
+
+// Checks the signature and expiry of a JWT signed with HS256 and returns its claims.
+func verifyTenantToken(token string, secret []byte) (map[string]interface{}, error) {
+
+	parts := strings.Split(token, ".")
+
+	if len(parts) != 3 {
+		return nil, ErrInvalidTenantToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+
+	if err := decodeTokenSegment(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return nil, ErrInvalidTenantToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+
+	if err != nil {
+		return nil, ErrInvalidTenantToken
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, ErrInvalidTenantToken
+	}
+
+	var claims map[string]interface{}
+
+	if err := decodeTokenSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidTenantToken
+	}
+
+	if exp, ok := claims["exp"].(float64); ok && time.Now().Unix() > int64(exp) {
+		return nil, ErrInvalidTenantToken
+	}
+
+	return claims, nil
+}
+
+func decodeTokenSegment(segment string, v interface{}) error {
+
+	decoded, err := base64.RawURLEncoding.DecodeString(segment)
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(decoded, v)
+}
+
+// Reads the tenant identifier from the subdomain of the host, e.g. acme.example.com.
+type SubdomainResolver struct {
+	Connection      *gorm.DB
+	Cache           *tenants.LookupCache
+	Parser          SubdomainParser
+	RedirectAliases bool // Send hosts using a previous identifier to the current one rather than serving them.
+}
+
+func (r SubdomainResolver) Resolve(c *gin.Context) (tenants.TenantConnectionInformation, string, error) {
+
+	tenantInfo, identifier, aliased, err := getSubdomainInformation(c.Request.Host, r.Parser, r.Connection, r.Cache)
+
+	if err != nil || !aliased {
+		return tenantInfo, identifier, err
+	}
+
+	if r.RedirectAliases {
+		return tenantInfo, identifier, TenantRedirect{Location: renamedTenantURL(c.Request, identifier, tenantInfo.TenantSubDomainIdentifier)}
+	}
+
+	return tenantInfo, tenantInfo.TenantSubDomainIdentifier, nil
+}
+
+// Returned when the request should be sent elsewhere, e.g. to a tenants new subdomain after a rename.
+type TenantRedirect struct {
+	Location string
+}
+
+func (r TenantRedirect) Error() string {
+	return "the tenant has moved to " + r.Location
+}
+
+// Rewrites the request URL onto the tenants current subdomain.
+func renamedTenantURL(req *http.Request, alias string, identifier string) string {
+
+	scheme := "http"
+
+	if req.TLS != nil || strings.EqualFold(req.Header.Get("X-Forwarded-Proto"), "https") {
+		scheme = "https"
+	}
+
+	host := tenants.NormalizeHost(req.Host)
+
+	if _, port, err := net.SplitHostPort(req.Host); err == nil {
+		host = net.JoinHostPort(host, port)
+	}
+
+	host = strings.Replace(host, alias+".", strings.ToLower(identifier)+".", 1)
+
+	target := url.URL{Scheme: scheme, Host: host, Path: req.URL.Path, RawQuery: req.URL.RawQuery}
+
+	return target.String()
+}
+
+// Looks up a tenant by its identifier, an empty identifier means the resolver didn't apply.
+func findTenantByIdentifier(Connection *gorm.DB, Cache *tenants.LookupCache, identifier string) (tenants.TenantConnectionInformation, string, error) {
+
+	if len(identifier) == 0 {
+		return tenants.TenantConnectionInformation{}, "", ErrTenantNotResolved
+	}
+
+	tenantInfo, aliased, err := lookupTenant(Connection, Cache, identifier)
+
+	// Previous identifiers resolve to the tenant under its current identifier.
+	if aliased {
+		identifier = tenantInfo.TenantSubDomainIdentifier
+	}
+
+	return tenantInfo, identifier, err
+}
+
+// Finds the tenant with any of the identifiers through the cache, unknown identifiers are cached too.
+func lookupTenant(Connection *gorm.DB, Cache *tenants.LookupCache, identifiers ...string) (tenantInfo tenants.TenantConnectionInformation, aliased bool, err error) {
+
+	key := tenants.IdentifierCacheKey(identifiers[0])
+
+	if entry, found := Cache.Get(key); found {
+		if !entry.Found {
+			return entry.Tenant, false, ErrTenantNotFound
+		}
+
+		return entry.Tenant, entry.Aliased, nil
+	}
+
+	tenantInfo, aliased, err = queryTenant(Connection, identifiers...)
+
+	switch err {
+	case nil:
+		Cache.Put(key, tenants.LookupEntry{Tenant: tenantInfo, Aliased: aliased, Found: true})
+	case ErrTenantNotFound:
+		Cache.Put(key, tenants.LookupEntry{})
+	}
+
+	return tenantInfo, aliased, err
+}
+
+// Finds the tenant with any of the identifiers, falling back to the identifiers tenants have been renamed from.
+func queryTenant(Connection *gorm.DB, identifiers ...string) (tenantInfo tenants.TenantConnectionInformation, aliased bool, err error) {
+
+	var lower []string
+
+	for _, identifier := range identifiers {
+		lower = append(lower, strings.ToLower(identifier))
+	}
+
+	err = Connection.Where("lower(tenant_sub_domain_identifier) IN (?)", lower).First(&tenantInfo).Error
+
+	if !gorm.IsRecordNotFoundError(err) {
+		return tenantInfo, false, err
+	}
+
+	for _, identifier := range lower {
+		tenantInfo, err = tenants.FindTenantByAlias(Connection, identifier)
+
+		if err == nil {
+			return tenantInfo, true, nil
+		}
+
+		if !gorm.IsRecordNotFoundError(err) {
+			return tenantInfo, false, err
+		}
+	}
+
+	return tenantInfo, false, ErrTenantNotFound
+}
@@ -0,0 +1,404 @@
+package migrations
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"sort"
+	"strings"
+)
+
+// The kinds of difference drift detection reports.
+const (
+	DriftMissingTable     = "missing_table"
+	DriftMissingColumn    = "missing_column"
+	DriftUnexpectedColumn = "unexpected_column"
+	DriftColumnType       = "column_type"
+	DriftMissingIndex     = "missing_index"
+	DriftUnexpectedIndex  = "unexpected_index"
+	DriftIndexDefinition  = "index_definition"
+)
+
+// The shape of a single table, either expected from a model or introspected from a database.
+type TableSchema struct {
+	Name    string         `json:"name"`
+	Columns []ColumnSchema `json:"columns"`
+	Indexes []IndexSchema  `json:"indexes"`
+}
+
+type ColumnSchema struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type IndexSchema struct {
+	Name    string   `json:"name"`
+	Columns []string `json:"columns"`
+	Unique  bool     `json:"unique"`
+}
+
+// A single way a database differs from the expected schema.
+type SchemaDifference struct {
+	Table    string `json:"table"`
+	Kind     string `json:"kind"`
+	Name     string `json:"name,omitempty"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+}
+
+// How a single database differs from the expected schema.
+type DriftReport struct {
+	Database    string             `json:"database"`
+	Drifted     bool               `json:"drifted"`
+	Differences []SchemaDifference `json:"differences"`
+	Error       string             `json:"error,omitempty"`
+}
+
+// Type names postgres reports differently to how they are usually written.
+var postgresTypeAliases = map[string]string{
+	"serial":      "integer",
+	"bigserial":   "bigint",
+	"smallserial": "smallint",
+	"int":         "integer",
+	"int4":        "integer",
+	"int8":        "bigint",
+	"int2":        "smallint",
+	"bool":        "boolean",
+	"varchar":     "character varying",
+	"char":        "character",
+	"decimal":     "numeric",
+	"float4":      "real",
+	"float8":      "double precision",
+	"timestamptz": "timestamp with time zone",
+	"timestamp":   "timestamp without time zone",
+}
+
+// Builds the schema gorm would create for the models, normalised to the type names postgres reports.
+func ExpectedSchema(db *gorm.DB, models ...interface{}) []TableSchema {
+
+	var tables []TableSchema
+
+	for _, model := range models {
+		scope := db.NewScope(model)
+		table := TableSchema{Name: scope.TableName()}
+		var primaryKeys []string
+
+		for _, field := range scope.GetModelStruct().StructFields {
+			if field.IsNormal {
+				_, _, _, additionalType := gorm.ParseFieldStructForDialect(field, scope.Dialect())
+				sqlType := strings.TrimSpace(strings.TrimSuffix(scope.Dialect().DataTypeOf(field), additionalType))
+
+				table.Columns = append(table.Columns, ColumnSchema{Name: field.DBName, Type: NormalizeColumnType(sqlType)})
+
+				if _, unique := field.TagSettingsGet("UNIQUE"); unique {
+					table.Indexes = append(table.Indexes, IndexSchema{Name: table.Name + "_" + field.DBName + "_key", Columns: []string{field.DBName}, Unique: true})
+				}
+			}
+
+			if field.IsPrimaryKey {
+				primaryKeys = append(primaryKeys, field.DBName)
+			}
+		}
+
+		if len(primaryKeys) > 0 {
+			table.Indexes = append(table.Indexes, IndexSchema{Name: table.Name + "_pkey", Columns: primaryKeys, Unique: true})
+		}
+
+		table.Indexes = append(table.Indexes, taggedIndexes(scope, table.Name)...)
+
+		tables = append(tables, table)
+	}
+
+	return tables
+}
+
+// Reads the indexes gorm adds for index and unique_index tags, the same way AutoMigrate names them.
+func taggedIndexes(scope *gorm.Scope, tableName string) []IndexSchema {
+
+	indexes := map[string]*IndexSchema{}
+	var names []string
+
+	add := func(name string, column string, unique bool) {
+		if _, found := indexes[name]; !found {
+			indexes[name] = &IndexSchema{Name: name, Unique: unique}
+			names = append(names, name)
+		}
+
+		indexes[name].Columns = append(indexes[name].Columns, column)
+	}
+
+	for _, field := range scope.GetStructFields() {
+		for _, tagged := range []struct{ tag, kind string }{{"INDEX", "idx"}, {"UNIQUE_INDEX", "uix"}} {
+			value, ok := field.TagSettingsGet(tagged.tag)
+
+			if !ok {
+				continue
+			}
+
+			for _, name := range strings.Split(value, ",") {
+				if name == tagged.tag || name == "" {
+					name = scope.Dialect().BuildKeyName(tagged.kind, tableName, field.DBName)
+				}
+
+				name, column := scope.Dialect().NormalizeIndexAndColumn(name, field.DBName)
+				add(name, column, tagged.kind == "uix")
+			}
+		}
+	}
+
+	var result []IndexSchema
+
+	for _, name := range names {
+		result = append(result, *indexes[name])
+	}
+
+	return result
+}
+
+// Introspects the tables in the current schema of a postgres database, tables that don't exist are left out.
+func ActualSchema(db *gorm.DB, tableNames ...string) (map[string]TableSchema, error) {
+
+	if db.Dialect().GetName() != "postgres" {
+		return nil, fmt.Errorf("drift detection isn't supported on %v", db.Dialect().GetName())
+	}
+
+	tables := map[string]TableSchema{}
+
+	for _, name := range tableNames {
+		if !db.Dialect().HasTable(name) {
+			continue
+		}
+
+		table := TableSchema{Name: name}
+
+		columns, err := db.DB().Query(`SELECT a.attname, format_type(a.atttypid, a.atttypmod)
+			FROM pg_attribute a
+			JOIN pg_class c ON c.oid = a.attrelid
+			JOIN pg_namespace n ON n.oid = c.relnamespace
+			WHERE n.nspname = current_schema() AND c.relname = $1 AND a.attnum > 0 AND NOT a.attisdropped
+			ORDER BY a.attnum`, name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for columns.Next() {
+			var column ColumnSchema
+
+			if err := columns.Scan(&column.Name, &column.Type); err != nil {
+				columns.Close()
+				return nil, err
+			}
+
+			table.Columns = append(table.Columns, column)
+		}
+
+		columns.Close()
+
+		if err := columns.Err(); err != nil {
+			return nil, err
+		}
+
+		indexes, err := db.DB().Query(`SELECT i.relname, ix.indisunique, a.attname
+			FROM pg_index ix
+			JOIN pg_class t ON t.oid = ix.indrelid
+			JOIN pg_class i ON i.oid = ix.indexrelid
+			JOIN pg_namespace n ON n.oid = t.relnamespace
+			JOIN pg_attribute a ON a.attrelid = t.oid AND a.attnum = ANY(ix.indkey)
+			WHERE n.nspname = current_schema() AND t.relname = $1
+			ORDER BY i.relname, array_position(ix.indkey::int2[], a.attnum)`, name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for indexes.Next() {
+			var indexName, column string
+			var unique bool
+
+			if err := indexes.Scan(&indexName, &unique, &column); err != nil {
+				indexes.Close()
+				return nil, err
+			}
+
+			if last := len(table.Indexes) - 1; last >= 0 && table.Indexes[last].Name == indexName {
+				table.Indexes[last].Columns = append(table.Indexes[last].Columns, column)
+				continue
+			}
+
+			table.Indexes = append(table.Indexes, IndexSchema{Name: indexName, Columns: []string{column}, Unique: unique})
+		}
+
+		indexes.Close()
+
+		if err := indexes.Err(); err != nil {
+			return nil, err
+		}
+
+		tables[name] = table
+	}
+
+	return tables, nil
+}
+
+// Lists every way the actual tables differ from the expected ones.
+// Tables that aren't expected are ignored as the database may hold other things, e.g. the master tables.
+func CompareSchemas(expected []TableSchema, actual map[string]TableSchema) []SchemaDifference {
+
+	var differences []SchemaDifference
+
+	for _, want := range expected {
+		got, found := actual[want.Name]
+
+		if !found {
+			differences = append(differences, SchemaDifference{Table: want.Name, Kind: DriftMissingTable})
+			continue
+		}
+
+		gotColumns := map[string]ColumnSchema{}
+
+		for _, column := range got.Columns {
+			gotColumns[column.Name] = column
+		}
+
+		for _, column := range want.Columns {
+			existing, found := gotColumns[column.Name]
+
+			switch {
+			case !found:
+				differences = append(differences, SchemaDifference{Table: want.Name, Kind: DriftMissingColumn, Name: column.Name, Expected: column.Type})
+			case NormalizeColumnType(existing.Type) != NormalizeColumnType(column.Type):
+				differences = append(differences, SchemaDifference{Table: want.Name, Kind: DriftColumnType, Name: column.Name, Expected: column.Type, Actual: existing.Type})
+			}
+
+			delete(gotColumns, column.Name)
+		}
+
+		for _, column := range got.Columns {
+			if _, extra := gotColumns[column.Name]; extra {
+				differences = append(differences, SchemaDifference{Table: want.Name, Kind: DriftUnexpectedColumn, Name: column.Name, Actual: column.Type})
+			}
+		}
+
+		gotIndexes := map[string]IndexSchema{}
+
+		for _, index := range got.Indexes {
+			gotIndexes[index.Name] = index
+		}
+
+		for _, index := range want.Indexes {
+			existing, found := gotIndexes[index.Name]
+
+			switch {
+			case !found:
+				differences = append(differences, SchemaDifference{Table: want.Name, Kind: DriftMissingIndex, Name: index.Name, Expected: index.String()})
+			case existing.String() != index.String():
+				differences = append(differences, SchemaDifference{Table: want.Name, Kind: DriftIndexDefinition, Name: index.Name, Expected: index.String(), Actual: existing.String()})
+			}
+
+			delete(gotIndexes, index.Name)
+		}
+
+		for _, index := range got.Indexes {
+			if _, extra := gotIndexes[index.Name]; extra {
+				differences = append(differences, SchemaDifference{Table: want.Name, Kind: DriftUnexpectedIndex, Name: index.Name, Actual: index.String()})
+			}
+		}
+	}
+
+	return differences
+}
+
+// Compares a database against the schema expected from the models.
+func CheckDrift(db *gorm.DB, database string, models ...interface{}) DriftReport {
+
+	report := DriftReport{Database: database}
+	expected := ExpectedSchema(db, models...)
+
+	var names []string
+
+	for _, table := range expected {
+		names = append(names, table.Name)
+	}
+
+	actual, err := ActualSchema(db, names...)
+
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+
+	report.Differences = CompareSchemas(expected, actual)
+	report.Drifted = len(report.Differences) > 0
+
+	return report
+}
+
+// Rewrites a column type the way postgres reports it, e.g. varchar(255) becomes character varying(255).
+func NormalizeColumnType(sqlType string) string {
+
+	sqlType = strings.ToLower(strings.Join(strings.Fields(sqlType), " "))
+	base, rest := sqlType, ""
+
+	if i := strings.Index(sqlType, "("); i >= 0 {
+		base, rest = strings.TrimSpace(sqlType[:i]), sqlType[i:]
+	}
+
+	if alias, found := postgresTypeAliases[base]; found {
+		base = alias
+	}
+
+	return base + rest
+}
+
+// Formats the index for reports, e.g. unique (tenant_id, email).
+func (i IndexSchema) String() string {
+
+	columns := "(" + strings.Join(i.Columns, ", ") + ")"
+
+	if i.Unique {
+		return "unique " + columns
+	}
+
+	return columns
+}
+
+// Formats the report for the command line.
+func (r DriftReport) String() string {
+
+	var b strings.Builder
+
+	switch {
+	case len(r.Error) > 0:
+		fmt.Fprintf(&b, "== %v: %v\n", r.Database, r.Error)
+		return b.String()
+	case !r.Drifted:
+		fmt.Fprintf(&b, "== %v: matches the expected schema\n", r.Database)
+		return b.String()
+	}
+
+	fmt.Fprintf(&b, "== %v: %d differences\n", r.Database, len(r.Differences))
+
+	differences := append([]SchemaDifference(nil), r.Differences...)
+	sort.SliceStable(differences, func(i, j int) bool { return differences[i].Table < differences[j].Table })
+
+	for _, d := range differences {
+		name := d.Table
+
+		if len(d.Name) > 0 {
+			name += "." + d.Name
+		}
+
+		switch {
+		case len(d.Expected) > 0 && len(d.Actual) > 0:
+			fmt.Fprintf(&b, "  %-18v %-40v expected %v, found %v\n", d.Kind, name, d.Expected, d.Actual)
+		case len(d.Expected) > 0:
+			fmt.Fprintf(&b, "  %-18v %-40v expected %v\n", d.Kind, name, d.Expected)
+		case len(d.Actual) > 0:
+			fmt.Fprintf(&b, "  %-18v %-40v found %v\n", d.Kind, name, d.Actual)
+		default:
+			fmt.Fprintf(&b, "  %-18v %v\n", d.Kind, name)
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,312 @@
+package migrations
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"regexp"
+	"strings"
+)
+
+// Statements that drop, rename, truncate or rewrite existing data.
+var destructivePatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\bDROP\s+(TABLE|COLUMN|SCHEMA|DATABASE|INDEX|VIEW|TYPE|CONSTRAINT|SEQUENCE)\b`),
+	regexp.MustCompile(`(?i)\bALTER\s+TABLE\b[\s\S]*\bDROP\b`),
+	regexp.MustCompile(`(?i)\bRENAME\b`),
+	regexp.MustCompile(`(?i)\bTRUNCATE\b`),
+	regexp.MustCompile(`(?i)\bDELETE\s+FROM\b`),
+	regexp.MustCompile(`(?i)\bALTER\s+COLUMN\b[\s\S]*\bTYPE\b`),
+	regexp.MustCompile(`(?i)\bMODIFY\b`),
+}
+
+// Matches UPDATE statements without a WHERE clause, which rewrite every row.
+var unboundedUpdatePattern = regexp.MustCompile(`(?i)^\s*UPDATE\b`)
+var wherePattern = regexp.MustCompile(`(?i)\bWHERE\b`)
+
+// Matches string literals, whose contents are data rather than SQL.
+var stringLiteralPattern = regexp.MustCompile(`'(?:[^']|'')*'`)
+
+// Matches the tag opening a postgres dollar quoted string, e.g. $$ or $body$.
+var dollarQuotePattern = regexp.MustCompile(`^\$[A-Za-z_]*\$`)
+
+// A statement a pending migration would run.
+type PlannedStatement struct {
+	SQL         string        `json:"sql"`
+	Vars        []interface{} `json:"vars,omitempty"`
+	Destructive bool          `json:"destructive"`
+}
+
+// A pending migration along with the statements it would run.
+type PlannedMigration struct {
+	Version    uint64             `json:"version"`
+	Name       string             `json:"name"`
+	Statements []PlannedStatement `json:"statements"`
+	Previewed  bool               `json:"previewed"` // False for Go migrations on databases that can't preview them.
+	Error      string             `json:"error,omitempty"`
+}
+
+// The pending changes for a single database.
+type Plan struct {
+	Database    string             `json:"database"`
+	Migrations  []PlannedMigration `json:"migrations"`
+	Destructive bool               `json:"destructive"`
+	Error       string             `json:"error,omitempty"`
+}
+
+// Checks if any of the statements in sql drops, renames or rewrites existing data.
+func IsDestructive(sql string) bool {
+
+	for _, statement := range SplitStatements(sql) {
+		if isDestructiveStatement(statement) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isDestructiveStatement(statement string) bool {
+
+	statement = stringLiteralPattern.ReplaceAllString(statement, "''")
+
+	for _, pattern := range destructivePatterns {
+		if pattern.MatchString(statement) {
+			return true
+		}
+	}
+
+	return unboundedUpdatePattern.MatchString(statement) && !wherePattern.MatchString(statement)
+}
+
+// Splits sql into its statements on the semicolons between them, leaving out comments and empty statements.
+// Semicolons inside of quoted identifiers, strings and dollar quoted bodies don't end a statement.
+func SplitStatements(sql string) []string {
+
+	var statements []string
+	var current strings.Builder
+
+	end := func() {
+		if statement := strings.TrimSpace(current.String()); len(statement) > 0 {
+			statements = append(statements, statement)
+		}
+
+		current.Reset()
+	}
+
+	for i := 0; i < len(sql); i++ {
+		rest := sql[i:]
+
+		switch {
+		case strings.HasPrefix(rest, "--"):
+			if n := strings.IndexByte(rest, '\n'); n >= 0 {
+				i += n
+				current.WriteByte('\n')
+			} else {
+				i = len(sql)
+			}
+		case strings.HasPrefix(rest, "/*"):
+			if n := strings.Index(rest[2:], "*/"); n >= 0 {
+				i += n + 3
+				current.WriteByte(' ')
+			} else {
+				i = len(sql)
+			}
+		case rest[0] == '\'' || rest[0] == '"':
+			n := closingQuote(rest, rest[0])
+			current.WriteString(rest[:n])
+			i += n - 1
+		case rest[0] == '$' && dollarQuotePattern.MatchString(rest):
+			tag := dollarQuotePattern.FindString(rest)
+			n := len(rest)
+
+			if closing := strings.Index(rest[len(tag):], tag); closing >= 0 {
+				n = len(tag) + closing + len(tag)
+			}
+
+			current.WriteString(rest[:n])
+			i += n - 1
+		case rest[0] == ';':
+			end()
+		default:
+			current.WriteByte(rest[0])
+		}
+	}
+
+	end()
+
+	return statements
+}
+
+// Finds the length of the quoted string at the start of s, a doubled quote is an escaped one.
+func closingQuote(s string, quote byte) int {
+
+	for i := 1; i < len(s); i++ {
+		if s[i] != quote {
+			continue
+		}
+
+		if i+1 < len(s) && s[i+1] == quote {
+			i++
+			continue
+		}
+
+		return i + 1
+	}
+
+	return len(s)
+}
+
+// Works out the statements every pending migration would run without applying any of them.
+// SQL migrations are read as written. On postgres Go migrations are run inside of a transaction that is always rolled back,
+// recording the statements gorm generates, this is only safe where DDL is transactional
+// so on other databases they are listed by version and name only.
+func (r *Registry) Plan(db *gorm.DB, database string) Plan {
+
+	plan := Plan{Database: database}
+
+	pending, err := r.Pending(db)
+
+	if err != nil {
+		plan.Error = err.Error()
+		return plan
+	}
+
+	if len(pending) == 0 {
+		return plan
+	}
+
+	transactional := db.Dialect().GetName() == "postgres"
+
+	recorder := &statementRecorder{}
+	tx := db
+
+	if transactional {
+		tx = db.Begin()
+
+		if tx.Error != nil {
+			plan.Error = tx.Error.Error()
+			return plan
+		}
+
+		defer tx.Rollback()
+
+		tx.SetLogger(recorder)
+		tx = tx.LogMode(true)
+	}
+
+	for _, m := range pending {
+		planned := PlannedMigration{Version: m.Version, Name: m.Name, Previewed: m.Up == nil || transactional}
+
+		switch {
+		case m.Up == nil:
+			for _, statement := range SplitStatements(m.UpSQL) {
+				planned.Statements = append(planned.Statements, PlannedStatement{SQL: statement, Destructive: isDestructiveStatement(statement)})
+			}
+
+			// Apply it so later Go migrations are planned against the right schema.
+			if transactional && len(planned.Statements) > 0 {
+				if err := tx.Exec(m.UpSQL).Error; err != nil {
+					planned.Error = err.Error()
+				}
+			}
+		case transactional:
+			recorder.reset()
+
+			if err := m.Up(tx); err != nil {
+				planned.Error = err.Error()
+			}
+
+			planned.Statements = recorder.statements
+		}
+
+		for _, statement := range planned.Statements {
+			if statement.Destructive {
+				plan.Destructive = true
+			}
+		}
+
+		plan.Migrations = append(plan.Migrations, planned)
+
+		// Once a migration fails we can't know what the ones after it would do.
+		if len(planned.Error) > 0 {
+			break
+		}
+	}
+
+	return plan
+}
+
+// Formats the plan for the command line.
+func (p Plan) String() string {
+
+	var b strings.Builder
+
+	switch {
+	case len(p.Error) > 0:
+		fmt.Fprintf(&b, "== %v: %v\n", p.Database, p.Error)
+		return b.String()
+	case len(p.Migrations) == 0:
+		fmt.Fprintf(&b, "== %v: up to date\n", p.Database)
+		return b.String()
+	case p.Destructive:
+		fmt.Fprintf(&b, "== %v: %d pending, CONTAINS DESTRUCTIVE CHANGES\n", p.Database, len(p.Migrations))
+	default:
+		fmt.Fprintf(&b, "== %v: %d pending\n", p.Database, len(p.Migrations))
+	}
+
+	for _, m := range p.Migrations {
+		fmt.Fprintf(&b, "-- %d %v\n", m.Version, m.Name)
+
+		for _, statement := range m.Statements {
+			if statement.Destructive {
+				b.WriteString("-- DESTRUCTIVE\n")
+			}
+
+			b.WriteString(strings.TrimSpace(statement.SQL) + ";\n")
+
+			if len(statement.Vars) > 0 {
+				fmt.Fprintf(&b, "-- vars: %v\n", statement.Vars)
+			}
+		}
+
+		if len(m.Error) > 0 {
+			fmt.Fprintf(&b, "-- failed: %v\n", m.Error)
+		}
+
+		if !m.Previewed {
+			b.WriteString("-- go migration, its statements can only be previewed on postgres\n")
+		}
+	}
+
+	return b.String()
+}
+
+// A gorm logger that keeps the statements that change the database.
+type statementRecorder struct {
+	statements []PlannedStatement
+}
+
+func (r *statementRecorder) Print(values ...interface{}) {
+
+	if len(values) < 5 || values[0] != "sql" {
+		return
+	}
+
+	sql, ok := values[3].(string)
+
+	if !ok {
+		return
+	}
+
+	// Reads don't change anything so leave them out of the preview.
+	if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(sql)), "SELECT") {
+		return
+	}
+
+	vars, _ := values[4].([]interface{})
+
+	r.statements = append(r.statements, PlannedStatement{SQL: sql, Vars: vars, Destructive: IsDestructive(sql)})
+}
+
+func (r *statementRecorder) reset() {
+	r.statements = nil
+}
@@ -0,0 +1,188 @@
+package migrations
+
+import (
+	"errors"
+	"fmt"
+	"github.com/LiamDotPro/Go-Multitenancy/helpers"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outcomes recorded against each database in a fleet run.
+const (
+	OutcomeSucceeded = "succeeded"
+	OutcomeFailed    = "failed"
+	OutcomeSkipped   = "skipped"
+)
+
+// Settings for migrating many tenant databases at once.
+type FleetOptions struct {
+	Workers       int           // Number of databases migrated at the same time.
+	TenantTimeout time.Duration // How long a single database may take before it is reported as failed, 0 waits forever.
+}
+
+// A database taking part in a fleet run.
+type FleetTarget struct {
+	Name    string
+	Migrate func() error
+}
+
+// Returned by a targets Migrate function when there was nothing to do, the target is reported as skipped.
+type SkipError struct {
+	Reason string
+}
+
+func (e SkipError) Error() string {
+	return e.Reason
+}
+
+// Marks a fleet target as skipped for the given reason.
+func Skip(reason string) error {
+	return SkipError{Reason: reason}
+}
+
+// The outcome for a single database in a fleet run.
+type FleetResult struct {
+	Database string        `json:"database"`
+	Outcome  string        `json:"outcome"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// The outcome of a whole fleet run.
+type FleetSummary struct {
+	StartedAt  time.Time     `json:"startedAt"`
+	FinishedAt time.Time     `json:"finishedAt"`
+	Duration   time.Duration `json:"duration"`
+	Succeeded  int           `json:"succeeded"`
+	Failed     int           `json:"failed"`
+	Skipped    int           `json:"skipped"`
+	Results    []FleetResult `json:"results"`
+}
+
+// Reads the fleet options from the environment.
+func FleetOptionsFromEnv() FleetOptions {
+	return FleetOptions{
+		Workers:       helpers.GetEnvInt("migrationWorkers", 4),
+		TenantTimeout: helpers.GetEnvDuration("migrationTenantTimeout", 5*time.Minute),
+	}
+}
+
+// Migrates every target using a pool of workers, a failing target never stops the others.
+// Results are returned in the same order as the targets.
+func RunFleet(targets []FleetTarget, options FleetOptions) FleetSummary {
+
+	summary := FleetSummary{StartedAt: time.Now().UTC(), Results: make([]FleetResult, len(targets))}
+
+	workers := options.Workers
+
+	if workers <= 0 {
+		workers = 1
+	}
+
+	jobs := make(chan int)
+	var wait sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wait.Add(1)
+
+		go func() {
+			defer wait.Done()
+
+			for i := range jobs {
+				summary.Results[i] = migrateTarget(targets[i], options.TenantTimeout)
+			}
+		}()
+	}
+
+	for i := range targets {
+		jobs <- i
+	}
+
+	close(jobs)
+	wait.Wait()
+
+	for _, result := range summary.Results {
+		switch result.Outcome {
+		case OutcomeSucceeded:
+			summary.Succeeded++
+		case OutcomeFailed:
+			summary.Failed++
+		case OutcomeSkipped:
+			summary.Skipped++
+		}
+	}
+
+	summary.FinishedAt = time.Now().UTC()
+	summary.Duration = summary.FinishedAt.Sub(summary.StartedAt)
+
+	return summary
+}
+
+// Runs a single target, recovering from panics and giving up waiting after the timeout.
+// A timed out migration carries on in the background as gorm can't cancel it, but it no longer holds up the fleet.
+func migrateTarget(target FleetTarget, timeout time.Duration) FleetResult {
+
+	started := time.Now()
+	done := make(chan error, 1)
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("panic: %v", r)
+			}
+		}()
+
+		done <- target.Migrate()
+	}()
+
+	var err error
+
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case err = <-done:
+		case <-timer.C:
+			err = fmt.Errorf("timed out after %v", timeout)
+		}
+	} else {
+		err = <-done
+	}
+
+	result := FleetResult{Database: target.Name, Outcome: OutcomeSucceeded, Duration: time.Since(started)}
+
+	var skip SkipError
+
+	if errors.As(err, &skip) {
+		result.Outcome = OutcomeSkipped
+		result.Error = skip.Reason
+	} else if err != nil {
+		result.Outcome = OutcomeFailed
+		result.Error = err.Error()
+	}
+
+	return result
+}
+
+// Formats the summary for the startup log.
+func (s FleetSummary) String() string {
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Tenant migrations finished in %v: %d succeeded, %d failed, %d skipped\n", s.Duration, s.Succeeded, s.Failed, s.Skipped)
+
+	for _, result := range s.Results {
+		fmt.Fprintf(&b, "  %-30v %-10v %10v", result.Database, result.Outcome, result.Duration.Round(time.Millisecond))
+
+		if len(result.Error) > 0 {
+			fmt.Fprintf(&b, "  %v", result.Error)
+		}
+
+		b.WriteString("\n")
+	}
+
+	return b.String()
+}
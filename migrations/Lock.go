@@ -0,0 +1,241 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/LiamDotPro/Go-Multitenancy/helpers"
+	"github.com/jinzhu/gorm"
+	"hash/fnv"
+	"os"
+	"strings"
+	"time"
+)
+
+// What an instance does when another instance already holds a migration lock.
+const (
+	LockWait = "wait" // Wait for the lock, then carry on (usually finding nothing left to migrate).
+	LockSkip = "skip" // Skip the database and leave it to the instance holding the lock.
+)
+
+// Returned in skip mode when another instance holds the lock.
+var ErrLockNotAcquired = errors.New("another instance is already migrating this database")
+
+// Returned in wait mode when the lock couldn't be taken before the timeout.
+var ErrLockTimeout = errors.New("timed out waiting for another instance to finish migrating this database")
+
+// Returned on postgres when no connection string was given to hold the advisory lock on.
+var ErrLockConnectionString = errors.New("the migration lock needs the databases connection string to hold its advisory lock on")
+
+// Settings for the distributed migration lock.
+type LockOptions struct {
+	Mode          string        // LockWait or LockSkip.
+	Timeout       time.Duration // How long to wait for the lock in wait mode.
+	RetryInterval time.Duration // How often to retry while waiting.
+	Lease         time.Duration // How long a lock row is honoured before being treated as abandoned, only used outside of postgres.
+
+	// The database the lock is taken in, postgres holds its advisory lock on a connection of its own made with it.
+	ConnectionString string
+}
+
+// A held lock row, used for dialects without advisory locks.
+type MigrationLock struct {
+	Name       string `gorm:"primary_key"`
+	Owner      string
+	AcquiredAt time.Time
+	ExpiresAt  time.Time
+}
+
+// Reads the lock options from the environment, the connection string is left for the caller to set.
+func LockOptionsFromEnv() LockOptions {
+	return LockOptions{
+		Mode:          strings.ToLower(helpers.GetEnvString("migrationLockMode", LockWait)),
+		Timeout:       helpers.GetEnvDuration("migrationLockTimeout", 2*time.Minute),
+		RetryInterval: helpers.GetEnvDuration("migrationLockRetryInterval", time.Second),
+		Lease:         helpers.GetEnvDuration("migrationLockLease", 15*time.Minute),
+	}
+}
+
+// Runs fn while holding the named migration lock in the given database, so only one instance migrates it at a time.
+// Postgres uses a session advisory lock which is released automatically if the instance dies,
+// other dialects use a row in the migration_locks table with a lease.
+func WithLock(db *gorm.DB, name string, options LockOptions, fn func() error) error {
+
+	if options.RetryInterval <= 0 {
+		options.RetryInterval = time.Second
+	}
+
+	if db.Dialect().GetName() == "postgres" {
+		return withAdvisoryLock(db, name, options, fn)
+	}
+
+	return withLockRow(db, name, options, fn)
+}
+
+func withAdvisoryLock(db *gorm.DB, name string, options LockOptions, fn func() error) error {
+
+	if len(options.ConnectionString) == 0 {
+		return ErrLockConnectionString
+	}
+
+	ctx := context.Background()
+
+	// Advisory locks belong to a session, so hold a single connection for the whole migration.
+	// It is opened apart from db's pool, so fn still has the whole pool to run on and the pool is left as it was.
+	lockDB, err := sql.Open(db.Dialect().GetName(), options.ConnectionString)
+
+	if err != nil {
+		return err
+	}
+
+	defer lockDB.Close()
+
+	lockDB.SetMaxOpenConns(1)
+
+	conn, err := lockDB.Conn(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	key := lockKey(name)
+
+	if err := acquire(options, func() (bool, error) {
+		var acquired bool
+		err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&acquired)
+		return acquired, err
+	}); err != nil {
+		return err
+	}
+
+	defer func() {
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", key); err != nil {
+			fmt.Println("Failed to release the migration lock "+name+":", err)
+		}
+	}()
+
+	return fn()
+}
+
+func withLockRow(db *gorm.DB, name string, options LockOptions, fn func() error) error {
+
+	if err := db.AutoMigrate(&MigrationLock{}).Error; err != nil {
+		return err
+	}
+
+	owner := lockOwner()
+
+	if err := acquire(options, func() (bool, error) {
+		// Clear out locks left behind by instances that died mid migration.
+		if err := db.Where("name = ? AND expires_at < ?", name, time.Now().UTC()).Delete(&MigrationLock{}).Error; err != nil {
+			return false, err
+		}
+
+		now := time.Now().UTC()
+		lock := MigrationLock{Name: name, Owner: owner, AcquiredAt: now, ExpiresAt: now.Add(options.Lease)}
+
+		// The primary key makes the insert fail while someone else holds the lock.
+		if err := db.Create(&lock).Error; err != nil {
+			var count int
+
+			if countErr := db.Model(&MigrationLock{}).Where("name = ?", name).Count(&count).Error; countErr != nil || count == 0 {
+				return false, err
+			}
+
+			return false, nil
+		}
+
+		return true, nil
+	}); err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := db.Where("name = ? AND owner = ?", name, owner).Delete(&MigrationLock{}).Error; err != nil {
+			fmt.Println("Failed to release the migration lock "+name+":", err)
+		}
+	}()
+
+	// Keep the lease while fn runs, however long the migration takes.
+	stopRenewing := renewLockRow(db, name, owner, options.Lease)
+	defer stopRenewing()
+
+	return fn()
+}
+
+// Pushes back the lock rows expiry in the background until the returned func is called.
+func renewLockRow(db *gorm.DB, name string, owner string, lease time.Duration) func() {
+
+	if lease <= 0 {
+		return func() {}
+	}
+
+	quit := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(lease / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := db.Model(&MigrationLock{}).Where("name = ? AND owner = ?", name, owner).Update("expires_at", time.Now().UTC().Add(lease)).Error; err != nil {
+					fmt.Println("Failed to renew the migration lock "+name+":", err)
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+// Keeps trying to take the lock according to the lock mode.
+func acquire(options LockOptions, try func() (bool, error)) error {
+
+	deadline := time.Now().Add(options.Timeout)
+
+	for {
+		acquired, err := try()
+
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+
+		if acquired {
+			return nil
+		}
+
+		if options.Mode == LockSkip {
+			return ErrLockNotAcquired
+		}
+
+		if time.Now().After(deadline) {
+			return ErrLockTimeout
+		}
+
+		time.Sleep(options.RetryInterval)
+	}
+}
+
+// Advisory locks are keyed by a number, so hash the lock name into one.
+func lockKey(name string) int64 {
+	hash := fnv.New64a()
+	hash.Write([]byte("go-multitenancy:migrations:" + name))
+	return int64(hash.Sum64())
+}
+
+func lockOwner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%v:%d", host, os.Getpid())
+}
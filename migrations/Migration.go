@@ -0,0 +1,296 @@
+package migrations
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"sort"
+	"time"
+)
+
+// A single versioned schema change.
+// Changes can either be written in Go using Up and Down, or as SQL using UpSQL and DownSQL.
+type Migration struct {
+	Version uint64
+	Name    string
+	Up      func(db *gorm.DB) error
+	Down    func(db *gorm.DB) error
+	UpSQL   string
+	DownSQL string
+}
+
+// The table a registry keeps its ledger in unless it is given its own with SetLedger.
+const DefaultLedger = "schema_migrations"
+
+// A row in a registry's ledger, one per applied migration.
+type SchemaMigration struct {
+	Version   uint64 `gorm:"primary_key;auto_increment:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (SchemaMigration) TableName() string {
+	return DefaultLedger
+}
+
+// The migration state of a single database.
+type Status struct {
+	CurrentVersion uint64 `json:"currentVersion"`
+	LatestVersion  uint64 `json:"latestVersion"`
+	Pending        int    `json:"pending"`
+}
+
+// An ordered set of migrations for one kind of database, e.g. the master database or tenant databases.
+type Registry struct {
+	name       string
+	ledger     string
+	migrations []Migration
+}
+
+// Creates an empty migration registry keeping its ledger in schema_migrations.
+func NewRegistry(name string) *Registry {
+	return &Registry{name: name, ledger: DefaultLedger}
+}
+
+// Keeps the registry's ledger in its own table, so registries migrating the same database don't read each others versions.
+func (r *Registry) SetLedger(table string) {
+	r.ledger = table
+}
+
+// Returns the table the registry keeps its ledger in.
+func (r *Registry) Ledger() string {
+	return r.ledger
+}
+
+// Returns the name of the registry.
+func (r *Registry) Name() string {
+	return r.name
+}
+
+// Adds a migration to the registry, registering the same version twice is a programming error and panics.
+func (r *Registry) Register(m Migration) {
+
+	if m.Version == 0 {
+		panic(fmt.Sprintf("%v migration %q must have a version above 0", r.name, m.Name))
+	}
+
+	for _, existing := range r.migrations {
+		if existing.Version == m.Version {
+			panic(fmt.Sprintf("%v migration version %d is registered twice", r.name, m.Version))
+		}
+	}
+
+	r.migrations = append(r.migrations, m)
+
+	sort.Slice(r.migrations, func(i, j int) bool { return r.migrations[i].Version < r.migrations[j].Version })
+}
+
+// Returns every registered migration ordered by version.
+func (r *Registry) Migrations() []Migration {
+	return append([]Migration(nil), r.migrations...)
+}
+
+// Returns the version of the newest registered migration.
+func (r *Registry) LatestVersion() uint64 {
+	if len(r.migrations) == 0 {
+		return 0
+	}
+
+	return r.migrations[len(r.migrations)-1].Version
+}
+
+// Returns the migrations that haven't been applied to the database yet, oldest first.
+func (r *Registry) Pending(db *gorm.DB) ([]Migration, error) {
+
+	applied, err := r.appliedVersions(db)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []Migration
+
+	for _, m := range r.migrations {
+		if _, found := applied[m.Version]; !found {
+			pending = append(pending, m)
+		}
+	}
+
+	return pending, nil
+}
+
+// Returns the current and latest versions for the database.
+func (r *Registry) Status(db *gorm.DB) (Status, error) {
+
+	current, err := r.CurrentVersion(db)
+
+	if err != nil {
+		return Status{}, err
+	}
+
+	pending, err := r.Pending(db)
+
+	if err != nil {
+		return Status{}, err
+	}
+
+	return Status{CurrentVersion: current, LatestVersion: r.LatestVersion(), Pending: len(pending)}, nil
+}
+
+// Applies every pending migration in order, each inside of its own transaction along with its ledger entry.
+// Returns the migrations that were applied before any error.
+func (r *Registry) Migrate(db *gorm.DB) ([]Migration, error) {
+	return r.MigrateTo(db, r.LatestVersion())
+}
+
+// Applies the pending migrations up to and including version, e.g. to bring a copy of a database to the same schema as the original.
+func (r *Registry) MigrateTo(db *gorm.DB, version uint64) ([]Migration, error) {
+
+	if err := r.ensureLedger(db); err != nil {
+		return nil, err
+	}
+
+	pending, err := r.Pending(db)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+
+	for _, m := range pending {
+		if m.Version > version {
+			break
+		}
+
+		if err := db.Transaction(func(tx *gorm.DB) error {
+			if err := run(tx, m.Up, m.UpSQL); err != nil {
+				return err
+			}
+
+			return tx.Table(r.ledger).Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now().UTC()}).Error
+		}); err != nil {
+			return applied, fmt.Errorf("%v migration %d %v failed: %v", r.name, m.Version, m.Name, err)
+		}
+
+		applied = append(applied, m)
+	}
+
+	return applied, nil
+}
+
+// Reverts the last N applied migrations, newest first.
+// Returns the migrations that were reverted before any error.
+func (r *Registry) Rollback(db *gorm.DB, steps int) ([]Migration, error) {
+
+	if steps <= 0 {
+		return nil, errors.New("rollback steps must be above 0")
+	}
+
+	var ledger []SchemaMigration
+
+	if err := r.ensureLedger(db); err != nil {
+		return nil, err
+	}
+
+	if err := db.Table(r.ledger).Order("version desc").Limit(steps).Find(&ledger).Error; err != nil {
+		return nil, err
+	}
+
+	var reverted []Migration
+
+	for _, entry := range ledger {
+		m, found := r.find(entry.Version)
+
+		if !found {
+			return reverted, fmt.Errorf("%v migration %d is applied but no longer registered", r.name, entry.Version)
+		}
+
+		if m.Down == nil && len(m.DownSQL) == 0 {
+			return reverted, fmt.Errorf("%v migration %d %v can't be rolled back", r.name, m.Version, m.Name)
+		}
+
+		if err := db.Transaction(func(tx *gorm.DB) error {
+			if err := run(tx, m.Down, m.DownSQL); err != nil {
+				return err
+			}
+
+			return tx.Table(r.ledger).Where("version = ?", m.Version).Delete(&SchemaMigration{}).Error
+		}); err != nil {
+			return reverted, fmt.Errorf("%v migration %d %v failed to roll back: %v", r.name, m.Version, m.Name, err)
+		}
+
+		reverted = append(reverted, m)
+	}
+
+	return reverted, nil
+}
+
+// Returns the highest version recorded in the databases ledger, 0 when nothing has been applied.
+func (r *Registry) CurrentVersion(db *gorm.DB) (uint64, error) {
+
+	if !db.HasTable(r.ledger) {
+		return 0, nil
+	}
+
+	var latest SchemaMigration
+
+	if err := db.Table(r.ledger).Order("version desc").First(&latest).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return 0, nil
+		}
+
+		return 0, err
+	}
+
+	return latest.Version, nil
+}
+
+func (r *Registry) find(version uint64) (Migration, bool) {
+	for _, m := range r.migrations {
+		if m.Version == version {
+			return m, true
+		}
+	}
+
+	return Migration{}, false
+}
+
+// Reading the ledger never creates it, so status checks and dry runs leave the database untouched.
+func (r *Registry) appliedVersions(db *gorm.DB) (map[uint64]struct{}, error) {
+
+	if !db.HasTable(r.ledger) {
+		return map[uint64]struct{}{}, nil
+	}
+
+	var ledger []SchemaMigration
+
+	if err := db.Table(r.ledger).Find(&ledger).Error; err != nil {
+		return nil, err
+	}
+
+	applied := make(map[uint64]struct{}, len(ledger))
+
+	for _, entry := range ledger {
+		applied[entry.Version] = struct{}{}
+	}
+
+	return applied, nil
+}
+
+func (r *Registry) ensureLedger(db *gorm.DB) error {
+	return db.Table(r.ledger).AutoMigrate(&SchemaMigration{}).Error
+}
+
+func run(tx *gorm.DB, fn func(db *gorm.DB) error, sql string) error {
+
+	if fn != nil {
+		return fn(tx)
+	}
+
+	if len(sql) > 0 {
+		return tx.Exec(sql).Error
+	}
+
+	return nil
+}
@@ -0,0 +1,388 @@
+package migrations
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Rollout states.
+const (
+	RolloutRunning    = "running"
+	RolloutPaused     = "paused"
+	RolloutCompleted  = "completed"
+	RolloutSuperseded = "superseded"
+)
+
+// Tenant outcome while it is still waiting for its wave.
+const OutcomePending = "pending"
+
+// A step in a rollout. Tenants with any of the tags join the wave, then the wave is topped up
+// until Percent of the fleet has been included in this and earlier waves.
+type Wave struct {
+	Name           string   `json:"name"`
+	Tags           []string `json:"tags,omitempty"`
+	Percent        int      `json:"percent,omitempty"`
+	MaxFailureRate float64  `json:"maxFailureRate"` // The rollout pauses when more than this share of the wave fails.
+}
+
+// A tenant database that can take part in a rollout.
+type RolloutCandidate struct {
+	TenantID uint
+	Database string
+	Tags     []string
+	Order    int
+}
+
+// A wave based migration rollout, persisted in the master database so it can be resumed after a restart.
+type Rollout struct {
+	gorm.Model
+	Status        string
+	TargetVersion uint64
+	CurrentWave   int
+	Waves         string `gorm:"type:text"` // JSON encoded []Wave
+	PausedReason  string
+}
+
+// A tenants place and outcome in a rollout.
+type RolloutTenant struct {
+	gorm.Model
+	RolloutID uint `gorm:"index"`
+	TenantID  uint
+	Database  string
+	Wave      int
+	Outcome   string
+	Error     string `gorm:"type:text"`
+	Duration  time.Duration
+}
+
+// Runs rollouts against the tenant databases.
+type RolloutRunner struct {
+	DB      *gorm.DB // The master database holding rollout state.
+	Options FleetOptions
+	Target  func(tenantID uint) (FleetTarget, error) // Builds the migration for a tenant.
+	OnWave  func(wave Wave, summary FleetSummary)    // Called after every wave, optional.
+}
+
+// A rollout along with where each of its tenants is up to, grouped by wave.
+type RolloutReport struct {
+	Rollout Rollout      `json:"rollout"`
+	Waves   []WaveReport `json:"waves"`
+}
+
+// The tenants in a single wave of a rollout.
+type WaveReport struct {
+	Wave
+	Pending   int             `json:"pending"`
+	Succeeded int             `json:"succeeded"`
+	Failed    int             `json:"failed"`
+	Skipped   int             `json:"skipped"`
+	Tenants   []RolloutTenant `json:"tenants"`
+}
+
+// The waves used when none are given, the canary tenants, then 10% of the fleet, then everyone.
+func DefaultWaves() []Wave {
+	return []Wave{
+		{Name: "canary", Tags: []string{"canary"}, MaxFailureRate: 0},
+		{Name: "early", Percent: 10, MaxFailureRate: 0},
+		{Name: "everyone", Percent: 100, MaxFailureRate: 0.05},
+	}
+}
+
+// Parses waves from JSON, falling back to the default waves when empty.
+func ParseWaves(raw string) ([]Wave, error) {
+
+	if len(strings.TrimSpace(raw)) == 0 {
+		return DefaultWaves(), nil
+	}
+
+	var waves []Wave
+
+	if err := json.Unmarshal([]byte(raw), &waves); err != nil {
+		return nil, err
+	}
+
+	if len(waves) == 0 {
+		return nil, errors.New("a rollout needs at least one wave")
+	}
+
+	return waves, nil
+}
+
+// Splits the candidates into waves, tenants are taken in rollout order then id.
+// Anyone not picked up by a wave is added to the last wave so nobody is left behind.
+func AssignWaves(waves []Wave, candidates []RolloutCandidate) [][]RolloutCandidate {
+
+	ordered := append([]RolloutCandidate(nil), candidates...)
+
+	sort.SliceStable(ordered, func(i, j int) bool {
+		if ordered[i].Order != ordered[j].Order {
+			return ordered[i].Order < ordered[j].Order
+		}
+
+		return ordered[i].TenantID < ordered[j].TenantID
+	})
+
+	assigned := make([][]RolloutCandidate, len(waves))
+	taken := make(map[int]bool)
+	total := len(ordered)
+	included := 0
+
+	for w, wave := range waves {
+		for i, candidate := range ordered {
+			if !taken[i] && hasAnyTag(candidate.Tags, wave.Tags) {
+				assigned[w] = append(assigned[w], candidate)
+				taken[i] = true
+				included++
+			}
+		}
+
+		target := int(math.Ceil(float64(total) * float64(wave.Percent) / 100))
+
+		for i, candidate := range ordered {
+			if included >= target {
+				break
+			}
+
+			if !taken[i] {
+				assigned[w] = append(assigned[w], candidate)
+				taken[i] = true
+				included++
+			}
+		}
+	}
+
+	for i, candidate := range ordered {
+		if !taken[i] && len(waves) > 0 {
+			assigned[len(waves)-1] = append(assigned[len(waves)-1], candidate)
+		}
+	}
+
+	return assigned
+}
+
+// Persists a new rollout with every candidate assigned to a wave, any unfinished rollout is superseded.
+func StartRollout(db *gorm.DB, waves []Wave, candidates []RolloutCandidate, targetVersion uint64) (*Rollout, error) {
+
+	encoded, err := json.Marshal(waves)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rollout := &Rollout{Status: RolloutRunning, TargetVersion: targetVersion, Waves: string(encoded)}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&Rollout{}).Where("status IN (?)", []string{RolloutRunning, RolloutPaused}).Update("status", RolloutSuperseded).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Create(rollout).Error; err != nil {
+			return err
+		}
+
+		for w, wave := range AssignWaves(waves, candidates) {
+			for _, candidate := range wave {
+				if err := tx.Create(&RolloutTenant{RolloutID: rollout.ID, TenantID: candidate.TenantID, Database: candidate.Database, Wave: w, Outcome: OutcomePending}).Error; err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return rollout, nil
+}
+
+// Returns the newest rollout that is still running or paused.
+func ActiveRollout(db *gorm.DB) (*Rollout, bool, error) {
+
+	var rollout Rollout
+
+	if err := db.Where("status IN (?)", []string{RolloutRunning, RolloutPaused}).Order("id desc").First(&rollout).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, false, nil
+		}
+
+		return nil, false, err
+	}
+
+	return &rollout, true, nil
+}
+
+// Returns the waves of the rollout.
+func (r Rollout) WaveList() ([]Wave, error) {
+	var waves []Wave
+	err := json.Unmarshal([]byte(r.Waves), &waves)
+	return waves, err
+}
+
+// Carries on a rollout from its current wave until it completes or pauses.
+// Tenants that already succeeded or were skipped are left alone, so failed tenants are retried on resume.
+func (runner RolloutRunner) Run(rollout *Rollout) error {
+
+	waves, err := rollout.WaveList()
+
+	if err != nil {
+		return err
+	}
+
+	if err := runner.DB.Model(rollout).Updates(map[string]interface{}{"status": RolloutRunning, "paused_reason": ""}).Error; err != nil {
+		return err
+	}
+
+	for rollout.CurrentWave < len(waves) {
+		wave := waves[rollout.CurrentWave]
+
+		var members []RolloutTenant
+
+		if err := runner.DB.Where("rollout_id = ? AND wave = ?", rollout.ID, rollout.CurrentWave).Find(&members).Error; err != nil {
+			return err
+		}
+
+		var remaining []RolloutTenant
+		var targets []FleetTarget
+
+		for _, member := range members {
+			if member.Outcome == OutcomeSucceeded || member.Outcome == OutcomeSkipped {
+				continue
+			}
+
+			target, err := runner.Target(member.TenantID)
+
+			if err != nil {
+				target = FleetTarget{Name: member.Database, Migrate: func() error { return err }}
+			}
+
+			remaining = append(remaining, member)
+			targets = append(targets, target)
+		}
+
+		summary := RunFleet(targets, runner.Options)
+
+		for i, result := range summary.Results {
+			if err := runner.DB.Model(&remaining[i]).Updates(map[string]interface{}{"outcome": result.Outcome, "error": result.Error, "duration": result.Duration}).Error; err != nil {
+				return err
+			}
+		}
+
+		if runner.OnWave != nil {
+			runner.OnWave(wave, summary)
+		}
+
+		if len(members) > 0 && float64(summary.Failed)/float64(len(members)) > wave.MaxFailureRate {
+			reason := fmt.Sprintf("%d of %d tenants failed in wave %v", summary.Failed, len(members), wave.Name)
+			rollout.Status = RolloutPaused
+			rollout.PausedReason = reason
+			return runner.DB.Model(rollout).Updates(map[string]interface{}{"status": RolloutPaused, "paused_reason": reason}).Error
+		}
+
+		rollout.CurrentWave++
+
+		if err := runner.DB.Model(rollout).Update("current_wave", rollout.CurrentWave).Error; err != nil {
+			return err
+		}
+	}
+
+	rollout.Status = RolloutCompleted
+
+	return runner.DB.Model(rollout).Update("status", RolloutCompleted).Error
+}
+
+// Loads a rollout and its tenants, the newest rollout is used when id is 0.
+func LoadRolloutReport(db *gorm.DB, id uint) (RolloutReport, error) {
+
+	var rollout Rollout
+
+	query := db.Order("id desc")
+
+	if id > 0 {
+		query = db.Where("id = ?", id)
+	}
+
+	if err := query.First(&rollout).Error; err != nil {
+		return RolloutReport{}, err
+	}
+
+	waves, err := rollout.WaveList()
+
+	if err != nil {
+		return RolloutReport{}, err
+	}
+
+	var members []RolloutTenant
+
+	if err := db.Where("rollout_id = ?", rollout.ID).Order("wave, id").Find(&members).Error; err != nil {
+		return RolloutReport{}, err
+	}
+
+	report := RolloutReport{Rollout: rollout, Waves: make([]WaveReport, len(waves))}
+
+	for w, wave := range waves {
+		report.Waves[w].Wave = wave
+	}
+
+	for _, member := range members {
+		if member.Wave < 0 || member.Wave >= len(waves) {
+			continue
+		}
+
+		wave := &report.Waves[member.Wave]
+		wave.Tenants = append(wave.Tenants, member)
+
+		switch member.Outcome {
+		case OutcomeSucceeded:
+			wave.Succeeded++
+		case OutcomeFailed:
+			wave.Failed++
+		case OutcomeSkipped:
+			wave.Skipped++
+		default:
+			wave.Pending++
+		}
+	}
+
+	return report, nil
+}
+
+// Formats the report for the command line.
+func (r RolloutReport) String() string {
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Rollout %d to version %d is %v", r.Rollout.ID, r.Rollout.TargetVersion, r.Rollout.Status)
+
+	if len(r.Rollout.PausedReason) > 0 {
+		fmt.Fprintf(&b, ": %v", r.Rollout.PausedReason)
+	}
+
+	b.WriteString("\n")
+
+	for w, wave := range r.Waves {
+		fmt.Fprintf(&b, "  %d %-20v %d succeeded, %d failed, %d skipped, %d pending\n", w+1, wave.Name, wave.Succeeded, wave.Failed, wave.Skipped, wave.Pending)
+	}
+
+	return b.String()
+}
+
+func hasAnyTag(tags []string, wanted []string) bool {
+	for _, tag := range tags {
+		for _, w := range wanted {
+			if strings.EqualFold(strings.TrimSpace(tag), w) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
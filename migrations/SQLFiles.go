@@ -0,0 +1,77 @@
+package migrations
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// Matches files named like 0002_add_phone_index.up.sql or 0002_add_phone_index.down.sql
+var sqlFilePattern = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// Registers the SQL migrations found in a directory.
+// Files are named <version>_<name>.up.sql with an optional matching <version>_<name>.down.sql.
+func (r *Registry) RegisterSQLDirectory(dir string) error {
+
+	files, err := ioutil.ReadDir(dir)
+
+	if err != nil {
+		return err
+	}
+
+	found := make(map[uint64]*Migration)
+
+	for _, file := range files {
+		match := sqlFilePattern.FindStringSubmatch(file.Name())
+
+		if file.IsDir() || match == nil {
+			continue
+		}
+
+		version, err := strconv.ParseUint(match[1], 10, 64)
+
+		if err != nil {
+			return fmt.Errorf("migration file %v has an invalid version: %v", file.Name(), err)
+		}
+
+		contents, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+
+		if err != nil {
+			return err
+		}
+
+		m, exists := found[version]
+
+		if !exists {
+			m = &Migration{Version: version, Name: match[2]}
+			found[version] = m
+		}
+
+		if match[3] == "up" {
+			m.UpSQL = string(contents)
+		} else {
+			m.DownSQL = string(contents)
+		}
+	}
+
+	var versions []uint64
+
+	for version, m := range found {
+		if len(m.UpSQL) == 0 {
+			return fmt.Errorf("migration %d %v in %v has no up file", version, m.Name, dir)
+		}
+
+		versions = append(versions, version)
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+
+	for _, version := range versions {
+		r.Register(*found[version])
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package params
+
+import "github.com/LiamDotPro/Go-Multitenancy/migrations"
+
+type MigrationPreviewParams struct {
+	Master bool   `form:"master" json:"master"`
+	Tenant string `form:"tenant" json:"tenant"`
+}
+
+type StartRolloutParams struct {
+	Waves []migrations.Wave `json:"waves"` // Uses tenantRolloutWaves when empty.
+}
+
+type RolloutStatusParams struct {
+	Id uint `form:"id" json:"id"` // The newest rollout when empty.
+}
+
+type ChangeTenantStateParams struct {
+	SubDomainIdentifier string `form:"subDomainIdentifier" json:"subDomainIdentifier" binding:"required"`
+	State               string `form:"state" json:"state" binding:"required"` // active, suspended, read_only or archived
+	Reason              string `form:"reason" json:"reason"`                  // Suspending with payment returns 402 rather than 403.
+}
+
+type ProvisioningStatusParams struct {
+	JobId uint `form:"jobId" json:"jobId" binding:"required"`
+}
+
+type UpdateTenantRolloutParams struct {
+	SubDomainIdentifier string `form:"subDomainIdentifier" json:"subDomainIdentifier" binding:"required"`
+	Tags                string `form:"tags" json:"tags"` // Comma separated, e.g. canary,internal
+	Order               int    `form:"order" json:"order"`
+}
+
+type SchemaDriftParams struct {
+	Tenant string `form:"tenant" json:"tenant"` // Every tenant when empty.
+}
+
+type AddTenantDomainParams struct {
+	SubDomainIdentifier string `form:"subDomainIdentifier" json:"subDomainIdentifier" binding:"required"`
+	Hostname            string `form:"hostname" json:"hostname" binding:"required"`
+}
+
+type TenantDomainParams struct {
+	Hostname string `form:"hostname" json:"hostname" binding:"required"`
+}
+
+type TenantIdentifierParams struct {
+	SubDomainIdentifier string `form:"subDomainIdentifier" json:"subDomainIdentifier" binding:"required"`
+}
+
+type RenameTenantParams struct {
+	SubDomainIdentifier    string `form:"subDomainIdentifier" json:"subDomainIdentifier" binding:"required"`
+	NewSubDomainIdentifier string `form:"newSubDomainIdentifier" json:"newSubDomainIdentifier" binding:"required"`
+}
+
+type AddTenantAliasParams struct {
+	SubDomainIdentifier string `form:"subDomainIdentifier" json:"subDomainIdentifier" binding:"required"`
+	Alias               string `form:"alias" json:"alias" binding:"required"`
+}
+
+type TenantAliasParams struct {
+	Alias string `form:"alias" json:"alias" binding:"required"`
+}
+
+type ScheduleTenantDeletionParams struct {
+	SubDomainIdentifier string `form:"subDomainIdentifier" json:"subDomainIdentifier" binding:"required"`
+	Reason              string `form:"reason" json:"reason"`
+}
+
+type RotateTenantCredentialsParams struct {
+	SubDomainIdentifier string `form:"subDomainIdentifier" json:"subDomainIdentifier" binding:"required"`
+	Force               bool   `form:"force" json:"force"` // Rotate even if the credentials were rotated within tenantCredentialMinAge.
+}
+
+type AddDatabaseServerParams struct {
+	Name                  string `form:"name" json:"name" binding:"required"`
+	Host                  string `form:"host" json:"host" binding:"required"`
+	Port                  int    `form:"port" json:"port"`       // Defaults to 5432.
+	SSLMode               string `form:"sslMode" json:"sslMode"` // Defaults to disable.
+	Region                string `form:"region" json:"region"`
+	Capacity              int    `form:"capacity" json:"capacity"`                           // The most tenants the server takes, 0 is unlimited.
+	Weight                int    `form:"weight" json:"weight"`                               // Defaults to 1.
+	AdminConnectionString string `form:"adminConnectionString" json:"adminConnectionString"` // Empty when the master connection can manage the server.
+}
+
+type UpdateDatabaseServerParams struct {
+	Name     string  `form:"name" json:"name" binding:"required"`
+	Region   *string `form:"region" json:"region"` // Fields left out are left alone.
+	Capacity *int    `form:"capacity" json:"capacity"`
+	Weight   *int    `form:"weight" json:"weight"`
+	Draining *bool   `form:"draining" json:"draining"` // Draining servers keep their tenants but aren't given new ones.
+}
+
+type RelocateTenantParams struct {
+	SubDomainIdentifier string `form:"subDomainIdentifier" json:"subDomainIdentifier" binding:"required"`
+	DatabaseServer      string `form:"databaseServer" json:"databaseServer" binding:"required"` // The name of the server to move the tenant to.
+}
+
+type AddReadReplicaParams struct {
+	Name                string `form:"name" json:"name" binding:"required"`
+	Host                string `form:"host" json:"host" binding:"required"`
+	Port                int    `form:"port" json:"port"`                               // Defaults to 5432.
+	SubDomainIdentifier string `form:"subDomainIdentifier" json:"subDomainIdentifier"` // The tenant the replica copies, or
+	DatabaseServer      string `form:"databaseServer" json:"databaseServer"`           // the server whose databases it copies.
+}
+
+type ReadReplicaParams struct {
+	Name string `form:"name" json:"name" binding:"required"`
+}
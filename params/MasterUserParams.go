@@ -2,4 +2,8 @@ package params
 
 type CreateNewTenantParams struct {
 	SubDomainIdentifier string `form:"subDomainIdentifier" json:"subDomainIdentifier" binding:"required"`
+	Isolation           string `form:"isolation" json:"isolation"`           // database, schema or shared, defaults to the deployment setting.
+	Placement           string `form:"placement" json:"placement"`           // least-loaded, round-robin or pinned, defaults to the deployment setting.
+	Region              string `form:"region" json:"region"`                 // Only place the tenant on servers in this region.
+	DatabaseServer      string `form:"databaseServer" json:"databaseServer"` // Pins the tenant to the named server.
 }
@@ -0,0 +1,474 @@
+package tenants
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"github.com/LiamDotPro/Go-Multitenancy/helpers"
+	"github.com/jinzhu/gorm"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A pool is never evicted to make room for another tenant unless it has been unused for at least this long,
+// this stops us closing a handle that a request picked up a moment ago. Evicted pools stay open this long for the same reason.
+const evictionGracePeriod = 30 * time.Second
+
+// How long a replica that couldn't be reached is passed over before it is tried again, its reads go to the primary meanwhile.
+const replicaRetryPeriod = 30 * time.Second
+
+// Settings applied to every tenant pool held by the connection manager.
+type ConnectionManagerOptions struct {
+	MaxOpenConnections    int           // Max open connections per tenant pool, 0 is unlimited.
+	MaxIdleConnections    int           // Max idle connections kept per tenant pool.
+	ConnectionMaxLifetime time.Duration // Max time a single connection is reused, 0 is forever.
+	IdleTimeout           time.Duration // Tenant pools unused for this long are closed.
+	MaxTenants            int           // Soft cap on the number of tenant pools kept open, 0 is unlimited.
+	GracePeriod           time.Duration // Overrides evictionGracePeriod, 0 keeps it.
+
+	// Opens a tenants pool, on the replica when one is given. Nil connects with the tenants connection string.
+	Open func(t TenantConnectionInformation, replica *ReadReplica) (*gorm.DB, error)
+}
+
+// Per tenant pool statistics, tenants using shared tables are reported as a single pool.
+type PoolStats struct {
+	TenantId           uint          `json:"tenantId"`
+	Identifier         string        `json:"identifier"`
+	Isolation          string        `json:"isolation"`
+	Replica            string        `json:"replica,omitempty"` // The read replica the pool reads from, empty for the primary.
+	LastUsed           time.Time     `json:"lastUsed"`
+	MaxOpenConnections int           `json:"maxOpenConnections"`
+	OpenConnections    int           `json:"openConnections"`
+	InUse              int           `json:"inUse"`
+	Idle               int           `json:"idle"`
+	WaitCount          int64         `json:"waitCount"`
+	WaitDuration       time.Duration `json:"waitDuration"`
+}
+
+// Keeps one pooled connection per tenant, closing pools that fall out of use.
+type ConnectionManager struct {
+	options ConnectionManagerOptions
+	mutex   sync.Mutex
+	pools   map[string]*list.Element
+	order   *list.List // Most recently used pool sits at the front.
+	quit    chan struct{}
+	closed  bool
+
+	replicas     []ReadReplica
+	replicasDown map[uint]time.Time // When each unreachable replica can be tried again.
+	replicaTurn  int
+}
+
+type pooledConnection struct {
+	key              string
+	tenantId         uint
+	identifier       string
+	isolation        string
+	connectionString string
+	replica          *ReadReplica
+	db               *gorm.DB
+	lastUsed         time.Time
+}
+
+// Reads the connection manager options from the environment.
+func ConnectionManagerOptionsFromEnv() ConnectionManagerOptions {
+	return ConnectionManagerOptions{
+		MaxOpenConnections:    helpers.GetEnvInt("tenantMaxOpenConnections", 10),
+		MaxIdleConnections:    helpers.GetEnvInt("tenantMaxIdleConnections", 2),
+		ConnectionMaxLifetime: helpers.GetEnvDuration("tenantConnectionMaxLifetime", 30*time.Minute),
+		IdleTimeout:           helpers.GetEnvDuration("tenantIdleTimeout", 10*time.Minute),
+		MaxTenants:            helpers.GetEnvInt("tenantMaxPools", 100),
+	}
+}
+
+// Creates a new connection manager and starts the idle pool janitor.
+func NewConnectionManager(options ConnectionManagerOptions) *ConnectionManager {
+	m := &ConnectionManager{
+		options: options,
+		pools:   make(map[string]*list.Element),
+		order:   list.New(),
+		quit:    make(chan struct{}),
+
+		replicasDown: make(map[uint]time.Time),
+	}
+
+	if options.IdleTimeout > 0 {
+		go m.evictIdlePeriodically(options.IdleTimeout / 2)
+	}
+
+	return m
+}
+
+// Returns the pooled connection for a tenant, opening a new pool if one isn't held yet.
+// If the tenants connection string has changed since the pool was opened the old pool is replaced.
+// Tenants using shared tables all share one pool, use ScopeConnection before handing it to queries.
+func (m *ConnectionManager) GetConnection(t TenantConnectionInformation) (*gorm.DB, error) {
+
+	return m.getPool(poolKey(t), t, nil, func() (*gorm.DB, error) {
+		db, err := m.open(t, nil)
+
+		if err == nil && t.Isolation() == IsolationShared {
+			RegisterRowScoping(db)
+		}
+
+		return db, err
+	})
+}
+
+// Returns a pooled connection to one of the tenants read replicas, taking turns when it has more than one.
+// The primary connection is returned when the tenant has no replicas or none of them can be reached, so reads always have somewhere to go.
+func (m *ConnectionManager) GetReadConnection(t TenantConnectionInformation) (*gorm.DB, error) {
+
+	if replica, found := m.nextReplica(t); found {
+		db, err := m.getPool(replicaPoolKey(t, replica), t, &replica, func() (*gorm.DB, error) {
+			return m.open(t, &replica)
+		})
+
+		if err == nil {
+			return db, nil
+		}
+
+		fmt.Printf("Reading from the primary, read replica %v could not be reached: %v\n", replica.Name, err)
+
+		m.mutex.Lock()
+		m.replicasDown[replica.ID] = time.Now().Add(replicaRetryPeriod)
+		m.mutex.Unlock()
+	}
+
+	return m.GetConnection(t)
+}
+
+// Replaces the read replicas tenants can read from, pools on replicas that have been removed are retired.
+func (m *ConnectionManager) SetReadReplicas(replicas []ReadReplica) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	current := map[uint]ReadReplica{}
+
+	for _, replica := range replicas {
+		current[replica.ID] = replica
+	}
+
+	for _, element := range m.pools {
+		pool := element.Value.(*pooledConnection)
+
+		if pool.replica == nil {
+			continue
+		}
+
+		if replica, found := current[pool.replica.ID]; !found || replica.Host != pool.replica.Host || replica.Port != pool.replica.Port {
+			m.retire(element)
+		}
+	}
+
+	m.replicas = replicas
+}
+
+// Picks the tenants replica whose turn it is, passing over replicas that couldn't be reached recently.
+func (m *ConnectionManager) nextReplica(t TenantConnectionInformation) (ReadReplica, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var available []ReadReplica
+
+	for _, replica := range ReplicasFor(t, m.replicas) {
+		if time.Now().After(m.replicasDown[replica.ID]) {
+			available = append(available, replica)
+		}
+	}
+
+	if len(available) == 0 {
+		return ReadReplica{}, false
+	}
+
+	m.replicaTurn++
+
+	return available[m.replicaTurn%len(available)], true
+}
+
+// Returns the pool held under key, opening it with open if one isn't held yet.
+func (m *ConnectionManager) getPool(key string, t TenantConnectionInformation, replica *ReadReplica, open func() (*gorm.DB, error)) (*gorm.DB, error) {
+
+	if db, found, err := m.lookup(key, t.ConnectionString); found || err != nil {
+		return db, err
+	}
+
+	// Open outside of the lock so one slow tenant doesn't hold up every other request.
+	db, err := open()
+
+	if err != nil {
+		return nil, err
+	}
+
+	m.configure(db)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.closed {
+		db.Close()
+		return nil, errors.New("the tenant connection manager has been closed")
+	}
+
+	// Another request may have opened the same pool while we were connecting.
+	if element, found := m.pools[key]; found {
+		existing := element.Value.(*pooledConnection)
+
+		if existing.connectionString == t.ConnectionString || key == IsolationShared {
+			db.Close()
+			existing.lastUsed = time.Now()
+			m.order.MoveToFront(element)
+			return existing.db, nil
+		}
+
+		m.retire(element)
+	}
+
+	pool := &pooledConnection{
+		key:              key,
+		tenantId:         t.ID,
+		identifier:       t.TenantSubDomainIdentifier,
+		isolation:        t.Isolation(),
+		connectionString: t.ConnectionString,
+		replica:          replica,
+		db:               db,
+		lastUsed:         time.Now(),
+	}
+
+	if pool.isolation == IsolationShared {
+		pool.tenantId = 0
+		pool.identifier = IsolationShared
+	}
+
+	m.pools[key] = m.order.PushFront(pool)
+
+	m.evictOverCapacity()
+
+	return db, nil
+}
+
+// Forgets the pools held for a tenant, its primary and any replicas, the next request will open fresh ones.
+// The old pools are retired rather than closed, so requests that already hold them can finish.
+// The shared pool is left alone as other tenants are still using it.
+func (m *ConnectionManager) Evict(tenantId uint) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, element := range m.pools {
+		if pool := element.Value.(*pooledConnection); pool.tenantId == tenantId && pool.key != IsolationShared {
+			m.retire(element)
+		}
+	}
+}
+
+// Returns statistics for every pool currently held, most recently used first.
+func (m *ConnectionManager) Stats() []PoolStats {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var stats []PoolStats
+
+	for element := m.order.Front(); element != nil; element = element.Next() {
+		pool := element.Value.(*pooledConnection)
+		dbStats := pool.db.DB().Stats()
+
+		stats = append(stats, PoolStats{
+			TenantId:           pool.tenantId,
+			Identifier:         pool.identifier,
+			Isolation:          pool.isolation,
+			Replica:            pool.replicaName(),
+			LastUsed:           pool.lastUsed,
+			MaxOpenConnections: dbStats.MaxOpenConnections,
+			OpenConnections:    dbStats.OpenConnections,
+			InUse:              dbStats.InUse,
+			Idle:               dbStats.Idle,
+			WaitCount:          dbStats.WaitCount,
+			WaitDuration:       dbStats.WaitDuration,
+		})
+	}
+
+	return stats
+}
+
+// Closes every pool and stops the janitor, used at shutdown.
+func (m *ConnectionManager) Close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.closed {
+		return nil
+	}
+
+	m.closed = true
+	close(m.quit)
+
+	var failed []string
+
+	for _, element := range m.pools {
+		if err := m.remove(element); err != nil {
+			failed = append(failed, element.Value.(*pooledConnection).identifier)
+		}
+	}
+
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("failed to close connections for tenants %v", failed)
+	}
+
+	return nil
+}
+
+func (m *ConnectionManager) lookup(key string, connectionString string) (*gorm.DB, bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.closed {
+		return nil, false, errors.New("the tenant connection manager has been closed")
+	}
+
+	element, found := m.pools[key]
+
+	if !found {
+		return nil, false, nil
+	}
+
+	pool := element.Value.(*pooledConnection)
+
+	// Every shared table tenant has its own encrypted copy of the shared connection string, they all still use the one pool.
+	if pool.connectionString != connectionString && key != IsolationShared {
+		return nil, false, nil
+	}
+
+	pool.lastUsed = time.Now()
+	m.order.MoveToFront(element)
+
+	return pool.db, true, nil
+}
+
+// Tenants using shared tables are pooled together, everyone else gets their own pool.
+func poolKey(t TenantConnectionInformation) string {
+	if t.Isolation() == IsolationShared {
+		return IsolationShared
+	}
+
+	return strconv.FormatUint(uint64(t.ID), 10)
+}
+
+// Replica pools are kept per tenant and replica.
+func replicaPoolKey(t TenantConnectionInformation, replica ReadReplica) string {
+	return fmt.Sprintf("%d:replica:%d", t.ID, replica.ID)
+}
+
+func (p *pooledConnection) replicaName() string {
+	if p.replica == nil {
+		return ""
+	}
+
+	return p.replica.Name
+}
+
+func (m *ConnectionManager) open(t TenantConnectionInformation, replica *ReadReplica) (*gorm.DB, error) {
+	if m.options.Open != nil {
+		return m.options.Open(t, replica)
+	}
+
+	if replica != nil {
+		return t.GetReplicaConnection(*replica)
+	}
+
+	return t.GetConnection()
+}
+
+func (m *ConnectionManager) gracePeriod() time.Duration {
+	if m.options.GracePeriod > 0 {
+		return m.options.GracePeriod
+	}
+
+	return evictionGracePeriod
+}
+
+func (m *ConnectionManager) configure(db *gorm.DB) {
+	sqlDB := db.DB()
+	sqlDB.SetMaxOpenConns(m.options.MaxOpenConnections)
+	sqlDB.SetMaxIdleConns(m.options.MaxIdleConnections)
+	sqlDB.SetConnMaxLifetime(m.options.ConnectionMaxLifetime)
+}
+
+// Closes a pool straight away, only used at shutdown once requests have finished.
+// Must be called while holding the lock.
+func (m *ConnectionManager) remove(element *list.Element) error {
+	pool := element.Value.(*pooledConnection)
+
+	m.order.Remove(element)
+	delete(m.pools, pool.key)
+
+	return pool.db.Close()
+}
+
+// Forgets a pool, closing it once the requests that picked it up have had time to finish.
+// Must be called while holding the lock.
+func (m *ConnectionManager) retire(element *list.Element) {
+	pool := element.Value.(*pooledConnection)
+
+	m.order.Remove(element)
+	delete(m.pools, pool.key)
+
+	time.AfterFunc(m.gracePeriod(), func() {
+		if err := pool.db.Close(); err != nil {
+			fmt.Println("Failed to close a retired tenant connection:", err)
+		}
+	})
+}
+
+// Drops least recently used pools while we hold more than the configured amount.
+// Must be called while holding the lock.
+func (m *ConnectionManager) evictOverCapacity() {
+	if m.options.MaxTenants <= 0 {
+		return
+	}
+
+	for m.order.Len() > m.options.MaxTenants {
+		oldest := m.order.Back()
+
+		if time.Since(oldest.Value.(*pooledConnection).lastUsed) < m.gracePeriod() {
+			return
+		}
+
+		m.retire(oldest)
+	}
+}
+
+func (m *ConnectionManager) evictIdle() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for element := m.order.Back(); element != nil; {
+		previous := element.Prev()
+
+		if time.Since(element.Value.(*pooledConnection).lastUsed) < m.options.IdleTimeout {
+			break
+		}
+
+		m.retire(element)
+
+		element = previous
+	}
+
+	m.evictOverCapacity()
+}
+
+func (m *ConnectionManager) evictIdlePeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.evictIdle()
+		case <-m.quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package tenants
+
+import (
+	"errors"
+	"fmt"
+	"github.com/LiamDotPro/Go-Multitenancy/helpers"
+	"github.com/jinzhu/gorm"
+	"strings"
+)
+
+// Placement policies, deciding which database server a new database isolated tenant goes on.
+const (
+	PlacementLeastLoaded = "least-loaded" // The server with the fewest tenants for its weight.
+	PlacementRoundRobin  = "round-robin"  // Servers take turns, servers with a higher weight take more turns.
+	PlacementPinned      = "pinned"       // The named server, as long as it has room.
+)
+
+// Returned when a tenant is placed with a policy we don't know.
+var ErrUnknownPlacementPolicy = errors.New("placement policy must be one of least-loaded, round-robin or pinned")
+
+// Returned when a pinned tenant names a server that hasn't been registered.
+var ErrUnknownDatabaseServer = errors.New("the database server could not be found")
+
+// Returned when pinning a tenant without naming a server and tenantPlacementServer isn't set.
+var ErrNoServerPinned = errors.New("pinned placement needs a database server")
+
+// Returned when a pinned tenants server is full or draining.
+var ErrServerUnavailable = errors.New("the database server is full or draining")
+
+// Returned when every server that could take the tenant is full or draining.
+var ErrNoServerAvailable = errors.New("no database server has room for another tenant")
+
+// Returned when registering a server without a name or host, or with a negative capacity or weight.
+var ErrInvalidDatabaseServer = errors.New("a database server needs a name and a host, and can't have a negative capacity or weight")
+
+// Returned when registering a server under a name that is taken.
+var ErrDatabaseServerExists = errors.New("a database server with that name already exists")
+
+// A postgres server database isolated tenants can be placed on.
+type DatabaseServer struct {
+	gorm.Model
+	Name                  string `gorm:"unique_index"`
+	Host                  string
+	Port                  int
+	SSLMode               string // Defaults to disable.
+	Region                string
+	Capacity              int    // The most tenants placed on the server, 0 is unlimited.
+	Weight                int    // The servers share of new tenants relative to the others, counted as 1 when unset.
+	Draining              bool   // Draining servers keep their tenants but aren't given new ones.
+	Placements            int    // How many tenants have ever been placed on the server, used to take turns.
+	AdminConnectionString string // Used to create databases and roles, encrypted like tenant connection strings. Empty when the master connection can.
+}
+
+// Where a new tenant should go, the policy picks among the servers in Region or takes the pinned server.
+type TenantPlacement struct {
+	Policy   string
+	Region   string
+	ServerId uint // The server pinned tenants go on.
+}
+
+// Returns the deployment wide placement policy used when a tenant doesn't ask for one.
+func DefaultPlacementPolicy() string {
+	return strings.ToLower(helpers.GetEnvString("tenantPlacementPolicy", PlacementLeastLoaded))
+}
+
+// Checks the placement policy is one we know how to place with.
+func ValidPlacementPolicy(policy string) bool {
+	switch policy {
+	case PlacementLeastLoaded, PlacementRoundRobin, PlacementPinned:
+		return true
+	}
+	return false
+}
+
+// Returns the connection string of a database on the server, without credentials.
+func (s DatabaseServer) ConnectionString(database string) string {
+
+	sslMode := s.SSLMode
+
+	if len(sslMode) == 0 {
+		sslMode = "disable"
+	}
+
+	return fmt.Sprintf("host=%v port=%d dbname=%v sslmode=%v", s.Host, s.Port, database, sslMode)
+}
+
+// Checks if the master connection manages the server, rather than a connection of its own.
+func (s DatabaseServer) ManagedByMaster() bool {
+	return len(s.AdminConnectionString) == 0
+}
+
+// Opens a connection to the server as its admin user, callers close it once done.
+func (s DatabaseServer) AdminConnection() (*gorm.DB, error) {
+
+	if s.ManagedByMaster() {
+		return nil, fmt.Errorf("database server %v has no admin connection of its own", s.Name)
+	}
+
+	connectionString, err := DecryptConnectionString(s.AdminConnectionString)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return gorm.Open("postgres", connectionString)
+}
+
+// Checks if the server can take another tenant on top of the ones it has.
+func (s DatabaseServer) HasRoom(tenants int) bool {
+	return !s.Draining && (s.Capacity <= 0 || tenants < s.Capacity)
+}
+
+func (s DatabaseServer) weight() int {
+	if s.Weight < 1 {
+		return 1
+	}
+
+	return s.Weight
+}
+
+// Validates a new server and stores it, encrypting its admin connection string.
+func RegisterDatabaseServer(db *gorm.DB, server *DatabaseServer) error {
+
+	server.Name = strings.TrimSpace(server.Name)
+
+	if len(server.Name) == 0 || len(strings.TrimSpace(server.Host)) == 0 || server.Capacity < 0 || server.Weight < 0 {
+		return ErrInvalidDatabaseServer
+	}
+
+	if server.Port == 0 {
+		server.Port = 5432
+	}
+
+	if server.Weight == 0 {
+		server.Weight = 1
+	}
+
+	if err := db.Where("name = ?", server.Name).First(&DatabaseServer{}).Error; err == nil {
+		return ErrDatabaseServerExists
+	} else if !gorm.IsRecordNotFoundError(err) {
+		return err
+	}
+
+	// Servers added later join the round robin where the others are, rather than taking every tenant until they catch up.
+	servers, err := DatabaseServers(db)
+
+	if err != nil {
+		return err
+	}
+
+	for i, existing := range servers {
+		if turns := existing.Placements / existing.weight(); i == 0 || turns*server.Weight < server.Placements {
+			server.Placements = turns * server.Weight
+		}
+	}
+
+	encrypted, err := EncryptConnectionString(server.AdminConnectionString)
+
+	if err != nil {
+		return err
+	}
+
+	server.AdminConnectionString = encrypted
+
+	return db.Create(server).Error
+}
+
+// Returns every registered server, oldest first.
+func DatabaseServers(db *gorm.DB) ([]DatabaseServer, error) {
+
+	var servers []DatabaseServer
+
+	err := db.Order("id").Find(&servers).Error
+
+	return servers, err
+}
+
+// Finds a server by name.
+func FindDatabaseServer(db *gorm.DB, name string) (DatabaseServer, error) {
+
+	var server DatabaseServer
+
+	err := db.Where("name = ?", name).First(&server).Error
+
+	if gorm.IsRecordNotFoundError(err) {
+		return server, ErrUnknownDatabaseServer
+	}
+
+	return server, err
+}
+
+// Returns how many tenants each server has by server id, counting tenants still being provisioned or relocated onto it.
+// Soft deleted tenants still own their database so are counted until they are purged.
+func ServerLoads(db *gorm.DB) (map[uint]int, error) {
+
+	var rows []struct {
+		DatabaseServerId uint
+		Tenants          int
+	}
+
+	err := db.Raw(`SELECT database_server_id, count(*) AS tenants FROM (
+		SELECT database_server_id FROM tenant_connection_informations WHERE database_server_id > 0
+		UNION ALL
+		SELECT database_server_id FROM provisioning_jobs WHERE database_server_id > 0 AND coalesce(tenant_connection_information_id, 0) = 0 AND status NOT IN (?)
+		UNION ALL
+		SELECT target_server_id FROM tenant_relocations WHERE status IN (?)
+	) placed GROUP BY database_server_id`, []string{ProvisioningReady, ProvisioningFailed}, []string{RelocationRunning, RelocationFailed}).Scan(&rows).Error
+
+	loads := map[uint]int{}
+
+	for _, row := range rows {
+		loads[row.DatabaseServerId] = row.Tenants
+	}
+
+	return loads, err
+}
+
+// Picks the server for a new tenant from the servers and their loads.
+// Servers outside the placements region, draining or at capacity are passed over, pinned tenants only go on their server.
+func ChooseServer(servers []DatabaseServer, loads map[uint]int, placement TenantPlacement) (DatabaseServer, error) {
+
+	if !ValidPlacementPolicy(placement.Policy) {
+		return DatabaseServer{}, ErrUnknownPlacementPolicy
+	}
+
+	if placement.Policy == PlacementPinned {
+		for _, server := range servers {
+			if server.ID != placement.ServerId {
+				continue
+			}
+
+			if !server.HasRoom(loads[server.ID]) {
+				return server, ErrServerUnavailable
+			}
+
+			return server, nil
+		}
+
+		return DatabaseServer{}, ErrUnknownDatabaseServer
+	}
+
+	var chosen *DatabaseServer
+
+	for i := range servers {
+		server := &servers[i]
+
+		if len(placement.Region) > 0 && !strings.EqualFold(server.Region, placement.Region) {
+			continue
+		}
+
+		if !server.HasRoom(loads[server.ID]) {
+			continue
+		}
+
+		// Compared as fractions of the weight, ties go to the older server.
+		if chosen == nil || placementScore(*server, loads, placement.Policy)*chosen.weight() < placementScore(*chosen, loads, placement.Policy)*server.weight() {
+			chosen = server
+		}
+	}
+
+	if chosen == nil {
+		return DatabaseServer{}, ErrNoServerAvailable
+	}
+
+	return *chosen, nil
+}
+
+// Least loaded counts the tenants on the server, round robin counts the tenants ever placed on it.
+func placementScore(server DatabaseServer, loads map[uint]int, policy string) int {
+	if policy == PlacementRoundRobin {
+		return server.Placements
+	}
+
+	return loads[server.ID]
+}
+
+// Chooses the server for a provisioning job and records it on the job.
+// The servers are locked while choosing, so jobs placed at the same time see each others tenants.
+func PlaceTenant(db *gorm.DB, job *ProvisioningJob) (server DatabaseServer, err error) {
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var servers []DatabaseServer
+
+		if err := tx.Set("gorm:query_option", "FOR UPDATE").Order("id").Find(&servers).Error; err != nil {
+			return err
+		}
+
+		loads, err := ServerLoads(tx)
+
+		if err != nil {
+			return err
+		}
+
+		server, err = ChooseServer(servers, loads, job.Placement())
+
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Model(&server).UpdateColumn("placements", gorm.Expr("placements + 1")).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(job).Update("database_server_id", server.ID).Error
+	})
+
+	if err == nil {
+		job.DatabaseServerId = server.ID
+	}
+
+	return server, err
+}
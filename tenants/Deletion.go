@@ -0,0 +1,290 @@
+package tenants
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"strings"
+	"time"
+)
+
+// Deletion states.
+const (
+	DeletionScheduled = "scheduled" // Waiting for the grace period to end.
+	DeletionCancelled = "cancelled"
+	DeletionPurging   = "purging"
+	DeletionFailed    = "failed" // A purge step failed, it is retried on the next run.
+	DeletionCompleted = "completed"
+)
+
+// Returned when cancelling a deletion that has already started purging or doesn't exist.
+var ErrDeletionNotCancellable = errors.New("the tenant has no deletion that can still be cancelled")
+
+// A scheduled hard deletion of a tenant. What is needed to finish the purge is copied here, so it can carry on after the tenant record is gone.
+type TenantDeletion struct {
+	gorm.Model
+	TenantConnectionInformationId uint   `gorm:"index"`
+	SubDomainIdentifier           string `gorm:"index"`
+	Identifiers                   string // The identifier and aliases, comma separated, used to purge sessions.
+	IsolationMode                 string
+	DatabaseName                  string
+	SchemaName                    string
+	RoleName                      string
+	DatabaseServerId              uint
+	PreviousState                 string // Restored if the deletion is cancelled.
+	Reason                        string
+	RequestedBy                   uint
+	PurgeAfter                    time.Time `gorm:"index"`
+	Status                        string    `gorm:"index"`
+	CompletedSteps                string    // Comma separated purge steps already done, so a retried purge skips them.
+	Error                         string
+	CompletedAt                   *time.Time
+}
+
+// Proof a tenant was purged, kept after everything else about the tenant is gone.
+type DeletionCertificate struct {
+	gorm.Model
+	TenantDeletionId              uint `gorm:"unique_index"`
+	TenantConnectionInformationId uint
+	SubDomainIdentifier           string
+	IsolationMode                 string
+	DatabaseName                  string
+	SchemaName                    string
+	Steps                         string // The purge steps that ran, comma separated.
+	RequestedBy                   uint
+	RequestedAt                   time.Time
+	PurgedAt                      time.Time
+	Digest                        string // SHA-256 of the fields above, so later changes to the certificate show.
+}
+
+// Checks if a purge step has already been done.
+func (d TenantDeletion) StepDone(step string) bool {
+
+	for _, done := range strings.Split(d.CompletedSteps, ",") {
+		if done == step {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the identifiers the tenant was known by.
+func (d TenantDeletion) IdentifierList() []string {
+
+	var identifiers []string
+
+	for _, identifier := range strings.Split(d.Identifiers, ",") {
+		if len(identifier) > 0 {
+			identifiers = append(identifiers, identifier)
+		}
+	}
+
+	return identifiers
+}
+
+// Returns the deletion of a tenant that hasn't been cancelled or completed.
+func OpenTenantDeletion(db *gorm.DB, tenantId uint) (TenantDeletion, bool, error) {
+
+	var deletion TenantDeletion
+
+	err := db.Where("tenant_connection_information_id = ? AND status IN (?)", tenantId, []string{DeletionScheduled, DeletionPurging, DeletionFailed}).Order("id DESC").First(&deletion).Error
+
+	if gorm.IsRecordNotFoundError(err) {
+		return deletion, false, nil
+	}
+
+	return deletion, err == nil, err
+}
+
+// Moves the tenant to pending deletion and schedules the purge for after the grace period.
+// Scheduling a tenant that is already pending deletion returns its existing deletion.
+func ScheduleTenantDeletion(db *gorm.DB, tenant *TenantConnectionInformation, grace time.Duration, reason string, requestedBy uint) (deletion TenantDeletion, err error) {
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		existing, found, err := OpenTenantDeletion(tx, tenant.ID)
+
+		if err != nil || found {
+			deletion = existing
+			return err
+		}
+
+		deletion = TenantDeletion{
+			TenantConnectionInformationId: tenant.ID,
+			SubDomainIdentifier:           tenant.TenantSubDomainIdentifier,
+			IsolationMode:                 tenant.Isolation(),
+			DatabaseName:                  tenant.DatabaseName,
+			SchemaName:                    tenant.SchemaName,
+			RoleName:                      tenant.RoleName,
+			DatabaseServerId:              tenant.DatabaseServerId,
+			PreviousState:                 tenant.State(),
+			Reason:                        reason,
+			RequestedBy:                   requestedBy,
+			PurgeAfter:                    time.Now().Add(grace),
+			Status:                        DeletionScheduled,
+		}
+
+		if _, err := transitionTenant(tx, tenant, StatePendingDeletion, reason, requestedBy); err != nil {
+			return err
+		}
+
+		return tx.Create(&deletion).Error
+	})
+
+	return deletion, err
+}
+
+// Cancels a deletion still in its grace period, putting the tenant back in the state it was in before.
+func CancelTenantDeletion(db *gorm.DB, tenant *TenantConnectionInformation, cancelledBy uint) (deletion TenantDeletion, err error) {
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&TenantDeletion{}).Where("tenant_connection_information_id = ? AND status = ?", tenant.ID, DeletionScheduled).Update("status", DeletionCancelled)
+
+		if result.Error != nil {
+			return result.Error
+		}
+
+		if result.RowsAffected == 0 {
+			return ErrDeletionNotCancellable
+		}
+
+		if err := tx.Where("tenant_connection_information_id = ? AND status = ?", tenant.ID, DeletionCancelled).Order("id DESC").First(&deletion).Error; err != nil {
+			return err
+		}
+
+		_, err := transitionTenant(tx, tenant, deletion.PreviousState, "deletion cancelled", cancelledBy)
+
+		return err
+	})
+
+	return deletion, err
+}
+
+// Returns the deletions whose grace period is over, along with failed and interrupted purges to retry.
+func DueTenantDeletions(db *gorm.DB) ([]TenantDeletion, error) {
+
+	var deletions []TenantDeletion
+
+	err := db.Where("status IN (?) AND purge_after <= ?", []string{DeletionScheduled, DeletionPurging, DeletionFailed}, time.Now()).Order("purge_after").Find(&deletions).Error
+
+	return deletions, err
+}
+
+// Marks a due deletion as purging, false when it was cancelled or finished in the meantime.
+func ClaimTenantDeletion(db *gorm.DB, deletion *TenantDeletion) (bool, error) {
+
+	result := db.Model(&TenantDeletion{}).Where("id = ? AND status IN (?)", deletion.ID, []string{DeletionScheduled, DeletionPurging, DeletionFailed}).Update("status", DeletionPurging)
+
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false, result.Error
+	}
+
+	deletion.Status = DeletionPurging
+
+	return true, nil
+}
+
+// Sets the status of a deletion and its error.
+func SetDeletionStatus(db *gorm.DB, deletion *TenantDeletion, status string, deletionErr error) error {
+
+	updates := map[string]interface{}{"status": status, "error": ""}
+
+	if deletionErr != nil {
+		updates["error"] = deletionErr.Error()
+	}
+
+	if err := db.Model(deletion).Updates(updates).Error; err != nil {
+		return err
+	}
+
+	deletion.Status = status
+	deletion.Error, _ = updates["error"].(string)
+
+	return nil
+}
+
+// Records the tenants identifiers and storage on the deletion while its records still exist.
+func SnapshotTenantDeletion(db *gorm.DB, deletion *TenantDeletion, tenant TenantConnectionInformation, identifiers []string) error {
+
+	deletion.Identifiers = strings.Join(identifiers, ",")
+	deletion.IsolationMode = tenant.Isolation()
+	deletion.DatabaseName = tenant.DatabaseName
+	deletion.SchemaName = tenant.SchemaName
+	deletion.RoleName = tenant.RoleName
+	deletion.DatabaseServerId = tenant.DatabaseServerId
+
+	return db.Model(deletion).Updates(map[string]interface{}{
+		"identifiers":        deletion.Identifiers,
+		"isolation_mode":     deletion.IsolationMode,
+		"database_name":      deletion.DatabaseName,
+		"schema_name":        deletion.SchemaName,
+		"role_name":          deletion.RoleName,
+		"database_server_id": deletion.DatabaseServerId,
+	}).Error
+}
+
+// Records a purge step as done.
+func CompleteDeletionStep(db *gorm.DB, deletion *TenantDeletion, step string) error {
+
+	if deletion.StepDone(step) {
+		return nil
+	}
+
+	completed := strings.Trim(deletion.CompletedSteps+","+step, ",")
+
+	if err := db.Model(deletion).Update("completed_steps", completed).Error; err != nil {
+		return err
+	}
+
+	deletion.CompletedSteps = completed
+
+	return nil
+}
+
+// Completes the deletion and issues its certificate, both or neither.
+func CompleteTenantDeletion(db *gorm.DB, deletion *TenantDeletion) (certificate DeletionCertificate, err error) {
+
+	now := time.Now()
+
+	certificate = DeletionCertificate{
+		TenantDeletionId:              deletion.ID,
+		TenantConnectionInformationId: deletion.TenantConnectionInformationId,
+		SubDomainIdentifier:           deletion.SubDomainIdentifier,
+		IsolationMode:                 deletion.IsolationMode,
+		DatabaseName:                  deletion.DatabaseName,
+		SchemaName:                    deletion.SchemaName,
+		Steps:                         deletion.CompletedSteps,
+		RequestedBy:                   deletion.RequestedBy,
+		RequestedAt:                   deletion.CreatedAt,
+		PurgedAt:                      now,
+	}
+
+	certificate.Digest = certificate.ComputeDigest()
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&certificate).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(deletion).Updates(map[string]interface{}{"status": DeletionCompleted, "error": "", "completed_at": &now}).Error
+	})
+
+	if err == nil {
+		deletion.Status = DeletionCompleted
+		deletion.CompletedAt = &now
+	}
+
+	return certificate, err
+}
+
+// Hashes the certificate fields, matching Digest when the certificate hasn't been changed. Times are to the second as the database may not keep more.
+func (c DeletionCertificate) ComputeDigest() string {
+
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d|%d|%v|%v|%v|%v|%v|%d|%v|%v",
+		c.TenantDeletionId, c.TenantConnectionInformationId, c.SubDomainIdentifier, c.IsolationMode, c.DatabaseName, c.SchemaName,
+		c.Steps, c.RequestedBy, c.RequestedAt.UTC().Format(time.RFC3339), c.PurgedAt.UTC().Format(time.RFC3339))))
+
+	return hex.EncodeToString(sum[:])
+}
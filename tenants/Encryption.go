@@ -0,0 +1,314 @@
+package tenants
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/LiamDotPro/Go-Multitenancy/helpers"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Encrypted connection strings start with this, anything else is a plaintext one stored before encryption was turned on.
+const encryptedPrefix = "enc:v1:"
+
+// Returned when decrypting a connection string without a key provider configured.
+var ErrNoKeyProvider = errors.New("the connection string is encrypted but no master key has been configured")
+
+// Wraps and unwraps the data keys connection strings are encrypted with.
+// Master keys never leave the provider, so it can be backed by a KMS instead of local keys.
+type KeyProvider interface {
+	CurrentKeyId() string                                   // The master key new data keys are wrapped with.
+	WrapKey(keyId string, dataKey []byte) ([]byte, error)   // Encrypts a data key with the master key.
+	UnwrapKey(keyId string, wrapped []byte) ([]byte, error) // Decrypts a data key wrapped with the master key.
+}
+
+// A key provider holding its master keys in memory, read from a keyfile or the environment.
+// Old keys are kept alongside the current one so values wrapped with them can still be read until they are re-encrypted.
+type LocalKeyProvider struct {
+	keys    map[string][]byte
+	current string
+}
+
+var keyProvider KeyProvider
+var keyProviderMutex sync.RWMutex
+
+// Sets the key provider connection strings are encrypted and decrypted with, nil leaves new connection strings in plaintext.
+func SetKeyProvider(provider KeyProvider) {
+	keyProviderMutex.Lock()
+	defer keyProviderMutex.Unlock()
+
+	keyProvider = provider
+}
+
+func currentKeyProvider() KeyProvider {
+	keyProviderMutex.RLock()
+	defer keyProviderMutex.RUnlock()
+
+	return keyProvider
+}
+
+// Creates a provider from 32 byte AES-256 keys by id, new data keys are wrapped with the current key.
+func NewLocalKeyProvider(keys map[string][]byte, current string) (*LocalKeyProvider, error) {
+
+	for id, key := range keys {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("master key %v must be 32 bytes but is %d", id, len(key))
+		}
+
+		if len(id) == 0 || strings.ContainsAny(id, ":,= \n") {
+			return nil, fmt.Errorf("master key id %q can't be empty or contain separators", id)
+		}
+	}
+
+	if _, found := keys[current]; !found {
+		return nil, fmt.Errorf("the current master key %v has not been configured", current)
+	}
+
+	return &LocalKeyProvider{keys: keys, current: current}, nil
+}
+
+// Reads the master keys from the keyfile named by connectionStringKeyFile, one id=base64 key per line,
+// or from connectionStringKeys, comma separated id=base64 keys. The current key is connectionStringKeyId, or the last key listed.
+// Returns nil when neither is set.
+func KeyProviderFromEnv() (KeyProvider, error) {
+
+	listed := helpers.GetEnvString("connectionStringKeys", "")
+	separator := ","
+
+	if path := os.Getenv("connectionStringKeyFile"); len(path) > 0 {
+		contents, err := ioutil.ReadFile(path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		listed, separator = string(contents), "\n"
+	}
+
+	if len(strings.TrimSpace(listed)) == 0 {
+		return nil, nil
+	}
+
+	keys := map[string][]byte{}
+	var last string
+
+	for _, line := range strings.Split(listed, separator) {
+		if line = strings.TrimSpace(line); len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("master keys must be written as id=base64 key")
+		}
+
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1]))
+
+		if err != nil {
+			return nil, fmt.Errorf("master key %v is not valid base64", parts[0])
+		}
+
+		last = strings.TrimSpace(parts[0])
+		keys[last] = key
+	}
+
+	return NewLocalKeyProvider(keys, helpers.GetEnvString("connectionStringKeyId", last))
+}
+
+func (p *LocalKeyProvider) CurrentKeyId() string {
+	return p.current
+}
+
+func (p *LocalKeyProvider) WrapKey(keyId string, dataKey []byte) ([]byte, error) {
+
+	key, found := p.keys[keyId]
+
+	if !found {
+		return nil, fmt.Errorf("master key %v has not been configured", keyId)
+	}
+
+	return seal(key, dataKey, []byte(keyId))
+}
+
+func (p *LocalKeyProvider) UnwrapKey(keyId string, wrapped []byte) ([]byte, error) {
+
+	key, found := p.keys[keyId]
+
+	if !found {
+		return nil, fmt.Errorf("master key %v has not been configured", keyId)
+	}
+
+	return open(key, wrapped, []byte(keyId))
+}
+
+// Checks if a key provider has been configured.
+func EncryptionEnabled() bool {
+	return currentKeyProvider() != nil
+}
+
+// Decrypts a stored connection string and encrypts it again with the current master key.
+// Returns false when it is already encrypted with the current key.
+func ReencryptConnectionString(connectionString string) (string, bool, error) {
+
+	provider := currentKeyProvider()
+
+	if provider == nil {
+		return connectionString, false, ErrNoKeyProvider
+	}
+
+	if EncryptionKeyId(connectionString) == provider.CurrentKeyId() {
+		return connectionString, false, nil
+	}
+
+	plaintext, err := DecryptConnectionString(connectionString)
+
+	if err != nil {
+		return connectionString, false, err
+	}
+
+	encrypted, err := EncryptConnectionString(plaintext)
+
+	return encrypted, err == nil, err
+}
+
+// Checks if a stored connection string has been encrypted.
+func IsEncrypted(connectionString string) bool {
+	return strings.HasPrefix(connectionString, encryptedPrefix)
+}
+
+// Returns the id of the master key an encrypted connection string's data key is wrapped with.
+func EncryptionKeyId(connectionString string) string {
+
+	if !IsEncrypted(connectionString) {
+		return ""
+	}
+
+	return strings.SplitN(strings.TrimPrefix(connectionString, encryptedPrefix), ":", 2)[0]
+}
+
+// Encrypts a connection string with a new data key wrapped by the current master key, ready to be stored.
+// Without a key provider the connection string is returned as it is.
+func EncryptConnectionString(connectionString string) (string, error) {
+
+	provider := currentKeyProvider()
+
+	if provider == nil || IsEncrypted(connectionString) {
+		return connectionString, nil
+	}
+
+	dataKey := make([]byte, 32)
+
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+
+	keyId := provider.CurrentKeyId()
+
+	wrapped, err := provider.WrapKey(keyId, dataKey)
+
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := seal(dataKey, []byte(connectionString), []byte(keyId))
+
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedPrefix + keyId + ":" + base64.RawURLEncoding.EncodeToString(wrapped) + ":" + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypts a stored connection string, plaintext ones are returned as they are.
+func DecryptConnectionString(connectionString string) (string, error) {
+
+	if !IsEncrypted(connectionString) {
+		return connectionString, nil
+	}
+
+	provider := currentKeyProvider()
+
+	if provider == nil {
+		return "", ErrNoKeyProvider
+	}
+
+	parts := strings.Split(strings.TrimPrefix(connectionString, encryptedPrefix), ":")
+
+	if len(parts) != 3 {
+		return "", errors.New("the encrypted connection string is malformed")
+	}
+
+	wrapped, err := base64.RawURLEncoding.DecodeString(parts[1])
+
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(parts[2])
+
+	if err != nil {
+		return "", err
+	}
+
+	dataKey, err := provider.UnwrapKey(parts[0], wrapped)
+
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := open(dataKey, sealed, []byte(parts[0]))
+
+	return string(plaintext), err
+}
+
+// Encrypts with AES-256-GCM, the nonce is put in front of the ciphertext.
+func seal(key []byte, plaintext []byte, additional []byte) ([]byte, error) {
+
+	gcm, err := newGCM(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+// Decrypts what seal made.
+func open(key []byte, sealed []byte, additional []byte) ([]byte, error) {
+
+	gcm, err := newGCM(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("the ciphertext is too short")
+	}
+
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], additional)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
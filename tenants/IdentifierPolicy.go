@@ -0,0 +1,179 @@
+package tenants
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/LiamDotPro/Go-Multitenancy/helpers"
+	"github.com/jinzhu/gorm"
+	"strings"
+)
+
+// Codes for the ways an identifier can break the policy.
+const (
+	IdentifierTooShort     = "too_short"
+	IdentifierTooLong      = "too_long"
+	IdentifierCharacters   = "invalid_characters"
+	IdentifierStart        = "invalid_start"
+	IdentifierEnd          = "invalid_end"
+	IdentifierDoubleHyphen = "double_hyphen"
+	IdentifierReserved     = "reserved"
+	IdentifierTaken        = "in_use"
+)
+
+// Postgres truncates names longer than this.
+const maxPhysicalNameLength = 63
+
+// Prefix for the databases and schemas made for tenants, keeps them apart from postgres, master and anything else on the server.
+const physicalNamePrefix = "tenant_"
+
+// The rules a tenant identifier has to follow. Identifiers are used as DNS labels, so they are lower case letters, digits and hyphens.
+type IdentifierPolicy struct {
+	MinLength int
+	MaxLength int
+	Reserved  []string
+}
+
+// One broken rule.
+type IdentifierViolation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Returned when an identifier breaks the policy, listing every rule it broke.
+type IdentifierError struct {
+	Identifier string                `json:"identifier"`
+	Violations []IdentifierViolation `json:"violations"`
+}
+
+func (e *IdentifierError) Error() string {
+
+	var messages []string
+
+	for _, violation := range e.Violations {
+		messages = append(messages, violation.Message)
+	}
+
+	return fmt.Sprintf("identifier %q is not allowed: %v", e.Identifier, strings.Join(messages, ", "))
+}
+
+func (e *IdentifierError) add(code string, message string) {
+	e.Violations = append(e.Violations, IdentifierViolation{Code: code, Message: message})
+}
+
+// Reads the policy from tenantIdentifierMinLength, tenantIdentifierMaxLength and tenantReservedIdentifiers.
+func IdentifierPolicyFromEnv() IdentifierPolicy {
+
+	var reserved []string
+
+	for _, word := range strings.Split(helpers.GetEnvString("tenantReservedIdentifiers", "www,api,admin,master"), ",") {
+		if word = strings.ToLower(strings.TrimSpace(word)); len(word) > 0 {
+			reserved = append(reserved, word)
+		}
+	}
+
+	return IdentifierPolicy{
+		MinLength: helpers.GetEnvInt("tenantIdentifierMinLength", 3),
+		MaxLength: helpers.GetEnvInt("tenantIdentifierMaxLength", 63),
+		Reserved:  reserved,
+	}
+}
+
+// Returns the form identifiers are stored and compared in.
+func NormalizeIdentifier(identifier string) string {
+	return strings.ToLower(strings.TrimSpace(identifier))
+}
+
+// Checks the normalized identifier against the policy, returning an *IdentifierError listing every broken rule.
+func (p IdentifierPolicy) Validate(identifier string) error {
+
+	identifier = NormalizeIdentifier(identifier)
+	problems := &IdentifierError{Identifier: identifier}
+
+	if len(identifier) < p.MinLength {
+		problems.add(IdentifierTooShort, fmt.Sprintf("must be at least %d characters", p.MinLength))
+	}
+
+	// DNS labels can't be longer than 63 characters whatever the policy says.
+	max := p.MaxLength
+
+	if max <= 0 || max > 63 {
+		max = 63
+	}
+
+	if len(identifier) > max {
+		problems.add(IdentifierTooLong, fmt.Sprintf("must be at most %d characters", max))
+	}
+
+	for _, r := range identifier {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			problems.add(IdentifierCharacters, "may only contain letters, digits and hyphens")
+			break
+		}
+	}
+
+	if len(identifier) > 0 && (identifier[0] < 'a' || identifier[0] > 'z') {
+		problems.add(IdentifierStart, "must start with a letter")
+	}
+
+	if strings.HasSuffix(identifier, "-") {
+		problems.add(IdentifierEnd, "must not end with a hyphen")
+	}
+
+	// Also keeps punycode prefixes like xn-- out.
+	if strings.Contains(identifier, "--") {
+		problems.add(IdentifierDoubleHyphen, "must not contain consecutive hyphens")
+	}
+
+	for _, word := range p.Reserved {
+		if identifier == word {
+			problems.add(IdentifierReserved, "is reserved")
+			break
+		}
+	}
+
+	if len(problems.Violations) > 0 {
+		return problems
+	}
+
+	return nil
+}
+
+// Validates the identifier and checks no other tenant or alias is using it.
+func (p IdentifierPolicy) ValidateAvailable(db *gorm.DB, identifier string, exceptTenantId uint) error {
+
+	if err := p.Validate(identifier); err != nil {
+		return err
+	}
+
+	inUse, err := IdentifierInUse(db, NormalizeIdentifier(identifier), exceptTenantId)
+
+	if err != nil {
+		return err
+	}
+
+	if inUse {
+		problems := &IdentifierError{Identifier: NormalizeIdentifier(identifier)}
+		problems.add(IdentifierTaken, "is already used by another tenant")
+		return problems
+	}
+
+	return nil
+}
+
+// Maps a valid identifier onto the name of its database or schema, e.g. acme-corp becomes tenant_acme_corp.
+// Identifiers can't contain underscores, so swapping hyphens for them keeps names unique.
+// Names that would be too long for postgres are shortened and given a hash of the identifier.
+func PhysicalName(identifier string) string {
+
+	name := physicalNamePrefix + strings.Replace(NormalizeIdentifier(identifier), "-", "_", -1)
+
+	if len(name) <= maxPhysicalNameLength {
+		return name
+	}
+
+	sum := sha1.Sum([]byte(NormalizeIdentifier(identifier)))
+	suffix := "_" + hex.EncodeToString(sum[:])[:8]
+
+	return name[:maxPhysicalNameLength-len(suffix)] + suffix
+}
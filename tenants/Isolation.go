@@ -0,0 +1,97 @@
+package tenants
+
+import (
+	"github.com/LiamDotPro/Go-Multitenancy/helpers"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Tenant isolation strategies.
+const (
+	IsolationDatabase = "database" // Each tenant has its own database, created with CREATE DATABASE.
+	IsolationSchema   = "schema"   // Each tenant has its own schema inside the shared tenant database.
+	IsolationShared   = "shared"   // Tenants share one set of tables in the shared tenant database, rows are keyed by tenant_id.
+)
+
+// Returns the deployment wide isolation mode used when a tenant doesn't ask for one.
+func DefaultIsolationMode() string {
+	return strings.ToLower(helpers.GetEnvString("tenantIsolation", IsolationDatabase))
+}
+
+// Checks the isolation mode is one we know how to provision.
+func ValidIsolationMode(mode string) bool {
+	switch mode {
+	case IsolationDatabase, IsolationSchema, IsolationShared:
+		return true
+	}
+	return false
+}
+
+// Returns the connection string of the database shared between schema isolated and shared table tenants.
+// Falls back to the master database when a dedicated one hasn't been configured.
+func SharedConnectionString() string {
+	return helpers.GetEnvString("sharedTenantConnectionString", os.Getenv("connectionString"))
+}
+
+// Scopes a postgres connection string to a schema by setting the search_path run-time parameter.
+// Both the key=value and URL connection string formats are supported.
+func ConnectionStringWithSearchPath(connectionString string, schema string) string {
+
+	if strings.HasPrefix(connectionString, "postgres://") || strings.HasPrefix(connectionString, "postgresql://") {
+		if parsed, err := url.Parse(connectionString); err == nil {
+			query := parsed.Query()
+			query.Set("search_path", schema)
+			parsed.RawQuery = query.Encode()
+			return parsed.String()
+		}
+	}
+
+	return strings.TrimSpace(connectionString) + " search_path=" + schema
+}
+
+// Points a postgres connection string at another database on the same server, keeping its host and credentials.
+// Both the key=value and URL connection string formats are supported.
+func ConnectionStringWithDatabase(connectionString string, database string) string {
+
+	if strings.HasPrefix(connectionString, "postgres://") || strings.HasPrefix(connectionString, "postgresql://") {
+		if parsed, err := url.Parse(connectionString); err == nil {
+			parsed.Path = "/" + database
+			return parsed.String()
+		}
+	}
+
+	var settings []string
+
+	for _, setting := range strings.Fields(connectionString) {
+		if !strings.HasPrefix(setting, "dbname=") {
+			settings = append(settings, setting)
+		}
+	}
+
+	return strings.Join(append(settings, "dbname="+database), " ")
+}
+
+// Points a postgres connection string at another host, keeping its database and credentials.
+// Both the key=value and URL connection string formats are supported.
+func ConnectionStringWithHost(connectionString string, host string, port int) string {
+
+	if strings.HasPrefix(connectionString, "postgres://") || strings.HasPrefix(connectionString, "postgresql://") {
+		if parsed, err := url.Parse(connectionString); err == nil {
+			parsed.Host = net.JoinHostPort(host, strconv.Itoa(port))
+			return parsed.String()
+		}
+	}
+
+	var settings []string
+
+	for _, setting := range strings.Fields(connectionString) {
+		if !strings.HasPrefix(setting, "host=") && !strings.HasPrefix(setting, "hostaddr=") && !strings.HasPrefix(setting, "port=") {
+			settings = append(settings, setting)
+		}
+	}
+
+	return strings.Join(append(settings, "host="+host, "port="+strconv.Itoa(port)), " ")
+}
@@ -0,0 +1,141 @@
+package tenants
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+)
+
+// Lifecycle states of a tenant.
+const (
+	StateActive    = "active"
+	StateSuspended = "suspended" // Every request is refused, e.g. for an unpaid bill.
+	StateReadOnly  = "read_only" // Requests that would change anything are refused.
+	StateArchived  = "archived"  // The tenant is gone from the outside but its data is kept.
+	StateDeleted   = "deleted"   // The tenant no longer exists as far as requests are concerned.
+
+	StatePendingDeletion = "pending_deletion" // Deletion has been scheduled, it can be cancelled until the grace period is over.
+)
+
+// Suspension reason that asks for payment rather than simply refusing requests.
+const SuspensionPayment = "payment"
+
+// Returned when a tenant is moved to a state that can't be reached from its current one.
+type InvalidTransitionError struct {
+	From string
+	To   string
+}
+
+func (e InvalidTransitionError) Error() string {
+	return fmt.Sprintf("a tenant can't go from %v to %v", e.From, e.To)
+}
+
+// Returned when the tenant changed state while the transition was being made.
+var ErrStateChanged = errors.New("the tenant changed state at the same time, please try again")
+
+// The states each state can move to. Tenants are only deleted after a grace period pending deletion, deleted is final.
+var stateTransitions = map[string][]string{
+	StateActive:          {StateSuspended, StateReadOnly, StateArchived, StatePendingDeletion},
+	StateSuspended:       {StateActive, StateReadOnly, StateArchived, StatePendingDeletion},
+	StateReadOnly:        {StateActive, StateSuspended, StateArchived, StatePendingDeletion},
+	StateArchived:        {StateActive, StatePendingDeletion},
+	StatePendingDeletion: {StateActive, StateSuspended, StateReadOnly, StateArchived, StateDeleted},
+	StateDeleted:         {},
+}
+
+// A record of a tenant changing state, kept for auditing.
+type TenantStateTransition struct {
+	gorm.Model
+	TenantConnectionInformationId uint `gorm:"index"`
+	FromState                     string
+	ToState                       string
+	Reason                        string
+	ChangedBy                     uint // The master user that made the change, 0 for the system.
+}
+
+// Returns the tenants lifecycle state, tenants made before states existed are active.
+func (t TenantConnectionInformation) State() string {
+	if len(t.LifecycleState) == 0 {
+		return StateActive
+	}
+
+	return t.LifecycleState
+}
+
+// Checks the state is one we know.
+func ValidState(state string) bool {
+	_, found := stateTransitions[state]
+	return found
+}
+
+// Checks a tenant can move between the two states.
+func CanTransition(from string, to string) bool {
+
+	for _, state := range stateTransitions[from] {
+		if state == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Moves a tenant to another state and records who did it and why.
+func TransitionTenant(db *gorm.DB, tenant *TenantConnectionInformation, to string, reason string, changedBy uint) (transition TenantStateTransition, err error) {
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		transition, err = transitionTenant(tx, tenant, to, reason, changedBy)
+		return err
+	})
+
+	return transition, err
+}
+
+// Makes a transition inside of an open transaction.
+func transitionTenant(tx *gorm.DB, tenant *TenantConnectionInformation, to string, reason string, changedBy uint) (TenantStateTransition, error) {
+
+	from := tenant.State()
+	transition := TenantStateTransition{TenantConnectionInformationId: tenant.ID, FromState: from, ToState: to, Reason: reason, ChangedBy: changedBy}
+
+	if !CanTransition(from, to) {
+		return transition, InvalidTransitionError{From: from, To: to}
+	}
+
+	// Only move from the state we checked, two changes at once would otherwise skip the transition rules.
+	current := tx.Model(&TenantConnectionInformation{}).Where("id = ?", tenant.ID)
+
+	if from == StateActive {
+		current = current.Where("coalesce(lifecycle_state, '') IN ('', ?)", StateActive)
+	} else {
+		current = current.Where("lifecycle_state = ?", from)
+	}
+
+	result := current.Updates(map[string]interface{}{"lifecycle_state": to, "state_reason": reason})
+
+	if result.Error != nil {
+		return transition, result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return transition, ErrStateChanged
+	}
+
+	if err := tx.Create(&transition).Error; err != nil {
+		return transition, err
+	}
+
+	tenant.LifecycleState = to
+	tenant.StateReason = reason
+
+	return transition, nil
+}
+
+// Returns the state changes of a tenant, oldest first.
+func TenantStateHistory(db *gorm.DB, tenantId uint) ([]TenantStateTransition, error) {
+
+	var transitions []TenantStateTransition
+
+	err := db.Where("tenant_connection_information_id = ?", tenantId).Order("id").Find(&transitions).Error
+
+	return transitions, err
+}
@@ -0,0 +1,253 @@
+package tenants
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/LiamDotPro/Go-Multitenancy/helpers"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The postgres channel tenant routing changes are announced on.
+const LookupInvalidationChannel = "tenant_lookup"
+
+// Settings for the tenant lookup cache.
+type LookupCacheOptions struct {
+	TTL         time.Duration // How long a found tenant is cached.
+	NegativeTTL time.Duration // How long an unknown identifier is remembered as unknown.
+	MaxEntries  int
+}
+
+// Reads the cache options from tenantLookupCacheTTL, tenantLookupNegativeTTL and tenantLookupCacheSize.
+func LookupCacheOptionsFromEnv() LookupCacheOptions {
+	return LookupCacheOptions{
+		TTL:         helpers.GetEnvDuration("tenantLookupCacheTTL", time.Minute),
+		NegativeTTL: helpers.GetEnvDuration("tenantLookupNegativeTTL", 10*time.Second),
+		MaxEntries:  helpers.GetEnvInt("tenantLookupCacheSize", 10000),
+	}
+}
+
+// A cached lookup, Found is false for identifiers that don't belong to any tenant.
+type LookupEntry struct {
+	Tenant  TenantConnectionInformation
+	Aliased bool
+	Found   bool
+	expires time.Time
+}
+
+// An in process cache of identifier and hostname to tenant record, kept in step across instances with LISTEN/NOTIFY.
+type LookupCache struct {
+	options LookupCacheOptions
+	mutex   sync.RWMutex
+	entries map[string]LookupEntry
+
+	listener *pq.Listener
+	quit     chan struct{}
+}
+
+// The message sent when a tenants routing changes, listing the cache keys it affects.
+type lookupInvalidation struct {
+	TenantId uint     `json:"tenantId"`
+	Keys     []string `json:"keys"`
+}
+
+// Creates an empty lookup cache.
+func NewLookupCache(options LookupCacheOptions) *LookupCache {
+	return &LookupCache{options: options, entries: make(map[string]LookupEntry)}
+}
+
+// The cache key for a tenant identifier or alias.
+func IdentifierCacheKey(identifier string) string {
+	return "identifier:" + strings.ToLower(identifier)
+}
+
+// The cache key for a custom domain.
+func DomainCacheKey(hostname string) string {
+	return "domain:" + NormalizeHost(hostname)
+}
+
+// Returns the cached lookup for the key if it hasn't expired.
+func (c *LookupCache) Get(key string) (LookupEntry, bool) {
+
+	if c == nil {
+		return LookupEntry{}, false
+	}
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	entry, found := c.entries[key]
+
+	if !found || time.Now().After(entry.expires) {
+		return LookupEntry{}, false
+	}
+
+	return entry, true
+}
+
+// Caches a lookup, unknown identifiers are kept for the shorter negative ttl.
+func (c *LookupCache) Put(key string, entry LookupEntry) {
+
+	if c == nil {
+		return
+	}
+
+	ttl := c.options.TTL
+
+	if !entry.Found {
+		ttl = c.options.NegativeTTL
+	}
+
+	if ttl <= 0 {
+		return
+	}
+
+	entry.expires = time.Now().Add(ttl)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.options.MaxEntries > 0 && len(c.entries) >= c.options.MaxEntries {
+		c.makeRoom()
+	}
+
+	c.entries[key] = entry
+}
+
+// Drops the keys along with every entry for the tenant, in this instance only.
+func (c *LookupCache) Invalidate(tenantId uint, keys ...string) {
+
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, key := range keys {
+		delete(c.entries, key)
+	}
+
+	if tenantId == 0 {
+		return
+	}
+
+	for key, entry := range c.entries {
+		if entry.Found && entry.Tenant.ID == tenantId {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Empties the cache.
+func (c *LookupCache) Flush() {
+
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries = make(map[string]LookupEntry)
+}
+
+// Drops expired entries, then arbitrary ones if the cache is still full. Called with the lock held.
+func (c *LookupCache) makeRoom() {
+
+	now := time.Now()
+
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+
+	for key := range c.entries {
+		if len(c.entries) < c.options.MaxEntries {
+			return
+		}
+
+		delete(c.entries, key)
+	}
+}
+
+// Invalidates the tenants entries here and tells every other instance to do the same.
+func (c *LookupCache) Publish(db *gorm.DB, tenantId uint, keys ...string) error {
+
+	c.Invalidate(tenantId, keys...)
+
+	if db.Dialect().GetName() != "postgres" {
+		return nil
+	}
+
+	payload, err := json.Marshal(lookupInvalidation{TenantId: tenantId, Keys: keys})
+
+	if err != nil {
+		return err
+	}
+
+	return db.Exec("SELECT pg_notify(?, ?)", LookupInvalidationChannel, string(payload)).Error
+}
+
+// Listens for routing changes made by other instances until Close is called.
+// Notifications can be missed while the listener reconnects, so the whole cache is flushed when it does.
+func (c *LookupCache) Listen(connectionString string) error {
+
+	listener := pq.NewListener(connectionString, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			fmt.Println("Tenant lookup cache listener:", err)
+		}
+	})
+
+	if err := listener.Listen(LookupInvalidationChannel); err != nil {
+		listener.Close()
+		return err
+	}
+
+	c.listener = listener
+	c.quit = make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-c.quit:
+				return
+			case notification := <-listener.Notify:
+				if notification == nil {
+					c.Flush()
+					continue
+				}
+
+				var invalidation lookupInvalidation
+
+				if err := json.Unmarshal([]byte(notification.Extra), &invalidation); err != nil {
+					c.Flush()
+					continue
+				}
+
+				c.Invalidate(invalidation.TenantId, invalidation.Keys...)
+			case <-time.After(90 * time.Second):
+				// Make sure the connection is still alive, Ping reconnects it if not.
+				go listener.Ping()
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stops listening for changes.
+func (c *LookupCache) Close() error {
+
+	if c == nil || c.listener == nil {
+		return nil
+	}
+
+	close(c.quit)
+
+	return c.listener.Close()
+}
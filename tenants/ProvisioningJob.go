@@ -0,0 +1,345 @@
+package tenants
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"strings"
+	"time"
+)
+
+// Provisioning job states, a job moves through them in order until it is ready or has failed.
+const (
+	ProvisioningQueued           = "queued"
+	ProvisioningCreatingDatabase = "creating_db"
+	ProvisioningMigrating        = "migrating"
+	ProvisioningSeeding          = "seeding"
+	ProvisioningRollingBack      = "rolling_back" // A step failed and the finished steps are being undone.
+	ProvisioningReady            = "ready"
+	ProvisioningFailed           = "failed"
+)
+
+// Returned when a job for the identifier is still being worked on.
+var ErrProvisioningInProgress = errors.New("a tenant with that identifier is already being provisioned")
+
+// Name of the index keeping a single unfinished job per identifier, see AddProvisioningIdentifierIndex.
+const ProvisioningIdentifierIndex = "uix_provisioning_jobs_unfinished_identifier"
+
+// A request to create a tenant, worked through in the background so slow migrations don't hold up the request.
+type ProvisioningJob struct {
+	gorm.Model
+	SubDomainIdentifier           string `gorm:"index"`
+	Isolation                     string
+	Status                        string `gorm:"index"`
+	Error                         string // The error of the step that failed the job.
+	TenantConnectionInformationId uint   // Set once the tenant record has been made.
+	DatabaseName                  string // The database or schema the job made, kept so it can be dropped if the job fails.
+	SchemaName                    string
+	RoleName                      string // The group role the job made, its logins are named after it.
+	PlacementPolicy               string // How the database server is chosen, only database isolated tenants are placed.
+	PlacementRegion               string
+	PinnedServerId                uint
+	DatabaseServerId              uint       // The server the tenant was placed on.
+	LeaseExpiresAt                *time.Time // Pushed back while an instance is working on the job, once it passes the job is stuck.
+	FinishedAt                    *time.Time
+	Steps                         []ProvisioningStep
+}
+
+// One step of a provisioning job, e.g. migrations, with when it ran and what went wrong.
+// Steps that finished are undone when a later step fails, CompensatedAt records when.
+// Steps marked UndoIfFailed are undone even when they failed or were cut off themselves.
+type ProvisioningStep struct {
+	gorm.Model
+	ProvisioningJobId uint `gorm:"index"`
+	Name              string
+	Status            string // The job status while the step ran.
+	StartedAt         time.Time
+	FinishedAt        *time.Time
+	Error             string
+	CompensatedAt     *time.Time
+	CompensationError string
+	UndoIfFailed      bool // Set for steps whose undo is safe after they failed part way, e.g. seeding, which deletes by tenant.
+}
+
+// Checks if the step may have made something that hasn't been undone since,
+// either it finished without an error or it is undone however it ended.
+func (s ProvisioningStep) NeedsCompensation() bool {
+
+	if s.CompensatedAt != nil {
+		return false
+	}
+
+	return s.UndoIfFailed || (s.FinishedAt != nil && len(s.Error) == 0)
+}
+
+// Checks if the job has stopped, either ready or failed.
+func (j ProvisioningJob) Finished() bool {
+	return j.Status == ProvisioningReady || j.Status == ProvisioningFailed
+}
+
+// Checks if a running job has stopped being worked on, either its lease ran out,
+// or it was started before leases and hasn't been updated since staleBefore.
+func (j ProvisioningJob) Stale(now time.Time, staleBefore time.Time) bool {
+
+	if j.Status == ProvisioningQueued || j.Finished() {
+		return false
+	}
+
+	if j.LeaseExpiresAt != nil {
+		return j.LeaseExpiresAt.Before(now)
+	}
+
+	return j.UpdatedAt.Before(staleBefore)
+}
+
+// Returns where the job asked for its tenant to be placed.
+func (j ProvisioningJob) Placement() TenantPlacement {
+	return TenantPlacement{Policy: j.PlacementPolicy, Region: j.PlacementRegion, ServerId: j.PinnedServerId}
+}
+
+// Makes identifiers unique among unfinished jobs, so two requests for the same tenant can't both be queued.
+func AddProvisioningIdentifierIndex(db *gorm.DB) error {
+	return db.Exec(fmt.Sprintf("CREATE UNIQUE INDEX %v ON provisioning_jobs (lower(sub_domain_identifier)) WHERE status NOT IN ('%v', '%v') AND deleted_at IS NULL",
+		ProvisioningIdentifierIndex, ProvisioningReady, ProvisioningFailed)).Error
+}
+
+// Records a new queued job, ErrProvisioningInProgress is returned when another job for the identifier was queued first.
+func QueueProvisioningJob(db *gorm.DB, subDomainIdentifier string, isolation string, placement TenantPlacement) (ProvisioningJob, error) {
+
+	job := ProvisioningJob{
+		SubDomainIdentifier: subDomainIdentifier,
+		Isolation:           isolation,
+		Status:              ProvisioningQueued,
+		PlacementPolicy:     placement.Policy,
+		PlacementRegion:     placement.Region,
+		PinnedServerId:      placement.ServerId,
+	}
+
+	if err := db.Create(&job).Error; err != nil {
+		if inProgress, _ := ProvisioningInProgress(db, subDomainIdentifier); inProgress {
+			return job, ErrProvisioningInProgress
+		}
+
+		return job, err
+	}
+
+	return job, nil
+}
+
+// Checks if a job for the identifier is still being worked on.
+func ProvisioningInProgress(db *gorm.DB, subDomainIdentifier string) (bool, error) {
+
+	var count int
+
+	err := db.Model(&ProvisioningJob{}).Where("lower(sub_domain_identifier) = lower(?) AND status NOT IN (?)", subDomainIdentifier, []string{ProvisioningReady, ProvisioningFailed}).Count(&count).Error
+
+	return count > 0, err
+}
+
+// Takes a queued job to work on for the length of the lease, claimed is false when the job isn't queued any more, e.g. another instance took it first.
+func ClaimProvisioningJob(db *gorm.DB, id uint, lease time.Duration) (job ProvisioningJob, claimed bool, err error) {
+
+	result := db.Model(&ProvisioningJob{}).Where("id = ? AND status = ?", id, ProvisioningQueued).Updates(map[string]interface{}{
+		"status":           ProvisioningCreatingDatabase,
+		"lease_expires_at": time.Now().Add(lease),
+	})
+
+	if result.Error != nil || result.RowsAffected == 0 {
+		return job, false, result.Error
+	}
+
+	err = db.First(&job, id).Error
+
+	return job, err == nil, err
+}
+
+// Pushes back the lease of a job this instance is working on, so it isn't taken for stuck while a step runs long.
+func RenewProvisioningLease(db *gorm.DB, id uint, lease time.Duration) error {
+	return db.Model(&ProvisioningJob{}).Where("id = ? AND status NOT IN (?)", id, []string{ProvisioningQueued, ProvisioningReady, ProvisioningFailed}).
+		Update("lease_expires_at", time.Now().Add(lease)).Error
+}
+
+// Takes over a stuck job so it can be undone, claimed is false when the job is being worked on again,
+// e.g. its lease was renewed after it was listed.
+func ReclaimProvisioningJob(db *gorm.DB, job *ProvisioningJob, staleBefore time.Time, lease time.Duration) (claimed bool, err error) {
+
+	now := time.Now()
+	expires := now.Add(lease)
+
+	result := staleProvisioningJobs(db.Model(&ProvisioningJob{}), now, staleBefore).Where("id = ?", job.ID).Update("lease_expires_at", expires)
+
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false, result.Error
+	}
+
+	job.LeaseExpiresAt = &expires
+
+	return true, nil
+}
+
+// Narrows a query to running jobs that have stopped being worked on, matching ProvisioningJob.Stale.
+func staleProvisioningJobs(db *gorm.DB, now time.Time, staleBefore time.Time) *gorm.DB {
+	return db.Where("status NOT IN (?) AND (lease_expires_at < ? OR (lease_expires_at IS NULL AND updated_at < ?))",
+		[]string{ProvisioningQueued, ProvisioningReady, ProvisioningFailed}, now, staleBefore)
+}
+
+// Returns the ids of every queued job, oldest first.
+func QueuedProvisioningJobs(db *gorm.DB) ([]uint, error) {
+
+	var ids []uint
+
+	err := db.Model(&ProvisioningJob{}).Where("status = ?", ProvisioningQueued).Order("id").Pluck("id", &ids).Error
+
+	return ids, err
+}
+
+// Moves the job on to a step and records when the step started.
+func StartProvisioningStep(db *gorm.DB, job *ProvisioningJob, name string, status string, undoIfFailed bool) (ProvisioningStep, error) {
+
+	step := ProvisioningStep{ProvisioningJobId: job.ID, Name: name, Status: status, StartedAt: time.Now(), UndoIfFailed: undoIfFailed}
+
+	if err := SetProvisioningStatus(db, job, status); err != nil {
+		return step, err
+	}
+
+	err := db.Create(&step).Error
+
+	return step, err
+}
+
+// Updates the status of a running job.
+func SetProvisioningStatus(db *gorm.DB, job *ProvisioningJob, status string) error {
+
+	if err := db.Model(job).Update("status", status).Error; err != nil {
+		return err
+	}
+
+	job.Status = status
+
+	return nil
+}
+
+// Records what a job has made so far, so a failed or interrupted job can be undone later.
+func RecordProvisionedResources(db *gorm.DB, job *ProvisioningJob) error {
+	return db.Model(job).Updates(map[string]interface{}{
+		"tenant_connection_information_id": job.TenantConnectionInformationId,
+		"database_name":                    job.DatabaseName,
+		"schema_name":                      job.SchemaName,
+		"role_name":                        job.RoleName,
+	}).Error
+}
+
+// Records when the step finished and its error, if it had one.
+func FinishProvisioningStep(db *gorm.DB, step *ProvisioningStep, stepErr error) error {
+
+	now := time.Now()
+	step.FinishedAt = &now
+	updates := map[string]interface{}{"finished_at": &now}
+
+	if stepErr != nil {
+		step.Error = stepErr.Error()
+		updates["error"] = step.Error
+	}
+
+	return db.Model(step).Updates(updates).Error
+}
+
+// Records that a step has been undone, or the error undoing it.
+func CompensateProvisioningStep(db *gorm.DB, step *ProvisioningStep, undoErr error) error {
+
+	if undoErr != nil {
+		step.CompensationError = undoErr.Error()
+		return db.Model(step).Update("compensation_error", step.CompensationError).Error
+	}
+
+	now := time.Now()
+	step.CompensatedAt = &now
+	step.CompensationError = ""
+
+	return db.Model(step).Updates(map[string]interface{}{"compensated_at": &now, "compensation_error": ""}).Error
+}
+
+// Undoes the finished steps in reverse with undo, carrying on past failures so as much as possible is cleaned up.
+// Steps that failed, unless marked UndoIfFailed, or were already undone are skipped, steps that couldn't be undone keep their error for the reconcile command to retry.
+func CompensateProvisioningSteps(db *gorm.DB, job *ProvisioningJob, finished []ProvisioningStep, undo func(step ProvisioningStep) error) error {
+
+	if err := SetProvisioningStatus(db, job, ProvisioningRollingBack); err != nil {
+		fmt.Println(err)
+	}
+
+	var failures []string
+
+	for i := len(finished) - 1; i >= 0; i-- {
+		record := finished[i]
+
+		if !record.NeedsCompensation() {
+			continue
+		}
+
+		undoErr := undo(record)
+
+		if undoErr != nil {
+			failures = append(failures, record.Name+": "+undoErr.Error())
+		}
+
+		if err := CompensateProvisioningStep(db, &record, undoErr); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("could not undo provisioning job %d, %v", job.ID, strings.Join(failures, ", "))
+	}
+
+	return nil
+}
+
+// Marks the job as ready or failed, depending on err.
+func FinishProvisioningJob(db *gorm.DB, job *ProvisioningJob, jobErr error) error {
+
+	now := time.Now()
+	updates := map[string]interface{}{"status": ProvisioningReady, "finished_at": &now, "lease_expires_at": nil}
+
+	if jobErr != nil {
+		updates["status"] = ProvisioningFailed
+		updates["error"] = jobErr.Error()
+	}
+
+	if err := db.Model(job).Updates(updates).Error; err != nil {
+		return err
+	}
+
+	job.Status = updates["status"].(string)
+	job.FinishedAt = &now
+	job.LeaseExpiresAt = nil
+
+	return nil
+}
+
+// Returns jobs that stopped part way through, either failed with steps left to undo or running with a lease that ran out.
+// Jobs started before leases count as stopped once they haven't been updated since staleBefore.
+func UnfinishedProvisioningJobs(db *gorm.DB, staleBefore time.Time) ([]ProvisioningJob, error) {
+
+	var jobs []ProvisioningJob
+
+	stale := staleProvisioningJobs(db.Model(&ProvisioningJob{}), time.Now(), staleBefore).Select("id").QueryExpr()
+	undone := db.Model(&ProvisioningStep{}).Select("provisioning_job_id").Where("finished_at IS NOT NULL AND coalesce(error, '') = '' AND compensated_at IS NULL").QueryExpr()
+
+	err := db.Preload("Steps", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id")
+	}).Where("id IN (?) OR (status = ? AND id IN (?))", stale, ProvisioningFailed, undone).Order("id").Find(&jobs).Error
+
+	return jobs, err
+}
+
+// Loads a job along with its steps in the order they ran.
+func FindProvisioningJob(db *gorm.DB, id uint) (ProvisioningJob, error) {
+
+	var job ProvisioningJob
+
+	err := db.Preload("Steps", func(db *gorm.DB) *gorm.DB {
+		return db.Order("id")
+	}).First(&job, id).Error
+
+	return job, err
+}
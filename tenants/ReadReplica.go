@@ -0,0 +1,111 @@
+package tenants
+
+import (
+	"errors"
+	"github.com/jinzhu/gorm"
+	"strings"
+)
+
+// Returned when a replica has no name or host, or doesn't belong to exactly one tenant or database server.
+var ErrInvalidReadReplica = errors.New("a read replica needs a name, a host and either a tenant or a database server")
+
+// Returned when adding a replica under a name that is taken.
+var ErrReadReplicaExists = errors.New("a read replica with that name already exists")
+
+// Returned when removing a replica that hasn't been added.
+var ErrUnknownReadReplica = errors.New("the read replica could not be found")
+
+// A read only copy of a tenants database, or of every database on a database server, that reads can be sent to.
+// Replicas are reached with the tenants own credentials and database, only the host and port change.
+type ReadReplica struct {
+	gorm.Model
+	Name                          string `gorm:"unique_index"`
+	Host                          string
+	Port                          int
+	TenantConnectionInformationId uint `gorm:"index"` // Set for a replica of a single tenant.
+	DatabaseServerId              uint `gorm:"index"` // Set for a replica of a whole server.
+}
+
+// Validates a new replica and stores it.
+func AddReadReplica(db *gorm.DB, replica *ReadReplica) error {
+
+	replica.Name = strings.TrimSpace(replica.Name)
+
+	if len(replica.Name) == 0 || len(strings.TrimSpace(replica.Host)) == 0 || (replica.TenantConnectionInformationId == 0) == (replica.DatabaseServerId == 0) {
+		return ErrInvalidReadReplica
+	}
+
+	if replica.Port == 0 {
+		replica.Port = 5432
+	}
+
+	if err := db.Where("name = ?", replica.Name).First(&ReadReplica{}).Error; err == nil {
+		return ErrReadReplicaExists
+	} else if !gorm.IsRecordNotFoundError(err) {
+		return err
+	}
+
+	return db.Create(replica).Error
+}
+
+// Removes a replica by name.
+func RemoveReadReplica(db *gorm.DB, name string) (ReadReplica, error) {
+
+	var replica ReadReplica
+
+	if err := db.Where("name = ?", name).First(&replica).Error; gorm.IsRecordNotFoundError(err) {
+		return replica, ErrUnknownReadReplica
+	} else if err != nil {
+		return replica, err
+	}
+
+	return replica, db.Delete(&replica).Error
+}
+
+// Returns every replica, oldest first.
+func ReadReplicas(db *gorm.DB) ([]ReadReplica, error) {
+
+	var replicas []ReadReplica
+
+	err := db.Order("id").Find(&replicas).Error
+
+	return replicas, err
+}
+
+// Returns the replicas a tenants reads can go to, its own when it has any, otherwise those of its database server.
+// Tenants on shared tables always read from the primary, their rows are only kept apart within a transaction on it.
+func ReplicasFor(t TenantConnectionInformation, replicas []ReadReplica) []ReadReplica {
+
+	if t.Isolation() == IsolationShared {
+		return nil
+	}
+
+	var own, server []ReadReplica
+
+	for _, replica := range replicas {
+		switch {
+		case replica.TenantConnectionInformationId != 0 && replica.TenantConnectionInformationId == t.ID:
+			own = append(own, replica)
+		case replica.DatabaseServerId != 0 && replica.DatabaseServerId == t.DatabaseServerId:
+			server = append(server, replica)
+		}
+	}
+
+	if len(own) > 0 {
+		return own
+	}
+
+	return server
+}
+
+// Opens a connection to the tenants database on a replica, decrypting the connection string first.
+func (t TenantConnectionInformation) GetReplicaConnection(replica ReadReplica) (*gorm.DB, error) {
+
+	connectionString, err := DecryptConnectionString(t.ConnectionString)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return gorm.Open("postgres", ConnectionStringWithHost(connectionString, replica.Host, replica.Port))
+}
@@ -0,0 +1,203 @@
+package tenants
+
+import (
+	"errors"
+	"github.com/jinzhu/gorm"
+	"strings"
+	"time"
+)
+
+// Relocation states.
+const (
+	RelocationRunning   = "running"
+	RelocationFailed    = "failed" // Stopped on an error, relocating again carries on from the step that failed.
+	RelocationCompleted = "completed"
+	RelocationCancelled = "cancelled"
+)
+
+// The steps of a relocation, in order. The tenant is only read-only during cutover.
+var RelocationSteps = []string{"prepare", "schema", "copy", "sync", "cutover", "cleanup"}
+
+// Returned when relocating a tenant that is already being relocated to another server.
+var ErrRelocationInProgress = errors.New("the tenant is already being relocated to another server")
+
+// Returned when cancelling a relocation that has already switched the tenant over, or doesn't exist.
+var ErrRelocationNotCancellable = errors.New("the tenant has no relocation that can still be cancelled")
+
+// A move of a database isolated tenant to another database server.
+// Its database is copied with logical replication while the tenant carries on as normal, it is only read-only while the copy catches up and is checked.
+type TenantRelocation struct {
+	gorm.Model
+	TenantConnectionInformationId uint   `gorm:"index"`
+	SubDomainIdentifier           string `gorm:"index"`
+	DatabaseName                  string
+	RoleName                      string
+	SourceServerId                uint
+	TargetServerId                uint
+	TargetConnectionString        string // The tenants connection string on the target, encrypted like every other connection string.
+	PreviousState                 string // The state the tenant was in before it was made read-only, empty when it was left alone.
+	RequestedBy                   uint
+	Status                        string `gorm:"index"`
+	Step                          string // The step running or that failed.
+	CompletedSteps                string // Comma separated steps already done, so a resumed relocation skips them.
+	TablesTotal                   int    // Tables being copied, and how many of them have caught up.
+	TablesCopied                  int
+	RowsVerified                  int64
+	Error                         string
+	CompletedAt                   *time.Time
+}
+
+// Checks if a relocation step has already been done.
+func (r TenantRelocation) StepDone(step string) bool {
+
+	for _, done := range strings.Split(r.CompletedSteps, ",") {
+		if done == step {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns how far through its steps the relocation is as a percentage, the copy counts in proportion to the tables that have caught up.
+func (r TenantRelocation) Progress() int {
+
+	if r.Status == RelocationCompleted {
+		return 100
+	}
+
+	var done float64
+
+	for _, step := range RelocationSteps {
+		if r.StepDone(step) {
+			done++
+		} else if step == "sync" && r.TablesTotal > 0 {
+			done += float64(r.TablesCopied) / float64(r.TablesTotal)
+		}
+	}
+
+	return int(done * 100 / float64(len(RelocationSteps)))
+}
+
+// Returns the relocation of a tenant that hasn't been cancelled or completed.
+func OpenTenantRelocation(db *gorm.DB, tenantId uint) (TenantRelocation, bool, error) {
+
+	var relocation TenantRelocation
+
+	err := db.Where("tenant_connection_information_id = ? AND status IN (?)", tenantId, []string{RelocationRunning, RelocationFailed}).Order("id DESC").First(&relocation).Error
+
+	if gorm.IsRecordNotFoundError(err) {
+		return relocation, false, nil
+	}
+
+	return relocation, err == nil, err
+}
+
+// Returns the newest relocation of a tenant, whatever its state.
+func LatestTenantRelocation(db *gorm.DB, tenantId uint) (TenantRelocation, bool, error) {
+
+	var relocation TenantRelocation
+
+	err := db.Where("tenant_connection_information_id = ?", tenantId).Order("id DESC").First(&relocation).Error
+
+	if gorm.IsRecordNotFoundError(err) {
+		return relocation, false, nil
+	}
+
+	return relocation, err == nil, err
+}
+
+// Records a relocation of the tenant to the target server, or returns the one still open so it can be resumed.
+func StartTenantRelocation(db *gorm.DB, tenant TenantConnectionInformation, targetServerId uint, requestedBy uint) (relocation TenantRelocation, err error) {
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		existing, found, err := OpenTenantRelocation(tx, tenant.ID)
+
+		if err != nil {
+			return err
+		}
+
+		if found {
+			if existing.TargetServerId != targetServerId {
+				return ErrRelocationInProgress
+			}
+
+			relocation = existing
+			return nil
+		}
+
+		relocation = TenantRelocation{
+			TenantConnectionInformationId: tenant.ID,
+			SubDomainIdentifier:           tenant.TenantSubDomainIdentifier,
+			DatabaseName:                  tenant.DatabaseName,
+			RoleName:                      tenant.RoleName,
+			SourceServerId:                tenant.DatabaseServerId,
+			TargetServerId:                targetServerId,
+			RequestedBy:                   requestedBy,
+			Status:                        RelocationRunning,
+		}
+
+		return tx.Create(&relocation).Error
+	})
+
+	return relocation, err
+}
+
+// Returns the relocations that were running or failed, to be carried on with.
+func OpenTenantRelocations(db *gorm.DB) ([]TenantRelocation, error) {
+
+	var relocations []TenantRelocation
+
+	err := db.Where("status IN (?)", []string{RelocationRunning, RelocationFailed}).Order("id").Find(&relocations).Error
+
+	return relocations, err
+}
+
+// Sets the status of a relocation, the step it is on and its error.
+func SetRelocationStatus(db *gorm.DB, relocation *TenantRelocation, status string, step string, relocationErr error) error {
+
+	updates := map[string]interface{}{"status": status, "step": step, "error": ""}
+
+	if relocationErr != nil {
+		updates["error"] = relocationErr.Error()
+	}
+
+	if status == RelocationCompleted || status == RelocationCancelled {
+		now := time.Now()
+		updates["completed_at"] = &now
+		relocation.CompletedAt = &now
+	}
+
+	if err := db.Model(relocation).Updates(updates).Error; err != nil {
+		return err
+	}
+
+	relocation.Status = status
+	relocation.Step = step
+	relocation.Error, _ = updates["error"].(string)
+
+	return nil
+}
+
+// Records progress made within a step, e.g. how many tables have been copied.
+func RecordRelocationProgress(db *gorm.DB, relocation *TenantRelocation, updates map[string]interface{}) error {
+	return db.Model(relocation).Updates(updates).Error
+}
+
+// Records a relocation step as done.
+func CompleteRelocationStep(db *gorm.DB, relocation *TenantRelocation, step string) error {
+
+	if relocation.StepDone(step) {
+		return nil
+	}
+
+	completed := strings.Trim(relocation.CompletedSteps+","+step, ",")
+
+	if err := db.Model(relocation).Update("completed_steps", completed).Error; err != nil {
+		return err
+	}
+
+	relocation.CompletedSteps = completed
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package tenants
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/url"
+	"strings"
+)
+
+// The two login roles of a tenant take turns, rotating sets a new password on the one not in use and switches to it.
+// Connections still using the other carry on working until the next rotation.
+var loginRoleSuffixes = []string{"__a", "__b"}
+
+// The database roles of a tenant. Privileges are granted to the group role, which can't log in,
+// and the login roles are members of it that act as it, so whatever either one makes is owned by the group.
+type TenantRoles struct {
+	Group  string
+	Logins []string
+}
+
+// Returns the role names for an identifier, e.g. acme gets tenant_acme with the logins tenant_acme__a and tenant_acme__b.
+// Identifiers can't have consecutive hyphens, so no group role ever ends like a login role.
+func RolesFor(identifier string) TenantRoles {
+	return RolesForGroup(PhysicalName(identifier))
+}
+
+// Returns the roles of a group role, e.g. one read back from a tenant record after the tenant was renamed.
+func RolesForGroup(group string) TenantRoles {
+
+	roles := TenantRoles{Group: group}
+
+	for _, suffix := range loginRoleSuffixes {
+		base := group
+
+		// Names too long for the suffix are shortened and given a hash of the group name to keep them apart.
+		if len(base)+len(suffix) > maxPhysicalNameLength {
+			sum := sha1.Sum([]byte(group))
+			hash := "_" + hex.EncodeToString(sum[:])[:8]
+			base = base[:maxPhysicalNameLength-len(suffix)-len(hash)] + hash
+		}
+
+		roles.Logins = append(roles.Logins, base+suffix)
+	}
+
+	return roles
+}
+
+// Returns the login role to rotate onto, the one that isn't current.
+func (r TenantRoles) NextLogin(current string) string {
+
+	if len(r.Logins) > 0 && current == r.Logins[0] {
+		return r.Logins[1]
+	}
+
+	return r.Logins[0]
+}
+
+// Returns every role, logins first so they can be dropped before the group they belong to.
+func (r TenantRoles) All() []string {
+	return append(append([]string{}, r.Logins...), r.Group)
+}
+
+// Generates a random password made up of hex digits, safe to put in either connection string format unquoted.
+func GeneratePassword() (string, error) {
+
+	secret := make([]byte, 24)
+
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(secret), nil
+}
+
+// Sets the user and password of a postgres connection string, replacing any it already had.
+// Both the key=value and URL connection string formats are supported.
+func ConnectionStringWithCredentials(connectionString string, user string, password string) string {
+
+	if strings.HasPrefix(connectionString, "postgres://") || strings.HasPrefix(connectionString, "postgresql://") {
+		if parsed, err := url.Parse(connectionString); err == nil {
+			parsed.User = url.UserPassword(user, password)
+			return parsed.String()
+		}
+	}
+
+	var settings []string
+
+	for _, setting := range strings.Fields(connectionString) {
+		if !strings.HasPrefix(setting, "user=") && !strings.HasPrefix(setting, "password=") {
+			settings = append(settings, setting)
+		}
+	}
+
+	return strings.Join(append(settings, "user="+user, "password="+password), " ")
+}
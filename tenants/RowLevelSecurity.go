@@ -0,0 +1,61 @@
+package tenants
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+// Session setting holding the tenant id that postgres row level security policies compare against.
+const CurrentTenantSetting = "app.current_tenant"
+
+// Returns the statements that enable row level security on a shared tenant table.
+// Rows are only visible or writable while app.current_tenant matches their tenant_id, with nothing set no rows are visible.
+func RowLevelSecurityStatements(table string) []string {
+
+	quotedTable := pq.QuoteIdentifier(table)
+	policy := pq.QuoteIdentifier(table + "_tenant_isolation")
+	condition := fmt.Sprintf("tenant_id = NULLIF(current_setting('%v', true), '')::bigint", CurrentTenantSetting)
+
+	return []string{
+		"ALTER TABLE " + quotedTable + " ENABLE ROW LEVEL SECURITY",
+		// Without forcing, the table owner (usually the user we connect as) would skip the policy.
+		"ALTER TABLE " + quotedTable + " FORCE ROW LEVEL SECURITY",
+		"DROP POLICY IF EXISTS " + policy + " ON " + quotedTable,
+		"CREATE POLICY " + policy + " ON " + quotedTable + " USING (" + condition + ") WITH CHECK (" + condition + ")",
+	}
+}
+
+// Applies the row level security policies to the tables of the given models, safe to run repeatedly.
+func ApplyRowLevelSecurity(db *gorm.DB, models ...interface{}) error {
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, model := range models {
+			for _, statement := range RowLevelSecurityStatements(tx.NewScope(model).TableName()) {
+				if err := tx.Exec(statement).Error; err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// Starts a transaction with app.current_tenant set for the lifetime of the transaction.
+// SET LOCAL only lasts as long as the transaction, so the setting never leaks onto a pooled connection used by another tenant.
+func BeginTenantTransaction(db *gorm.DB, t TenantConnectionInformation) (*gorm.DB, error) {
+
+	tx := db.Begin()
+
+	if err := tx.Error; err != nil {
+		return nil, err
+	}
+
+	if err := tx.Exec(fmt.Sprintf("SET LOCAL %v = '%d'", CurrentTenantSetting, t.ID)).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return tx, nil
+}
@@ -0,0 +1,79 @@
+package tenants
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jinzhu/gorm"
+)
+
+// Key used to carry the current tenant id on a shared table connection, see ScopeConnection.
+const TenantScopeKey = "tenancy:tenant_id"
+
+// Returned when a query touches a shared tenant table without a tenant scope.
+var ErrMissingTenantScope = errors.New("refusing to query shared tenant tables without a tenant scope")
+
+// Returned when a record is written with a tenant id other than the one the connection is scoped to.
+var ErrCrossTenantWrite = errors.New("refusing to write a record belonging to another tenant")
+
+// Returns a connection that will only ever read and write the given tenants rows.
+// Connections for tenants that don't use shared tables are returned untouched.
+func ScopeConnection(db *gorm.DB, t TenantConnectionInformation) *gorm.DB {
+	if t.Isolation() != IsolationShared {
+		return db
+	}
+
+	return db.Set(TenantScopeKey, t.ID)
+}
+
+// Registers the callbacks that scope every query on a shared table connection to the current tenant.
+// Any model with a TenantId field is treated as a shared tenant table.
+func RegisterRowScoping(db *gorm.DB) {
+	db.Callback().Create().Before("gorm:create").Register("tenancy:assign_tenant", assignTenant)
+	db.Callback().Query().Before("gorm:query").Register("tenancy:scope_query", scopeToTenant)
+	db.Callback().RowQuery().Before("gorm:row_query").Register("tenancy:scope_row_query", scopeToTenant)
+	db.Callback().Update().Before("gorm:update").Register("tenancy:scope_update", scopeToTenant)
+	db.Callback().Delete().Before("gorm:delete").Register("tenancy:scope_delete", scopeToTenant)
+}
+
+// Fills in the tenant id on every insert.
+func assignTenant(scope *gorm.Scope) {
+
+	field, ok := scope.FieldByName("TenantId")
+
+	if !ok {
+		return
+	}
+
+	tenantId, ok := scope.Get(TenantScopeKey)
+
+	if !ok {
+		scope.Err(ErrMissingTenantScope)
+		return
+	}
+
+	if !field.IsBlank && field.Field.Interface() != tenantId {
+		scope.Err(ErrCrossTenantWrite)
+		return
+	}
+
+	if err := scope.SetColumn("TenantId", tenantId); err != nil {
+		scope.Err(err)
+	}
+}
+
+// Adds a tenant_id condition to every select, update and delete.
+func scopeToTenant(scope *gorm.Scope) {
+
+	if _, ok := scope.FieldByName("TenantId"); !ok {
+		return
+	}
+
+	tenantId, ok := scope.Get(TenantScopeKey)
+
+	if !ok {
+		scope.Err(ErrMissingTenantScope)
+		return
+	}
+
+	scope.Search.Where(fmt.Sprintf("%v.%v = ?", scope.QuotedTableName(), scope.Quote("tenant_id")), tenantId)
+}
@@ -0,0 +1,121 @@
+package tenants
+
+import (
+	"errors"
+	"github.com/jinzhu/gorm"
+	"strings"
+)
+
+// Returned when an identifier is already used by a tenant or alias.
+var ErrIdentifierInUse = errors.New("the identifier is already used by another tenant")
+
+// A previous identifier of a tenant, kept after a rename so old links keep working.
+type TenantAlias struct {
+	gorm.Model
+	Identifier                    string `gorm:"unique_index"`
+	TenantConnectionInformationId uint   `gorm:"index"`
+}
+
+// Finds a tenant by its identifier, falling back to the identifiers it has been renamed from.
+// Identifiers are compared the way they are stored, so any case or surrounding space finds the tenant.
+func FindTenantByIdentifier(db *gorm.DB, identifier string) (TenantConnectionInformation, error) {
+
+	var tenant TenantConnectionInformation
+
+	identifier = NormalizeIdentifier(identifier)
+
+	err := db.Where("lower(tenant_sub_domain_identifier) = ?", identifier).First(&tenant).Error
+
+	if !gorm.IsRecordNotFoundError(err) {
+		return tenant, err
+	}
+
+	return FindTenantByAlias(db, identifier)
+}
+
+// Finds the tenant a previous identifier now belongs to.
+func FindTenantByAlias(db *gorm.DB, identifier string) (TenantConnectionInformation, error) {
+
+	var alias TenantAlias
+	var tenant TenantConnectionInformation
+
+	if err := db.Where("lower(identifier) = ?", strings.ToLower(identifier)).First(&alias).Error; err != nil {
+		return tenant, err
+	}
+
+	err := db.First(&tenant, alias.TenantConnectionInformationId).Error
+
+	return tenant, err
+}
+
+// Checks if an identifier is taken by a tenant or an alias, ignoring those belonging to the given tenant id.
+func IdentifierInUse(db *gorm.DB, identifier string, exceptTenantId uint) (bool, error) {
+
+	var count int
+
+	if err := db.Model(&TenantConnectionInformation{}).Where("lower(tenant_sub_domain_identifier) = ? AND id <> ?", strings.ToLower(identifier), exceptTenantId).Count(&count).Error; err != nil || count > 0 {
+		return count > 0, err
+	}
+
+	if err := db.Model(&TenantAlias{}).Where("lower(identifier) = ? AND tenant_connection_information_id <> ?", strings.ToLower(identifier), exceptTenantId).Count(&count).Error; err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// Changes a tenants public identifier, keeping the old one as an alias. The database, schema and connection are left alone.
+// Renaming back to one of the tenants own aliases removes that alias.
+func RenameTenant(db *gorm.DB, tenant *TenantConnectionInformation, newIdentifier string) error {
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		inUse, err := IdentifierInUse(tx, newIdentifier, tenant.ID)
+
+		if err != nil {
+			return err
+		}
+
+		if inUse {
+			return ErrIdentifierInUse
+		}
+
+		// Only the tenants own alias is removed, one another tenant added since the check above is left alone.
+		if err := tx.Unscoped().Where("lower(identifier) = ? AND tenant_connection_information_id = ?", strings.ToLower(newIdentifier), tenant.ID).Delete(&TenantAlias{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Create(&TenantAlias{Identifier: tenant.TenantSubDomainIdentifier, TenantConnectionInformationId: tenant.ID}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(tenant).Update("tenant_sub_domain_identifier", newIdentifier).Error; err != nil {
+			return err
+		}
+
+		tenant.TenantSubDomainIdentifier = newIdentifier
+
+		return nil
+	})
+}
+
+// Adds an extra identifier for a tenant.
+func AddTenantAlias(db *gorm.DB, tenant TenantConnectionInformation, identifier string) (TenantAlias, error) {
+
+	alias := TenantAlias{Identifier: identifier, TenantConnectionInformationId: tenant.ID}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		inUse, err := IdentifierInUse(tx, identifier, 0)
+
+		if err != nil {
+			return err
+		}
+
+		if inUse {
+			return ErrIdentifierInUse
+		}
+
+		return tx.Create(&alias).Error
+	})
+
+	return alias, err
+}
@@ -4,23 +4,64 @@ import (
 	"github.com/jinzhu/gorm"
 	"github.com/pkg/errors"
 	"strings"
+	"time"
 )
 
 type TenantConnectionInformation struct {
 	gorm.Model
 	TenantId                  uint `gorm:"AUTO_INCREMENT"`
 	TenantSubDomainIdentifier string
-	ConnectionString          string
+	ConnectionString          string // Encrypted when a master key has been configured, see DecryptConnectionString.
+	IsolationMode             string // database, schema or shared, empty for tenants made before isolation modes existed.
+	SchemaName                string // Only set for schema isolated tenants.
+	DatabaseName              string // The database made for database isolated tenants, fixed at creation so renames leave it alone.
+	RolloutTags               string // Comma separated tags used to pick migration rollout waves, e.g. canary.
+	RolloutOrder              int    // Tenants with a lower order are migrated earlier in a rollout.
+	LifecycleState            string // active, suspended, read_only, archived, pending_deletion or deleted, empty for tenants made before states existed.
+	StateReason               string // Why the tenant was last moved, suspensions for SuspensionPayment ask for payment.
+	RoleName                  string // The tenants group role, empty for shared table tenants and tenants made before roles existed.
+	LoginRole                 string // The login role the connection string uses.
+	CredentialsRotatedAt      *time.Time
+	DatabaseServerId          uint `gorm:"index"` // The server a database isolated tenant was placed on, 0 for the server the master connection manages.
 }
 
-// Helper method that create's and returns the database connection.
+// Returns the isolation mode for the tenant, tenants created before modes existed are database isolated.
+func (t TenantConnectionInformation) Isolation() string {
+	if len(t.IsolationMode) == 0 {
+		return IsolationDatabase
+	}
+
+	return t.IsolationMode
+}
+
+// Returns the tenants rollout tags.
+func (t TenantConnectionInformation) RolloutTagList() []string {
+
+	var tags []string
+
+	for _, tag := range strings.Split(t.RolloutTags, ",") {
+		if tag = strings.TrimSpace(tag); len(tag) > 0 {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags
+}
+
+// Helper method that create's and returns the database connection, decrypting the connection string first.
 func (t TenantConnectionInformation) GetConnection() (*gorm.DB, error) {
 
 	if len(strings.TrimSpace(t.ConnectionString)) == 0 {
 		return nil, errors.New("Connection string was not found or was empty..")
 	}
 
-	db, err := gorm.Open("postgres", t.ConnectionString)
+	connectionString, err := DecryptConnectionString(t.ConnectionString)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decrypt the tenants connection string")
+	}
+
+	db, err := gorm.Open("postgres", connectionString)
 
 	if err != nil {
 		return nil, err
@@ -0,0 +1,265 @@
+package tenants
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/LiamDotPro/Go-Multitenancy/helpers"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/net/idna"
+	"net"
+	"strings"
+	"time"
+)
+
+// The TXT record a tenant publishes to prove they own a domain, at _tenant-verification.<hostname>.
+const (
+	DomainVerificationRecordPrefix = "_tenant-verification."
+	DomainVerificationValuePrefix  = "tenant-verification="
+)
+
+// Returned when the verification TXT record can't be found or holds a different token.
+var ErrDomainNotVerified = errors.New("the domain verification record was not found")
+
+// Returned when a hostname isn't a valid domain name.
+var ErrInvalidHostname = errors.New("the hostname is not a valid domain name")
+
+// Name of the index keeping a verified hostname to a single tenant, see AddVerifiedHostnameIndex.
+const VerifiedHostnameIndex = "uix_tenant_domains_verified_hostname"
+
+// A hostname that belongs to a tenant, e.g. portal.customer.com.
+// Requests are only routed by the hostname once its ownership has been verified.
+// Several tenants can claim the same hostname, only verified hostnames are unique and verifying one removes the other claims.
+type TenantDomain struct {
+	gorm.Model
+	Hostname                      string `gorm:"index"`
+	TenantConnectionInformationId uint   `gorm:"index"`
+	VerificationToken             string
+	VerifiedAt                    *time.Time
+}
+
+// Returns true once ownership of the domain has been verified.
+func (d TenantDomain) Verified() bool {
+	return d.VerifiedAt != nil
+}
+
+// The name of the TXT record holding the verification token.
+func (d TenantDomain) VerificationRecord() string {
+	return DomainVerificationRecordPrefix + d.Hostname
+}
+
+// The value the TXT record must hold.
+func (d TenantDomain) VerificationValue() string {
+	return DomainVerificationValuePrefix + d.VerificationToken
+}
+
+// Looks up TXT records, swapped out to stub DNS locally and in tests.
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Answers TXT lookups from a fixed set of records.
+type StaticTXTResolver map[string][]string
+
+func (r StaticTXTResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return r[strings.ToLower(name)], nil
+}
+
+// Returns the TXT resolver set in tenantDomainVerification, dns by default or nil for skip which accepts every domain locally.
+func TXTResolverFromEnv() TXTResolver {
+
+	if strings.ToLower(helpers.GetEnvString("tenantDomainVerification", "dns")) == "skip" {
+		return nil
+	}
+
+	return net.DefaultResolver
+}
+
+// Creates an unverified domain for the tenant with a fresh verification token.
+func AddTenantDomain(db *gorm.DB, tenant TenantConnectionInformation, hostname string) (TenantDomain, error) {
+
+	hostname = NormalizeHost(hostname)
+
+	if !ValidHostname(hostname) {
+		return TenantDomain{}, ErrInvalidHostname
+	}
+
+	token := make([]byte, 16)
+
+	if _, err := rand.Read(token); err != nil {
+		return TenantDomain{}, err
+	}
+
+	domain := TenantDomain{Hostname: hostname, TenantConnectionInformationId: tenant.ID, VerificationToken: hex.EncodeToString(token)}
+
+	if err := db.Create(&domain).Error; err != nil {
+		return TenantDomain{}, err
+	}
+
+	return domain, nil
+}
+
+// Makes verified hostnames unique, unverified claims are left out so nobody can hold a hostname by claiming it first.
+func AddVerifiedHostnameIndex(db *gorm.DB) error {
+	return db.Exec("CREATE UNIQUE INDEX " + VerifiedHostnameIndex + " ON tenant_domains (hostname) WHERE verified_at IS NOT NULL AND deleted_at IS NULL").Error
+}
+
+// Checks the domains TXT record holds its token and marks it verified.
+// A nil resolver skips the DNS check entirely, which is only meant for local development.
+func VerifyTenantDomain(db *gorm.DB, resolver TXTResolver, domain *TenantDomain) error {
+
+	if resolver != nil {
+		records, err := lookupVerificationRecords(resolver, *domain)
+
+		if err != nil {
+			return err
+		}
+
+		if !containsRecord(records, domain.VerificationValue()) {
+			return ErrDomainNotVerified
+		}
+	}
+
+	return markDomainVerified(db, domain)
+}
+
+// Verifies the claim on the hostname whose token has been published, the oldest claim when the resolver is nil.
+// A hostname that is already verified is checked again for its owner. When nothing matches the oldest claim is returned with the error.
+func VerifyTenantDomainClaims(db *gorm.DB, resolver TXTResolver, hostname string) (TenantDomain, error) {
+
+	var claims []TenantDomain
+
+	// A verified claim sorts first, it keeps the hostname.
+	if err := db.Where("hostname = ?", NormalizeHost(hostname)).Order("verified_at IS NULL, id").Find(&claims).Error; err != nil {
+		return TenantDomain{}, err
+	}
+
+	if len(claims) == 0 {
+		return TenantDomain{}, gorm.ErrRecordNotFound
+	}
+
+	if claims[0].Verified() || resolver == nil {
+		err := VerifyTenantDomain(db, resolver, &claims[0])
+		return claims[0], err
+	}
+
+	// Every claim shares the one TXT record name, so look it up once.
+	records, err := lookupVerificationRecords(resolver, claims[0])
+
+	if err != nil {
+		return claims[0], err
+	}
+
+	for i := range claims {
+		if containsRecord(records, claims[i].VerificationValue()) {
+			err := markDomainVerified(db, &claims[i])
+			return claims[i], err
+		}
+	}
+
+	return claims[0], ErrDomainNotVerified
+}
+
+func lookupVerificationRecords(resolver TXTResolver, domain TenantDomain) ([]string, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	records, err := resolver.LookupTXT(ctx, domain.VerificationRecord())
+
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", ErrDomainNotVerified, err)
+	}
+
+	return records, nil
+}
+
+// Marks the domain verified and removes every other tenants pending claim on the hostname.
+func markDomainVerified(db *gorm.DB, domain *TenantDomain) error {
+
+	now := time.Now().UTC()
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(domain).Update("verified_at", now).Error; err != nil {
+			return err
+		}
+
+		// Hard delete so the claims don't linger as soft deleted rows.
+		return tx.Unscoped().Where("hostname = ? AND id <> ? AND verified_at IS NULL", domain.Hostname, domain.ID).Delete(&TenantDomain{}).Error
+	})
+
+	if err != nil {
+		return err
+	}
+
+	domain.VerifiedAt = &now
+
+	return nil
+}
+
+func containsRecord(records []string, value string) bool {
+	for _, record := range records {
+		if strings.TrimSpace(record) == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Finds the tenant that owns the exact verified hostname.
+func FindTenantByDomain(db *gorm.DB, hostname string) (TenantConnectionInformation, error) {
+
+	var domain TenantDomain
+	var tenant TenantConnectionInformation
+
+	if err := db.Where("hostname = ? AND verified_at IS NOT NULL", NormalizeHost(hostname)).First(&domain).Error; err != nil {
+		return tenant, err
+	}
+
+	err := db.First(&tenant, domain.TenantConnectionInformationId).Error
+
+	return tenant, err
+}
+
+// Checks the hostname is made of valid DNS labels and isn't an IP address.
+func ValidHostname(hostname string) bool {
+
+	if len(hostname) == 0 || len(hostname) > 253 || net.ParseIP(hostname) != nil || !strings.Contains(hostname, ".") {
+		return false
+	}
+
+	for _, label := range strings.Split(hostname, ".") {
+		if len(label) == 0 || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// Strips the port and trailing dot from a host, lower cases it and converts international names to punycode.
+func NormalizeHost(host string) string {
+
+	host = strings.TrimSpace(host)
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+
+	if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+		host = ascii
+	}
+
+	return strings.ToLower(host)
+}
@@ -0,0 +1,56 @@
+package tests
+
+import (
+	"github.com/LiamDotPro/Go-Multitenancy/middleware"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Checks headers set before the response is held back are kept alongside the ones the handler sets.
+func TestBufferedResponseKeepsUpstreamHeaders(t *testing.T) {
+	router := gin.New()
+	seenUpstream := false
+
+	router.Use(func(c *gin.Context) {
+		http.SetCookie(c.Writer, &http.Cookie{Name: "session", Value: "upstream"})
+		c.Writer.Header().Set("Vary", "Origin")
+		c.Next()
+	})
+
+	router.Use(func(c *gin.Context) {
+		response := middleware.NewBufferedResponseWriter(c.Writer)
+		c.Writer = response
+		c.Next()
+		c.Writer = response.ResponseWriter
+		response.Send()
+	})
+
+	router.GET("/", func(c *gin.Context) {
+		seenUpstream = c.Writer.Header().Get("Vary") == "Origin"
+		http.SetCookie(c.Writer, &http.Cookie{Name: "preference", Value: "handler"})
+		c.String(http.StatusCreated, "done")
+	})
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+
+	if !seenUpstream {
+		t.Error("Expected the handler to see headers set before it..")
+	}
+
+	cookies := map[string]string{}
+
+	for _, cookie := range recorder.Result().Cookies() {
+		cookies[cookie.Name] = cookie.Value
+	}
+
+	if cookies["session"] != "upstream" || cookies["preference"] != "handler" {
+		t.Errorf("Expected both cookies to be sent but found %v..", cookies)
+	}
+
+	if recorder.Code != http.StatusCreated || recorder.Body.String() != "done" || recorder.Header().Get("Vary") != "Origin" {
+		t.Errorf("Expected the held back response to be sent as written but found %d %q..", recorder.Code, recorder.Body.String())
+	}
+}
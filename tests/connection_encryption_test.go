@@ -0,0 +1,71 @@
+package tests
+
+import (
+	"bytes"
+	"github.com/LiamDotPro/Go-Multitenancy/tenants"
+	"strings"
+	"testing"
+)
+
+func testKeyProvider(t *testing.T, current string) tenants.KeyProvider {
+	provider, err := tenants.NewLocalKeyProvider(map[string][]byte{
+		"2023": bytes.Repeat([]byte{1}, 32),
+		"2024": bytes.Repeat([]byte{2}, 32),
+	}, current)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return provider
+}
+
+func TestConnectionStringEncryption(t *testing.T) {
+	defer tenants.SetKeyProvider(nil)
+
+	plaintext := "host=db dbname=tenant_acme user=tenant_acme__a password=secret"
+
+	// Stored before a key was configured.
+	if decrypted, err := tenants.DecryptConnectionString(plaintext); err != nil || decrypted != plaintext {
+		t.Errorf("Expected plaintext connection strings to be read as they are but got %v %v..", decrypted, err)
+	}
+
+	tenants.SetKeyProvider(testKeyProvider(t, "2023"))
+
+	encrypted, err := tenants.EncryptConnectionString(plaintext)
+
+	if err != nil || strings.Contains(encrypted, "secret") || tenants.EncryptionKeyId(encrypted) != "2023" {
+		t.Fatalf("Expected the connection string to be encrypted with 2023 but got %v %v..", encrypted, err)
+	}
+
+	if decrypted, err := tenants.DecryptConnectionString(encrypted); err != nil || decrypted != plaintext {
+		t.Errorf("Expected the connection string back but got %v %v..", decrypted, err)
+	}
+
+	// Rotating the master key keeps the old one around until everything has been re-encrypted.
+	tenants.SetKeyProvider(testKeyProvider(t, "2024"))
+
+	reencrypted, changed, err := tenants.ReencryptConnectionString(encrypted)
+
+	if err != nil || !changed || tenants.EncryptionKeyId(reencrypted) != "2024" {
+		t.Fatalf("Expected the connection string to be re-encrypted with 2024 but got %v %v..", reencrypted, err)
+	}
+
+	if _, changed, _ := tenants.ReencryptConnectionString(reencrypted); changed {
+		t.Error("Expected a connection string already on the current key to be left alone..")
+	}
+
+	// Swap a character well inside the ciphertext, the last one may only carry padding bits.
+	at := len(reencrypted) - 10
+	swapped := "A"
+
+	if reencrypted[at:at+1] == swapped {
+		swapped = "B"
+	}
+
+	tampered := reencrypted[:at] + swapped + reencrypted[at+1:]
+
+	if _, err := tenants.DecryptConnectionString(tampered); err == nil {
+		t.Error("Expected a changed ciphertext to fail to decrypt..")
+	}
+}
@@ -0,0 +1,183 @@
+package tests
+
+import (
+	"github.com/LiamDotPro/Go-Multitenancy/tenants"
+	"github.com/jinzhu/gorm"
+	"testing"
+	"time"
+)
+
+// Creates a connection manager that opens an in memory sqlite database for every pool.
+func newTestConnectionManager(t *testing.T, options tenants.ConnectionManagerOptions) *tenants.ConnectionManager {
+	options.Open = func(tenant tenants.TenantConnectionInformation, replica *tenants.ReadReplica) (*gorm.DB, error) {
+		return gorm.Open("sqlite3", ":memory:")
+	}
+
+	manager := tenants.NewConnectionManager(options)
+
+	t.Cleanup(func() { manager.Close() })
+
+	return manager
+}
+
+func databaseTenant(id uint, identifier string, connectionString string) tenants.TenantConnectionInformation {
+	tenant := tenants.TenantConnectionInformation{TenantSubDomainIdentifier: identifier, ConnectionString: connectionString, IsolationMode: tenants.IsolationDatabase}
+	tenant.ID = id
+	return tenant
+}
+
+// Checks a pool is closed once the grace period after it was retired has passed, not straight away.
+func expectRetired(t *testing.T, db *gorm.DB, gracePeriod time.Duration) {
+	t.Helper()
+
+	if err := db.DB().Ping(); err != nil {
+		t.Error("A retired pool should stay open during the grace period..", err)
+	}
+
+	time.Sleep(gracePeriod * 5)
+
+	if err := db.DB().Ping(); err == nil {
+		t.Error("A retired pool should be closed after the grace period..")
+	}
+}
+
+func poolIdentifiers(manager *tenants.ConnectionManager) []string {
+	var identifiers []string
+
+	for _, stats := range manager.Stats() {
+		identifiers = append(identifiers, stats.Identifier)
+	}
+
+	return identifiers
+}
+
+// Checks the same pool is handed out until the tenants connection string changes, then the old one is retired.
+func TestConnectionManagerReplacesPoolWhenConnectionStringChanges(t *testing.T) {
+	gracePeriod := 20 * time.Millisecond
+	manager := newTestConnectionManager(t, tenants.ConnectionManagerOptions{GracePeriod: gracePeriod})
+
+	first, err := manager.GetConnection(databaseTenant(1, "acme", "old"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	again, _ := manager.GetConnection(databaseTenant(1, "acme", "old"))
+
+	if again != first {
+		t.Error("The same connection string should reuse the pool..")
+	}
+
+	rotated, err := manager.GetConnection(databaseTenant(1, "acme", "new"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rotated == first {
+		t.Error("A changed connection string should open a new pool..")
+	}
+
+	if len(manager.Stats()) != 1 {
+		t.Errorf("Expected the old pool to be replaced but found %v..", poolIdentifiers(manager))
+	}
+
+	expectRetired(t, first, gracePeriod)
+}
+
+// Checks the least recently used pool makes room once it has been unused for the grace period.
+func TestConnectionManagerEvictsLeastRecentlyUsed(t *testing.T) {
+	gracePeriod := 20 * time.Millisecond
+	manager := newTestConnectionManager(t, tenants.ConnectionManagerOptions{MaxTenants: 2, GracePeriod: gracePeriod})
+
+	manager.GetConnection(databaseTenant(1, "one", "one"))
+	second, _ := manager.GetConnection(databaseTenant(2, "two", "two"))
+
+	time.Sleep(gracePeriod * 2)
+
+	// Using the first tenant again leaves the second as the least recently used.
+	manager.GetConnection(databaseTenant(1, "one", "one"))
+	manager.GetConnection(databaseTenant(3, "three", "three"))
+
+	if identifiers := poolIdentifiers(manager); len(identifiers) != 2 || identifiers[0] != "three" || identifiers[1] != "one" {
+		t.Errorf("Expected the pools of three and one but found %v..", identifiers)
+	}
+
+	expectRetired(t, second, gracePeriod)
+}
+
+// Checks the cap is soft, pools used within the grace period are kept even when over it.
+func TestConnectionManagerKeepsRecentlyUsedPoolsOverCapacity(t *testing.T) {
+	manager := newTestConnectionManager(t, tenants.ConnectionManagerOptions{MaxTenants: 1, GracePeriod: time.Minute})
+
+	manager.GetConnection(databaseTenant(1, "one", "one"))
+	manager.GetConnection(databaseTenant(2, "two", "two"))
+
+	if identifiers := poolIdentifiers(manager); len(identifiers) != 2 {
+		t.Errorf("Expected both pools to be kept but found %v..", identifiers)
+	}
+}
+
+// Checks pools unused for the idle timeout are retired by the janitor.
+func TestConnectionManagerEvictsIdlePools(t *testing.T) {
+	gracePeriod := 20 * time.Millisecond
+	manager := newTestConnectionManager(t, tenants.ConnectionManagerOptions{IdleTimeout: 30 * time.Millisecond, GracePeriod: gracePeriod})
+
+	idle, _ := manager.GetConnection(databaseTenant(1, "one", "one"))
+
+	time.Sleep(100 * time.Millisecond)
+
+	if identifiers := poolIdentifiers(manager); len(identifiers) != 0 {
+		t.Errorf("Expected the idle pool to be evicted but found %v..", identifiers)
+	}
+
+	time.Sleep(gracePeriod * 5)
+
+	if err := idle.DB().Ping(); err == nil {
+		t.Error("An idle pool should be closed after the grace period..")
+	}
+}
+
+// Checks evicting a tenant retires its pools instead of closing them under running requests.
+func TestConnectionManagerEvictRetiresPools(t *testing.T) {
+	gracePeriod := 20 * time.Millisecond
+	manager := newTestConnectionManager(t, tenants.ConnectionManagerOptions{GracePeriod: gracePeriod})
+
+	evicted, _ := manager.GetConnection(databaseTenant(1, "one", "one"))
+	manager.GetConnection(databaseTenant(2, "two", "two"))
+
+	manager.Evict(1)
+
+	if identifiers := poolIdentifiers(manager); len(identifiers) != 1 || identifiers[0] != "two" {
+		t.Errorf("Expected only the pool of two but found %v..", identifiers)
+	}
+
+	expectRetired(t, evicted, gracePeriod)
+}
+
+// Checks stats are reported per pool, most recently used first, with shared table tenants as one pool.
+func TestConnectionManagerStats(t *testing.T) {
+	manager := newTestConnectionManager(t, tenants.ConnectionManagerOptions{MaxOpenConnections: 3})
+
+	manager.GetConnection(databaseTenant(1, "one", "one"))
+	manager.GetConnection(sharedTenant(2))
+	manager.GetConnection(sharedTenant(3))
+
+	stats := manager.Stats()
+
+	if len(stats) != 2 {
+		t.Fatalf("Expected a pool for one and the shared pool but found %v..", stats)
+	}
+
+	if stats[0].Identifier != tenants.IsolationShared || stats[0].TenantId != 0 || stats[0].Isolation != tenants.IsolationShared {
+		t.Errorf("Expected the shared pool first but found %+v..", stats[0])
+	}
+
+	if stats[1].Identifier != "one" || stats[1].TenantId != 1 || stats[1].Isolation != tenants.IsolationDatabase {
+		t.Errorf("Expected the pool of one but found %+v..", stats[1])
+	}
+
+	if stats[1].MaxOpenConnections != 3 || stats[1].LastUsed.IsZero() {
+		t.Errorf("Expected the pool settings to be reported but found %+v..", stats[1])
+	}
+}
@@ -0,0 +1,24 @@
+package tests
+
+import (
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"testing"
+)
+
+// Opens an empty in memory sqlite database, closed when the test finishes.
+func openTestDatabase(t *testing.T) *gorm.DB {
+
+	db, err := gorm.Open("sqlite3", ":memory:")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every connection to :memory: is its own database, so keep to the one.
+	db.DB().SetMaxOpenConns(1)
+
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
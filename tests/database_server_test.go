@@ -0,0 +1,76 @@
+package tests
+
+import (
+	"github.com/LiamDotPro/Go-Multitenancy/tenants"
+	"github.com/jinzhu/gorm"
+	"testing"
+)
+
+func testDatabaseServers() []tenants.DatabaseServer {
+	return []tenants.DatabaseServer{
+		{Model: gorm.Model{ID: 1}, Name: "eu-1", Region: "eu", Weight: 1},
+		{Model: gorm.Model{ID: 2}, Name: "eu-2", Host: "eu-2.db", Port: 5433, Region: "eu", Weight: 2, Capacity: 3},
+		{Model: gorm.Model{ID: 3}, Name: "us-1", Region: "us", Weight: 1, Draining: true},
+	}
+}
+
+func TestLeastLoadedPlacement(t *testing.T) {
+	servers := testDatabaseServers()
+	placement := tenants.TenantPlacement{Policy: tenants.PlacementLeastLoaded}
+
+	// eu-2 has twice the weight, so two tenants on it count the same as one on eu-1.
+	if server, err := tenants.ChooseServer(servers, map[uint]int{1: 1, 2: 1}, placement); err != nil || server.Name != "eu-2" {
+		t.Errorf("Expected eu-2 but got %v %v..", server.Name, err)
+	}
+
+	if server, err := tenants.ChooseServer(servers, map[uint]int{1: 1, 2: 2}, placement); err != nil || server.Name != "eu-1" {
+		t.Errorf("Expected ties to go to eu-1 but got %v %v..", server.Name, err)
+	}
+
+	// eu-2 is at capacity and us-1 is draining.
+	if server, err := tenants.ChooseServer(servers, map[uint]int{1: 5, 2: 3}, placement); err != nil || server.Name != "eu-1" {
+		t.Errorf("Expected full and draining servers to be passed over but got %v %v..", server.Name, err)
+	}
+
+	placement.Region = "us"
+
+	if _, err := tenants.ChooseServer(servers, map[uint]int{}, placement); err != tenants.ErrNoServerAvailable {
+		t.Errorf("Expected no server in us to have room but got %v..", err)
+	}
+}
+
+func TestRoundRobinPlacement(t *testing.T) {
+	servers := testDatabaseServers()[:2]
+	placed := map[string]int{}
+
+	for i := 0; i < 6; i++ {
+		server, err := tenants.ChooseServer(servers, map[uint]int{}, tenants.TenantPlacement{Policy: tenants.PlacementRoundRobin})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		placed[server.Name]++
+		servers[server.ID-1].Placements++
+	}
+
+	if placed["eu-1"] != 2 || placed["eu-2"] != 4 {
+		t.Errorf("Expected servers to take turns by weight but got %v..", placed)
+	}
+}
+
+func TestPinnedPlacement(t *testing.T) {
+	servers := testDatabaseServers()
+
+	if server, err := tenants.ChooseServer(servers, map[uint]int{1: 100}, tenants.TenantPlacement{Policy: tenants.PlacementPinned, ServerId: 1}); err != nil || server.Name != "eu-1" {
+		t.Errorf("Expected the pinned server whatever its load but got %v %v..", server.Name, err)
+	}
+
+	if _, err := tenants.ChooseServer(servers, map[uint]int{}, tenants.TenantPlacement{Policy: tenants.PlacementPinned, ServerId: 3}); err != tenants.ErrServerUnavailable {
+		t.Errorf("Expected a draining pinned server to be refused but got %v..", err)
+	}
+
+	if connectionString := servers[1].ConnectionString("tenant_acme"); connectionString != "host=eu-2.db port=5433 dbname=tenant_acme sslmode=disable" {
+		t.Errorf("Unexpected connection string %v..", connectionString)
+	}
+}
@@ -0,0 +1,73 @@
+package tests
+
+import (
+	"github.com/LiamDotPro/Go-Multitenancy/migrations"
+	"testing"
+)
+
+// Checks hotfixed columns, missing indexes and type changes are all reported.
+func TestCompareSchemas(t *testing.T) {
+	expected := []migrations.TableSchema{
+		{
+			Name: "users",
+			Columns: []migrations.ColumnSchema{
+				{Name: "id", Type: "serial"},
+				{Name: "email", Type: "text"},
+				{Name: "account_type", Type: "integer"},
+			},
+			Indexes: []migrations.IndexSchema{
+				{Name: "users_pkey", Columns: []string{"id"}, Unique: true},
+				{Name: "idx_users_deleted_at", Columns: []string{"deleted_at"}},
+			},
+		},
+		{Name: "invoices"},
+	}
+
+	actual := map[string]migrations.TableSchema{
+		"users": {
+			Name: "users",
+			Columns: []migrations.ColumnSchema{
+				{Name: "id", Type: "integer"},
+				{Name: "email", Type: "character varying(255)"},
+				{Name: "account_type", Type: "integer"},
+				{Name: "legacy_flag", Type: "boolean"},
+			},
+			Indexes: []migrations.IndexSchema{
+				{Name: "users_pkey", Columns: []string{"id"}, Unique: true},
+			},
+		},
+	}
+
+	differences := migrations.CompareSchemas(expected, actual)
+
+	kinds := map[string]bool{}
+
+	for _, d := range differences {
+		kinds[d.Kind] = true
+	}
+
+	for _, kind := range []string{migrations.DriftColumnType, migrations.DriftUnexpectedColumn, migrations.DriftMissingIndex, migrations.DriftMissingTable} {
+		if !kinds[kind] {
+			t.Errorf("Expected a %v difference in %v..", kind, differences)
+		}
+	}
+
+	if len(differences) != 4 {
+		t.Errorf("Expected 4 differences but got %d: %v..", len(differences), differences)
+	}
+}
+
+func TestNormalizeColumnType(t *testing.T) {
+	cases := map[string]string{
+		"serial":       "integer",
+		"varchar(100)": "character varying(100)",
+		"TIMESTAMPTZ":  "timestamp with time zone",
+		"bigint":       "bigint",
+	}
+
+	for input, expected := range cases {
+		if actual := migrations.NormalizeColumnType(input); actual != expected {
+			t.Errorf("Expected %v to normalise to %v but got %v..", input, expected, actual)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package tests
+
+import (
+	"github.com/LiamDotPro/Go-Multitenancy/migrations"
+	"github.com/jinzhu/gorm"
+	"testing"
+)
+
+// Checks statements that lose or rewrite data are flagged.
+func TestIsDestructive(t *testing.T) {
+	destructive := []string{
+		`DROP TABLE "users"`,
+		`ALTER TABLE "users" DROP COLUMN "phone_number"`,
+		`ALTER TABLE users RENAME COLUMN email TO email_address`,
+		`TRUNCATE users`,
+		`DELETE FROM users WHERE id = 1`,
+		`ALTER TABLE users ALTER COLUMN account_type TYPE text`,
+		`UPDATE users SET account_type = 1`,
+		"CREATE TABLE a (id int);\nDELETE FROM users;",
+		"ALTER TABLE a ADD COLUMN b int;\nUPDATE users SET b = 1;",
+		"UPDATE users SET b = 1 WHERE b IS NULL;\nUPDATE users SET c = 1;",
+	}
+
+	for _, sql := range destructive {
+		if !migrations.IsDestructive(sql) {
+			t.Errorf("Expected %q to be flagged as destructive..", sql)
+		}
+	}
+
+	safe := []string{
+		`CREATE TABLE "users" ("id" serial, PRIMARY KEY ("id"))`,
+		`ALTER TABLE "users" ADD "recovery_email" text`,
+		`CREATE INDEX idx_users_deleted_at ON "users"(deleted_at)`,
+		`UPDATE users SET account_type = 1 WHERE account_type IS NULL`,
+		"CREATE TABLE a (id int);\n-- DROP TABLE a;\nINSERT INTO a VALUES (1);",
+		"INSERT INTO notes (body) VALUES ('DROP TABLE a; DELETE FROM users');",
+	}
+
+	for _, sql := range safe {
+		if migrations.IsDestructive(sql) {
+			t.Errorf("Expected %q not to be flagged as destructive..", sql)
+		}
+	}
+}
+
+// Checks statements are split on the semicolons between them and not the ones in strings, bodies or comments.
+func TestSplitStatements(t *testing.T) {
+	sql := `CREATE TABLE a (id int); -- trailing; comment
+INSERT INTO a (body) VALUES ('it''s; quoted');
+/* a; block */ CREATE FUNCTION f() RETURNS int AS $body$ SELECT 1; $body$ LANGUAGE sql;;`
+
+	expected := []string{
+		"CREATE TABLE a (id int)",
+		"INSERT INTO a (body) VALUES ('it''s; quoted')",
+		"CREATE FUNCTION f() RETURNS int AS $body$ SELECT 1; $body$ LANGUAGE sql",
+	}
+
+	statements := migrations.SplitStatements(sql)
+
+	if len(statements) != len(expected) {
+		t.Fatalf("Expected %d statements but found %q..", len(expected), statements)
+	}
+
+	for i, statement := range statements {
+		if statement != expected[i] {
+			t.Errorf("Expected statement %d to be %q but found %q..", i, expected[i], statement)
+		}
+	}
+}
+
+// Checks a SQL migration is planned one statement at a time so only the destructive ones are flagged.
+func TestPlanSplitsSQLMigrations(t *testing.T) {
+	db := openTestDatabase(t)
+	registry := migrations.NewRegistry("test")
+
+	registry.Register(migrations.Migration{Version: 1, Name: "archive", UpSQL: "CREATE TABLE a (id int);\nDELETE FROM users;"})
+
+	plan := registry.Plan(db, "test")
+
+	if len(plan.Migrations) != 1 || !plan.Destructive {
+		t.Fatalf("Expected a destructive plan but found %+v..", plan)
+	}
+
+	statements := plan.Migrations[0].Statements
+
+	if len(statements) != 2 || statements[0].Destructive || !statements[1].Destructive {
+		t.Errorf("Expected only the DELETE to be flagged but found %+v..", statements)
+	}
+}
+
+// Checks planning lists Go migrations without running them and reads SQL migrations without applying them.
+func TestPlanDoesNotRunMigrations(t *testing.T) {
+	db := openTestDatabase(t)
+	registry := migrations.NewRegistry("test")
+	ran := false
+
+	registry.Register(migrations.Migration{Version: 1, Name: "drop notes", UpSQL: "DROP TABLE notes"})
+	registry.Register(migrations.Migration{Version: 2, Name: "backfill", Up: func(db *gorm.DB) error {
+		ran = true
+		return nil
+	}})
+
+	if err := db.Exec("CREATE TABLE notes (id integer)").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	plan := registry.Plan(db, "test")
+
+	if len(plan.Error) > 0 || len(plan.Migrations) != 2 {
+		t.Fatalf("Expected both migrations to be planned but found %+v..", plan)
+	}
+
+	if ran {
+		t.Error("Planning shouldn't run Go migrations..")
+	}
+
+	if !db.HasTable("notes") {
+		t.Error("Planning shouldn't apply SQL migrations..")
+	}
+
+	if sqlMigration := plan.Migrations[0]; !sqlMigration.Previewed || len(sqlMigration.Statements) != 1 || !plan.Destructive {
+		t.Errorf("Expected the SQL migration to be previewed as destructive but found %+v..", sqlMigration)
+	}
+
+	if goMigration := plan.Migrations[1]; goMigration.Previewed || len(goMigration.Statements) != 0 || goMigration.Name != "backfill" {
+		t.Errorf("Expected the Go migration to be listed without statements but found %+v..", goMigration)
+	}
+
+	if db.HasTable(migrations.DefaultLedger) {
+		t.Error("Planning shouldn't create the ledger..")
+	}
+}
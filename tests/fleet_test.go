@@ -0,0 +1,33 @@
+package tests
+
+import (
+	"errors"
+	"github.com/LiamDotPro/Go-Multitenancy/migrations"
+	"testing"
+	"time"
+)
+
+// Checks one failing or hanging tenant doesn't stop the rest of the fleet.
+func TestRunFleetIsolatesFailures(t *testing.T) {
+	targets := []migrations.FleetTarget{
+		{Name: "ok", Migrate: func() error { return nil }},
+		{Name: "broken", Migrate: func() error { return errors.New("broken") }},
+		{Name: "current", Migrate: func() error { return migrations.Skip("already up to date") }},
+		{Name: "hanging", Migrate: func() error { time.Sleep(time.Second); return nil }},
+		{Name: "panics", Migrate: func() error { panic("boom") }},
+	}
+
+	summary := migrations.RunFleet(targets, migrations.FleetOptions{Workers: 2, TenantTimeout: 50 * time.Millisecond})
+
+	if summary.Succeeded != 1 || summary.Failed != 3 || summary.Skipped != 1 {
+		t.Errorf("Unexpected summary counts: %d succeeded, %d failed, %d skipped", summary.Succeeded, summary.Failed, summary.Skipped)
+	}
+
+	expected := []string{migrations.OutcomeSucceeded, migrations.OutcomeFailed, migrations.OutcomeSkipped, migrations.OutcomeFailed, migrations.OutcomeFailed}
+
+	for i, outcome := range expected {
+		if summary.Results[i].Outcome != outcome {
+			t.Errorf("Expected %v to be %v but was %v..", summary.Results[i].Database, outcome, summary.Results[i].Outcome)
+		}
+	}
+}
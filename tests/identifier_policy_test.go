@@ -0,0 +1,69 @@
+package tests
+
+import (
+	"github.com/LiamDotPro/Go-Multitenancy/tenants"
+	"strings"
+	"testing"
+)
+
+func TestIdentifierPolicy(t *testing.T) {
+	policy := tenants.IdentifierPolicy{MinLength: 3, MaxLength: 63, Reserved: []string{"www", "api", "admin", "master"}}
+
+	cases := map[string]string{
+		"acme":                  "",
+		"Acme-Corp":             "",
+		"ab":                    tenants.IdentifierTooShort,
+		strings.Repeat("a", 64): tenants.IdentifierTooLong,
+		"acme_corp":             tenants.IdentifierCharacters,
+		"acme; DROP DATABASE x": tenants.IdentifierCharacters,
+		"1acme":                 tenants.IdentifierStart,
+		"acme-":                 tenants.IdentifierEnd,
+		"xn--bcher-kva":         tenants.IdentifierDoubleHyphen,
+		"Admin":                 tenants.IdentifierReserved,
+	}
+
+	for identifier, code := range cases {
+		err := policy.Validate(identifier)
+
+		if len(code) == 0 {
+			if err != nil {
+				t.Errorf("Expected %v to be allowed but got %v..", identifier, err)
+			}
+			continue
+		}
+
+		problems, ok := err.(*tenants.IdentifierError)
+
+		if !ok {
+			t.Errorf("Expected %v to break the %v rule but got %v..", identifier, code, err)
+			continue
+		}
+
+		found := false
+
+		for _, violation := range problems.Violations {
+			found = found || violation.Code == code
+		}
+
+		if !found {
+			t.Errorf("Expected %v to break the %v rule but got %v..", identifier, code, problems.Violations)
+		}
+	}
+}
+
+func TestPhysicalName(t *testing.T) {
+	if name := tenants.PhysicalName("Acme-Corp"); name != "tenant_acme_corp" {
+		t.Errorf("Expected tenant_acme_corp but got %v..", name)
+	}
+
+	long := strings.Repeat("a", 60) + "-b"
+	name := tenants.PhysicalName(long)
+
+	if len(name) > 63 {
+		t.Errorf("Expected the name to fit in 63 characters but it was %d..", len(name))
+	}
+
+	if name == tenants.PhysicalName(strings.Repeat("a", 60)+"-c") {
+		t.Error("Expected shortened names to stay unique..")
+	}
+}
@@ -0,0 +1,48 @@
+package tests
+
+import (
+	"github.com/LiamDotPro/Go-Multitenancy/tenants"
+	"github.com/jinzhu/gorm"
+	"testing"
+	"time"
+)
+
+func TestLookupCacheNegativeEntriesExpireFirst(t *testing.T) {
+	cache := tenants.NewLookupCache(tenants.LookupCacheOptions{TTL: time.Minute, NegativeTTL: 10 * time.Millisecond})
+
+	cache.Put(tenants.IdentifierCacheKey("Acme"), tenants.LookupEntry{Tenant: tenants.TenantConnectionInformation{Model: gorm.Model{ID: 1}}, Found: true})
+	cache.Put(tenants.IdentifierCacheKey("unknown"), tenants.LookupEntry{})
+
+	time.Sleep(20 * time.Millisecond)
+
+	if _, found := cache.Get(tenants.IdentifierCacheKey("acme")); !found {
+		t.Error("Expected the tenant to still be cached..")
+	}
+
+	if _, found := cache.Get(tenants.IdentifierCacheKey("unknown")); found {
+		t.Error("Expected the unknown identifier to have expired..")
+	}
+}
+
+// Renaming a tenant has to drop every entry pointing at it, including aliases the caller didn't name.
+func TestLookupCacheInvalidatesByTenant(t *testing.T) {
+	cache := tenants.NewLookupCache(tenants.LookupCacheOptions{TTL: time.Minute, NegativeTTL: time.Minute})
+	acme := tenants.TenantConnectionInformation{Model: gorm.Model{ID: 1}}
+
+	cache.Put(tenants.IdentifierCacheKey("acme"), tenants.LookupEntry{Tenant: acme, Found: true})
+	cache.Put(tenants.IdentifierCacheKey("acme-old"), tenants.LookupEntry{Tenant: acme, Aliased: true, Found: true})
+	cache.Put(tenants.IdentifierCacheKey("other"), tenants.LookupEntry{Tenant: tenants.TenantConnectionInformation{Model: gorm.Model{ID: 2}}, Found: true})
+	cache.Put(tenants.IdentifierCacheKey("acme-new"), tenants.LookupEntry{})
+
+	cache.Invalidate(1, tenants.IdentifierCacheKey("acme-new"))
+
+	for _, identifier := range []string{"acme", "acme-old", "acme-new"} {
+		if _, found := cache.Get(tenants.IdentifierCacheKey(identifier)); found {
+			t.Errorf("Expected %v to have been invalidated..", identifier)
+		}
+	}
+
+	if _, found := cache.Get(tenants.IdentifierCacheKey("other")); !found {
+		t.Error("Expected other tenants to stay cached..")
+	}
+}
@@ -0,0 +1,149 @@
+package tests
+
+import (
+	"errors"
+	"github.com/LiamDotPro/Go-Multitenancy/migrations"
+	"github.com/jinzhu/gorm"
+	"testing"
+	"time"
+)
+
+// Holds the named lock in the background until the returned func is called.
+func holdMigrationLock(t *testing.T, db *gorm.DB, name string) (release func()) {
+	held := make(chan struct{})
+	done := make(chan struct{})
+	finished := make(chan error)
+
+	go func() {
+		finished <- migrations.WithLock(db, name, migrations.LockOptions{Mode: migrations.LockSkip, Lease: time.Minute}, func() error {
+			close(held)
+			<-done
+			return nil
+		})
+	}()
+
+	select {
+	case <-held:
+	case err := <-finished:
+		t.Fatal("Could not take the lock..", err)
+	}
+
+	return func() {
+		close(done)
+
+		if err := <-finished; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// Checks skip mode gives up straight away while another instance holds the lock.
+func TestWithLockSkipsWhenHeld(t *testing.T) {
+	db := openTestDatabase(t)
+	release := holdMigrationLock(t, db, "master")
+	defer release()
+
+	ran := false
+
+	err := migrations.WithLock(db, "master", migrations.LockOptions{Mode: migrations.LockSkip, Lease: time.Minute}, func() error {
+		ran = true
+		return nil
+	})
+
+	if err != migrations.ErrLockNotAcquired || ran {
+		t.Errorf("Expected ErrLockNotAcquired without running but found %v..", err)
+	}
+
+	// Other lock names aren't held up.
+	if err := migrations.WithLock(db, "tenant:1", migrations.LockOptions{Mode: migrations.LockSkip, Lease: time.Minute}, func() error { return nil }); err != nil {
+		t.Errorf("A different lock name should be free but found %v..", err)
+	}
+}
+
+// Checks wait mode runs once the other instance lets go of the lock.
+func TestWithLockWaitsForRelease(t *testing.T) {
+	db := openTestDatabase(t)
+	release := holdMigrationLock(t, db, "master")
+
+	time.AfterFunc(50*time.Millisecond, release)
+
+	ran := false
+	options := migrations.LockOptions{Mode: migrations.LockWait, Timeout: 5 * time.Second, RetryInterval: 10 * time.Millisecond, Lease: time.Minute}
+
+	err := migrations.WithLock(db, "master", options, func() error {
+		ran = true
+		return nil
+	})
+
+	if err != nil || !ran {
+		t.Errorf("Expected to run once the lock was released but found %v..", err)
+	}
+}
+
+// Checks wait mode gives up once the timeout passes.
+func TestWithLockTimesOut(t *testing.T) {
+	db := openTestDatabase(t)
+	release := holdMigrationLock(t, db, "master")
+	defer release()
+
+	options := migrations.LockOptions{Mode: migrations.LockWait, Timeout: 50 * time.Millisecond, RetryInterval: 10 * time.Millisecond, Lease: time.Minute}
+
+	if err := migrations.WithLock(db, "master", options, func() error { return nil }); err != migrations.ErrLockTimeout {
+		t.Errorf("Expected ErrLockTimeout but found %v..", err)
+	}
+}
+
+// Checks a lock row left behind by an instance that died is taken over once its lease has run out.
+func TestWithLockTakesOverExpiredLockRow(t *testing.T) {
+	db := openTestDatabase(t)
+
+	if err := db.AutoMigrate(&migrations.MigrationLock{}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	past := time.Now().UTC().Add(-time.Hour)
+	db.Create(&migrations.MigrationLock{Name: "master", Owner: "gone:1", AcquiredAt: past, ExpiresAt: past.Add(time.Minute)})
+
+	ran := false
+
+	err := migrations.WithLock(db, "master", migrations.LockOptions{Mode: migrations.LockSkip, Lease: time.Minute}, func() error {
+		ran = true
+		return nil
+	})
+
+	if err != nil || !ran {
+		t.Errorf("Expected the expired lock to be taken over but found %v..", err)
+	}
+}
+
+// Checks the lock row is removed once fn returns, even when it fails.
+func TestWithLockReleasesLockRow(t *testing.T) {
+	db := openTestDatabase(t)
+	failure := errors.New("migration failed")
+
+	if err := migrations.WithLock(db, "master", migrations.LockOptions{Mode: migrations.LockSkip, Lease: time.Minute}, func() error { return failure }); err != failure {
+		t.Errorf("Expected the error from fn but found %v..", err)
+	}
+
+	var count int
+	db.Model(&migrations.MigrationLock{}).Count(&count)
+
+	if count != 0 {
+		t.Errorf("Expected the lock row to be removed but found %d..", count)
+	}
+}
+
+// Checks the lock row's lease is renewed while fn runs, so a migration outlasting its lease isn't taken over.
+func TestWithLockRenewsLockRow(t *testing.T) {
+	db := openTestDatabase(t)
+	options := migrations.LockOptions{Mode: migrations.LockSkip, Lease: 300 * time.Millisecond}
+
+	err := migrations.WithLock(db, "master", options, func() error {
+		time.Sleep(2 * options.Lease)
+		return migrations.WithLock(db, "master", options, func() error { return nil })
+	})
+
+	if err != migrations.ErrLockNotAcquired {
+		t.Errorf("Expected the lock to still be held once its first lease ran out but found %v..", err)
+	}
+}
@@ -0,0 +1,111 @@
+package tests
+
+import (
+	"github.com/LiamDotPro/Go-Multitenancy/migrations"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Checks migrations are kept in version order no matter the order they are registered in.
+func TestRegistryOrdersMigrations(t *testing.T) {
+	registry := migrations.NewRegistry("test")
+
+	registry.Register(migrations.Migration{Version: 3, Name: "third"})
+	registry.Register(migrations.Migration{Version: 1, Name: "first"})
+	registry.Register(migrations.Migration{Version: 2, Name: "second"})
+
+	registered := registry.Migrations()
+
+	for i, name := range []string{"first", "second", "third"} {
+		if registered[i].Name != name {
+			t.Errorf("Expected %v at position %d but found %v..", name, i, registered[i].Name)
+		}
+	}
+
+	if registry.LatestVersion() != 3 {
+		t.Error("Latest version should be the highest registered version..")
+	}
+}
+
+// Checks registering the same version twice is refused.
+func TestRegistryRejectsDuplicateVersions(t *testing.T) {
+	registry := migrations.NewRegistry("test")
+	registry.Register(migrations.Migration{Version: 1, Name: "first"})
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Registering a duplicate version should panic..")
+		}
+	}()
+
+	registry.Register(migrations.Migration{Version: 1, Name: "again"})
+}
+
+// Checks up and down SQL files are paired into a single migration.
+func TestRegisterSQLDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrations")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"0002_add_index.up.sql":   "CREATE INDEX idx_users_email ON users (email);",
+		"0002_add_index.down.sql": "DROP INDEX idx_users_email;",
+		"README.txt":              "not a migration",
+	}
+
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	registry := migrations.NewRegistry("test")
+
+	if err := registry.RegisterSQLDirectory(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	registered := registry.Migrations()
+
+	if len(registered) != 1 {
+		t.Fatalf("Expected a single migration but found %d..", len(registered))
+	}
+
+	if registered[0].Version != 2 || registered[0].Name != "add_index" || len(registered[0].DownSQL) == 0 {
+		t.Errorf("SQL migration was not parsed correctly: %#v", registered[0])
+	}
+}
+
+func TestRegistriesKeepSeparateLedgers(t *testing.T) {
+	db := openTestDatabase(t)
+
+	master := migrations.NewRegistry("master")
+	master.Register(migrations.Migration{Version: 1, Name: "master", UpSQL: "CREATE TABLE accounts (id integer)"})
+
+	tenant := migrations.NewRegistry("tenant")
+	tenant.SetLedger("tenant_schema_migrations")
+	tenant.Register(migrations.Migration{Version: 1, Name: "tenant", UpSQL: "CREATE TABLE users (id integer)"})
+
+	if _, err := master.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// The masters version 1 lives in schema_migrations, which isn't the tenants even though it is there.
+	if pending, err := tenant.Pending(db); err != nil || len(pending) != 1 {
+		t.Fatalf("Expected the tenant migration to be pending but got %v %v..", pending, err)
+	}
+
+	if _, err := tenant.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	if !db.HasTable("users") || !db.HasTable("tenant_schema_migrations") || !db.HasTable("schema_migrations") {
+		t.Error("Expected the tenant migration to run with its own ledger next to the masters..")
+	}
+}
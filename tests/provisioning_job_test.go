@@ -0,0 +1,385 @@
+package tests
+
+import (
+	"errors"
+	"github.com/LiamDotPro/Go-Multitenancy/tenants"
+	"github.com/jinzhu/gorm"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Opens a test database with the provisioning job tables.
+func openProvisioningDatabase(t *testing.T) *gorm.DB {
+	db := openTestDatabase(t)
+
+	if err := db.AutoMigrate(&tenants.ProvisioningJob{}, &tenants.ProvisioningStep{}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+// Checks only running jobs with a lapsed lease, or old jobs without a lease and no recent update, count as stale.
+func TestProvisioningJobStale(t *testing.T) {
+	now := time.Now()
+	staleBefore := now.Add(-30 * time.Minute)
+	expired := now.Add(-time.Second)
+	renewed := now.Add(time.Minute)
+
+	cases := []struct {
+		name  string
+		job   tenants.ProvisioningJob
+		stale bool
+	}{
+		{"live lease on a long migration", tenants.ProvisioningJob{Status: tenants.ProvisioningMigrating, LeaseExpiresAt: &renewed, Model: gorm.Model{UpdatedAt: now.Add(-time.Hour)}}, false},
+		{"lapsed lease", tenants.ProvisioningJob{Status: tenants.ProvisioningMigrating, LeaseExpiresAt: &expired, Model: gorm.Model{UpdatedAt: now}}, true},
+		{"no lease, recently updated", tenants.ProvisioningJob{Status: tenants.ProvisioningSeeding, Model: gorm.Model{UpdatedAt: now}}, false},
+		{"no lease, not updated since the cutoff", tenants.ProvisioningJob{Status: tenants.ProvisioningSeeding, Model: gorm.Model{UpdatedAt: now.Add(-time.Hour)}}, true},
+		{"queued", tenants.ProvisioningJob{Status: tenants.ProvisioningQueued, Model: gorm.Model{UpdatedAt: now.Add(-time.Hour)}}, false},
+		{"ready", tenants.ProvisioningJob{Status: tenants.ProvisioningReady, LeaseExpiresAt: &expired}, false},
+		{"failed", tenants.ProvisioningJob{Status: tenants.ProvisioningFailed, LeaseExpiresAt: &expired}, false},
+	}
+
+	for _, c := range cases {
+		if c.job.Stale(now, staleBefore) != c.stale {
+			t.Errorf("Expected %v to be stale: %v..", c.name, c.stale)
+		}
+	}
+}
+
+// Checks a job whose lease is being renewed isn't listed as unfinished, however long ago it started.
+func TestUnfinishedProvisioningJobsSkipsLeasedJobs(t *testing.T) {
+	db := openProvisioningDatabase(t)
+
+	running, claimed, err := claimTestJob(db, "running", time.Minute)
+
+	if err != nil || !claimed {
+		t.Fatal("Could not claim the job..", err)
+	}
+
+	interrupted, _, err := claimTestJob(db, "interrupted", time.Minute)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both jobs started well before the cutoff, only the interrupted one lost its lease.
+	old := time.Now().Add(-time.Hour)
+	db.Model(&tenants.ProvisioningJob{}).Where("id IN (?)", []uint{running.ID, interrupted.ID}).UpdateColumn("updated_at", old)
+	db.Model(&interrupted).UpdateColumn("lease_expires_at", old)
+
+	if err := tenants.RenewProvisioningLease(db, running.ID, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, err := tenants.UnfinishedProvisioningJobs(db, time.Now().Add(-30*time.Minute))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(jobs) != 1 || jobs[0].ID != interrupted.ID {
+		t.Errorf("Expected only the interrupted job to be unfinished but found %v..", jobs)
+	}
+}
+
+// Checks reconcile can only take over a job once its lease has run out, and only once.
+func TestReclaimProvisioningJobNeedsAnExpiredLease(t *testing.T) {
+	db := openProvisioningDatabase(t)
+	staleBefore := time.Now().Add(-30 * time.Minute)
+
+	job, _, err := claimTestJob(db, "acme", time.Minute)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claimed, err := tenants.ReclaimProvisioningJob(db, &job, staleBefore, time.Minute); err != nil || claimed {
+		t.Error("A job with a live lease shouldn't be reclaimed..", err)
+	}
+
+	db.Model(&job).UpdateColumn("lease_expires_at", time.Now().Add(-time.Second))
+
+	if claimed, err := tenants.ReclaimProvisioningJob(db, &job, staleBefore, time.Minute); err != nil || !claimed {
+		t.Error("A job with a lapsed lease should be reclaimed..", err)
+	}
+
+	if claimed, _ := tenants.ReclaimProvisioningJob(db, &job, staleBefore, time.Minute); claimed {
+		t.Error("A reclaimed job holds a new lease and shouldn't be reclaimed again..")
+	}
+}
+
+// Checks finished jobs give up their lease.
+func TestFinishProvisioningJobClearsLease(t *testing.T) {
+	db := openProvisioningDatabase(t)
+
+	job, _, err := claimTestJob(db, "acme", time.Minute)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tenants.FinishProvisioningJob(db, &job, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := tenants.FindProvisioningJob(db, job.ID)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if found.LeaseExpiresAt != nil || found.Status != tenants.ProvisioningReady {
+		t.Errorf("Expected a ready job without a lease but found %v with lease %v..", found.Status, found.LeaseExpiresAt)
+	}
+}
+
+// Queues and claims a job for the identifier.
+func claimTestJob(db *gorm.DB, identifier string, lease time.Duration) (tenants.ProvisioningJob, bool, error) {
+	queued, err := tenants.QueueProvisioningJob(db, identifier, tenants.IsolationShared, tenants.TenantPlacement{})
+
+	if err != nil {
+		return queued, false, err
+	}
+
+	return tenants.ClaimProvisioningJob(db, queued.ID, lease)
+}
+
+// Checks a second unfinished job for the same identifier is turned away by the index, even when the in progress check was passed.
+func TestQueueProvisioningJobOncePerIdentifier(t *testing.T) {
+	db := openProvisioningDatabase(t)
+
+	if err := tenants.AddProvisioningIdentifierIndex(db); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := tenants.QueueProvisioningJob(db, "acme", tenants.IsolationShared, tenants.TenantPlacement{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tenants.QueueProvisioningJob(db, "ACME", tenants.IsolationShared, tenants.TenantPlacement{}); err != tenants.ErrProvisioningInProgress {
+		t.Errorf("Expected a second job for the identifier to be refused but found %v..", err)
+	}
+
+	if err := db.Model(&first).Update("status", tenants.ProvisioningFailed).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tenants.QueueProvisioningJob(db, "acme", tenants.IsolationShared, tenants.TenantPlacement{}); err != nil {
+		t.Errorf("Expected the identifier to be free again once the job failed but found %v..", err)
+	}
+}
+
+// Checks only ready and failed jobs count as finished.
+func TestProvisioningJobFinished(t *testing.T) {
+	finished := map[string]bool{
+		tenants.ProvisioningQueued:           false,
+		tenants.ProvisioningCreatingDatabase: false,
+		tenants.ProvisioningMigrating:        false,
+		tenants.ProvisioningSeeding:          false,
+		tenants.ProvisioningRollingBack:      false,
+		tenants.ProvisioningReady:            true,
+		tenants.ProvisioningFailed:           true,
+	}
+
+	for status, expected := range finished {
+		if (tenants.ProvisioningJob{Status: status}).Finished() != expected {
+			t.Errorf("Expected a %v job finished to be %v..", status, expected)
+		}
+	}
+}
+
+// Checks a step is only undone once it has finished without an error and hasn't been undone already.
+func TestProvisioningStepNeedsCompensation(t *testing.T) {
+	now := time.Now()
+
+	cases := []struct {
+		name  string
+		step  tenants.ProvisioningStep
+		needs bool
+	}{
+		{"running", tenants.ProvisioningStep{}, false},
+		{"failed", tenants.ProvisioningStep{FinishedAt: &now, Error: "boom"}, false},
+		{"done", tenants.ProvisioningStep{FinishedAt: &now}, true},
+		{"done, undo failed", tenants.ProvisioningStep{FinishedAt: &now, CompensationError: "still there"}, true},
+		{"undone", tenants.ProvisioningStep{FinishedAt: &now, CompensatedAt: &now}, false},
+		{"failed, undone if failed", tenants.ProvisioningStep{FinishedAt: &now, Error: "boom", UndoIfFailed: true}, true},
+		{"cut off, undone if failed", tenants.ProvisioningStep{UndoIfFailed: true}, true},
+		{"failed, undone", tenants.ProvisioningStep{FinishedAt: &now, Error: "boom", UndoIfFailed: true, CompensatedAt: &now}, false},
+	}
+
+	for _, c := range cases {
+		if c.step.NeedsCompensation() != c.needs {
+			t.Errorf("Expected a %v step to need compensation: %v..", c.name, c.needs)
+		}
+	}
+}
+
+// Checks finishing a step records when it finished and its error.
+func TestFinishProvisioningStep(t *testing.T) {
+	db := openProvisioningDatabase(t)
+
+	job, _, err := claimTestJob(db, "acme", time.Minute)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := runTestStep(t, db, &job, "role", nil)
+	failed := runTestStep(t, db, &job, "database", errors.New("disk full"))
+
+	found, err := tenants.FindProvisioningJob(db, job.ID)
+
+	if err != nil || len(found.Steps) != 2 {
+		t.Fatalf("Expected the job with both steps but found %+v, %v..", found, err)
+	}
+
+	if found.Steps[0].ID != done.ID || found.Steps[0].FinishedAt == nil || len(found.Steps[0].Error) > 0 || !found.Steps[0].NeedsCompensation() {
+		t.Errorf("Expected the first step to be done but found %+v..", found.Steps[0])
+	}
+
+	if found.Steps[1].ID != failed.ID || found.Steps[1].FinishedAt == nil || found.Steps[1].Error != "disk full" {
+		t.Errorf("Expected the second step to have failed but found %+v..", found.Steps[1])
+	}
+}
+
+// Checks finished steps are undone last first, carrying on past a failed undo, and only the failed undo is retried later.
+func TestCompensateProvisioningStepsInReverse(t *testing.T) {
+	db := openProvisioningDatabase(t)
+
+	job, _, err := claimTestJob(db, "acme", time.Minute)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var finished []tenants.ProvisioningStep
+
+	for _, name := range []string{"placement", "role", "database", "record"} {
+		finished = append(finished, runTestStep(t, db, &job, name, nil))
+	}
+
+	// The step that failed the job isn't undone.
+	runTestStep(t, db, &job, "migrations", errors.New("bad migration"))
+
+	var undone []string
+
+	undo := func(step tenants.ProvisioningStep) error {
+		undone = append(undone, step.Name)
+
+		if step.Name == "database" {
+			return errors.New("database in use")
+		}
+
+		return nil
+	}
+
+	if err := tenants.CompensateProvisioningSteps(db, &job, finished, undo); err == nil {
+		t.Error("Expected the failed undo to be reported..")
+	}
+
+	if expected := []string{"record", "database", "role", "placement"}; !reflect.DeepEqual(undone, expected) {
+		t.Errorf("Expected the steps to be undone in the order %v but found %v..", expected, undone)
+	}
+
+	found, err := tenants.FindProvisioningJob(db, job.ID)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if found.Status != tenants.ProvisioningRollingBack {
+		t.Errorf("Expected the job to be rolling back but found %v..", found.Status)
+	}
+
+	// Only the step that couldn't be undone is tried again, e.g. by reconcile.
+	undone = nil
+
+	if err := tenants.CompensateProvisioningSteps(db, &found, found.Steps, undo); err == nil {
+		t.Error("Expected the undo to fail again..")
+	}
+
+	if expected := []string{"database"}; !reflect.DeepEqual(undone, expected) {
+		t.Errorf("Expected only %v to be retried but found %v..", expected, undone)
+	}
+
+	for _, step := range found.Steps {
+		if step.Name == "database" && step.CompensationError != "database in use" {
+			t.Errorf("Expected the undo error to be kept on the step but found %q..", step.CompensationError)
+		}
+	}
+}
+
+// Checks a failing seed is undone along with the steps before it, as seeds only delete the tenants rows when undone.
+func TestCompensateProvisioningStepsUndoesFailedSeed(t *testing.T) {
+	db := openProvisioningDatabase(t)
+
+	job, _, err := claimTestJob(db, "acme", time.Minute)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var started []tenants.ProvisioningStep
+
+	for _, name := range []string{"record", "migrations"} {
+		started = append(started, runTestStep(t, db, &job, name, nil))
+	}
+
+	seed, err := tenants.StartProvisioningStep(db, &job, "seed", tenants.ProvisioningSeeding, true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tenants.FinishProvisioningStep(db, &seed, errors.New("duplicate key")); err != nil {
+		t.Fatal(err)
+	}
+
+	started = append(started, seed)
+
+	var undone []string
+
+	undo := func(step tenants.ProvisioningStep) error {
+		undone = append(undone, step.Name)
+		return nil
+	}
+
+	if err := tenants.CompensateProvisioningSteps(db, &job, started, undo); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"seed", "migrations", "record"}; !reflect.DeepEqual(undone, expected) {
+		t.Errorf("Expected the steps to be undone in the order %v but found %v..", expected, undone)
+	}
+
+	found, err := tenants.FindProvisioningJob(db, job.ID)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, step := range found.Steps {
+		if step.Name == "seed" && (step.CompensatedAt == nil || step.Error != "duplicate key") {
+			t.Errorf("Expected the failed seed to keep its error and be undone but found %+v..", step)
+		}
+	}
+}
+
+// Starts and finishes a step of the job with the given error.
+func runTestStep(t *testing.T, db *gorm.DB, job *tenants.ProvisioningJob, name string, stepErr error) tenants.ProvisioningStep {
+	step, err := tenants.StartProvisioningStep(db, job, name, tenants.ProvisioningCreatingDatabase, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tenants.FinishProvisioningStep(db, &step, stepErr); err != nil {
+		t.Fatal(err)
+	}
+
+	return step
+}
@@ -0,0 +1,44 @@
+package tests
+
+import (
+	"github.com/LiamDotPro/Go-Multitenancy/migrations"
+	"testing"
+)
+
+// Checks canary tenants go first, then the percentage waves fill up in rollout order.
+func TestAssignWaves(t *testing.T) {
+	var candidates []migrations.RolloutCandidate
+
+	for id := uint(1); id <= 20; id++ {
+		candidates = append(candidates, migrations.RolloutCandidate{TenantID: id, Order: int(20 - id)})
+	}
+
+	candidates[9].Tags = []string{"Canary"}
+
+	waves := migrations.AssignWaves(migrations.DefaultWaves(), candidates)
+
+	if len(waves[0]) != 1 || waves[0][0].TenantID != 10 {
+		t.Fatalf("Expected only the canary tenant in the first wave but got %v..", waves[0])
+	}
+
+	// 10% of 20 tenants is 2, the canary already counts as one of them.
+	if len(waves[1]) != 1 || waves[1][0].TenantID != 20 {
+		t.Errorf("Expected the lowest ordered tenant to top up the second wave but got %v..", waves[1])
+	}
+
+	if len(waves[2]) != 18 {
+		t.Errorf("Expected everyone else in the last wave but got %d tenants..", len(waves[2]))
+	}
+}
+
+func TestParseWavesRejectsEmptyList(t *testing.T) {
+	if _, err := migrations.ParseWaves("[]"); err == nil {
+		t.Error("Expected an empty wave list to be rejected..")
+	}
+
+	waves, err := migrations.ParseWaves("")
+
+	if err != nil || len(waves) != len(migrations.DefaultWaves()) {
+		t.Errorf("Expected the default waves when nothing is configured, got %v %v..", waves, err)
+	}
+}
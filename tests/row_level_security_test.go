@@ -0,0 +1,26 @@
+package tests
+
+import (
+	"github.com/LiamDotPro/Go-Multitenancy/tenants"
+	"strings"
+	"testing"
+)
+
+// Checks the policy is keyed on the current tenant setting and forced onto the table owner.
+func TestRowLevelSecurityStatements(t *testing.T) {
+	statements := tenants.RowLevelSecurityStatements("users")
+
+	joined := strings.Join(statements, ";")
+
+	if !strings.Contains(joined, `ALTER TABLE "users" FORCE ROW LEVEL SECURITY`) {
+		t.Error("Row level security was not forced onto the table owner..")
+	}
+
+	if !strings.Contains(joined, "current_setting('app.current_tenant', true)") {
+		t.Error("Policy is not keyed on the current tenant setting..")
+	}
+
+	if !strings.HasPrefix(statements[len(statements)-1], `CREATE POLICY "users_tenant_isolation" ON "users"`) {
+		t.Error("Policy should be created last so it can be dropped and recreated..")
+	}
+}
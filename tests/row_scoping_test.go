@@ -0,0 +1,150 @@
+package tests
+
+import (
+	"github.com/LiamDotPro/Go-Multitenancy/tenants"
+	"github.com/jinzhu/gorm"
+	"testing"
+)
+
+// A shared tenant table, picked up by row scoping through its TenantId field.
+type scopedNote struct {
+	gorm.Model
+	TenantId uint
+	Body     string
+}
+
+// A table that isn't shared between tenants.
+type unscopedNote struct {
+	gorm.Model
+	Body string
+}
+
+// Opens a test database with row scoping registered and a connection scoped to each of two shared table tenants.
+func openScopedDatabase(t *testing.T) (db *gorm.DB, first *gorm.DB, second *gorm.DB) {
+	db = openTestDatabase(t)
+	tenants.RegisterRowScoping(db)
+
+	if err := db.AutoMigrate(&scopedNote{}, &unscopedNote{}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	first = tenants.ScopeConnection(db, sharedTenant(1))
+	second = tenants.ScopeConnection(db, sharedTenant(2))
+
+	return db, first, second
+}
+
+func sharedTenant(id uint) tenants.TenantConnectionInformation {
+	tenant := tenants.TenantConnectionInformation{IsolationMode: tenants.IsolationShared}
+	tenant.ID = id
+	return tenant
+}
+
+// Checks the tenant id is filled in on create.
+func TestRowScopingAssignsTenantOnCreate(t *testing.T) {
+	_, first, _ := openScopedDatabase(t)
+
+	note := scopedNote{Body: "hello"}
+
+	if err := first.Create(&note).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if note.TenantId != 1 {
+		t.Errorf("Expected the note to belong to tenant 1 but found %d..", note.TenantId)
+	}
+}
+
+// Checks a record can't be created for another tenant.
+func TestRowScopingRefusesCrossTenantWrites(t *testing.T) {
+	_, first, _ := openScopedDatabase(t)
+
+	if err := first.Create(&scopedNote{TenantId: 2, Body: "not mine"}).Error; err != tenants.ErrCrossTenantWrite {
+		t.Errorf("Expected ErrCrossTenantWrite but found %v..", err)
+	}
+
+	if err := first.Create(&scopedNote{TenantId: 1, Body: "mine"}).Error; err != nil {
+		t.Errorf("Writing with the scoped tenant id should be allowed but found %v..", err)
+	}
+}
+
+// Checks shared tables can't be touched through a connection without a tenant scope.
+func TestRowScopingRequiresTenantScope(t *testing.T) {
+	db, first, _ := openScopedDatabase(t)
+
+	note := scopedNote{Body: "hello"}
+
+	if err := first.Create(&note).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Create(&scopedNote{Body: "unscoped"}).Error; err != tenants.ErrMissingTenantScope {
+		t.Errorf("Expected create to fail with ErrMissingTenantScope but found %v..", err)
+	}
+
+	if err := db.Find(&[]scopedNote{}).Error; err != tenants.ErrMissingTenantScope {
+		t.Errorf("Expected find to fail with ErrMissingTenantScope but found %v..", err)
+	}
+
+	if err := db.Model(&note).Update("body", "changed").Error; err != tenants.ErrMissingTenantScope {
+		t.Errorf("Expected update to fail with ErrMissingTenantScope but found %v..", err)
+	}
+
+	if err := db.Delete(&note).Error; err != tenants.ErrMissingTenantScope {
+		t.Errorf("Expected delete to fail with ErrMissingTenantScope but found %v..", err)
+	}
+
+	// Tables without a tenant id aren't scoped.
+	if err := db.Create(&unscopedNote{Body: "free"}).Error; err != nil {
+		t.Errorf("Unscoped tables shouldn't need a tenant scope but found %v..", err)
+	}
+}
+
+// Checks reads, updates and deletes only reach the scoped tenants rows.
+func TestRowScopingAddsTenantToQueries(t *testing.T) {
+	_, first, second := openScopedDatabase(t)
+
+	mine := scopedNote{Body: "first"}
+	theirs := scopedNote{Body: "second"}
+
+	if err := first.Create(&mine).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := second.Create(&theirs).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var found []scopedNote
+
+	if err := first.Find(&found).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(found) != 1 || found[0].ID != mine.ID {
+		t.Errorf("Expected only the first tenants note but found %v..", found)
+	}
+
+	if err := first.First(&scopedNote{}, theirs.ID).Error; !gorm.IsRecordNotFoundError(err) {
+		t.Errorf("Another tenants note shouldn't be found by id but found %v..", err)
+	}
+
+	var count int
+	first.Model(&scopedNote{}).Count(&count)
+
+	if count != 1 {
+		t.Errorf("Expected a count of 1 but found %d..", count)
+	}
+
+	if affected := first.Model(&scopedNote{}).Where("id = ?", theirs.ID).Update("body", "changed").RowsAffected; affected != 0 {
+		t.Error("Updating another tenants note shouldn't change it..")
+	}
+
+	if affected := first.Where("id = ?", theirs.ID).Delete(&scopedNote{}).RowsAffected; affected != 0 {
+		t.Error("Deleting another tenants note shouldn't remove it..")
+	}
+
+	if err := second.First(&found, theirs.ID).Error; err != nil || found[0].Body != "second" {
+		t.Errorf("Expected the second tenants note to be untouched but found %v, %v..", found, err)
+	}
+}
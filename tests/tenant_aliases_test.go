@@ -0,0 +1,218 @@
+package tests
+
+import (
+	"github.com/LiamDotPro/Go-Multitenancy/middleware"
+	"github.com/LiamDotPro/Go-Multitenancy/tenants"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// The columns of the tenant table aliases need, sqlite takes the AUTO_INCREMENT tenant id for a second primary key.
+type aliasedTenant struct {
+	gorm.Model
+	TenantSubDomainIdentifier string
+}
+
+func (aliasedTenant) TableName() string {
+	return "tenant_connection_informations"
+}
+
+// Opens a test database with the tenant and alias tables and a tenant for each identifier.
+func openAliasDatabase(t *testing.T, identifiers ...string) (*gorm.DB, []tenants.TenantConnectionInformation) {
+	db := openTestDatabase(t)
+
+	if err := db.AutoMigrate(&aliasedTenant{}, &tenants.TenantAlias{}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var created []tenants.TenantConnectionInformation
+
+	for _, identifier := range identifiers {
+		row := aliasedTenant{TenantSubDomainIdentifier: identifier}
+
+		if err := db.Create(&row).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		tenant := tenants.TenantConnectionInformation{TenantSubDomainIdentifier: identifier}
+		tenant.ID = row.ID
+		created = append(created, tenant)
+	}
+
+	return db, created
+}
+
+// Checks a rename keeps the old identifier as an alias of the tenant.
+func TestRenameTenantKeepsOldIdentifierAsAlias(t *testing.T) {
+	db, created := openAliasDatabase(t, "acme")
+	tenant := created[0]
+
+	if err := tenants.RenameTenant(db, &tenant, "acme-corp"); err != nil {
+		t.Fatal(err)
+	}
+
+	var renamed tenants.TenantConnectionInformation
+	db.First(&renamed, tenant.ID)
+
+	if renamed.TenantSubDomainIdentifier != "acme-corp" || tenant.TenantSubDomainIdentifier != "acme-corp" {
+		t.Errorf("Expected the tenant to be renamed but found %v..", renamed.TenantSubDomainIdentifier)
+	}
+
+	found, err := tenants.FindTenantByAlias(db, "ACME")
+
+	if err != nil || found.ID != tenant.ID {
+		t.Errorf("Expected the old identifier to find the tenant but found %v, %v..", found.ID, err)
+	}
+}
+
+// Checks renaming back to an alias takes the alias away rather than leaving the tenant aliased to itself.
+func TestRenameTenantBackToAlias(t *testing.T) {
+	db, created := openAliasDatabase(t, "acme")
+	tenant := created[0]
+
+	if err := tenants.RenameTenant(db, &tenant, "acme-corp"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tenants.RenameTenant(db, &tenant, "acme"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tenants.FindTenantByAlias(db, "acme"); !gorm.IsRecordNotFoundError(err) {
+		t.Errorf("Expected the current identifier not to be an alias but found %v..", err)
+	}
+
+	if found, err := tenants.FindTenantByAlias(db, "acme-corp"); err != nil || found.ID != tenant.ID {
+		t.Errorf("Expected the second identifier to be kept as an alias but found %v..", err)
+	}
+}
+
+// Checks identifiers and aliases of other tenants can't be taken by a rename or a new alias.
+func TestIdentifierInUseChecksAliases(t *testing.T) {
+	db, created := openAliasDatabase(t, "acme", "globex")
+	acme, globex := created[0], created[1]
+
+	if _, err := tenants.AddTenantAlias(db, globex, "initech"); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		identifier string
+		except     uint
+		inUse      bool
+	}{
+		{"globex", acme.ID, true},
+		{"INITECH", acme.ID, true},
+		{"initech", globex.ID, false},
+		{"acme", acme.ID, false},
+		{"umbrella", 0, false},
+	}
+
+	for _, c := range cases {
+		if inUse, err := tenants.IdentifierInUse(db, c.identifier, c.except); err != nil || inUse != c.inUse {
+			t.Errorf("Expected %v in use to be %v but found %v, %v..", c.identifier, c.inUse, inUse, err)
+		}
+	}
+
+	if err := tenants.RenameTenant(db, &acme, "initech"); err != tenants.ErrIdentifierInUse {
+		t.Errorf("Expected renaming onto another tenants alias to fail but found %v..", err)
+	}
+
+	if _, err := tenants.AddTenantAlias(db, acme, "Globex"); err != tenants.ErrIdentifierInUse {
+		t.Errorf("Expected aliasing another tenants identifier to fail but found %v..", err)
+	}
+}
+
+// Checks an alias subdomain is redirected to the current one, keeping the path and query.
+func TestSubdomainResolverRedirectsAliases(t *testing.T) {
+	db, created := openAliasDatabase(t, "acme")
+	tenant := created[0]
+
+	if err := tenants.RenameTenant(db, &tenant, "acme-corp"); err != nil {
+		t.Fatal(err)
+	}
+
+	resolver := middleware.SubdomainResolver{
+		Connection:      db,
+		Cache:           tenants.NewLookupCache(tenants.LookupCacheOptions{TTL: time.Minute, NegativeTTL: time.Minute}),
+		Parser:          middleware.NewSubdomainParser([]string{"example.com"}, nil),
+		RedirectAliases: true,
+	}
+
+	_, _, err := resolver.Resolve(aliasRequest("http://acme.example.com:8080/api/users?page=2"))
+
+	redirect, ok := err.(middleware.TenantRedirect)
+
+	if !ok || redirect.Location != "http://acme-corp.example.com:8080/api/users?page=2" {
+		t.Errorf("Expected a redirect to the new subdomain but found %v..", err)
+	}
+
+	// Without redirects the alias is served under the current identifier.
+	resolver.RedirectAliases = false
+
+	found, identifier, err := resolver.Resolve(aliasRequest("http://acme.example.com/api/users"))
+
+	if err != nil || found.ID != tenant.ID || identifier != "acme-corp" {
+		t.Errorf("Expected the alias to resolve to acme-corp but found %v, %v..", identifier, err)
+	}
+}
+
+// Checks a removed alias stops resolving once its cache entry is invalidated, and frees the identifier.
+func TestRemovedAliasNoLongerResolves(t *testing.T) {
+	db, created := openAliasDatabase(t, "acme")
+	tenant := created[0]
+
+	if _, err := tenants.AddTenantAlias(db, tenant, "acme-old"); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := tenants.NewLookupCache(tenants.LookupCacheOptions{TTL: time.Minute, NegativeTTL: time.Minute})
+	resolver := middleware.SubdomainResolver{Connection: db, Cache: cache, Parser: middleware.NewSubdomainParser([]string{"example.com"}, nil)}
+
+	if _, _, err := resolver.Resolve(aliasRequest("http://acme-old.example.com/")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Unscoped().Where("lower(identifier) = lower(?)", "acme-old").Delete(&tenants.TenantAlias{}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	cache.Invalidate(0, tenants.IdentifierCacheKey("acme-old"))
+
+	if _, _, err := resolver.Resolve(aliasRequest("http://acme-old.example.com/")); err != middleware.ErrTenantNotFound {
+		t.Errorf("Expected the removed alias not to resolve but found %v..", err)
+	}
+
+	if inUse, err := tenants.IdentifierInUse(db, "acme-old", 0); err != nil || inUse {
+		t.Errorf("Expected the removed alias to be free again but found %v, %v..", inUse, err)
+	}
+}
+
+func aliasRequest(target string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", target, nil)
+	return c
+}
+
+// Checks admin lookups find a tenant whatever the case of the identifier, and through its aliases.
+func TestFindTenantByIdentifier(t *testing.T) {
+	db, created := openAliasDatabase(t, "acme")
+	tenant := created[0]
+
+	if err := tenants.RenameTenant(db, &tenant, "acme-corp"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, identifier := range []string{"acme-corp", " ACME-Corp ", "acme", "Acme"} {
+		if found, err := tenants.FindTenantByIdentifier(db, identifier); err != nil || found.ID != tenant.ID {
+			t.Errorf("Expected %q to find the tenant but found %v..", identifier, err)
+		}
+	}
+
+	if _, err := tenants.FindTenantByIdentifier(db, "globex"); !gorm.IsRecordNotFoundError(err) {
+		t.Errorf("Expected an unknown identifier not to be found but found %v..", err)
+	}
+}
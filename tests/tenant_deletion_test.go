@@ -0,0 +1,35 @@
+package tests
+
+import (
+	"github.com/LiamDotPro/Go-Multitenancy/tenants"
+	"testing"
+	"time"
+)
+
+func TestTenantDeletionSteps(t *testing.T) {
+	deletion := tenants.TenantDeletion{CompletedSteps: "storage,sessions", Identifiers: "acme,,acme-old"}
+
+	if !deletion.StepDone("sessions") || deletion.StepDone("records") {
+		t.Errorf("Expected only storage and sessions to be done but got %v..", deletion.CompletedSteps)
+	}
+
+	if identifiers := deletion.IdentifierList(); len(identifiers) != 2 || identifiers[1] != "acme-old" {
+		t.Errorf("Expected the identifier and its alias but got %v..", identifiers)
+	}
+}
+
+// Changing a certificate after it was issued should no longer match its digest.
+func TestDeletionCertificateDigest(t *testing.T) {
+	certificate := tenants.DeletionCertificate{TenantDeletionId: 1, SubDomainIdentifier: "acme", DatabaseName: "tenant_acme", RequestedAt: time.Now(), PurgedAt: time.Now()}
+	digest := certificate.ComputeDigest()
+
+	if digest != certificate.ComputeDigest() {
+		t.Error("Expected the digest to be stable..")
+	}
+
+	certificate.DatabaseName = "tenant_other"
+
+	if digest == certificate.ComputeDigest() {
+		t.Error("Expected a changed certificate to have a different digest..")
+	}
+}
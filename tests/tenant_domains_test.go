@@ -0,0 +1,122 @@
+package tests
+
+import (
+	"github.com/LiamDotPro/Go-Multitenancy/tenants"
+	"github.com/jinzhu/gorm"
+	"testing"
+	"time"
+)
+
+func TestValidHostname(t *testing.T) {
+	valid := []string{"portal.customer.com", "xn--bcher-kva.example.de", "a-b.example.co.uk"}
+	invalid := []string{"", "localhost", "127.0.0.1", "-bad.example.com", "under_score.example.com", "double..dot.com"}
+
+	for _, hostname := range valid {
+		if !tenants.ValidHostname(hostname) {
+			t.Errorf("Expected %v to be a valid hostname..", hostname)
+		}
+	}
+
+	for _, hostname := range invalid {
+		if tenants.ValidHostname(hostname) {
+			t.Errorf("Expected %v to be rejected..", hostname)
+		}
+	}
+}
+
+// A TXT record holding someone else's token must not verify the domain.
+func TestVerifyTenantDomainRejectsWrongToken(t *testing.T) {
+	domain := tenants.TenantDomain{Hostname: "portal.customer.com", VerificationToken: "expected"}
+
+	resolver := tenants.StaticTXTResolver{
+		domain.VerificationRecord(): {tenants.DomainVerificationValuePrefix + "someone-else"},
+	}
+
+	if err := tenants.VerifyTenantDomain(nil, resolver, &domain); err != tenants.ErrDomainNotVerified {
+		t.Errorf("Expected the domain to fail verification but got %v..", err)
+	}
+
+	if domain.Verified() {
+		t.Error("Expected the domain to stay unverified..")
+	}
+}
+
+// Opens a test database with the tenant domain table and its index on verified hostnames.
+func openDomainDatabase(t *testing.T) *gorm.DB {
+	db := openTestDatabase(t)
+
+	if err := db.AutoMigrate(&tenants.TenantDomain{}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tenants.AddVerifiedHostnameIndex(db); err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func claimDomain(t *testing.T, db *gorm.DB, tenantId uint, hostname string) tenants.TenantDomain {
+	tenant := tenants.TenantConnectionInformation{}
+	tenant.ID = tenantId
+
+	domain, err := tenants.AddTenantDomain(db, tenant, hostname)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return domain
+}
+
+// Checks an unverified claim doesn't stop another tenant from claiming and verifying the hostname.
+func TestVerifiedDomainEvictsPendingClaims(t *testing.T) {
+	db := openDomainDatabase(t)
+
+	squatter := claimDomain(t, db, 1, "portal.customer.com")
+	owner := claimDomain(t, db, 2, "portal.customer.com")
+
+	resolver := tenants.StaticTXTResolver{
+		owner.VerificationRecord(): {owner.VerificationValue()},
+	}
+
+	verified, err := tenants.VerifyTenantDomainClaims(db, resolver, "Portal.Customer.com")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if verified.ID != owner.ID || !verified.Verified() {
+		t.Errorf("Expected the claim with the published token to be verified but found %+v..", verified)
+	}
+
+	if err := db.Unscoped().First(&tenants.TenantDomain{}, squatter.ID).Error; !gorm.IsRecordNotFoundError(err) {
+		t.Errorf("Expected the pending claim to be removed but found %v..", err)
+	}
+
+	// A later claim by the squatter is refused by the handler, and can't be verified next to the owners.
+	again := claimDomain(t, db, 1, "portal.customer.com")
+
+	if err := db.Model(&again).Update("verified_at", time.Now()).Error; err == nil {
+		t.Error("A second verified claim on the hostname should be refused..")
+	}
+}
+
+// Checks a claim without its token published isn't verified.
+func TestVerifyTenantDomainClaimsNeedsPublishedToken(t *testing.T) {
+	db := openDomainDatabase(t)
+
+	claim := claimDomain(t, db, 1, "portal.customer.com")
+
+	resolver := tenants.StaticTXTResolver{
+		claim.VerificationRecord(): {tenants.DomainVerificationValuePrefix + "someone-else"},
+	}
+
+	if _, err := tenants.VerifyTenantDomainClaims(db, resolver, "portal.customer.com"); err != tenants.ErrDomainNotVerified {
+		t.Errorf("Expected ErrDomainNotVerified but found %v..", err)
+	}
+
+	if _, err := tenants.VerifyTenantDomainClaims(db, resolver, "unknown.customer.com"); !gorm.IsRecordNotFoundError(err) {
+		t.Errorf("Expected an unclaimed hostname not to be found but found %v..", err)
+	}
+}
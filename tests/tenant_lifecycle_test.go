@@ -0,0 +1,70 @@
+package tests
+
+import (
+	"github.com/LiamDotPro/Go-Multitenancy/middleware"
+	"github.com/LiamDotPro/Go-Multitenancy/tenants"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type fixedTenantResolver struct {
+	tenant tenants.TenantConnectionInformation
+}
+
+func (r fixedTenantResolver) Resolve(c *gin.Context) (tenants.TenantConnectionInformation, string, error) {
+	return r.tenant, "acme", nil
+}
+
+// Requests for tenants that aren't active should be refused before they reach a handler.
+func TestFindTenancyEnforcesState(t *testing.T) {
+	cases := []struct {
+		state  string
+		reason string
+		method string
+		status int
+	}{
+		{tenants.StateSuspended, tenants.SuspensionPayment, http.MethodGet, http.StatusPaymentRequired},
+		{tenants.StateSuspended, "abuse", http.MethodGet, http.StatusForbidden},
+		{tenants.StateReadOnly, "", http.MethodPost, http.StatusForbidden},
+		{tenants.StateArchived, "", http.MethodGet, http.StatusGone},
+		{tenants.StatePendingDeletion, "", http.MethodGet, http.StatusGone},
+		{tenants.StateDeleted, "", http.MethodGet, http.StatusNotFound},
+	}
+
+	for _, tc := range cases {
+		recorder := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(recorder)
+		c.Request = httptest.NewRequest(tc.method, "/api/users/create", nil)
+
+		tenant := tenants.TenantConnectionInformation{LifecycleState: tc.state, StateReason: tc.reason}
+		middleware.FindTenancyWith(nil, fixedTenantResolver{tenant: tenant})(c)
+
+		if recorder.Code != tc.status {
+			t.Errorf("Expected a %d for a %v %v tenant but got %d..", tc.status, tc.method, tc.state, recorder.Code)
+		}
+	}
+}
+
+func TestTenantStateTransitions(t *testing.T) {
+	if !tenants.CanTransition(tenants.StateActive, tenants.StateSuspended) {
+		t.Error("Expected active tenants to be suspendable..")
+	}
+
+	if tenants.CanTransition(tenants.StateArchived, tenants.StateReadOnly) {
+		t.Error("Expected archived tenants to only be restored or deleted..")
+	}
+
+	if tenants.CanTransition(tenants.StateActive, tenants.StateDeleted) {
+		t.Error("Expected tenants to only be deleted after pending deletion..")
+	}
+
+	if tenants.CanTransition(tenants.StateDeleted, tenants.StateActive) {
+		t.Error("Expected deleted to be final..")
+	}
+
+	if (tenants.TenantConnectionInformation{}).State() != tenants.StateActive {
+		t.Error("Expected tenants without a state to be active..")
+	}
+}
@@ -0,0 +1,135 @@
+package tests
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/LiamDotPro/Go-Multitenancy/middleware"
+	"github.com/LiamDotPro/Go-Multitenancy/tenants"
+	"github.com/gin-gonic/gin"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStripTenantPathPrefix(t *testing.T) {
+	var path string
+
+	handler := middleware.StripTenantPathPrefix(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		path = req.URL.Path
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/t/acme/api/users/getCurrentUser", nil))
+
+	if path != "/api/users/getCurrentUser" {
+		t.Errorf("Expected the tenant prefix to be stripped but got %v..", path)
+	}
+}
+
+// Resolvers with nothing to go on should hand over to the next resolver rather than failing the request.
+func TestResolversFallThrough(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/api/users/getCurrentUser", nil)
+
+	resolvers := []middleware.TenantResolver{
+		middleware.HeaderResolver{Header: "X-Tenant-ID"},
+		middleware.PathPrefixResolver{},
+		middleware.TokenClaimResolver{Secret: []byte("secret"), Claim: "tenant"},
+	}
+
+	for _, resolver := range resolvers {
+		if _, _, err := resolver.Resolve(c); err != middleware.ErrTenantNotResolved {
+			t.Errorf("Expected %T to fall through but got %v..", resolver, err)
+		}
+	}
+}
+
+func TestTokenClaimResolverRejectsBadSignatures(t *testing.T) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	claims := base64.RawURLEncoding.EncodeToString([]byte(`{"tenant":"acme"}`))
+
+	mac := hmac.New(sha256.New, []byte("someone else"))
+	mac.Write([]byte(header + "." + claims))
+	token := header + "." + claims + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/api/users/getCurrentUser", nil)
+	c.Request.Header.Set("Authorization", "Bearer "+token)
+
+	resolver := middleware.TokenClaimResolver{Secret: []byte("secret"), Claim: "tenant"}
+
+	if _, _, err := resolver.Resolve(c); err != middleware.ErrInvalidTenantToken {
+		t.Errorf("Expected a token signed with another secret to be rejected but got %v..", err)
+	}
+}
+
+func TestSubdomainParser(t *testing.T) {
+	parser := middleware.NewSubdomainParser([]string{"example.co.uk", "App.Example.co.uk"}, []string{"www", "api"})
+
+	cases := map[string]string{
+		"acme.app.example.co.uk":      "acme",
+		"ACME.app.example.co.uk:8000": "acme",
+		"www.acme.app.example.co.uk":  "acme",
+		"acme.example.co.uk.":         "acme",
+		"bücher.example.co.uk":        "xn--bcher-kva",
+		"app.example.co.uk":           "",
+		"www.example.co.uk":           "",
+		"api.app.example.co.uk":       "",
+		"example.co.uk":               "",
+		"acme.other.com":              "",
+		"127.0.0.1:8000":              "",
+	}
+
+	for host, expected := range cases {
+		identifier, found := parser.Identifier(host)
+
+		if identifier != expected || found != (len(expected) > 0) {
+			t.Errorf("Expected %v to give %q but got %q..", host, expected, identifier)
+		}
+	}
+}
+
+// Checks the tenant is read from a small JSON body and the body is left for the handler.
+func TestParamResolverReadsJSONBody(t *testing.T) {
+	db, created := openAliasDatabase(t, "acme")
+	resolver := middleware.ParamResolver{Connection: db, Cache: tenants.NewLookupCache(tenants.LookupCacheOptions{TTL: time.Minute, NegativeTTL: time.Minute})}
+
+	body := `{"tenant":"acme","name":"widget"}`
+	c := jsonRequest(body)
+
+	tenant, identifier, err := resolver.Resolve(c)
+
+	if err != nil || tenant.ID != created[0].ID || identifier != "acme" {
+		t.Errorf("Expected the tenant from the body but found %v, %v..", identifier, err)
+	}
+
+	if left, _ := ioutil.ReadAll(c.Request.Body); string(left) != body {
+		t.Errorf("Expected the body to be left in place but found %v..", string(left))
+	}
+}
+
+// Checks large bodies aren't buffered to look for the tenant, and reach the handler whole.
+func TestParamResolverSkipsLargeBodies(t *testing.T) {
+	resolver := middleware.ParamResolver{}
+
+	body := `{"tenant":"acme","padding":"` + strings.Repeat("x", 1<<20) + `"}`
+	c := jsonRequest(body)
+
+	if _, _, err := resolver.Resolve(c); err != middleware.ErrTenantNotResolved {
+		t.Errorf("Expected a large body to be passed over but found %v..", err)
+	}
+
+	if left, _ := ioutil.ReadAll(c.Request.Body); string(left) != body {
+		t.Errorf("Expected the whole body to be left for the handler but found %d bytes..", len(left))
+	}
+}
+
+func jsonRequest(body string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/api/things", strings.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	return c
+}
@@ -0,0 +1,47 @@
+package tests
+
+import (
+	"github.com/LiamDotPro/Go-Multitenancy/tenants"
+	"strings"
+	"testing"
+)
+
+func TestTenantRoleNames(t *testing.T) {
+	roles := tenants.RolesFor("acme-corp")
+
+	if roles.Group != "tenant_acme_corp" || roles.Logins[0] != "tenant_acme_corp__a" || roles.Logins[1] != "tenant_acme_corp__b" {
+		t.Errorf("Unexpected role names %v..", roles)
+	}
+
+	if roles.NextLogin(roles.Logins[0]) != roles.Logins[1] || roles.NextLogin(roles.Logins[1]) != roles.Logins[0] || roles.NextLogin("") != roles.Logins[0] {
+		t.Error("Expected rotations to take turns between the two logins..")
+	}
+
+	long := tenants.RolesFor(strings.Repeat("a", 63))
+
+	for _, role := range long.All() {
+		if len(role) > 63 {
+			t.Errorf("Expected %v to fit in a postgres name..", role)
+		}
+	}
+
+	if long.Logins[0] == long.Logins[1] || long.Logins[0] == long.Group {
+		t.Errorf("Expected long role names to stay apart but got %v..", long)
+	}
+}
+
+// Rotating again should replace the credentials rather than pile them up.
+func TestConnectionStringWithCredentials(t *testing.T) {
+	rotated := tenants.ConnectionStringWithCredentials("host=db port=5432 user=admin dbname=tenant_acme password=secret sslmode=disable", "tenant_acme__a", "abc")
+	rotated = tenants.ConnectionStringWithCredentials(rotated, "tenant_acme__b", "def")
+
+	if rotated != "host=db port=5432 dbname=tenant_acme sslmode=disable user=tenant_acme__b password=def" {
+		t.Errorf("Unexpected connection string %v..", rotated)
+	}
+
+	url := tenants.ConnectionStringWithCredentials("postgres://admin:secret@db:5432/shared?search_path=tenant_acme", "tenant_acme__a", "abc")
+
+	if url != "postgres://tenant_acme__a:abc@db:5432/shared?search_path=tenant_acme" {
+		t.Errorf("Unexpected connection string %v..", url)
+	}
+}